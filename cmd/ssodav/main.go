@@ -27,9 +27,25 @@ import (
 	"log"
 	"net/http"
 
+	"git.napaalm.xyz/napaalm/ssodav/internal/audit"
 	"git.napaalm.xyz/napaalm/ssodav/internal/auth"
+	"git.napaalm.xyz/napaalm/ssodav/internal/cas"
 	"git.napaalm.xyz/napaalm/ssodav/internal/config"
+	"git.napaalm.xyz/napaalm/ssodav/internal/crossdomain"
+	"git.napaalm.xyz/napaalm/ssodav/internal/device"
+	"git.napaalm.xyz/napaalm/ssodav/internal/emaillogin"
 	"git.napaalm.xyz/napaalm/ssodav/internal/handlers"
+	"git.napaalm.xyz/napaalm/ssodav/internal/knowndevices"
+	"git.napaalm.xyz/napaalm/ssodav/internal/logout"
+	"git.napaalm.xyz/napaalm/ssodav/internal/mail"
+	"git.napaalm.xyz/napaalm/ssodav/internal/mfa"
+	"git.napaalm.xyz/napaalm/ssodav/internal/policy"
+	"git.napaalm.xyz/napaalm/ssodav/internal/proxy"
+	"git.napaalm.xyz/napaalm/ssodav/internal/recovery"
+	"git.napaalm.xyz/napaalm/ssodav/internal/saml"
+	"git.napaalm.xyz/napaalm/ssodav/internal/session"
+	"git.napaalm.xyz/napaalm/ssodav/internal/totp"
+	"git.napaalm.xyz/napaalm/ssodav/internal/webauthn"
 )
 
 // Set at compile time - see Makefile
@@ -46,8 +62,76 @@ func main() {
 
 	// Initialize packages
 	log.Println("Inizalizzazione...")
-	auth.InitializeSigning()
+	if err := auth.InitializeSigning(); err != nil {
+		log.Fatal(err)
+	}
+	if err := auth.InitializeClaims(); err != nil {
+		log.Fatal(err)
+	}
+	if err := auth.InitializeEncryption(); err != nil {
+		log.Fatal(err)
+	}
+	if err := audit.Initialize(); err != nil {
+		log.Fatal(err)
+	}
+	if err := session.Initialize(); err != nil {
+		log.Fatal(err)
+	}
+	if err := policy.Initialize(); err != nil {
+		log.Fatal(err)
+	}
+	if err := handlers.InitializeTemplates(); err != nil {
+		log.Fatal(err)
+	}
 	handlers.InitializeLimiters()
+	if err := handlers.InitializeTrustedProxies(); err != nil {
+		log.Fatal(err)
+	}
+	if err := handlers.InitializeDPoP(); err != nil {
+		log.Fatal(err)
+	}
+	if err := handlers.InitializeCookies(); err != nil {
+		log.Fatal(err)
+	}
+	if err := handlers.InitializeCSRF(); err != nil {
+		log.Fatal(err)
+	}
+	if err := totp.Initialize(); err != nil {
+		log.Fatal(err)
+	}
+	if err := webauthn.Initialize(); err != nil {
+		log.Fatal(err)
+	}
+	if err := recovery.Initialize(); err != nil {
+		log.Fatal(err)
+	}
+	if err := mail.Initialize(); err != nil {
+		log.Fatal(err)
+	}
+	if err := emaillogin.Initialize(); err != nil {
+		log.Fatal(err)
+	}
+	if err := knowndevices.Initialize(); err != nil {
+		log.Fatal(err)
+	}
+	mfa.Initialize()
+	device.Initialize()
+	crossdomain.Initialize()
+	logout.Initialize()
+
+	if config.Config.SAML.Enabled {
+		if err := saml.Initialize(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if config.Config.CAS.Enabled {
+		cas.Initialize()
+	}
+
+	if err := proxy.Initialize(); err != nil {
+		log.Fatal(err)
+	}
 
 	// Put compile-time variables where needed
 	handlers.Version = Version
@@ -58,6 +142,49 @@ func main() {
 
 	mux.HandleFunc("/", handlers.HandleRootOr404)
 	mux.HandleFunc("/logout", handlers.HandleLogout)
+	mux.HandleFunc("/logout/status", handlers.HandleLogoutStatus)
+	mux.HandleFunc("/device_authorization", handlers.HandleDeviceAuthorization)
+	mux.HandleFunc("/device", handlers.HandleDeviceVerification)
+	mux.HandleFunc("/token", handlers.HandleToken)
+	mux.HandleFunc("/token/exchange", handlers.HandleTokenExchange)
+	mux.HandleFunc("/.well-known/jwks.json", handlers.HandleJWKS)
+	mux.HandleFunc("/introspect", handlers.HandleIntrospection)
+	mux.HandleFunc("/auth/verify", handlers.HandleForwardAuth)
+	mux.HandleFunc("/sessions", handlers.HandleSessions)
+	mux.HandleFunc("/sessions/", handlers.HandleSessions)
+	mux.HandleFunc("/devices", handlers.HandleDevices)
+	mux.HandleFunc("/devices/", handlers.HandleDevices)
+	mux.HandleFunc("/keepalive", handlers.HandleKeepAlive)
+	mux.HandleFunc("/totp", handlers.HandleTOTP)
+	mux.HandleFunc("/totp/enroll", handlers.HandleTOTPEnroll)
+	mux.HandleFunc("/webauthn", handlers.HandleWebAuthn)
+	mux.HandleFunc("/webauthn/login", handlers.HandleWebAuthnLogin)
+	mux.HandleFunc("/email/login", handlers.HandleEmailLogin)
+	mux.HandleFunc("/email/link", handlers.HandleEmailLink)
+	mux.HandleFunc("/recovery", handlers.HandleRecoveryCodes)
+	mux.HandleFunc("/recovery/reset", handlers.HandlePasswordReset)
+	mux.HandleFunc("/crossdomain", handlers.HandleCrossDomain)
+	mux.HandleFunc("/crossdomain/token", handlers.HandleCrossDomainToken)
+
+	if config.Config.Impersonation.Enabled {
+		mux.HandleFunc("/impersonate", handlers.HandleImpersonation)
+	}
+
+	if config.Config.SAML.Enabled {
+		mux.HandleFunc("/saml/metadata", handlers.HandleSAMLMetadata)
+		mux.HandleFunc("/saml/sso", handlers.HandleSAMLSSO)
+		mux.HandleFunc("/saml/idp", handlers.HandleSAMLIdPInitiated)
+	}
+
+	if config.Config.CAS.Enabled {
+		mux.HandleFunc("/cas/login", handlers.HandleCASLogin)
+		mux.HandleFunc("/cas/logout", handlers.HandleCASLogout)
+		mux.HandleFunc("/cas/serviceValidate", handlers.HandleCASServiceValidate)
+		mux.HandleFunc("/cas/proxyValidate", handlers.HandleCASProxyValidate)
+		mux.HandleFunc("/cas/p3/serviceValidate", handlers.HandleCASServiceValidateV3)
+		mux.HandleFunc("/cas/p3/proxyValidate", handlers.HandleCASProxyValidateV3)
+		mux.HandleFunc("/cas/proxy", handlers.HandleCASProxy)
+	}
 	mux.HandleFunc("/api", handlers.HandleSwaggerUI)
 	mux.HandleFunc("/api/openapi.yaml", handlers.HandleOpenAPI)
 	mux.HandleFunc("/favicon.ico", handlers.HandleFavicon)
@@ -66,10 +193,16 @@ func main() {
 	fs := http.FileServer(http.Dir("web/ssodav-login-page/assets"))
 	mux.Handle("/assets/", http.StripPrefix("/assets/", fs))
 
+	// Serve the built-in reverse proxy routes, if any
+	var handler http.Handler = mux
+	if proxy.Enabled() {
+		handler = handlers.ProxyOr(mux)
+	}
+
 	srvAddress := config.Config.General.Port
 	srv := &http.Server{
 		Addr:    srvAddress,
-		Handler: mux,
+		Handler: handler,
 	}
 
 	log.Println("Inizializzazione completata!")
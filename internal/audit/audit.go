@@ -0,0 +1,119 @@
+/*
+ * audit.go
+ *
+ * Registro degli eventi rilevanti per la sicurezza.
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+// Registro degli eventi rilevanti per la sicurezza (scambi di token, impersonificazioni).
+package audit
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"git.napaalm.xyz/napaalm/ssodav/internal/config"
+)
+
+// Tipi di evento
+const (
+	TokenExchange      = "token_exchange"
+	Impersonation      = "impersonation"
+	SessionTermination = "session_termination"
+	RecoveryCodes      = "recovery_codes"
+	PasswordReset      = "password_reset"
+	NewDevice          = "new_device"
+	DeviceRemoval      = "device_removal"
+)
+
+// Esito degli eventi riusciti; negli altri casi è il codice dell'errore
+const Success = "success"
+
+// Evento registrato, scritto come una riga JSON
+type Event struct {
+	Time     time.Time `json:"time"`
+	Type     string    `json:"type"`
+	Actor    string    `json:"actor,omitempty"`
+	Subject  string    `json:"subject,omitempty"`
+	Client   string    `json:"client,omitempty"`
+	Audience string    `json:"audience,omitempty"`
+	Scope    string    `json:"scope,omitempty"`
+	IP       string    `json:"ip,omitempty"`
+	Outcome  string    `json:"outcome"`
+}
+
+var (
+	mutex  sync.Mutex
+	output io.Writer
+)
+
+// Apre il file di registro indicato nella configurazione.
+// Se non è specificato, gli eventi vengono scritti nel log del server.
+func Initialize() error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if c, ok := output.(io.Closer); ok {
+		c.Close()
+	}
+	output = nil
+
+	path := config.Config.General.AuditLog
+	if path == "" {
+		return nil
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	output = f
+	return nil
+}
+
+// Registra un evento
+func Record(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		log.Println("audit: ", err.Error())
+		return
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if output == nil {
+		log.Println("audit: " + string(b))
+		return
+	}
+
+	if _, err := output.Write(append(b, '\n')); err != nil {
+		log.Println("audit: ", err.Error())
+	}
+}
@@ -0,0 +1,79 @@
+/*
+ * audit_test.go
+ *
+ * File di test per il package audit.
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"git.napaalm.xyz/napaalm/ssodav/internal/config"
+)
+
+func TestRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssodav-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config.Config.General.AuditLog = filepath.Join(dir, "audit.log")
+	if err := Initialize(); err != nil {
+		t.Fatal(err)
+	}
+
+	Record(Event{Type: Impersonation, Actor: "hermes", Subject: "fry", Outcome: Success})
+	Record(Event{Type: TokenExchange, Client: "moodle", Outcome: "invalid_grant"})
+
+	config.Config.General.AuditLog = ""
+	if err := Initialize(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(filepath.Join(dir, "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var events []Event
+	scanner := bufio.NewScanner(f)
+
+	for scanner.Scan() {
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+
+		events = append(events, e)
+	}
+
+	if len(events) != 2 || events[0].Actor != "hermes" || events[1].Outcome != "invalid_grant" || events[0].Time.IsZero() {
+		t.Errorf("unexpected events %+v", events)
+	}
+}
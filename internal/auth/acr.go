@@ -0,0 +1,89 @@
+/*
+ * acr.go
+ *
+ * Livelli di garanzia dell'autenticazione (claim acr).
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+package auth
+
+// Livelli di garanzia dell'autenticazione, secondo i profili REFEDS, dal più basso
+const (
+	ACRSingleFactor = "https://refeds.org/profile/sfa"
+	ACRMultiFactor  = "https://refeds.org/profile/mfa"
+)
+
+var acrLevels = []string{ACRSingleFactor, ACRMultiFactor}
+
+// Metodo di autenticazione (claim amr) dell'accesso con un codice o un link
+// inviato per email. Non è tra i valori registrati da RFC 8176: "otp" farebbe
+// passare un solo fattore per la verifica in due passaggi.
+const MethodEmail = "email"
+
+// Restituisce il livello di garanzia raggiunto con i metodi di autenticazione
+// indicati, vuoto se non ce ne sono
+func ACR(methods []string) string {
+	if len(methods) == 0 {
+		return ""
+	}
+
+	for _, m := range methods {
+		switch m {
+		case "otp", "hwk", "mfa":
+			return ACRMultiFactor
+		}
+	}
+
+	return ACRSingleFactor
+}
+
+// Restituisce il livello minimo tra quelli richiesti da un servizio (parametro
+// acr_values di OpenID Connect), vuoto se nessuno è conosciuto
+func RequiredACR(values []string) string {
+	required := -1
+
+	for _, v := range values {
+		if l := acrLevel(v); l >= 0 && (required < 0 || l < required) {
+			required = l
+		}
+	}
+
+	if required < 0 {
+		return ""
+	}
+
+	return acrLevels[required]
+}
+
+// Indica se i metodi di autenticazione raggiungono il livello richiesto
+func SatisfiesACR(methods []string, required string) bool {
+	return required == "" || acrLevel(ACR(methods)) >= acrLevel(required)
+}
+
+// Restituisce la posizione del livello, -1 se non è conosciuto
+func acrLevel(acr string) int {
+	for i, l := range acrLevels {
+		if l == acr {
+			return i
+		}
+	}
+
+	return -1
+}
@@ -26,18 +26,35 @@
 package auth
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"strings"
 	"time"
 
 	"git.napaalm.xyz/napaalm/ssodav/internal/config"
+	"git.napaalm.xyz/napaalm/ssodav/internal/keys"
+	"git.napaalm.xyz/napaalm/ssodav/pkg/jwk"
 	"github.com/gbrlsnchs/jwt/v3"
 	ldap "github.com/go-ldap/ldap/v3"
 )
 
 var (
-	jwtSigner *jwt.HMACSHA
+	jwtSigner jwt.Algorithm
+	jwtKeyID  string
+
+	// Segreto o chiave privata di firma, da cui sono derivate le altre chiavi del server
+	jwtSecret []byte
+
+	// Chiavi pubbliche per la verifica dei token (vuoto con HS256)
+	jwtKeys = jwk.Set{Keys: []jwk.Key{}}
 )
 
 // Errore di autenticazione
@@ -49,6 +66,12 @@ func (e *AuthenticationError) Error() string {
 	return fmt.Sprintf("Errore di autenticazione oppure utente \"%s\" non esistente.", e.username)
 }
 
+// Errori di verifica del token
+var (
+	ErrInvalidAudience = errors.New("Il token non è destinato a questo servizio")
+	ErrInvalidToken    = errors.New("Token non valido")
+)
+
 // Errore di generazione del token
 type JWTCreationError struct {
 	username string
@@ -63,12 +86,89 @@ type UserInfo struct {
 	Username string `json:"username"`
 	FullName string `json:"full_name"`
 	Group    string `json:"group"`
+
+	// Attributi della voce LDAP, presenti solo se l'utente è stato cercato nella directory
+	Attributes map[string][]string `json:"-"`
+
+	// Impronta della chiave DPoP a cui è vincolato il token (RFC 9449), se presente
+	KeyThumbprint string `json:"-"`
+
+	// Scope a cui è limitato il token, vuoto se non ci sono limitazioni
+	Scope string `json:"-"`
+
+	// Utente che agisce per conto di questo (impersonificazione, RFC 8693)
+	Actor string `json:"-"`
+
+	// Scadenza del token o della sessione da cui sono state ottenute le informazioni
+	Expires time.Time `json:"-"`
+
+	// Sessione da cui è stato ottenuto il token, se presente
+	SessionID string `json:"-"`
+
+	// Metodi con cui l'utente si è autenticato, come nella claim amr (RFC 8176)
+	Methods []string `json:"-"`
+
+	// Momento dell'ultima autenticazione dell'utente, come nella claim auth_time
+	AuthTime time.Time `json:"-"`
+}
+
+// Restituisce il valore di un campo (secondo il nome JSON) delle informazioni sull'utente,
+// oppure dell'attributo LDAP con quel nome
+func (u UserInfo) Field(name string) string {
+	switch name {
+	case "username":
+		return u.Username
+	case "full_name":
+		return u.FullName
+	case "group":
+		return u.Group
+	default:
+		return u.Attribute(name)
+	}
+}
+
+// Restituisce il primo valore di un attributo LDAP (il nome non distingue maiuscole e minuscole)
+func (u UserInfo) Attribute(name string) string {
+	if values := u.AttributeValues(name); len(values) > 0 {
+		return values[0]
+	}
+
+	return ""
+}
+
+// Restituisce tutti i valori di un attributo LDAP
+func (u UserInfo) AttributeValues(name string) []string {
+	for attribute, values := range u.Attributes {
+		if strings.EqualFold(attribute, name) {
+			return values
+		}
+	}
+
+	return nil
+}
+
+// Indica se qualcuno dei campi (come per Field) è un attributo LDAP non disponibile,
+// come per le informazioni ottenute da una sessione: l'utente va allora cercato nella directory
+func (u UserInfo) MissingAttributes(fields ...string) bool {
+	if u.Attributes != nil {
+		return false
+	}
+
+	for _, name := range fields {
+		switch name {
+		case "username", "full_name", "group":
+		default:
+			return true
+		}
+	}
+
+	return false
 }
 
 var dummyUserInfo = UserInfo{
-	"h4x0r",
-	"1337 h4x0r",
-	"1337",
+	Username: "h4x0r",
+	FullName: "1337 h4x0r",
+	Group:    "1337",
 }
 
 // Formato del payload JWT
@@ -76,33 +176,192 @@ type customPayload struct {
 	Payload  jwt.Payload
 	FullName string `json:"full_name"`
 	Group    string `json:"group"`
+
+	// Chiave a cui è vincolato il token (RFC 7800)
+	Confirmation *confirmation `json:"cnf,omitempty"`
+
+	Scope     string `json:"scope,omitempty"`
+	Actor     *actor `json:"act,omitempty"`
+	SessionID string `json:"sid,omitempty"`
+
+	// Metodi di autenticazione (RFC 8176), es. "pwd" e "otp", livello di
+	// garanzia che ne deriva e momento dell'autenticazione
+	Methods  []string  `json:"amr,omitempty"`
+	ACR      string    `json:"acr,omitempty"`
+	AuthTime *jwt.Time `json:"auth_time,omitempty"`
+
+	// Claim aggiuntive definite nella configurazione
+	Extra map[string]interface{} `json:"-"`
 }
 
-// Inizializza l'algoritmo per la firma HS256
-func InitializeSigning() {
+// Claim "cnf" dei token vincolati a una chiave DPoP
+type confirmation struct {
+	JKT string `json:"jkt"`
+}
+
+// Claim "act" dei token ottenuti per conto di un altro utente (RFC 8693, sezione 4.1)
+type actor struct {
+	Subject string `json:"sub"`
+}
 
-	// Ottiene la chiave segreta dalla configurazione
-	secret := config.Config.General.JWTSecret
+// Opzione aggiuntiva per l'emissione di un token
+type TokenOption func(*customPayload)
 
-	// Inizializza l'algoritmo
-	jwtSigner = jwt.NewHS256([]byte(secret))
+// Vincola il token alla chiave DPoP con l'impronta indicata
+func WithConfirmation(jkt string) TokenOption {
+	return func(pl *customPayload) {
+		if jkt != "" {
+			pl.Confirmation = &confirmation{JKT: jkt}
+		}
+	}
 }
 
-// Verifica le credenziali, ottiene il livello di permessi dell'utente e restituisce il token.
-func AuthenticateUser(username, password string, exp time.Duration) ([]byte, error) {
-	var (
-		err      error = nil
-		userInfo       = UserInfo{username, "unknown", "unknown"}
-	)
+// Codifica il payload aggiungendo le claim aggiuntive al primo livello
+func (p customPayload) MarshalJSON() ([]byte, error) {
+	type plain customPayload
+
+	b, err := json.Marshal(plain(p))
+	if err != nil || len(p.Extra) == 0 {
+		return b, err
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, err
+	}
+
+	for name, value := range p.Extra {
+		// Never override the standard claims
+		if _, ok := fields[name]; ok {
+			continue
+		}
+
+		raw, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+
+		fields[name] = raw
+	}
+
+	return json.Marshal(fields)
+}
+
+// Decodifica il payload separando le claim aggiuntive
+func (p *customPayload) UnmarshalJSON(b []byte) error {
+	type plain customPayload
+
+	if err := json.Unmarshal(b, (*plain)(p)); err != nil {
+		return err
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return err
+	}
+
+	delete(fields, "Payload")
+	delete(fields, "full_name")
+	delete(fields, "group")
+	delete(fields, "cnf")
+	delete(fields, "scope")
+	delete(fields, "act")
+	delete(fields, "sid")
+	delete(fields, "amr")
+	delete(fields, "acr")
+	delete(fields, "auth_time")
+
+	if len(fields) > 0 {
+		p.Extra = fields
+	}
+
+	return nil
+}
+
+// Inizializza l'algoritmo per la firma: HS256 con la chiave segreta,
+// oppure RS256 o ES256 con la chiave privata indicata nella configurazione
+func InitializeSigning() error {
+	alg := config.Config.General.JWTAlgorithm
+
+	jwtKeyID = ""
+	jwtKeys = jwk.Set{Keys: []jwk.Key{}}
+	jwtSecret = nil
+
+	if alg == "" || alg == "HS256" {
+		// Ottiene la chiave segreta dalla configurazione
+		secret := config.Config.General.JWTSecret
+		jwtSecret = []byte(secret)
+
+		// Inizializza l'algoritmo
+		jwtSigner = jwt.NewHS256([]byte(secret))
+		return nil
+	}
+
+	signer, err := keys.LoadPrivateKey(config.Config.General.JWTKey)
+	if err != nil {
+		return err
+	}
+
+	switch key := signer.(type) {
+	case *rsa.PrivateKey:
+		if alg != "RS256" {
+			return fmt.Errorf("auth: an RSA key can't be used with %s", alg)
+		}
+		jwtSigner = jwt.NewRS256(jwt.RSAPrivateKey(key))
+
+	case *ecdsa.PrivateKey:
+		if alg != "ES256" || key.Curve != elliptic.P256() {
+			return fmt.Errorf("auth: %s requires a P-256 key", alg)
+		}
+		jwtSigner = jwt.NewES256(jwt.ECDSAPrivateKey(key))
 
-	if !config.Config.General.DummyAuth {
-		// Controlla le credenziali
-		userInfo, err = checkCredentials(username, password)
+	default:
+		return fmt.Errorf("auth: unsupported key type in %s", config.Config.General.JWTKey)
 	}
 
+	if jwtSecret, err = x509.MarshalPKCS8PrivateKey(signer); err != nil {
+		return err
+	}
+
+	// Publish the public key, identified by its thumbprint
+	key, err := jwk.New(signer.Public())
+	if err != nil {
+		return err
+	}
+	key.Use = "sig"
+	key.Algorithm = alg
+
+	jwtKeyID = key.KeyID
+	jwtKeys = jwk.Set{Keys: []jwk.Key{key}}
+
+	return nil
+}
+
+// Deriva dalla chiave di firma una chiave per lo scopo indicato, uguale tra
+// riavvii e repliche del server con la stessa configurazione
+func DeriveKey(purpose string) ([]byte, error) {
+	if len(jwtSecret) == 0 {
+		return nil, errors.New("auth: missing signing key")
+	}
+
+	mac := hmac.New(sha256.New, jwtSecret)
+	mac.Write([]byte("ssodav " + purpose))
+	return mac.Sum(nil), nil
+}
+
+// Restituisce le chiavi pubbliche per la verifica dei token
+func PublicKeys() jwk.Set {
+	return jwtKeys
+}
+
+// Verifica le credenziali, ottiene il livello di permessi dell'utente e restituisce
+// il token valido per l'audience indicata.
+func AuthenticateUser(username, password, audience string, exp time.Duration, opts ...TokenOption) ([]byte, error) {
+	userInfo, err := Authenticate(username, password)
+
 	if err == nil {
 		// Genera il token
-		token, err := getToken(userInfo, exp)
+		token, err := IssueToken(userInfo, audience, exp, opts...)
 
 		if err != nil {
 			return nil, err
@@ -115,9 +374,164 @@ func AuthenticateUser(username, password string, exp time.Duration) ([]byte, err
 	}
 }
 
+// Verifica le credenziali e restituisce le informazioni sull'utente
+func Authenticate(username, password string) (UserInfo, error) {
+	if config.Config.General.DummyAuth {
+		return UserInfo{Username: username, FullName: "unknown", Group: "unknown"}, nil
+	}
+
+	// Controlla le credenziali
+	return checkCredentials(username, password)
+}
+
 // Controlla le credenziali sul server LDAP
 func checkCredentials(username string, password string) (UserInfo, error) {
 
+	// Connessione al server LDAP
+	l, err := dialLDAP()
+	if err != nil {
+		log.Println("auth: ", err.Error())
+		return dummyUserInfo, &AuthenticationError{username}
+	}
+	defer l.Close()
+
+	// Cerco l'username richiesto
+	entry, err := searchUser(l, username)
+	if err != nil {
+		return dummyUserInfo, err
+	}
+
+	// Verifica la password
+	err = l.Bind(entry.DN, password)
+	if err != nil {
+		return dummyUserInfo, errors.New("Password errata!")
+	}
+
+	return newUserInfo(username, entry), nil
+}
+
+// Cerca un utente sul server LDAP, senza verificarne la password
+func LookupUser(username string) (UserInfo, error) {
+	if config.Config.General.DummyAuth {
+		return UserInfo{Username: username, FullName: "unknown", Group: "unknown"}, nil
+	}
+
+	// Connessione al server LDAP
+	l, err := dialLDAP()
+	if err != nil {
+		log.Println("auth: ", err.Error())
+		return UserInfo{}, &AuthenticationError{username}
+	}
+	defer l.Close()
+
+	entry, err := searchUser(l, username)
+	if err != nil {
+		return UserInfo{}, err
+	}
+
+	return newUserInfo(username, entry), nil
+}
+
+// Ottiene le informazioni sull'utente LDAP con l'indirizzo email indicato
+// nell'attributo attribute, senza verificarne le credenziali
+func LookupEmail(address, attribute string) (UserInfo, error) {
+	if config.Config.General.DummyAuth {
+		return UserInfo{Username: address, FullName: "unknown", Group: "unknown"}, nil
+	}
+
+	l, err := dialLDAP()
+	if err != nil {
+		log.Println("auth: ", err.Error())
+		return UserInfo{}, &AuthenticationError{address}
+	}
+	defer l.Close()
+
+	searchRequest := ldap.NewSearchRequest(
+		config.Config.LDAP.BaseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		fmt.Sprintf("(%s=%s)", ldap.EscapeFilter(attribute), ldap.EscapeFilter(address)),
+		append(userAttributes(), "uid"),
+		nil,
+	)
+
+	sr, err := l.Search(searchRequest)
+	if err != nil {
+		log.Println("auth: ", err.Error())
+		return UserInfo{}, &AuthenticationError{address}
+	}
+
+	// Shared addresses don't identify a user
+	if len(sr.Entries) != 1 || sr.Entries[0].GetAttributeValue("uid") == "" {
+		return UserInfo{}, &AuthenticationError{address}
+	}
+
+	return newUserInfo(sr.Entries[0].GetAttributeValue("uid"), sr.Entries[0]), nil
+}
+
+// Legge i valori di un attributo della voce LDAP dell'utente
+func UserAttribute(username, attribute string) ([]string, error) {
+	l, err := dialLDAP()
+	if err != nil {
+		log.Println("auth: ", err.Error())
+		return nil, &AuthenticationError{username}
+	}
+	defer l.Close()
+
+	entry, err := searchUser(l, username, attribute)
+	if err != nil {
+		return nil, err
+	}
+
+	return entry.GetAttributeValues(attribute), nil
+}
+
+// Sostituisce i valori di un attributo della voce LDAP dell'utente; senza valori
+// l'attributo viene eliminato
+func SetUserAttribute(username, attribute string, values []string) error {
+	l, err := dialLDAP()
+	if err != nil {
+		log.Println("auth: ", err.Error())
+		return &AuthenticationError{username}
+	}
+	defer l.Close()
+
+	entry, err := searchUser(l, username, "dn")
+	if err != nil {
+		return err
+	}
+
+	modify := ldap.NewModifyRequest(entry.DN, nil)
+	modify.Replace(attribute, values)
+
+	return l.Modify(modify)
+}
+
+// Imposta una nuova password per l'utente con l'operazione Password Modify
+// (RFC 3062), eseguita dall'utente admin
+func SetPassword(username, password string) error {
+	if config.Config.General.DummyAuth {
+		return nil
+	}
+
+	l, err := dialLDAP()
+	if err != nil {
+		log.Println("auth: ", err.Error())
+		return &AuthenticationError{username}
+	}
+	defer l.Close()
+
+	entry, err := searchUser(l, username, "dn")
+	if err != nil {
+		return err
+	}
+
+	_, err = l.PasswordModify(ldap.NewPasswordModifyRequest(entry.DN, "", password))
+	return err
+}
+
+// Si connette al server LDAP ed effettua l'accesso con l'utente admin
+func dialLDAP() (*ldap.Conn, error) {
+
 	// Ottiene la configurazione
 	host := config.Config.LDAP.URI
 	port := config.Config.LDAP.Port
@@ -128,74 +542,78 @@ func checkCredentials(username string, password string) (UserInfo, error) {
 	// Connessione al server LDAP
 	l, err := ldap.DialURL("ldap://" + host + ":" + port)
 	if err != nil {
-		log.Println("auth: ", err.Error())
-		return dummyUserInfo, &AuthenticationError{username}
+		return nil, err
 	}
-	defer l.Close()
 
 	// Per prima cosa effettuo l'accesso con un utente admin
 	err = l.Bind(bindUserDN, bindPassword)
 	if err != nil {
-		log.Println("auth: ", err.Error())
-		return dummyUserInfo, &AuthenticationError{username}
+		l.Close()
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// Cerca la voce dell'utente richiesto, con gli attributi indicati oppure, se non
+// ne sono indicati, con quelli necessari per le claim
+func searchUser(l *ldap.Conn, username string, attributes ...string) (*ldap.Entry, error) {
+	if len(attributes) == 0 {
+		attributes = userAttributes()
 	}
 
-	// Cerco l'username richiesto
 	searchRequest := ldap.NewSearchRequest(
-		baseDN,
+		config.Config.LDAP.BaseDN,
 		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
 		fmt.Sprintf("(uid=%s)", ldap.EscapeFilter(username)), // Escape username
-		[]string{"dn", "cn", "ou"},
+		attributes,
 		nil,
 	)
 
 	sr, err := l.Search(searchRequest)
 	if err != nil {
 		log.Println("auth: ", err.Error())
-		return dummyUserInfo, &AuthenticationError{username}
+		return nil, &AuthenticationError{username}
 	}
 
-	// Verifico il numero di utenti corrispondenti e ottendo il DN dell'utente
+	// Verifico il numero di utenti corrispondenti
 	if len(sr.Entries) != 1 {
-		return dummyUserInfo, &AuthenticationError{username}
+		return nil, &AuthenticationError{username}
 	}
 
-	userDN := sr.Entries[0].DN
-	fullName := sr.Entries[0].GetAttributeValue("cn")
-	group := sr.Entries[0].GetAttributeValue("ou")
+	return sr.Entries[0], nil
+}
 
-	// Verifica la password
-	err = l.Bind(userDN, password)
-	if err != nil {
-		return dummyUserInfo, errors.New("Password errata!")
+// Costruisce le informazioni sull'utente a partire dalla voce LDAP
+func newUserInfo(username string, entry *ldap.Entry) UserInfo {
+	attributes := make(map[string][]string, len(entry.Attributes))
+	for _, attribute := range entry.Attributes {
+		attributes[attribute.Name] = attribute.Values
 	}
 
-	return UserInfo{username, fullName, group}, nil
+	return UserInfo{
+		Username:   username,
+		FullName:   entry.GetAttributeValue("cn"),
+		Group:      entry.GetAttributeValue("ou"),
+		Attributes: attributes,
+	}
 }
 
-// Genera un token
-func getToken(userInfo UserInfo, exp time.Duration) ([]byte, error) {
+// Genera un token valido solo per l'audience indicata
+// (l'origine di un servizio oppure l'ID di un client)
+func IssueToken(userInfo UserInfo, audience string, exp time.Duration, opts ...TokenOption) ([]byte, error) {
 
 	var (
 		// Ottiene il tempo corrente
 		now = time.Now()
 
-		// Carico i domini autorizzati dalla configurazione
-		domains = config.Config.General.Domains
-
 		// Carico il FQDN
 		fqdn = config.Config.General.FQDN
 
-		// Inizializzo l'audience
-		aud = jwt.Audience{}
+		// Definisco l'audience
+		aud = jwt.Audience{audience}
 	)
 
-	// Definisco l'audience
-	for _, domain := range domains {
-		aud = append(aud, "http://"+domain)
-		aud = append(aud, "https://"+domain)
-	}
-
 	// Definisco il payload
 	pl := customPayload{
 		Payload: jwt.Payload{
@@ -205,57 +623,176 @@ func getToken(userInfo UserInfo, exp time.Duration) ([]byte, error) {
 			ExpirationTime: jwt.NumericDate(now.Add(exp)),
 			IssuedAt:       jwt.NumericDate(now),
 		},
-		FullName: userInfo.FullName,
-		Group:    userInfo.Group,
+		FullName:  userInfo.FullName,
+		Group:     userInfo.Group,
+		Scope:     userInfo.Scope,
+		SessionID: userInfo.SessionID,
+		Methods:   userInfo.Methods,
+		ACR:       ACR(userInfo.Methods),
+		Extra:     customClaims(userInfo, audience),
+	}
+
+	if !userInfo.AuthTime.IsZero() {
+		pl.AuthTime = jwt.NumericDate(userInfo.AuthTime)
+	}
+
+	if userInfo.Actor != "" {
+		pl.Actor = &actor{Subject: userInfo.Actor}
+	}
+
+	for _, opt := range opts {
+		opt(&pl)
 	}
 
 	// Firma il token
-	token, err := jwt.Sign(pl, jwtSigner)
+	token, err := jwt.Sign(pl, jwtSigner, jwt.KeyID(jwtKeyID))
 
 	if err != nil {
 		return nil, &JWTCreationError{userInfo.Username}
 	}
 
+	// Cifra il token, se previsto per l'audience
+	token, err = encryptToken(token, audience)
+
+	if err != nil {
+		log.Println("auth: ", err.Error())
+		return nil, &JWTCreationError{userInfo.Username}
+	}
+
 	return token, nil
 }
 
-// Verify a token
-func VerifyToken(token []byte) error {
+// Verify a token for one of the given audiences
+func VerifyToken(token []byte, audiences ...string) error {
+	_, err := ParseToken(token, audiences...)
+	return err
+}
 
-	var (
-		// Ottiene il tempo corrente
-		now = time.Now()
+// Verifica un token destinato a una delle audience indicate e restituisce le informazioni sull'utente
+func ParseToken(token []byte, audiences ...string) (UserInfo, error) {
 
-		// Carico i domini autorizzati dalla configurazione
-		domains = config.Config.General.Domains
+	// Inizializzo l'audience
+	aud := jwt.Audience(audiences)
 
-		// Inizializzo l'audience
-		aud = jwt.Audience{}
-	)
+	pl, err := verifyPayload(token, jwt.AudienceValidator(aud))
+	if err != nil {
+		return UserInfo{}, err
+	}
 
-	// Definisco l'audience
-	for _, domain := range domains {
-		aud = append(aud, "http://"+domain)
-		aud = append(aud, "https://"+domain)
+	userInfo := UserInfo{
+		Username:  pl.Payload.Subject,
+		FullName:  pl.FullName,
+		Group:     pl.Group,
+		Scope:     pl.Scope,
+		Expires:   pl.Payload.ExpirationTime.Time,
+		SessionID: pl.SessionID,
+		Methods:   pl.Methods,
 	}
 
-	var (
-		// Inizializzo i "validatori"
-		iatValidator = jwt.IssuedAtValidator(now)
-		expValidator = jwt.ExpirationTimeValidator(now)
-		audValidator = jwt.AudienceValidator(aud)
-
-		// Costruisco il validatore supremo
-		pl              customPayload
-		validatePayload = jwt.ValidatePayload(&pl.Payload, iatValidator, expValidator, audValidator)
-	)
+	if pl.AuthTime != nil {
+		userInfo.AuthTime = pl.AuthTime.Time
+	}
+
+	if pl.Confirmation != nil {
+		userInfo.KeyThumbprint = pl.Confirmation.JKT
+	}
+
+	if pl.Actor != nil {
+		userInfo.Actor = pl.Actor.Subject
+	}
+
+	return userInfo, nil
+}
+
+// Verifica un token per qualunque audience e ne restituisce tutte le claim,
+// nel formato della risposta di introspezione (RFC 7662)
+func Introspect(token []byte) (map[string]interface{}, error) {
+	pl, err := verifyPayload(token)
+	if err != nil {
+		return nil, err
+	}
+
+	claims := make(map[string]interface{}, len(pl.Extra)+9)
+	for name, value := range pl.Extra {
+		claims[name] = value
+	}
+
+	claims["active"] = true
+	claims["iss"] = pl.Payload.Issuer
+	claims["sub"] = pl.Payload.Subject
+	claims["aud"] = pl.Payload.Audience[0]
+	claims["exp"] = pl.Payload.ExpirationTime.Unix()
+	claims["iat"] = pl.Payload.IssuedAt.Unix()
+	claims["username"] = pl.Payload.Subject
+	claims["full_name"] = pl.FullName
+	claims["group"] = pl.Group
+
+	if pl.Confirmation != nil {
+		claims["cnf"] = pl.Confirmation
+		claims["token_type"] = "DPoP"
+	}
+
+	if pl.Scope != "" {
+		claims["scope"] = pl.Scope
+	}
+
+	if pl.Actor != nil {
+		claims["act"] = pl.Actor
+	}
+
+	if pl.SessionID != "" {
+		claims["sid"] = pl.SessionID
+	}
+
+	if len(pl.Methods) > 0 {
+		claims["amr"] = pl.Methods
+	}
+
+	if pl.ACR != "" {
+		claims["acr"] = pl.ACR
+	}
+
+	if pl.AuthTime != nil {
+		claims["auth_time"] = pl.AuthTime.Unix()
+	}
+
+	return claims, nil
+}
+
+// Decifra (se necessario) e verifica un token, restituendone il payload
+func verifyPayload(token []byte, validators ...jwt.Validator) (customPayload, error) {
+	var pl customPayload
+
+	// Ottiene il tempo corrente
+	now := time.Now()
+
+	token, err := decryptToken(token)
+	if err != nil {
+		return pl, err
+	}
+
+	// Inizializzo i "validatori"
+	validators = append(validators, jwt.IssuedAtValidator(now), jwt.ExpirationTimeValidator(now))
+
+	// Costruisco il validatore supremo
+	validatePayload := jwt.ValidatePayload(&pl.Payload, validators...)
 
 	// Verifico il token
-	_, err := jwt.Verify(token, jwtSigner, &pl, validatePayload)
+	_, err = jwt.Verify(token, jwtSigner, &pl, jwt.ValidateHeader, validatePayload)
 
 	if err != nil {
-		return err
+		return pl, err
 	}
 
-	return nil
+	// Tokens valid for more than one service (as issued by older versions) are rejected
+	if len(pl.Payload.Audience) != 1 {
+		return pl, ErrInvalidAudience
+	}
+
+	// Tokens issued by ssodav always have these claims
+	if pl.Payload.ExpirationTime == nil || pl.Payload.IssuedAt == nil {
+		return pl, ErrInvalidToken
+	}
+
+	return pl, nil
 }
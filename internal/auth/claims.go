@@ -0,0 +1,220 @@
+/*
+ * claims.go
+ *
+ * Claim aggiuntive dei token definite nella configurazione.
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"text/template"
+
+	"git.napaalm.xyz/napaalm/ssodav/internal/config"
+)
+
+// Claim aggiuntiva compilata a partire dalla configurazione
+type customClaim struct {
+	name      string
+	attribute string
+	value     interface{}
+	template  *template.Template
+	audiences []string
+}
+
+// Claim già usate da ssodav o registrate (RFC 7519), che non possono essere ridefinite
+var reservedClaims = map[string]bool{
+	"Payload":   true,
+	"full_name": true,
+	"group":     true,
+	"iss":       true,
+	"sub":       true,
+	"aud":       true,
+	"exp":       true,
+	"nbf":       true,
+	"iat":       true,
+	"jti":       true,
+	"cnf":       true,
+	"scope":     true,
+	"act":       true,
+	"sid":       true,
+	"amr":       true,
+	"acr":       true,
+	"auth_time": true,
+}
+
+// Funzioni disponibili nei template
+var claimFuncs = template.FuncMap{
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+}
+
+var claims []customClaim
+
+// Compila le claim aggiuntive definite nella configurazione.
+// Ogni claim deve avere esattamente una sorgente tra attributo, valore e template.
+func InitializeClaims() error {
+	claims = nil
+
+	for _, cfg := range config.Config.Claims {
+		if cfg.Name == "" || reservedClaims[cfg.Name] {
+			return fmt.Errorf("auth: invalid claim name %q", cfg.Name)
+		}
+
+		c := customClaim{
+			name:      cfg.Name,
+			attribute: cfg.Attribute,
+			value:     cfg.Value,
+			audiences: cfg.Audiences,
+		}
+
+		sources := 0
+		if cfg.Attribute != "" {
+			sources++
+		}
+		if cfg.Value != nil {
+			sources++
+		}
+		if cfg.Template != "" {
+			sources++
+
+			tmpl, err := template.New(cfg.Name).Funcs(claimFuncs).Option("missingkey=zero").Parse(cfg.Template)
+			if err != nil {
+				return fmt.Errorf("auth: claim %q: %v", cfg.Name, err)
+			}
+			c.template = tmpl
+		}
+
+		if sources != 1 {
+			return errors.New("auth: claim " + cfg.Name + " needs exactly one of attributo, valore and template")
+		}
+
+		claims = append(claims, c)
+	}
+
+	return nil
+}
+
+// Restituisce gli attributi LDAP da richiedere per ogni utente: quelli usati
+// dalle claim oppure tutti se qualche template può accedere alla voce intera
+func userAttributes() []string {
+	attributes := []string{"dn", "cn", "ou"}
+
+	for _, c := range claims {
+		if c.template != nil {
+			return append(attributes, "*")
+		}
+
+		if c.attribute != "" {
+			attributes = append(attributes, c.attribute)
+		}
+	}
+
+	return attributes
+}
+
+// Controlla se la claim va aggiunta ai token per l'audience indicata
+func (c customClaim) appliesTo(audience string) bool {
+	if len(c.audiences) == 0 {
+		return true
+	}
+
+	for _, a := range c.audiences {
+		if a == audience {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Indica se la claim ha bisogno degli attributi LDAP dell'utente
+func (c customClaim) needsEntry() bool {
+	return c.attribute != "" || c.template != nil
+}
+
+// Calcola il valore della claim per l'utente. Restituisce false se la claim va omessa.
+func (c customClaim) evaluate(userInfo UserInfo) (interface{}, bool) {
+	switch {
+	case c.attribute != "":
+		values := userInfo.AttributeValues(c.attribute)
+
+		switch len(values) {
+		case 0:
+			return nil, false
+		case 1:
+			return values[0], true
+		default:
+			return values, true
+		}
+
+	case c.template != nil:
+		var b strings.Builder
+
+		if err := c.template.Execute(&b, userInfo); err != nil {
+			log.Println("auth: ", err.Error())
+			return nil, false
+		}
+
+		return b.String(), true
+
+	default:
+		return c.value, true
+	}
+}
+
+// Restituisce le claim aggiuntive per un token destinato all'audience indicata.
+// Se servono gli attributi LDAP e non sono disponibili, l'utente viene cercato nella directory.
+func customClaims(userInfo UserInfo, audience string) map[string]interface{} {
+	var selected []customClaim
+
+	for _, c := range claims {
+		if c.appliesTo(audience) {
+			selected = append(selected, c)
+		}
+	}
+
+	if len(selected) == 0 {
+		return nil
+	}
+
+	for _, c := range selected {
+		if c.needsEntry() && userInfo.Attributes == nil {
+			if entry, err := LookupUser(userInfo.Username); err == nil {
+				userInfo.Attributes = entry.Attributes
+			}
+			break
+		}
+	}
+
+	values := make(map[string]interface{}, len(selected))
+
+	for _, c := range selected {
+		if value, ok := c.evaluate(userInfo); ok {
+			values[c.name] = value
+		}
+	}
+
+	return values
+}
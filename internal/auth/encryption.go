@@ -0,0 +1,134 @@
+/*
+ * encryption.go
+ *
+ * Cifratura dei token destinati ad alcune audience (JWE).
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+
+	"git.napaalm.xyz/napaalm/ssodav/internal/config"
+	"git.napaalm.xyz/napaalm/ssodav/internal/keys"
+	"git.napaalm.xyz/napaalm/ssodav/pkg/jwe"
+	"git.napaalm.xyz/napaalm/ssodav/pkg/jwk"
+)
+
+// Errore di decifratura di un token per cui non è disponibile la chiave privata
+var ErrNoDecryptionKey = errors.New("Impossibile decifrare il token")
+
+// Chiave per la cifratura dei token di alcune audience
+type encryptionKey struct {
+	audiences []string
+	alg       string
+	kid       string
+	pub       crypto.PublicKey
+
+	// Presente solo se nella configurazione è indicata la chiave privata
+	priv crypto.PrivateKey
+}
+
+var encryptionKeys []encryptionKey
+
+// Carica le chiavi per la cifratura dei token
+func InitializeEncryption() error {
+	encryptionKeys = nil
+
+	for _, cfg := range config.Config.Encryption {
+		var key encryptionKey
+
+		// The key file may contain either the private or the public key
+		if priv, err := keys.LoadPrivateKey(cfg.Key); err == nil {
+			key.priv = priv
+			key.pub = priv.Public()
+		} else if key.pub, err = keys.LoadPublicKey(cfg.Key); err != nil {
+			return err
+		}
+
+		key.alg = cfg.Algorithm
+		if key.alg == "" {
+			key.alg = jwe.DefaultAlgorithm(key.pub)
+		}
+
+		switch key.pub.(type) {
+		case *rsa.PublicKey:
+			if key.alg != jwe.RSAOAEP && key.alg != jwe.RSAOAEP256 {
+				return fmt.Errorf("auth: an RSA key can't be used with %s", key.alg)
+			}
+		case *ecdsa.PublicKey:
+			if key.alg != jwe.ECDHES {
+				return fmt.Errorf("auth: an EC key can't be used with %s", key.alg)
+			}
+		default:
+			return fmt.Errorf("auth: unsupported key type in %s", cfg.Key)
+		}
+
+		public, err := jwk.New(key.pub)
+		if err != nil {
+			return err
+		}
+
+		key.kid = public.KeyID
+		key.audiences = cfg.Audiences
+
+		encryptionKeys = append(encryptionKeys, key)
+	}
+
+	return nil
+}
+
+// Cifra il token se per l'audience è configurata una chiave
+func encryptToken(token []byte, audience string) ([]byte, error) {
+	for _, key := range encryptionKeys {
+		for _, a := range key.audiences {
+			if a == audience {
+				return jwe.Encrypt(token, key.pub, key.alg, key.kid)
+			}
+		}
+	}
+
+	return token, nil
+}
+
+// Decifra il token se è cifrato e la chiave privata è disponibile
+func decryptToken(token []byte) ([]byte, error) {
+	if !jwe.IsEncrypted(token) {
+		return token, nil
+	}
+
+	header, err := jwe.ParseHeader(token)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range encryptionKeys {
+		if key.kid == header.KeyID && key.priv != nil {
+			return jwe.Decrypt(token, key.priv)
+		}
+	}
+
+	return nil, ErrNoDecryptionKey
+}
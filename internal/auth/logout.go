@@ -0,0 +1,79 @@
+/*
+ * logout.go
+ *
+ * Logout token per la disconnessione delle applicazioni (back-channel).
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"time"
+
+	"git.napaalm.xyz/napaalm/ssodav/internal/config"
+	"github.com/gbrlsnchs/jwt/v3"
+)
+
+// Evento che identifica i logout token (OpenID Connect Back-Channel Logout)
+const LogoutEvent = "http://schemas.openid.net/event/backchannel-logout"
+
+// Durata dei logout token
+const logoutTokenLifetime = 2 * time.Minute
+
+// Payload dei logout token. A differenza dei token di accesso le claim
+// registrate non sono annidate, come previsto dalla specifica.
+type logoutPayload struct {
+	jwt.Payload
+	Events    map[string]struct{} `json:"events"`
+	SessionID string              `json:"sid,omitempty"`
+}
+
+// Genera il logout token che comunica all'applicazione audience la fine della
+// sessione sessionID dell'utente. Il token non viene mai cifrato.
+func IssueLogoutToken(username, sessionID, audience string) ([]byte, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
+	pl := logoutPayload{
+		Payload: jwt.Payload{
+			Issuer:         config.Config.General.FQDN,
+			Subject:        username,
+			Audience:       jwt.Audience{audience},
+			ExpirationTime: jwt.NumericDate(now.Add(logoutTokenLifetime)),
+			IssuedAt:       jwt.NumericDate(now),
+			JWTID:          base64.RawURLEncoding.EncodeToString(id),
+		},
+		Events:    map[string]struct{}{LogoutEvent: {}},
+		SessionID: sessionID,
+	}
+
+	token, err := jwt.Sign(pl, jwtSigner, jwt.KeyID(jwtKeyID))
+	if err != nil {
+		return nil, &JWTCreationError{username}
+	}
+
+	return token, nil
+}
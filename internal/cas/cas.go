@@ -0,0 +1,364 @@
+/*
+ * cas.go
+ *
+ * Gestione dei ticket del protocollo CAS (v2/v3).
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+// Package per la gestione dei ticket del protocollo CAS (v2/v3).
+package cas
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"git.napaalm.xyz/napaalm/ssodav/internal/auth"
+	"git.napaalm.xyz/napaalm/ssodav/internal/config"
+	"git.napaalm.xyz/napaalm/ssodav/internal/session"
+)
+
+// Prefissi dei ticket
+const (
+	prefixLoginTicket            = "LT-"
+	prefixServiceTicket          = "ST-"
+	prefixProxyTicket            = "PT-"
+	prefixProxyGrantingTicket    = "PGT-"
+	prefixProxyGrantingTicketIOU = "PGTIOU-"
+)
+
+const (
+	defaultTicketValidity = 10 * time.Second
+
+	// Tempo concesso per l'accesso richiesto con renew
+	loginTicketValidity = 10 * time.Minute
+
+	// Validità dei proxy-granting ticket
+	proxyGrantingTicketValidity = 2 * time.Hour
+
+	// Tempo massimo di attesa della callback del proxy
+	callbackTimeout = 5 * time.Second
+)
+
+// Errore CAS, con codice come da specifica
+type Error struct {
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+var (
+	ErrInvalidRequest       = &Error{"INVALID_REQUEST", "Parametri obbligatori mancanti"}
+	ErrInvalidTicket        = &Error{"INVALID_TICKET", "Ticket non riconosciuto"}
+	ErrInvalidService       = &Error{"INVALID_SERVICE", "Il ticket non è stato emesso per questo servizio"}
+	ErrUnauthorizedService  = &Error{"UNAUTHORIZED_SERVICE", "Servizio non autorizzato"}
+	ErrUnauthorizedProxy    = &Error{"UNAUTHORIZED_SERVICE_PROXY", "Il servizio non è autorizzato a fare da proxy"}
+	ErrInvalidProxyCallback = &Error{"INVALID_PROXY_CALLBACK", "Callback del proxy non valida"}
+	ErrInternal             = &Error{"INTERNAL_ERROR", "Errore interno"}
+)
+
+// Ticket emesso dal server
+type Ticket struct {
+	ID      string
+	Service string
+	User    auth.UserInfo
+	Created time.Time
+	Expires time.Time
+
+	// Indica se il ticket è stato emesso subito dopo un accesso con le
+	// credenziali, invece che da una sessione esistente (parametro renew)
+	Renewed bool
+
+	// Catena dei proxy attraverso cui è passato il ticket, dal più recente
+	Proxies []string
+}
+
+var (
+	mutex      sync.Mutex
+	tickets    map[string]*Ticket
+	validity   time.Duration
+	httpClient = &http.Client{Timeout: callbackTimeout}
+)
+
+// Inizializza l'archivio dei ticket
+func Initialize() {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	tickets = make(map[string]*Ticket)
+
+	validity = config.Config.CAS.TicketValidity.Duration
+	if validity <= 0 {
+		validity = defaultTicketValidity
+	}
+}
+
+// Controlla se un servizio appartiene alla lista di quelli autorizzati.
+// Un servizio è autorizzato se ha lo stesso schema e host di una delle voci
+// e il percorso è contenuto in quello della voce (per segmenti interi).
+func ServiceAllowed(service string) bool {
+	u, err := url.Parse(service)
+	if err != nil || !u.IsAbs() {
+		return false
+	}
+
+	for _, entry := range config.Config.CAS.Services {
+		allowed, err := url.Parse(entry)
+		if err != nil {
+			continue
+		}
+
+		if u.Scheme == allowed.Scheme && strings.EqualFold(u.Host, allowed.Host) && pathWithin(u.Path, allowed.Path) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Controlla se path è uguale a prefix o si trova al suo interno:
+// /app comprende /app e /app/x, ma non /app-evil
+func pathWithin(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
+
+// Emette un service ticket per il servizio indicato. renewed indica se
+// l'utente ha appena inserito le credenziali.
+func NewServiceTicket(service string, user auth.UserInfo, renewed bool) (string, error) {
+	if !ServiceAllowed(service) {
+		return "", ErrUnauthorizedService
+	}
+
+	id, err := store(prefixServiceTicket, service, user, nil, validity)
+	if err != nil {
+		return "", err
+	}
+
+	mutex.Lock()
+	tickets[id].Renewed = renewed
+	mutex.Unlock()
+
+	return id, nil
+}
+
+// Emette un login ticket, che attesta la richiesta di un nuovo accesso al
+// servizio indicato (parametro renew)
+func NewLoginTicket(service string) (string, error) {
+	if !ServiceAllowed(service) {
+		return "", ErrUnauthorizedService
+	}
+
+	return store(prefixLoginTicket, service, auth.UserInfo{}, nil, loginTicketValidity)
+}
+
+// Consuma un login ticket per il servizio indicato e indica se l'autenticazione
+// dell'utente è avvenuta dopo la sua emissione
+func RedeemLoginTicket(id, service string, authTime time.Time) bool {
+	if !strings.HasPrefix(id, prefixLoginTicket) {
+		return false
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	t, ok := tickets[id]
+	if !ok {
+		return false
+	}
+
+	delete(tickets, id)
+
+	return t.Service == service && !time.Now().After(t.Expires) && authTime.After(t.Created)
+}
+
+// Valida un ticket per il servizio indicato. I proxy ticket sono accettati
+// solo se allowProxy è vero; con renew solo i ticket emessi subito dopo un
+// accesso con le credenziali. Il ticket non può più essere usato.
+func Validate(id, service string, allowProxy, renew bool) (*Ticket, error) {
+	if id == "" || service == "" {
+		return nil, ErrInvalidRequest
+	}
+
+	if !strings.HasPrefix(id, prefixServiceTicket) && !(allowProxy && strings.HasPrefix(id, prefixProxyTicket)) {
+		return nil, ErrInvalidTicket
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	t, ok := tickets[id]
+	if !ok {
+		return nil, ErrInvalidTicket
+	}
+
+	// Tickets can be validated only once
+	delete(tickets, id)
+
+	if time.Now().After(t.Expires) {
+		return nil, ErrInvalidTicket
+	}
+
+	if t.Service != service {
+		return nil, ErrInvalidService
+	}
+
+	if renew && !t.Renewed {
+		return nil, ErrInvalidTicket
+	}
+
+	return t, nil
+}
+
+// Emette un proxy-granting ticket per l'utente di un ticket appena validato.
+// Il PGT viene consegnato alla callback pgtURL; viene restituito il PGTIOU.
+func NewProxyGrantingTicket(pgtURL string, t *Ticket) (string, error) {
+	if !config.Config.CAS.Proxy {
+		return "", ErrUnauthorizedProxy
+	}
+
+	u, err := url.Parse(pgtURL)
+	if err != nil || u.Scheme != "https" || !ServiceAllowed(pgtURL) {
+		return "", ErrInvalidProxyCallback
+	}
+
+	proxies := append([]string{pgtURL}, t.Proxies...)
+
+	pgt, err := store(prefixProxyGrantingTicket, "", t.User, proxies, proxyGrantingTicketValidity)
+	if err != nil {
+		return "", ErrInternal
+	}
+
+	iou, err := newID(prefixProxyGrantingTicketIOU)
+	if err != nil {
+		remove(pgt)
+		return "", ErrInternal
+	}
+
+	// Deliver the PGT to the callback
+	query := u.Query()
+	query.Set("pgtId", pgt)
+	query.Set("pgtIou", iou)
+	u.RawQuery = query.Encode()
+
+	resp, err := httpClient.Get(u.String())
+	if err != nil || resp.StatusCode != http.StatusOK {
+		if err == nil {
+			resp.Body.Close()
+		}
+
+		remove(pgt)
+		return "", ErrInvalidProxyCallback
+	}
+	resp.Body.Close()
+
+	return iou, nil
+}
+
+// Emette un proxy ticket per il servizio indicato a partire da un proxy-granting ticket
+func NewProxyTicket(pgt, targetService string) (string, error) {
+	if pgt == "" || targetService == "" {
+		return "", ErrInvalidRequest
+	}
+
+	if !strings.HasPrefix(pgt, prefixProxyGrantingTicket) {
+		return "", ErrInvalidTicket
+	}
+
+	if !ServiceAllowed(targetService) {
+		return "", ErrUnauthorizedService
+	}
+
+	mutex.Lock()
+	t, ok := tickets[pgt]
+	mutex.Unlock()
+
+	if !ok || time.Now().After(t.Expires) {
+		return "", ErrInvalidTicket
+	}
+
+	// The ticket is revoked with the session of the user
+	if t.User.SessionID != "" && !session.Active(t.User.SessionID) {
+		remove(pgt)
+		return "", ErrInvalidTicket
+	}
+
+	return store(prefixProxyTicket, targetService, t.User, t.Proxies, validity)
+}
+
+// Invalida un ticket
+func remove(id string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	delete(tickets, id)
+}
+
+// Memorizza un nuovo ticket e ne restituisce l'identificatore
+func store(prefix, service string, user auth.UserInfo, proxies []string, validity time.Duration) (string, error) {
+	id, err := newID(prefix)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	// Remove expired tickets
+	for k, t := range tickets {
+		if now.After(t.Expires) {
+			delete(tickets, k)
+		}
+	}
+
+	tickets[id] = &Ticket{
+		ID:      id,
+		Service: service,
+		User:    user,
+		Created: now,
+		Expires: now.Add(validity),
+		Proxies: proxies,
+	}
+
+	return id, nil
+}
+
+// Genera un identificatore casuale con il prefisso indicato
+func newID(prefix string) (string, error) {
+	b := make([]byte, 32)
+
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return prefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,262 @@
+/*
+ * cas_test.go
+ *
+ * File di test per il package cas.
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+package cas
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"git.napaalm.xyz/napaalm/ssodav/internal/auth"
+	"git.napaalm.xyz/napaalm/ssodav/internal/config"
+	"git.napaalm.xyz/napaalm/ssodav/internal/session"
+)
+
+var user = auth.UserInfo{Username: "professor", FullName: "Hubert J. Farnsworth", Group: "Office Management"}
+
+func TestServiceAllowed(t *testing.T) {
+	config.Config.CAS.Services = []string{"https://moodle.example.org/", "https://app.example.org/cas"}
+
+	cases := map[string]bool{
+		"https://moodle.example.org/login?x=1":          true,
+		"https://app.example.org/cas/callback":          true,
+		"https://app.example.org/cas":                   true,
+		"https://app.example.org/cas-evil":              false,
+		"https://app.example.org/castle/":               false,
+		"https://app.example.org/other":                 false,
+		"http://moodle.example.org/":                    false,
+		"https://moodle.example.org.evil.com/":          false,
+		"https://evil.com/?https://moodle.example.org/": false,
+		"/relative": false,
+	}
+
+	for service, expected := range cases {
+		if ServiceAllowed(service) != expected {
+			t.Errorf("ServiceAllowed(%q) != %v", service, expected)
+		}
+	}
+}
+
+func TestServiceTicket(t *testing.T) {
+	config.Config.CAS.Services = []string{"https://moodle.example.org/"}
+	Initialize()
+
+	service := "https://moodle.example.org/login"
+
+	st, err := NewServiceTicket(service, user, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Wrong service: the ticket is consumed anyway
+	if _, err := Validate(st, "https://moodle.example.org/other", false, false); err != ErrInvalidService {
+		t.Errorf("expected %v, got %v", ErrInvalidService, err)
+	}
+
+	st, _ = NewServiceTicket(service, user, false)
+
+	ticket, err := Validate(st, service, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(ticket.User, user) {
+		t.Errorf("expected %v, got %v", user, ticket.User)
+	}
+
+	// Tickets can be used only once
+	if _, err := Validate(st, service, false, false); err != ErrInvalidTicket {
+		t.Errorf("expected %v, got %v", ErrInvalidTicket, err)
+	}
+
+	response := SuccessResponse(ticket, "", true)
+	if !bytes.Contains(response, []byte("<cas:full_name>Hubert J. Farnsworth</cas:full_name>")) {
+		t.Errorf("attributes not found in %s", response)
+	}
+}
+
+func TestRenew(t *testing.T) {
+	config.Config.CAS.Services = []string{"https://moodle.example.org/"}
+	Initialize()
+
+	service := "https://moodle.example.org/login"
+
+	// Tickets from an existing session don't satisfy renew
+	st, _ := NewServiceTicket(service, user, false)
+	if _, err := Validate(st, service, false, true); err != ErrInvalidTicket {
+		t.Errorf("expected %v, got %v", ErrInvalidTicket, err)
+	}
+
+	st, _ = NewServiceTicket(service, user, true)
+	if _, err := Validate(st, service, false, true); err != nil {
+		t.Error(err)
+	}
+
+	// Login tickets are redeemed only by a later authentication, once
+	lt, err := NewLoginTicket(service)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if RedeemLoginTicket(lt, service, time.Now().Add(-time.Minute)) {
+		t.Error("login ticket redeemed by an earlier authentication")
+	}
+
+	lt, _ = NewLoginTicket(service)
+	if RedeemLoginTicket(lt, "https://moodle.example.org/other", time.Now()) {
+		t.Error("login ticket redeemed for another service")
+	}
+
+	lt, _ = NewLoginTicket(service)
+	if !RedeemLoginTicket(lt, service, time.Now()) {
+		t.Error("login ticket not redeemed")
+	}
+
+	if RedeemLoginTicket(lt, service, time.Now()) {
+		t.Error("login ticket redeemed twice")
+	}
+
+	// Login tickets can't be validated as service tickets
+	lt, _ = NewLoginTicket(service)
+	if _, err := Validate(lt, service, true, false); err != ErrInvalidTicket {
+		t.Errorf("expected %v, got %v", ErrInvalidTicket, err)
+	}
+}
+
+func TestProxy(t *testing.T) {
+	var pgt string
+
+	callback := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pgt = r.URL.Query().Get("pgtId")
+	}))
+	defer callback.Close()
+
+	httpClient = callback.Client()
+
+	config.Config.CAS.Proxy = true
+	config.Config.CAS.Services = []string{"https://moodle.example.org/", callback.URL + "/"}
+	Initialize()
+
+	service := "https://moodle.example.org/login"
+
+	st, _ := NewServiceTicket(service, user, false)
+	ticket, err := Validate(st, service, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	iou, err := NewProxyGrantingTicket(callback.URL+"/pgt", ticket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if iou == "" || pgt == "" {
+		t.Fatal("the proxy-granting ticket wasn't delivered")
+	}
+
+	pt, err := NewProxyTicket(pgt, service)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Proxy tickets are accepted only by proxyValidate
+	if _, err := Validate(pt, service, false, false); err != ErrInvalidTicket {
+		t.Errorf("expected %v, got %v", ErrInvalidTicket, err)
+	}
+
+	pt, _ = NewProxyTicket(pgt, service)
+
+	proxied, err := Validate(pt, service, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(proxied.Proxies) != 1 || proxied.Proxies[0] != callback.URL+"/pgt" {
+		t.Errorf("unexpected proxy chain %v", proxied.Proxies)
+	}
+
+	// Proxy-granting tickets end with the session they were obtained from
+	config.Config.Sessions.File = ""
+	if err := session.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, s, _, err := session.Create(user, "127.0.0.1", "curl", []string{"pwd"}, time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st, _ = NewServiceTicket(service, s.UserInfo(), false)
+	ticket, _ = Validate(st, service, false, false)
+	if _, err := NewProxyGrantingTicket(callback.URL+"/pgt", ticket); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewProxyTicket(pgt, service); err != nil {
+		t.Fatal(err)
+	}
+
+	session.Delete(s.ID)
+
+	if _, err := NewProxyTicket(pgt, service); err != ErrInvalidTicket {
+		t.Errorf("expected %v after the logout, got %v", ErrInvalidTicket, err)
+	}
+}
+
+func TestAttributes(t *testing.T) {
+	lookups := 0
+	lookupUser = func(username string) (auth.UserInfo, error) {
+		lookups++
+
+		u := user
+		u.Attributes = map[string][]string{"mail": {"professor@planetexpress.com"}}
+		return u, nil
+	}
+	defer func() { lookupUser = auth.LookupUser }()
+
+	config.Config.CAS.Attributes = map[string]string{"email": "mail", "displayName": "full_name"}
+	defer func() { config.Config.CAS.Attributes = nil }()
+
+	// Users from a session carry no LDAP attributes, which are looked up in the directory
+	res := string(SuccessResponse(&Ticket{User: user}, "", true))
+
+	for _, s := range []string{"<cas:email>professor@planetexpress.com</cas:email>", "<cas:displayName>Hubert J. Farnsworth</cas:displayName>"} {
+		if !strings.Contains(res, s) {
+			t.Errorf("%q not found in %s", s, res)
+		}
+	}
+
+	// The directory isn't searched when the attributes aren't needed
+	config.Config.CAS.Attributes = nil
+	SuccessResponse(&Ticket{User: user}, "", true)
+
+	if lookups != 1 {
+		t.Errorf("%d directory lookups", lookups)
+	}
+}
@@ -0,0 +1,149 @@
+/*
+ * response.go
+ *
+ * Risposte XML del protocollo CAS.
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+package cas
+
+import (
+	"bytes"
+	"encoding/xml"
+	"sort"
+
+	"git.napaalm.xyz/napaalm/ssodav/internal/auth"
+	"git.napaalm.xyz/napaalm/ssodav/internal/config"
+)
+
+// Attributi rilasciati se non specificati nella configurazione
+var defaultAttributes = map[string]string{
+	"full_name": "full_name",
+	"group":     "group",
+}
+
+// Cerca un utente nella directory; sostituita nei test
+var lookupUser = auth.LookupUser
+
+// Genera la risposta a una validazione riuscita.
+// Gli attributi vengono inclusi solo per il protocollo v3.
+func SuccessResponse(t *Ticket, pgtIOU string, withAttributes bool) []byte {
+	var buf bytes.Buffer
+
+	buf.WriteString(`<cas:serviceResponse xmlns:cas="http://www.yale.edu/tp/cas"><cas:authenticationSuccess>`)
+	writeElement(&buf, "cas:user", t.User.Username)
+
+	if withAttributes {
+		attributes := config.Config.CAS.Attributes
+		if len(attributes) == 0 {
+			attributes = defaultAttributes
+		}
+
+		names := make([]string, 0, len(attributes))
+		fields := make([]string, 0, len(attributes))
+		for name, field := range attributes {
+			names = append(names, name)
+			fields = append(fields, field)
+		}
+		sort.Strings(names)
+
+		// Tickets issued from a session don't carry the LDAP attributes
+		user := t.User
+		if user.MissingAttributes(fields...) {
+			if entry, err := lookupUser(user.Username); err == nil {
+				user.Attributes = entry.Attributes
+			}
+		}
+
+		buf.WriteString(`<cas:attributes>`)
+		for _, name := range names {
+			writeElement(&buf, "cas:"+name, user.Field(attributes[name]))
+		}
+		buf.WriteString(`</cas:attributes>`)
+	}
+
+	if pgtIOU != "" {
+		writeElement(&buf, "cas:proxyGrantingTicket", pgtIOU)
+	}
+
+	if len(t.Proxies) > 0 {
+		buf.WriteString(`<cas:proxies>`)
+		for _, proxy := range t.Proxies {
+			writeElement(&buf, "cas:proxy", proxy)
+		}
+		buf.WriteString(`</cas:proxies>`)
+	}
+
+	buf.WriteString(`</cas:authenticationSuccess></cas:serviceResponse>`)
+
+	return buf.Bytes()
+}
+
+// Genera la risposta a una validazione fallita
+func FailureResponse(err error) []byte {
+	var buf bytes.Buffer
+
+	casErr, ok := err.(*Error)
+	if !ok {
+		casErr = ErrInternal
+	}
+
+	buf.WriteString(`<cas:serviceResponse xmlns:cas="http://www.yale.edu/tp/cas">`)
+	buf.WriteString(`<cas:authenticationFailure code="` + casErr.Code + `">`)
+	xml.EscapeText(&buf, []byte(casErr.Message))
+	buf.WriteString(`</cas:authenticationFailure></cas:serviceResponse>`)
+
+	return buf.Bytes()
+}
+
+// Genera la risposta a una richiesta di proxy ticket
+func ProxySuccessResponse(pt string) []byte {
+	var buf bytes.Buffer
+
+	buf.WriteString(`<cas:serviceResponse xmlns:cas="http://www.yale.edu/tp/cas"><cas:proxySuccess>`)
+	writeElement(&buf, "cas:proxyTicket", pt)
+	buf.WriteString(`</cas:proxySuccess></cas:serviceResponse>`)
+
+	return buf.Bytes()
+}
+
+// Genera la risposta a una richiesta di proxy ticket fallita
+func ProxyFailureResponse(err error) []byte {
+	var buf bytes.Buffer
+
+	casErr, ok := err.(*Error)
+	if !ok {
+		casErr = ErrInternal
+	}
+
+	buf.WriteString(`<cas:serviceResponse xmlns:cas="http://www.yale.edu/tp/cas">`)
+	buf.WriteString(`<cas:proxyFailure code="` + casErr.Code + `">`)
+	xml.EscapeText(&buf, []byte(casErr.Message))
+	buf.WriteString(`</cas:proxyFailure></cas:serviceResponse>`)
+
+	return buf.Bytes()
+}
+
+// Scrive un elemento con il suo contenuto testuale
+func writeElement(buf *bytes.Buffer, name, text string) {
+	buf.WriteString("<" + name + ">")
+	xml.EscapeText(buf, []byte(text))
+	buf.WriteString("</" + name + ">")
+}
@@ -27,14 +27,34 @@ package config
 
 import (
 	"path/filepath"
+	"time"
 
 	"github.com/BurntSushi/toml"
 )
 
 type config struct {
-	General general `toml:"Generale"`
-	LDAP    ldap    `toml:"LDAP"`
-	Limits  limits  `toml:"Limiti"`
+	General       general       `toml:"Generale"`
+	LDAP          ldap          `toml:"LDAP"`
+	Limits        limits        `toml:"Limiti"`
+	Device        device        `toml:"Dispositivi"`
+	SAML          saml          `toml:"SAML"`
+	CAS           cas           `toml:"CAS"`
+	DPoP          dpop          `toml:"DPoP"`
+	Sessions      sessions      `toml:"Sessioni"`
+	Cookies       cookies       `toml:"Cookie"`
+	TOTP          totp          `toml:"TOTP"`
+	WebAuthn      webauthn      `toml:"WebAuthn"`
+	Recovery      recovery      `toml:"Recupero"`
+	SMTP          smtp          `toml:"SMTP"`
+	EmailLogin    emailLogin    `toml:"AccessoEmail"`
+	KnownDevices  knownDevices  `toml:"DispositiviConosciuti"`
+	Admins        admins        `toml:"Amministratori"`
+	Impersonation impersonation `toml:"Impersonificazione"`
+	Clients       []client      `toml:"Client"`
+	Proxy         []route       `toml:"Proxy"`
+	Claims        []claim       `toml:"Claim"`
+	Encryption    []encryption  `toml:"Cifratura"`
+	Policies      []policy      `toml:"Politica"`
 }
 
 type general struct {
@@ -43,9 +63,23 @@ type general struct {
 	Domains       []string `toml:"domini_autorizzati"`
 	Port          string   `toml:"porta_http"`
 	JWTSecret     string   `toml:"chiave_firma"`
+	JWTAlgorithm  string   `toml:"algoritmo_firma"`
+	JWTKey        string   `toml:"chiave_privata_firma"`
 	SecureCookies bool     `toml:"cookie_sicuri"`
 	PageTitle     string   `toml:"titolo_pagina"`
 	DummyAuth     bool     `toml:"dummy_auth"`
+	AuditLog      string   `toml:"registro_audit"`
+
+	// URL dei ricevitori dei servizi, gli unici a cui la pagina di accesso
+	// consegna il codice monouso per ottenere un token
+	Receivers []string `toml:"ricevitori"`
+
+	// Reverse proxy (reti o indirizzi) di cui considerare l'header X-Forwarded-For
+	TrustedProxies []string `toml:"proxy_fidati"`
+
+	// Il template della pagina di accesso non invia il token CSRF: viene
+	// controllata l'origine delle richieste
+	LegacyLoginTemplate bool `toml:"template_accesso_senza_csrf"`
 }
 
 type ldap struct {
@@ -59,10 +93,288 @@ type ldap struct {
 type limits struct {
 	Rate  float64 `toml:"rps_totali"`
 	Burst int     `toml:"max_richieste"`
+
+	// Numero massimo di limitatori per utente e per indirizzo mantenuti in memoria
+	MaxLimiters int `toml:"max_limitatori"`
+}
+
+// Configurazione dell'OAuth2 device authorization grant (RFC 8628)
+type device struct {
+	Expiry      Duration `toml:"scadenza_codici"`
+	Interval    Duration `toml:"intervallo_polling"`
+	MaxPending  int      `toml:"max_codici_in_attesa"`
+	TokenExpiry Duration `toml:"durata_token"`
+}
+
+// Configurazione dell'identity provider SAML 2.0
+type saml struct {
+	Enabled     bool              `toml:"abilitato"`
+	EntityID    string            `toml:"entity_id"`
+	Certificate string            `toml:"certificato"`
+	PrivateKey  string            `toml:"chiave_privata"`
+	SPMetadata  []string          `toml:"metadata_sp"`
+	Validity    Duration          `toml:"validita_asserzioni"`
+	Attributes  map[string]string `toml:"attributi"`
+}
+
+// Configurazione del server CAS
+type cas struct {
+	Enabled        bool              `toml:"abilitato"`
+	Services       []string          `toml:"servizi"`
+	TicketValidity Duration          `toml:"validita_ticket"`
+	Proxy          bool              `toml:"proxy"`
+	Attributes     map[string]string `toml:"attributi"`
+}
+
+// Configurazione dei token vincolati a una chiave DPoP (RFC 9449)
+type dpop struct {
+	Nonce    bool `toml:"nonce"`
+	Required bool `toml:"obbligatorio"`
+}
+
+// Configurazione delle sessioni conservate sul server
+type sessions struct {
+	File       string `toml:"file"`
+	MaxPerUser int    `toml:"max_per_utente"`
+
+	// Durata massima e durata massima di inattività, normalmente e quando
+	// l'utente chiede di ricordare l'accesso
+	MaxLifetime         Duration `toml:"durata_massima"`
+	IdleTimeout         Duration `toml:"inattivita"`
+	RememberMaxLifetime Duration `toml:"durata_massima_ricordami"`
+	RememberIdleTimeout Duration `toml:"inattivita_ricordami"`
+}
+
+// Attributi dei cookie scritti dal server
+type cookies struct {
+	Name     string   `toml:"nome"`
+	Prefix   string   `toml:"prefisso"`
+	SameSite string   `toml:"samesite"`
+	HTTPOnly *bool    `toml:"solo_http"`
+	Secure   *bool    `toml:"sicuri"`
+	Domains  []string `toml:"domini"`
+	Path     string   `toml:"percorso"`
+	MaxSize  int      `toml:"dimensione_massima"`
+}
+
+// Verifica in due passaggi con codici TOTP (RFC 6238)
+type totp struct {
+	Enabled bool `toml:"abilitata"`
+
+	// Gruppi per cui la verifica è obbligatoria; gli altri utenti possono attivarla
+	Groups []string `toml:"gruppi"`
+
+	// Nome del servizio mostrato nelle app di autenticazione
+	Issuer string `toml:"emittente"`
+
+	// Archivio dei segreti ("file" oppure "ldap"), cifrati con la chiave indicata
+	Store     string `toml:"archivio"`
+	File      string `toml:"file"`
+	Attribute string `toml:"attributo_ldap"`
+	Key       string `toml:"chiave"`
+}
+
+// Chiavi di sicurezza e passkey (WebAuthn)
+type webauthn struct {
+	Enabled bool `toml:"abilitata"`
+
+	// Gruppi per cui la chiave è obbligatoria come secondo fattore
+	Groups []string `toml:"gruppi"`
+
+	// Accesso con una passkey al posto di nome utente e password
+	Passwordless bool `toml:"accesso_senza_password"`
+
+	// Dominio a cui sono legate le credenziali, nome mostrato dagli autenticatori
+	// e origini da cui il browser può usarle
+	RPID    string   `toml:"id_rp"`
+	RPName  string   `toml:"nome_rp"`
+	Origins []string `toml:"origini"`
+
+	// Verifica dell'utente con PIN o biometria: "required", "preferred" o "discouraged"
+	UserVerification string `toml:"verifica_utente"`
+
+	// Attestazione chiesta agli autenticatori ("none", "indirect" o "direct"),
+	// formati e modelli (AAGUID) ammessi e certificati radice dei produttori
+	Attestation string   `toml:"attestazione"`
+	Formats     []string `toml:"formati_attestazione"`
+	AAGUIDs     []string `toml:"aaguid"`
+	Roots       string   `toml:"certificati_attestazione"`
+
+	File string `toml:"file"`
+}
+
+// Codici di recupero con cui gli utenti reimpostano la password da soli
+type recovery struct {
+	Enabled bool   `toml:"abilitato"`
+	File    string `toml:"file"`
+
+	// Codici generati ogni volta
+	Codes int `toml:"numero_codici"`
+
+	// Lunghezza minima della nuova password
+	MinPasswordLength int `toml:"lunghezza_minima_password"`
+}
+
+// Server SMTP per l'invio delle email
+type smtp struct {
+	// Indirizzo del server nel formato host:porta
+	Server   string `toml:"server"`
+	Username string `toml:"utente"`
+	Password string `toml:"password"`
+	From     string `toml:"mittente"`
+
+	// Cifratura della connessione: "starttls", "tls" oppure "nessuna"
+	Security string `toml:"sicurezza"`
+}
+
+// Accesso senza password con un codice o un link inviati per email
+type emailLogin struct {
+	Enabled bool `toml:"abilitato"`
+
+	// Indirizzi degli ospiti senza account LDAP, che accedono usando l'indirizzo
+	// come nome utente e appartengono al gruppo indicato
+	Addresses  []string `toml:"indirizzi"`
+	GuestGroup string   `toml:"gruppo_ospiti"`
+
+	// Attributo LDAP con l'indirizzo degli utenti; se vuoto possono accedere
+	// solo gli indirizzi elencati
+	Attribute string `toml:"attributo_ldap"`
+
+	// Validità del codice e del link
+	Expiry Duration `toml:"validita"`
+
+	// Invia anche un link con cui accedere senza inserire il codice
+	Link bool `toml:"link"`
+}
+
+// Dispositivi da cui gli utenti hanno effettuato l'accesso, riconosciuti da un
+// cookie di lunga durata
+type knownDevices struct {
+	Enabled bool   `toml:"abilitato"`
+	File    string `toml:"file"`
+
+	// Chiave con cui viene firmato l'identificatore contenuto nel cookie
+	Key string `toml:"chiave"`
+
+	// Durata del cookie e numero massimo di dispositivi ricordati per utente
+	Lifetime   Duration `toml:"durata"`
+	MaxPerUser int      `toml:"max_per_utente"`
+
+	// Avvisa per email gli utenti degli accessi da un nuovo dispositivo,
+	// all'indirizzo contenuto nell'attributo LDAP indicato
+	Notify    bool   `toml:"avvisa"`
+	Attribute string `toml:"attributo_ldap"`
+}
+
+// Utenti e gruppi con privilegi di amministrazione
+type admins struct {
+	Groups []string `toml:"gruppi"`
+	Users  []string `toml:"utenti"`
+}
+
+// Configurazione dell'impersonificazione degli utenti da parte degli amministratori
+type impersonation struct {
+	Enabled bool     `toml:"abilitata"`
+	Expiry  Duration `toml:"durata"`
+}
+
+// Applicazione client OAuth2
+type client struct {
+	ID          string `toml:"id"`
+	Name        string `toml:"nome"`
+	DeviceGrant bool   `toml:"flusso_dispositivo"`
+
+	// Segreto per l'autenticazione del client (es. per l'introspezione); vuoto per i client pubblici
+	Secret string `toml:"segreto"`
+
+	// Introspezione dei token destinati a qualunque audience, non solo al client stesso
+	Introspection bool `toml:"introspezione"`
+
+	// Scambio dei token per conto degli utenti (RFC 8693) verso le audience
+	// indicate; senza audience il client può ottenere token solo per sé stesso
+	TokenExchange     bool     `toml:"scambio_token"`
+	ExchangeAudiences []string `toml:"audience_scambio"`
+
+	// URL per la disconnessione dell'applicazione all'uscita dell'utente: il primo
+	// viene caricato dal browser in un iframe, al secondo il server invia il logout token
+	FrontChannelLogout string `toml:"logout_frontchannel"`
+	BackChannelLogout  string `toml:"logout_backchannel"`
+}
+
+// Percorso servito dal reverse proxy integrato
+type route struct {
+	Host        string `toml:"host"`
+	Path        string `toml:"percorso"`
+	Backend     string `toml:"destinazione"`
+	StripPrefix bool   `toml:"rimuovi_percorso"`
+}
+
+// Claim aggiuntiva dei token, ottenuta da un attributo LDAP, da un valore
+// costante o da un template. Se Audiences non è vuoto la claim viene aggiunta
+// solo ai token per quei servizi (origini o ID dei client).
+type claim struct {
+	Name      string      `toml:"nome"`
+	Attribute string      `toml:"attributo"`
+	Value     interface{} `toml:"valore"`
+	Template  string      `toml:"template"`
+	Audiences []string    `toml:"audience"`
+}
+
+// Cifratura dei token (JWE) destinati ad alcune audience. La chiave può essere
+// pubblica (solo cifratura) oppure privata, per poter anche decifrare i token.
+type encryption struct {
+	Audiences []string `toml:"audience"`
+	Key       string   `toml:"chiave"`
+	Algorithm string   `toml:"algoritmo"`
+}
+
+// Politica sulla durata delle sessioni e dei token. Si applica se l'utente
+// appartiene a uno dei gruppi, il servizio richiesto (origine o ID del client) è
+// tra le audience e l'indirizzo è in una delle reti; i criteri vuoti valgono per
+// tutti. Vale la prima politica applicabile, le durate non indicate sono quelle
+// della sezione Sessioni.
+type policy struct {
+	Name      string   `toml:"nome"`
+	Groups    []string `toml:"gruppi"`
+	Audiences []string `toml:"audience"`
+	Networks  []string `toml:"reti"`
+
+	MaxLifetime         Duration `toml:"durata_massima"`
+	IdleTimeout         Duration `toml:"inattivita"`
+	RememberMaxLifetime Duration `toml:"durata_massima_ricordami"`
+	RememberIdleTimeout Duration `toml:"inattivita_ricordami"`
+
+	// Se false la richiesta di ricordare l'accesso viene ignorata
+	Remember *bool `toml:"ricordami"`
+
+	// Durata dei token rilasciati all'accesso, e massima per quelli ottenuti dalla sessione
+	TokenLifetime Duration `toml:"durata_token"`
+}
+
+// Durata in formato testuale (es. "10m", "1h30m")
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
 }
 
 var Config config
 
+// Cerca un client a partire dal suo ID
+func GetClient(id string) (client, bool) {
+	for _, c := range Config.Clients {
+		if c.ID == id {
+			return c, true
+		}
+	}
+
+	return client{}, false
+}
+
 func LoadConfig(path string) error {
 	absPath, err := filepath.Abs(path)
 
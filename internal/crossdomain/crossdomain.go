@@ -0,0 +1,143 @@
+/*
+ * crossdomain.go
+ *
+ * Codici monouso per l'accesso ai domini autorizzati esterni al dominio dei cookie.
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+// Package per i codici monouso con cui i domini autorizzati esterni a tld_sito,
+// che non ricevono il cookie di sessione, ottengono un token per l'utente. Il
+// server reindirizza il browser al ricevitore del dominio con un codice, che il
+// ricevitore scambia con un token e conserva in un proprio cookie. Il codice è
+// legato all'impronta PKCE inviata dal servizio, che per scambiarlo deve
+// presentare il segreto corrispondente (RFC 7636).
+package crossdomain
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"sync"
+	"time"
+
+	"git.napaalm.xyz/napaalm/ssodav/internal/auth"
+	"git.napaalm.xyz/napaalm/ssodav/pkg/pkce"
+)
+
+const (
+	// Validità dei codici, che vengono scambiati subito dal ricevitore
+	codeLifetime = time.Minute
+
+	// Numero massimo di codici in attesa di essere scambiati
+	maxPending = 10000
+)
+
+var (
+	ErrInvalidCode     = errors.New("Codice non valido oppure scaduto")
+	ErrTooManyRequests = errors.New("Troppe richieste di accesso. Riprova più tardi.")
+)
+
+// Codice in attesa di essere scambiato
+type grant struct {
+	userInfo    auth.UserInfo
+	redirectURI string
+	challenge   string
+	tokenExpiry time.Duration
+	expires     time.Time
+}
+
+var (
+	mutex sync.Mutex
+	codes map[string]*grant
+)
+
+// Inizializza l'archivio dei codici
+func Initialize() {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	codes = make(map[string]*grant)
+}
+
+// Crea un codice per l'utente, valido solo per il ricevitore redirectURI, che
+// potrà scambiarlo con un token di durata tokenExpiry presentando il segreto
+// dell'impronta challenge
+func NewCode(userInfo auth.UserInfo, redirectURI, challenge string, tokenExpiry time.Duration) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	code := base64.RawURLEncoding.EncodeToString(b)
+	now := time.Now()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	sweep(now)
+
+	if len(codes) >= maxPending {
+		return "", ErrTooManyRequests
+	}
+
+	codes[code] = &grant{
+		userInfo:    userInfo,
+		redirectURI: redirectURI,
+		challenge:   challenge,
+		tokenExpiry: tokenExpiry,
+		expires:     now.Add(codeLifetime),
+	}
+
+	return code, nil
+}
+
+// Scambia un codice, che viene eliminato anche se non corrisponde al ricevitore
+// o al segreto verifier, e restituisce l'utente e la durata del token
+func Redeem(code, redirectURI, verifier string) (auth.UserInfo, time.Duration, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	g, ok := codes[code]
+	if !ok {
+		return auth.UserInfo{}, 0, ErrInvalidCode
+	}
+
+	// Codes can be used only once
+	delete(codes, code)
+
+	if time.Now().After(g.expires) || g.redirectURI != redirectURI {
+		return auth.UserInfo{}, 0, ErrInvalidCode
+	}
+
+	if !pkce.Verify(verifier, g.challenge) {
+		return auth.UserInfo{}, 0, ErrInvalidCode
+	}
+
+	return g.userInfo, g.tokenExpiry, nil
+}
+
+// Elimina i codici scaduti
+func sweep(now time.Time) {
+	for code, g := range codes {
+		if now.After(g.expires) {
+			delete(codes, code)
+		}
+	}
+}
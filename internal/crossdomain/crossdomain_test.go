@@ -0,0 +1,89 @@
+/*
+ * crossdomain_test.go
+ *
+ * File di test per il package crossdomain.
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+package crossdomain
+
+import (
+	"testing"
+	"time"
+
+	"git.napaalm.xyz/napaalm/ssodav/internal/auth"
+	"git.napaalm.xyz/napaalm/ssodav/pkg/pkce"
+)
+
+const receiver = "https://scuola.edu.it/sso/callback"
+
+func TestCodes(t *testing.T) {
+	Initialize()
+
+	user := auth.UserInfo{Username: "professor", SessionID: "session-id"}
+
+	verifier, _ := pkce.NewVerifier()
+	challenge := pkce.Challenge(verifier)
+
+	code, err := NewCode(user, receiver, challenge, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userInfo, exp, err := Redeem(code, receiver, verifier)
+	if err != nil || userInfo.Username != user.Username || userInfo.SessionID != user.SessionID || exp != time.Hour {
+		t.Errorf("unexpected grant %+v %v %v", userInfo, exp, err)
+	}
+
+	// Codes can be used only once
+	if _, _, err := Redeem(code, receiver, verifier); err != ErrInvalidCode {
+		t.Errorf("expected ErrInvalidCode, got %v", err)
+	}
+
+	// A code redeemed by another receiver is lost
+	code, _ = NewCode(user, receiver, challenge, time.Hour)
+	if _, _, err := Redeem(code, "https://evil.example.com/callback", verifier); err != ErrInvalidCode {
+		t.Errorf("expected ErrInvalidCode, got %v", err)
+	}
+
+	if _, _, err := Redeem(code, receiver, verifier); err != ErrInvalidCode {
+		t.Errorf("expected ErrInvalidCode, got %v", err)
+	}
+
+	// Expired codes
+	code, _ = NewCode(user, receiver, challenge, time.Hour)
+	codes[code].expires = time.Now().Add(-time.Second)
+
+	if _, _, err := Redeem(code, receiver, verifier); err != ErrInvalidCode {
+		t.Errorf("expected ErrInvalidCode, got %v", err)
+	}
+
+	// A code intercepted without the verifier is lost
+	code, _ = NewCode(user, receiver, challenge, time.Hour)
+	other, _ := pkce.NewVerifier()
+
+	if _, _, err := Redeem(code, receiver, other); err != ErrInvalidCode {
+		t.Errorf("expected ErrInvalidCode, got %v", err)
+	}
+
+	if _, _, err := Redeem(code, receiver, verifier); err != ErrInvalidCode {
+		t.Errorf("expected ErrInvalidCode, got %v", err)
+	}
+}
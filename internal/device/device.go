@@ -0,0 +1,346 @@
+/*
+ * device.go
+ *
+ * Gestione dei codici dell'OAuth2 device authorization grant (RFC 8628).
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+// Package per la gestione dei codici dell'OAuth2 device authorization grant (RFC 8628).
+package device
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"git.napaalm.xyz/napaalm/ssodav/internal/auth"
+	"git.napaalm.xyz/napaalm/ssodav/internal/config"
+	"git.napaalm.xyz/napaalm/ssodav/internal/limiter"
+)
+
+// Alfabeto dei codici utente: solo consonanti maiuscole, come suggerito dalla RFC 8628
+const userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+
+// Lunghezza dei codici utente (senza trattino)
+const userCodeLength = 8
+
+// Valori predefiniti se non specificati nella configurazione
+const (
+	defaultExpiry     = 10 * time.Minute
+	defaultInterval   = 5 * time.Second
+	defaultMaxPending = 1000
+)
+
+// Limiti per indirizzo alla creazione di nuove richieste
+const (
+	addressInterval = 6 * time.Minute
+	addressBurst    = 10
+
+	// Numero predefinito di limitatori per indirizzo mantenuti in memoria
+	defaultMaxLimiters = 100000
+)
+
+// Errori restituiti durante il polling, il messaggio corrisponde al codice di errore OAuth2
+var (
+	ErrAuthorizationPending = errors.New("authorization_pending")
+	ErrSlowDown             = errors.New("slow_down")
+	ErrAccessDenied         = errors.New("access_denied")
+	ErrExpiredToken         = errors.New("expired_token")
+	ErrInvalidGrant         = errors.New("invalid_grant")
+)
+
+// Errori restituiti durante la creazione e la verifica dei codici
+var (
+	ErrTooManyRequests = errors.New("Troppe richieste di autorizzazione. Riprova più tardi.")
+	ErrTooManyPending  = errors.New("Troppi codici in attesa di autorizzazione. Riprova più tardi.")
+	ErrInvalidUserCode = errors.New("Codice non valido oppure scaduto!")
+)
+
+type status int
+
+const (
+	statusPending status = iota
+	statusApproved
+	statusDenied
+)
+
+// Richiesta di autorizzazione di un dispositivo
+type Authorization struct {
+	DeviceCode string
+	UserCode   string
+	ClientID   string
+	Scope      string
+	Expires    time.Time
+	Interval   time.Duration
+
+	lastPoll time.Time
+	status   status
+	userInfo auth.UserInfo
+}
+
+var (
+	mutex           sync.Mutex
+	byDeviceCode    map[string]*Authorization
+	byUserCode      map[string]*Authorization
+	addressLimiters *limiter.Registry
+	expiry          time.Duration
+	interval        time.Duration
+	maxPending      int
+)
+
+// Inizializza l'archivio dei codici
+func Initialize() {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	byDeviceCode = make(map[string]*Authorization)
+	byUserCode = make(map[string]*Authorization)
+
+	expiry = config.Config.Device.Expiry.Duration
+	if expiry <= 0 {
+		expiry = defaultExpiry
+	}
+
+	interval = config.Config.Device.Interval.Duration
+	if interval <= 0 {
+		interval = defaultInterval
+	}
+
+	maxPending = config.Config.Device.MaxPending
+	if maxPending <= 0 {
+		maxPending = defaultMaxPending
+	}
+
+	maxLimiters := config.Config.Limits.MaxLimiters
+	if maxLimiters <= 0 {
+		maxLimiters = defaultMaxLimiters
+	}
+
+	addressLimiters = limiter.New(addressInterval, addressBurst, maxLimiters)
+}
+
+// Crea una nuova richiesta di autorizzazione per il client indicato
+func NewAuthorization(clientID, scope, ip string) (*Authorization, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	now := time.Now()
+	sweep(now)
+
+	// Limita le richieste per indirizzo (10 all'ora con burst di 10)
+	if !addressLimiters.Get(ip).AllowN(now, 1) {
+		return nil, ErrTooManyRequests
+	}
+
+	if len(byDeviceCode) >= maxPending {
+		return nil, ErrTooManyPending
+	}
+
+	deviceCode, err := randomDeviceCode()
+	if err != nil {
+		return nil, err
+	}
+
+	// Genera un codice utente non ancora in uso
+	var userCode string
+	for {
+		userCode, err = randomUserCode()
+		if err != nil {
+			return nil, err
+		}
+
+		if _, ok := byUserCode[userCode]; !ok {
+			break
+		}
+	}
+
+	a := &Authorization{
+		DeviceCode: deviceCode,
+		UserCode:   userCode,
+		ClientID:   clientID,
+		Scope:      scope,
+		Expires:    now.Add(expiry),
+		Interval:   interval,
+	}
+
+	byDeviceCode[deviceCode] = a
+	byUserCode[userCode] = a
+
+	return a, nil
+}
+
+// Interroga lo stato di una richiesta; se è stata approvata restituisce l'utente
+// e la richiesta viene eliminata.
+func Poll(deviceCode, clientID string) (auth.UserInfo, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	now := time.Now()
+
+	a, ok := byDeviceCode[deviceCode]
+	if !ok || a.ClientID != clientID {
+		return auth.UserInfo{}, ErrInvalidGrant
+	}
+
+	if now.After(a.Expires) {
+		remove(a)
+		return auth.UserInfo{}, ErrExpiredToken
+	}
+
+	// Il client interroga troppo frequentemente: l'intervallo viene aumentato di 5 secondi
+	if !a.lastPoll.IsZero() && now.Sub(a.lastPoll) < a.Interval {
+		a.lastPoll = now
+		a.Interval += 5 * time.Second
+		return auth.UserInfo{}, ErrSlowDown
+	}
+	a.lastPoll = now
+
+	switch a.status {
+	case statusApproved:
+		remove(a)
+		return a.userInfo, nil
+	case statusDenied:
+		remove(a)
+		return auth.UserInfo{}, ErrAccessDenied
+	default:
+		return auth.UserInfo{}, ErrAuthorizationPending
+	}
+}
+
+// Cerca una richiesta in attesa a partire dal codice utente
+func Lookup(userCode string) (Authorization, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	a, err := pending(userCode)
+	if err != nil {
+		return Authorization{}, err
+	}
+
+	return *a, nil
+}
+
+// Approva una richiesta a nome dell'utente indicato
+func Approve(userCode string, userInfo auth.UserInfo) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	a, err := pending(userCode)
+	if err != nil {
+		return err
+	}
+
+	a.status = statusApproved
+	a.userInfo = userInfo
+
+	return nil
+}
+
+// Rifiuta una richiesta
+func Deny(userCode string) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	a, err := pending(userCode)
+	if err != nil {
+		return err
+	}
+
+	a.status = statusDenied
+
+	return nil
+}
+
+// Formatta un codice utente per la visualizzazione (es. "BCDF-GHJK")
+func FormatUserCode(userCode string) string {
+	return userCode[:userCodeLength/2] + "-" + userCode[userCodeLength/2:]
+}
+
+// Normalizza il codice inserito dall'utente
+func normalizeUserCode(userCode string) string {
+	userCode = strings.ToUpper(userCode)
+	userCode = strings.Replace(userCode, "-", "", -1)
+	userCode = strings.Replace(userCode, " ", "", -1)
+	return userCode
+}
+
+// Restituisce una richiesta ancora in attesa. Richiede che mutex sia acquisito.
+func pending(userCode string) (*Authorization, error) {
+	a, ok := byUserCode[normalizeUserCode(userCode)]
+	if !ok || a.status != statusPending {
+		return nil, ErrInvalidUserCode
+	}
+
+	if time.Now().After(a.Expires) {
+		remove(a)
+		return nil, ErrInvalidUserCode
+	}
+
+	return a, nil
+}
+
+// Elimina una richiesta. Richiede che mutex sia acquisito.
+func remove(a *Authorization) {
+	delete(byDeviceCode, a.DeviceCode)
+	delete(byUserCode, a.UserCode)
+}
+
+// Elimina le richieste scadute. Richiede che mutex sia acquisito.
+func sweep(now time.Time) {
+	for _, a := range byDeviceCode {
+		if now.After(a.Expires) {
+			remove(a)
+		}
+	}
+}
+
+// Genera un codice dispositivo casuale
+func randomDeviceCode() (string, error) {
+	b := make([]byte, 32)
+
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Genera un codice utente casuale
+func randomUserCode() (string, error) {
+	var (
+		sb  strings.Builder
+		max = big.NewInt(int64(len(userCodeAlphabet)))
+	)
+
+	for i := 0; i < userCodeLength; i++ {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+
+		sb.WriteByte(userCodeAlphabet[n.Int64()])
+	}
+
+	return sb.String(), nil
+}
@@ -0,0 +1,126 @@
+/*
+ * device_test.go
+ *
+ * File di test per il package device.
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+package device
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"git.napaalm.xyz/napaalm/ssodav/internal/auth"
+	"git.napaalm.xyz/napaalm/ssodav/internal/config"
+)
+
+func TestAll(t *testing.T) {
+	config.Config.Device.Interval.Duration = time.Millisecond
+	Initialize()
+
+	a, err := NewAuthorization("tv", "", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// La richiesta è ancora in attesa
+	if _, err := Poll(a.DeviceCode, "tv"); err != ErrAuthorizationPending {
+		t.Errorf("expected %v, got %v", ErrAuthorizationPending, err)
+	}
+
+	// Il codice di un altro client non è valido
+	if _, err := Poll(a.DeviceCode, "other"); err != ErrInvalidGrant {
+		t.Errorf("expected %v, got %v", ErrInvalidGrant, err)
+	}
+
+	// Il codice utente viene normalizzato
+	user := auth.UserInfo{Username: "professor", FullName: "Hubert J. Farnsworth", Group: "Office Management"}
+	if err := Approve(FormatUserCode(a.UserCode)+" ", user); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(2 * a.Interval)
+
+	got, err := Poll(a.DeviceCode, "tv")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(got, user) {
+		t.Errorf("expected %v, got %v", user, got)
+	}
+
+	// La richiesta viene eliminata dopo l'uso
+	if _, err := Poll(a.DeviceCode, "tv"); err != ErrInvalidGrant {
+		t.Errorf("expected %v, got %v", ErrInvalidGrant, err)
+	}
+}
+
+func TestSlowDown(t *testing.T) {
+	config.Config.Device.Interval.Duration = time.Minute
+	Initialize()
+
+	a, err := NewAuthorization("tv", "", "127.0.0.4")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Poll(a.DeviceCode, "tv"); err != ErrAuthorizationPending {
+		t.Errorf("expected %v, got %v", ErrAuthorizationPending, err)
+	}
+
+	// Interrogazione troppo frequente
+	if _, err := Poll(a.DeviceCode, "tv"); err != ErrSlowDown {
+		t.Errorf("expected %v, got %v", ErrSlowDown, err)
+	}
+}
+
+func TestDeny(t *testing.T) {
+	Initialize()
+
+	a, err := NewAuthorization("tv", "", "127.0.0.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Deny(a.UserCode); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Poll(a.DeviceCode, "tv"); err != ErrAccessDenied {
+		t.Errorf("expected %v, got %v", ErrAccessDenied, err)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	Initialize()
+
+	for i := 0; i < addressBurst; i++ {
+		if _, err := NewAuthorization("tv", "", "127.0.0.3"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := NewAuthorization("tv", "", "127.0.0.3"); err != ErrTooManyRequests {
+		t.Errorf("expected %v, got %v", ErrTooManyRequests, err)
+	}
+}
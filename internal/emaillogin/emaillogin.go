@@ -0,0 +1,313 @@
+/*
+ * emaillogin.go
+ *
+ * Accesso senza password con un codice o un link inviati per email.
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+// Package per l'accesso senza password degli utenti, anche senza account LDAP,
+// con un codice numerico o un link inviati al loro indirizzo email. Il codice va
+// inserito nel browser che ha chiesto l'accesso, che conserva l'ID dell'accesso
+// in attesa; il link contiene l'ID firmato dal server e può essere aperto anche
+// su un altro dispositivo.
+package emaillogin
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	netmail "net/mail"
+	"strings"
+	"sync"
+	"time"
+
+	"git.napaalm.xyz/napaalm/ssodav/internal/auth"
+	"git.napaalm.xyz/napaalm/ssodav/internal/config"
+	"git.napaalm.xyz/napaalm/ssodav/internal/mail"
+)
+
+const (
+	// Cifre dei codici
+	codeDigits = 6
+
+	// Validità predefinita del codice e del link
+	defaultExpiry = 10 * time.Minute
+
+	// Tentativi a disposizione per ogni codice
+	maxAttempts = 5
+
+	// Numero massimo di accessi in attesa, in totale e per ogni indirizzo
+	maxPending           = 10000
+	maxPendingPerAddress = 5
+)
+
+var (
+	ErrInvalidAddress  = errors.New("Indirizzo email non valido")
+	ErrUnknownAddress  = errors.New("Indirizzo email non abilitato all'accesso")
+	ErrInvalidCode     = errors.New("Codice errato")
+	ErrInvalidLink     = errors.New("Link non valido oppure scaduto. Richiedi un nuovo codice.")
+	ErrNotFound        = errors.New("Accesso scaduto. Richiedi un nuovo codice.")
+	ErrTooManyAttempts = errors.New("Hai superato il numero massimo di tentativi. Richiedi un nuovo codice.")
+	ErrTooManyRequests = errors.New("Troppe richieste di accesso. Riprova più tardi.")
+)
+
+// Accesso in attesa del codice o del link
+type Login struct {
+	UserInfo auth.UserInfo
+	Address  string
+
+	// Opzioni della pagina di accesso
+	Remember bool
+	Next     string
+
+	// State inviato dal servizio con la richiesta di accesso, impronta PKCE a
+	// cui legare il codice monouso e livello di garanzia richiesto
+	State     string
+	Challenge string
+	ACR       string
+
+	code     string
+	attempts int
+	expires  time.Time
+}
+
+var (
+	enabled bool
+	expiry  time.Duration
+
+	// Chiave con cui vengono firmati i link, diversa a ogni avvio
+	linkKey []byte
+
+	mutex  sync.Mutex
+	logins map[string]*Login
+)
+
+// Inizializza l'archivio degli accessi; l'accesso via email richiede il server SMTP
+func Initialize() error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	logins = make(map[string]*Login)
+
+	c := config.Config.EmailLogin
+	if enabled = c.Enabled; !enabled {
+		return nil
+	}
+
+	if !mail.Enabled() {
+		enabled = false
+		return errors.New("L'accesso via email richiede la configurazione del server SMTP")
+	}
+
+	if expiry = c.Expiry.Duration; expiry <= 0 {
+		expiry = defaultExpiry
+	}
+
+	linkKey = make([]byte, 32)
+	if _, err := rand.Read(linkKey); err != nil {
+		enabled = false
+		return err
+	}
+
+	return nil
+}
+
+// Indica se l'accesso via email è abilitato
+func Enabled() bool {
+	return enabled
+}
+
+// Indica se oltre al codice viene inviato il link per accedere
+func LinkEnabled() bool {
+	return enabled && config.Config.EmailLogin.Link
+}
+
+// Validità del codice e del link
+func Expiry() time.Duration {
+	return expiry
+}
+
+// Restituisce l'utente con l'indirizzo indicato: un ospite elencato nella
+// configurazione, che usa l'indirizzo come nome utente, oppure un utente LDAP
+func Resolve(address string) (auth.UserInfo, error) {
+	parsed, err := netmail.ParseAddress(address)
+	if err != nil || parsed.Name != "" || parsed.Address != strings.TrimSpace(address) {
+		return auth.UserInfo{}, ErrInvalidAddress
+	}
+	address = strings.ToLower(parsed.Address)
+
+	c := config.Config.EmailLogin
+
+	for _, a := range c.Addresses {
+		if strings.EqualFold(a, address) {
+			return auth.UserInfo{
+				Username:   address,
+				FullName:   address,
+				Group:      c.GuestGroup,
+				Attributes: map[string][]string{"mail": {address}},
+			}, nil
+		}
+	}
+
+	if c.Attribute == "" {
+		return auth.UserInfo{}, ErrUnknownAddress
+	}
+
+	userInfo, err := auth.LookupEmail(address, c.Attribute)
+	if err != nil {
+		return auth.UserInfo{}, ErrUnknownAddress
+	}
+
+	return userInfo, nil
+}
+
+// Registra un accesso e ne restituisce l'ID, il codice da inviare all'utente e
+// il token del link. Restano validi gli ultimi codici inviati allo stesso
+// indirizzo, così che chi ne richiede altri non possa invalidare quello appena
+// ricevuto dall'utente. Gli accessi senza utente, creati per gli indirizzi
+// sconosciuti in modo da non rivelare quali siano abilitati, non possono essere
+// completati.
+func Start(login Login) (string, string, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", "", err
+	}
+
+	n, err := rand.Int(rand.Reader, big.NewInt(1e6))
+	if err != nil {
+		return "", "", "", err
+	}
+
+	id := base64.RawURLEncoding.EncodeToString(b)
+	now := time.Now()
+
+	login.Address = strings.ToLower(strings.TrimSpace(login.Address))
+	login.code = fmt.Sprintf("%0*d", codeDigits, n.Int64())
+	login.attempts = 0
+	login.expires = now.Add(expiry)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	var oldest string
+	sent := 0
+
+	for other, l := range logins {
+		if now.After(l.expires) {
+			delete(logins, other)
+			continue
+		}
+
+		if l.Address == login.Address {
+			sent++
+			if oldest == "" || l.expires.Before(logins[oldest].expires) {
+				oldest = other
+			}
+		}
+	}
+
+	if sent >= maxPendingPerAddress {
+		delete(logins, oldest)
+	}
+
+	if len(logins) >= maxPending {
+		return "", "", "", ErrTooManyRequests
+	}
+
+	logins[id] = &login
+
+	return id, login.code, id + "." + sign(id), nil
+}
+
+// Restituisce una copia dell'accesso
+func Get(id string) (Login, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	l, ok := logins[id]
+	if !ok || time.Now().After(l.expires) {
+		delete(logins, id)
+		return Login{}, ErrNotFound
+	}
+
+	return *l, nil
+}
+
+// Verifica il codice inserito dall'utente; se è corretto l'accesso viene
+// concluso e restituito, altrimenti viene registrato un tentativo fallito
+func Verify(id, code string) (Login, error) {
+	code = strings.Join(strings.Fields(code), "")
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	l, ok := logins[id]
+	if !ok || time.Now().After(l.expires) {
+		delete(logins, id)
+		return Login{}, ErrNotFound
+	}
+
+	if l.UserInfo.Username == "" || subtle.ConstantTimeCompare([]byte(code), []byte(l.code)) != 1 {
+		if l.attempts++; l.attempts >= maxAttempts {
+			delete(logins, id)
+			return Login{}, ErrTooManyAttempts
+		}
+
+		return Login{}, ErrInvalidCode
+	}
+
+	delete(logins, id)
+	return *l, nil
+}
+
+// Conclude l'accesso del link, che non può più essere usato
+func Redeem(token string) (Login, error) {
+	i := strings.LastIndex(token, ".")
+	if i < 0 || !hmac.Equal([]byte(token[i+1:]), []byte(sign(token[:i]))) {
+		return Login{}, ErrInvalidLink
+	}
+
+	id := token[:i]
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	l, ok := logins[id]
+	if !ok || time.Now().After(l.expires) || l.UserInfo.Username == "" {
+		delete(logins, id)
+		return Login{}, ErrInvalidLink
+	}
+
+	delete(logins, id)
+	return *l, nil
+}
+
+// Firma l'ID di un accesso per il link
+func sign(id string) string {
+	mac := hmac.New(sha256.New, linkKey)
+	mac.Write([]byte("link:" + id))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
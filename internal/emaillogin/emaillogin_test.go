@@ -0,0 +1,191 @@
+/*
+ * emaillogin_test.go
+ *
+ * File di test per il package emaillogin.
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+package emaillogin
+
+import (
+	"testing"
+	"time"
+
+	"git.napaalm.xyz/napaalm/ssodav/internal/auth"
+	"git.napaalm.xyz/napaalm/ssodav/internal/config"
+	"git.napaalm.xyz/napaalm/ssodav/internal/mail"
+)
+
+func initialize(t *testing.T) {
+	config.Config.SMTP.Server = "127.0.0.1:25"
+	config.Config.SMTP.From = "sso@example.org"
+	config.Config.EmailLogin.Enabled = true
+	config.Config.EmailLogin.Addresses = []string{"Relatore@example.net"}
+	config.Config.EmailLogin.GuestGroup = "Ospiti"
+	config.Config.EmailLogin.Link = true
+
+	if err := mail.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Initialize(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResolve(t *testing.T) {
+	initialize(t)
+
+	userInfo, err := Resolve("relatore@EXAMPLE.net")
+	if err != nil || userInfo.Username != "relatore@example.net" || userInfo.Group != "Ospiti" || userInfo.Attribute("mail") != "relatore@example.net" {
+		t.Errorf("unexpected guest %+v: %v", userInfo, err)
+	}
+
+	if _, err := Resolve("fry@example.org"); err != ErrUnknownAddress {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	for _, address := range []string{"", "relatore", "Relatore <relatore@example.net>"} {
+		if _, err := Resolve(address); err != ErrInvalidAddress {
+			t.Errorf("address %q: unexpected error %v", address, err)
+		}
+	}
+}
+
+func TestCode(t *testing.T) {
+	initialize(t)
+
+	guest := auth.UserInfo{Username: "relatore@example.net"}
+
+	id, code, _, err := Start(Login{UserInfo: guest, Address: "relatore@example.net", Next: "http://example.org"})
+	if err != nil || len(code) != codeDigits {
+		t.Fatalf("unexpected code %q: %v", code, err)
+	}
+
+	if l, err := Get(id); err != nil || l.Next != "http://example.org" {
+		t.Errorf("unexpected login %+v: %v", l, err)
+	}
+
+	wrong := "000000"
+	if code == wrong {
+		wrong = "111111"
+	}
+
+	if _, err := Verify(id, wrong); err != ErrInvalidCode {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	l, err := Verify(id, code[:3]+" "+code[3:])
+	if err != nil || l.UserInfo.Username != guest.Username {
+		t.Errorf("unexpected login %+v: %v", l, err)
+	}
+
+	// Codes can be used only once
+	if _, err := Verify(id, code); err != ErrNotFound {
+		t.Errorf("code reused: %v", err)
+	}
+
+	// Attempts are limited
+	id, code, _, _ = Start(Login{UserInfo: guest, Address: guest.Username})
+	for i := 1; i < maxAttempts; i++ {
+		Verify(id, wrong)
+	}
+
+	if _, err := Verify(id, wrong); err != ErrTooManyAttempts {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	if _, err := Verify(id, code); err != ErrNotFound {
+		t.Errorf("login not removed: %v", err)
+	}
+
+	// New codes don't invalidate the last ones sent, only the oldest over the limit
+	first, code, _, _ := Start(Login{UserInfo: guest, Address: guest.Username})
+	time.Sleep(time.Millisecond)
+	second, secondCode, _, _ := Start(Login{UserInfo: guest, Address: "RELATORE@example.net"})
+	time.Sleep(time.Millisecond)
+
+	for i := 2; i < maxPendingPerAddress; i++ {
+		Start(Login{UserInfo: guest, Address: guest.Username})
+	}
+
+	if _, err := Verify(first, code); err != nil {
+		t.Errorf("previous code invalidated: %v", err)
+	}
+
+	Start(Login{UserInfo: guest, Address: guest.Username})
+	Start(Login{UserInfo: guest, Address: guest.Username})
+
+	if _, err := Verify(second, secondCode); err != ErrNotFound {
+		t.Errorf("oldest code still valid: %v", err)
+	}
+
+	// Logins of unknown addresses can't be completed
+	id, code, token, _ := Start(Login{Address: "fry@example.org"})
+	if _, err := Verify(id, code); err != ErrInvalidCode {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	if _, err := Redeem(token); err != ErrInvalidLink {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestLink(t *testing.T) {
+	initialize(t)
+
+	guest := auth.UserInfo{Username: "relatore@example.net"}
+
+	id, _, token, err := Start(Login{UserInfo: guest, Address: guest.Username})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The ID alone isn't a valid link
+	for _, forged := range []string{id, id + ".", id + "." + sign(id+"x"), token + "x"} {
+		if _, err := Redeem(forged); err != ErrInvalidLink {
+			t.Errorf("forged link %q accepted: %v", forged, err)
+		}
+	}
+
+	if l, err := Redeem(token); err != nil || l.UserInfo.Username != guest.Username {
+		t.Errorf("unexpected login %+v: %v", l, err)
+	}
+
+	if _, err := Redeem(token); err != ErrInvalidLink {
+		t.Errorf("link reused: %v", err)
+	}
+
+	// The link key changes at every start
+	_, _, token, _ = Start(Login{UserInfo: guest, Address: guest.Username})
+	initialize(t)
+
+	if _, err := Redeem(token); err != ErrInvalidLink {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	// The SMTP server is required
+	config.Config.SMTP.Server = ""
+	mail.Initialize()
+
+	if err := Initialize(); err == nil || Enabled() {
+		t.Error("email login enabled without SMTP server")
+	}
+}
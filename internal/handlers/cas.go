@@ -0,0 +1,188 @@
+/*
+ * cas.go
+ *
+ * Handler per il server CAS (v2/v3).
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+package handlers
+
+import (
+	"net/http"
+	neturl "net/url"
+
+	"git.napaalm.xyz/napaalm/ssodav/internal/cas"
+	"git.napaalm.xyz/napaalm/ssodav/internal/config"
+	"git.napaalm.xyz/napaalm/ssodav/internal/url"
+)
+
+// Percorso: /cas/login
+// Emette un service ticket per il servizio, passando per la pagina di accesso se necessario.
+// Con renew la sessione esistente non basta e l'utente deve inserire di nuovo le credenziali.
+func HandleCASLogin(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	service := query.Get("service")
+	renew := query.Get("renew") == "true"
+
+	// Without a service this is a plain login
+	if service == "" {
+		http.Redirect(w, r, url.BaseURL()+"/", http.StatusSeeOther)
+		return
+	}
+
+	if !cas.ServiceAllowed(service) {
+		http.Error(w, cas.ErrUnauthorizedService.Error(), http.StatusForbidden)
+		return
+	}
+
+	userInfo, err := currentUser(r)
+	if err != nil && !renew {
+		// In gateway mode go back to the service without a ticket
+		if query.Get("gateway") == "true" {
+			http.Redirect(w, r, service, http.StatusSeeOther)
+			return
+		}
+
+		http.Redirect(w, r, loginURL(url.BaseURL()+r.URL.RequestURI()), http.StatusSeeOther)
+		return
+	}
+
+	// The login ticket comes back from the login page only if the user
+	// authenticated again after it was issued
+	if renew && (err != nil || !cas.RedeemLoginTicket(query.Get("lt"), service, userInfo.AuthTime)) {
+		renewLogin(w, r, service)
+		return
+	}
+
+	ticket, err := cas.NewServiceTicket(service, userInfo, renew)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, addQueryParam(service, "ticket", ticket), http.StatusSeeOther)
+}
+
+// Reindirizza alla pagina di accesso, che con max_age=0 chiede le credenziali
+// anche all'utente con una sessione, e poi di nuovo a /cas/login con un login ticket
+func renewLogin(w http.ResponseWriter, r *http.Request, service string) {
+	lt, err := cas.NewLoginTicket(service)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	query := neturl.Values{}
+	query.Set("service", service)
+	query.Set("renew", "true")
+	query.Set("lt", lt)
+
+	next := url.BaseURL() + r.URL.Path + "?" + query.Encode()
+	http.Redirect(w, r, loginURL(next)+"&max_age=0", http.StatusSeeOther)
+}
+
+// Percorso: /cas/logout
+// Termina la sessione, dopo la conferma, e torna al servizio se autorizzato.
+func HandleCASLogout(w http.ResponseWriter, r *http.Request) {
+	service := r.URL.Query().Get("service")
+
+	if service == "" || !cas.ServiceAllowed(service) {
+		service = "http://" + config.Config.General.TLD
+	}
+
+	confirmLogout(w, r, service)
+}
+
+// Percorso: /cas/serviceValidate
+// Validazione dei service ticket (CAS v2).
+func HandleCASServiceValidate(w http.ResponseWriter, r *http.Request) {
+	casValidate(w, r, false, false)
+}
+
+// Percorso: /cas/proxyValidate
+// Validazione dei service ticket e proxy ticket (CAS v2).
+func HandleCASProxyValidate(w http.ResponseWriter, r *http.Request) {
+	casValidate(w, r, true, false)
+}
+
+// Percorso: /cas/p3/serviceValidate
+// Validazione dei service ticket con rilascio degli attributi (CAS v3).
+func HandleCASServiceValidateV3(w http.ResponseWriter, r *http.Request) {
+	casValidate(w, r, false, true)
+}
+
+// Percorso: /cas/p3/proxyValidate
+// Validazione dei service ticket e proxy ticket con rilascio degli attributi (CAS v3).
+func HandleCASProxyValidateV3(w http.ResponseWriter, r *http.Request) {
+	casValidate(w, r, true, true)
+}
+
+// Percorso: /cas/proxy
+// Emette un proxy ticket a partire da un proxy-granting ticket.
+func HandleCASProxy(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+
+	pt, err := cas.NewProxyTicket(query.Get("pgt"), query.Get("targetService"))
+	if err != nil {
+		w.Write(cas.ProxyFailureResponse(err))
+		return
+	}
+
+	w.Write(cas.ProxySuccessResponse(pt))
+}
+
+// Valida un ticket ed eventualmente emette un proxy-granting ticket
+func casValidate(w http.ResponseWriter, r *http.Request, allowProxy, withAttributes bool) {
+	var (
+		query  = r.URL.Query()
+		pgtIOU string
+	)
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+
+	t, err := cas.Validate(query.Get("ticket"), query.Get("service"), allowProxy, query.Get("renew") == "true")
+	if err != nil {
+		w.Write(cas.FailureResponse(err))
+		return
+	}
+
+	if pgtURL := query.Get("pgtUrl"); pgtURL != "" {
+		// A failed callback doesn't invalidate the authentication
+		pgtIOU, _ = cas.NewProxyGrantingTicket(pgtURL, t)
+	}
+
+	w.Write(cas.SuccessResponse(t, pgtIOU, withAttributes))
+}
+
+// Aggiunge un parametro alla query di un URL
+func addQueryParam(rawURL, key, value string) string {
+	u, err := neturl.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+
+	query := u.Query()
+	query.Set(key, value)
+	u.RawQuery = query.Encode()
+
+	return u.String()
+}
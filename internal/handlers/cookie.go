@@ -0,0 +1,119 @@
+/*
+ * cookie.go
+ *
+ * Politica dei cookie scritti dal server.
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+package handlers
+
+import (
+	"fmt"
+
+	"git.napaalm.xyz/napaalm/ssodav/internal/config"
+	"git.napaalm.xyz/napaalm/ssodav/pkg/cookie"
+)
+
+// Nome predefinito del cookie con il segreto della sessione
+const defaultSessionCookie = "sso_session"
+
+var (
+	// Politica applicata al cookie di sessione
+	cookies cookie.Policy
+
+	// Politica dei cookie di supporto (CSRF, secondo fattore, accesso via email e
+	// dispositivo), validi solo per l'host del server: i servizi dei sottodomini
+	// non devono riceverli né, con il prefisso __Host-, poterli sovrascrivere
+	hostCookies cookie.Policy
+
+	// Nome del cookie di sessione, senza il prefisso
+	sessionCookie = defaultSessionCookie
+)
+
+// Legge la politica dei cookie dalla configurazione. Se non sono indicati domini
+// i cookie valgono per tld_sito, salvo con il prefisso __Host-, che li limita
+// all'host del server. I cookie di supporto valgono sempre solo per l'host del
+// server e hanno il prefisso __Host- se i cookie sono sicuri.
+func InitializeCookies() error {
+	conf := config.Config.Cookies
+
+	sameSite, err := cookie.ParseSameSite(conf.SameSite)
+	if err != nil {
+		return fmt.Errorf("Configurazione dei cookie non valida: %v", err)
+	}
+
+	policy := cookie.Policy{
+		Prefix:   conf.Prefix,
+		Domains:  conf.Domains,
+		Path:     conf.Path,
+		Secure:   config.Config.General.SecureCookies,
+		HTTPOnly: true,
+		SameSite: sameSite,
+		MaxSize:  conf.MaxSize,
+	}
+
+	if conf.Secure != nil {
+		policy.Secure = *conf.Secure
+	}
+
+	if conf.HTTPOnly != nil {
+		policy.HTTPOnly = *conf.HTTPOnly
+	}
+
+	if policy.Domains == nil && policy.Prefix != cookie.HostPrefix {
+		policy.Domains = []string{config.Config.General.TLD}
+	}
+
+	if err := policy.Validate(); err != nil {
+		return fmt.Errorf("Configurazione dei cookie non valida: %v", err)
+	}
+
+	host := policy
+	host.Domains = nil
+	if host.Secure {
+		host.Prefix = cookie.HostPrefix
+		host.Path = "/"
+	}
+
+	cookies = policy
+	hostCookies = host
+	sessionCookie = defaultSessionCookie
+	if conf.Name != "" {
+		sessionCookie = conf.Name
+	}
+
+	return nil
+}
+
+// Controlla se un cookie ricevuto è uno di quelli scritti dal server (o una delle
+// loro parti), che non vanno inoltrati ai servizi
+func isServerCookie(name string) bool {
+	if cookies.Matches(name, sessionCookie) {
+		return true
+	}
+
+	for _, c := range []string{csrfCookie, mfaCookie, emailCookie, deviceCookie} {
+		if hostCookies.Matches(name, c) {
+			return true
+		}
+	}
+
+	return false
+}
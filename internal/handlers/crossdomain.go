@@ -0,0 +1,153 @@
+/*
+ * crossdomain.go
+ *
+ * Accesso ai domini autorizzati esterni al dominio dei cookie.
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+package handlers
+
+import (
+	"net/http"
+
+	"git.napaalm.xyz/napaalm/ssodav/internal/auth"
+	"git.napaalm.xyz/napaalm/ssodav/internal/crossdomain"
+	"git.napaalm.xyz/napaalm/ssodav/internal/policy"
+	"git.napaalm.xyz/napaalm/ssodav/internal/session"
+	"git.napaalm.xyz/napaalm/ssodav/internal/url"
+	"git.napaalm.xyz/napaalm/ssodav/pkg/pkce"
+)
+
+// Percorso: /crossdomain
+// Accesso ai domini autorizzati che non ricevono il cookie di sessione. Se l'utente
+// è autenticato il browser viene reindirizzato al ricevitore redirect_uri con un
+// codice monouso, insieme a next e state se presenti; altrimenti passa prima
+// dalla pagina di accesso. Il codice è legato all'impronta PKCE code_challenge
+// (metodo S256), obbligatoria.
+func HandleCrossDomain(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	redirectURI := query.Get("redirect_uri")
+
+	// The receiver must be in one of the authorized domains
+	origin := url.Origin(redirectURI)
+	if origin == "" {
+		http.Error(w, "Servizio non autorizzato", http.StatusBadRequest)
+		return
+	}
+
+	// Without PKCE an intercepted code could be redeemed by anyone
+	challenge := codeChallenge(r)
+	if challenge == "" {
+		http.Error(w, "code_challenge S256 mancante o non valido", http.StatusBadRequest)
+		return
+	}
+
+	// Users are only sent back to the receiver's site
+	next := query.Get("next")
+	if next != "" && url.Origin(next) != origin {
+		next = ""
+	}
+
+	s, err := renewSession(w, r)
+	if err != nil {
+		http.Redirect(w, r, loginURL(url.BaseURL()+r.URL.RequestURI()), http.StatusSeeOther)
+		return
+	}
+
+	code, err := newServiceCode(r, s, redirectURI, challenge)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	target := addQueryParam(redirectURI, "code", code)
+	if next != "" {
+		target = addQueryParam(target, "next", next)
+	}
+	if state := query.Get("state"); state != "" {
+		target = addQueryParam(target, "state", state)
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, target, http.StatusSeeOther)
+}
+
+// Restituisce l'impronta PKCE inviata dal servizio, vuota se manca o se il
+// metodo non è S256
+func codeChallenge(r *http.Request) string {
+	query := r.URL.Query()
+
+	challenge := query.Get("code_challenge")
+	if query.Get("code_challenge_method") != pkce.Method || !pkce.ValidChallenge(challenge) {
+		return ""
+	}
+
+	return challenge
+}
+
+// Crea il codice monouso con cui il servizio all'origine di redirectURI ottiene
+// un token per l'utente della sessione, che non sopravvive alla sessione stessa.
+// Il servizio deve presentare il segreto dell'impronta PKCE challenge.
+func newServiceCode(r *http.Request, s session.Session, redirectURI, challenge string) (string, error) {
+	userInfo := s.UserInfo()
+	expTime := policy.For(userInfo, url.Origin(redirectURI), GetIP(r)).TokenLifetime
+	expTime = capExpiry(expTime, userInfo.Expires)
+
+	return crossdomain.NewCode(userInfo, redirectURI, challenge, expTime)
+}
+
+// Percorso: /crossdomain/token
+// Scambia il codice ricevuto dal ricevitore con un token destinato all'origine
+// del ricevitore. redirect_uri deve essere lo stesso usato per ottenere il codice
+// e code_verifier il segreto della sua impronta PKCE.
+func HandleCrossDomainToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	redirectURI := r.PostFormValue("redirect_uri")
+
+	userInfo, expTime, err := crossdomain.Redeem(r.PostFormValue("code"), redirectURI, r.PostFormValue("code_verifier"))
+	if err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", err.Error())
+		return
+	}
+
+	// The session may have ended after the code was issued
+	if !session.Active(userInfo.SessionID) {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", errSessionEnded.Error())
+		return
+	}
+
+	token, err := auth.IssueToken(userInfo, url.Origin(redirectURI), expTime)
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": string(token),
+		"token_type":   "bearer",
+		"expires_in":   int(expTime.Seconds()),
+	})
+}
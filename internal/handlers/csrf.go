@@ -0,0 +1,148 @@
+/*
+ * csrf.go
+ *
+ * Protezione dei form dalle richieste provenienti da altri siti (CSRF).
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"log"
+	"net/http"
+	neturl "net/url"
+	"strings"
+	"time"
+
+	"git.napaalm.xyz/napaalm/ssodav/internal/auth"
+	"git.napaalm.xyz/napaalm/ssodav/internal/config"
+	"git.napaalm.xyz/napaalm/ssodav/internal/url"
+)
+
+const (
+	// Nome del cookie con il segreto del browser e del campo dei form con il token
+	csrfCookie = "sso_csrf"
+	csrfField  = "csrf_token"
+
+	csrfSecretSize = 32
+)
+
+var errCSRF = errors.New("La richiesta non è valida oppure è scaduta. Riprova.")
+
+// Chiave con cui i token dei form vengono derivati dal segreto nel cookie. Il
+// cookie vale solo per l'host del server: i servizi dei sottodomini non lo
+// ricevono e, con il prefisso __Host-, non possono sostituirlo con un segreto di
+// cui ottenere il token dalla pagina di accesso.
+var csrfKey []byte
+
+// Vero se il template della pagina di accesso invia il token CSRF
+var loginCSRF bool
+
+// Deriva la chiave per i token CSRF da quella di firma, in modo che i token
+// restino validi dopo un riavvio e tra più istanze del server, e stabilisce
+// come proteggere il form di accesso
+func InitializeCSRF() error {
+	key, err := auth.DeriveKey("csrf")
+	if err != nil {
+		return err
+	}
+
+	csrfKey = key
+
+	// The login page comes from a separate repository: older templates, declared
+	// in the configuration, don't include the token, so the origin of their forms
+	// is checked instead
+	loginCSRF = !config.Config.General.LegacyLoginTemplate
+	if !loginCSRF {
+		log.Println("handlers: il template della pagina di accesso non include il token CSRF, verrà controllata l'origine delle richieste")
+	}
+
+	return nil
+}
+
+// Restituisce il token da inserire nei form (campo csrf_token), impostando il
+// cookie con il segreto del browser se non è ancora presente. Va chiamata una
+// sola volta per richiesta.
+func csrfToken(w http.ResponseWriter, r *http.Request) string {
+	secret, err := hostCookies.Get(r, csrfCookie)
+
+	if err != nil || base64.RawURLEncoding.DecodedLen(len(secret)) != csrfSecretSize {
+		b := make([]byte, csrfSecretSize)
+		if _, err := rand.Read(b); err != nil {
+			log.Println("handlers: ", err.Error())
+			return ""
+		}
+
+		// The cookie lasts until the browser is closed
+		secret = base64.RawURLEncoding.EncodeToString(b)
+		hostCookies.Set(w, r, csrfCookie, secret, time.Time{})
+	}
+
+	return csrfMAC(secret)
+}
+
+// Controlla che il form inviato contenga il token corrispondente al cookie
+func checkCSRF(r *http.Request) bool {
+	secret, err := hostCookies.Get(r, csrfCookie)
+	if err != nil || secret == "" {
+		return false
+	}
+
+	token := r.PostFormValue(csrfField)
+	return token != "" && hmac.Equal([]byte(token), []byte(csrfMAC(secret)))
+}
+
+// Controlla che il form di accesso sia stato inviato dalla pagina stessa: con il
+// token, oppure con gli header Origin o Referer se il template è dichiarato privo
+// del token nella configurazione
+func checkLoginCSRF(r *http.Request) bool {
+	if loginCSRF {
+		return checkCSRF(r)
+	}
+
+	return sameOrigin(r)
+}
+
+// Controlla che la richiesta provenga da una pagina del servizio SSO. Le
+// richieste senza Origin né Referer vengono rifiutate.
+func sameOrigin(r *http.Request) bool {
+	source := r.Header.Get("Origin")
+	if source == "" {
+		source = r.Header.Get("Referer")
+	}
+
+	u, err := neturl.Parse(source)
+	if err != nil || u.Host == "" {
+		return false
+	}
+
+	return strings.EqualFold(u.Scheme+"://"+u.Host, url.BaseURL())
+}
+
+func csrfMAC(secret string) string {
+	mac := hmac.New(sha256.New, csrfKey)
+	mac.Write([]byte(secret))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
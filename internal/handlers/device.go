@@ -0,0 +1,255 @@
+/*
+ * device.go
+ *
+ * Handler per l'OAuth2 device authorization grant (RFC 8628).
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"git.napaalm.xyz/napaalm/ssodav/internal/auth"
+	"git.napaalm.xyz/napaalm/ssodav/internal/config"
+	"git.napaalm.xyz/napaalm/ssodav/internal/device"
+	"git.napaalm.xyz/napaalm/ssodav/internal/policy"
+	"git.napaalm.xyz/napaalm/ssodav/internal/url"
+)
+
+const deviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+// Restituisce un errore OAuth2 (RFC 6749, sezione 5.2)
+func writeOAuthError(w http.ResponseWriter, status int, code, description string) {
+	body := map[string]string{"error": code}
+
+	if description != "" {
+		body["error_description"] = description
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, status, body)
+}
+
+// Percorso: /device_authorization
+// Crea una richiesta di autorizzazione per un dispositivo.
+func HandleDeviceAuthorization(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		writeOAuthError(w, http.StatusMethodNotAllowed, "invalid_request", "")
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "")
+		return
+	}
+
+	// Check if the client is allowed to use the device flow
+	clientID := r.PostFormValue("client_id")
+	client, ok := config.GetClient(clientID)
+
+	if !ok || !client.DeviceGrant {
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "")
+		return
+	}
+
+	a, err := device.NewAuthorization(clientID, r.PostFormValue("scope"), GetIP(r))
+
+	switch err {
+	case nil:
+	case device.ErrTooManyRequests:
+		// slow_down is only defined for polling the token endpoint (RFC 8628)
+		writeOAuthError(w, http.StatusTooManyRequests, "invalid_request", err.Error())
+		return
+	case device.ErrTooManyPending:
+		writeOAuthError(w, http.StatusServiceUnavailable, "temporarily_unavailable", err.Error())
+		return
+	default:
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+
+	verificationURI := url.BaseURL() + "/device"
+	userCode := device.FormatUserCode(a.UserCode)
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"device_code":               a.DeviceCode,
+		"user_code":                 userCode,
+		"verification_uri":          verificationURI,
+		"verification_uri_complete": verificationURI + "?user_code=" + userCode,
+		"expires_in":                int(time.Until(a.Expires).Seconds()),
+		"interval":                  int(a.Interval.Seconds()),
+	})
+}
+
+// Percorso: /token
+// Token endpoint OAuth2.
+func HandleToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		writeOAuthError(w, http.StatusMethodNotAllowed, "invalid_request", "")
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "")
+		return
+	}
+
+	switch r.PostFormValue("grant_type") {
+	case deviceCodeGrantType:
+		handleDeviceCodeGrant(w, r)
+	case tokenExchangeGrantType:
+		handleTokenExchangeGrant(w, r)
+	default:
+		writeOAuthError(w, http.StatusBadRequest, "unsupported_grant_type", "")
+	}
+}
+
+// Scambia un codice dispositivo approvato con un token
+func handleDeviceCodeGrant(w http.ResponseWriter, r *http.Request) {
+	clientID := r.PostFormValue("client_id")
+
+	if client, ok := config.GetClient(clientID); !ok || !client.DeviceGrant {
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "")
+		return
+	}
+
+	// The proof is checked before the device code is consumed
+	jkt, err := tokenBinding(w, r)
+	if err != nil {
+		writeDPoPError(w, err)
+		return
+	}
+
+	userInfo, err := device.Poll(r.PostFormValue("device_code"), clientID)
+	if err != nil {
+		writeOAuthError(w, http.StatusBadRequest, err.Error(), "")
+		return
+	}
+
+	expTime := config.Config.Device.TokenExpiry.Duration
+	if expTime <= 0 {
+		expTime = 24 * time.Hour
+	}
+	expTime = policy.For(userInfo, clientID, GetIP(r)).CapToken(expTime)
+
+	// The token is valid only for the device's client
+	token, err := auth.IssueToken(userInfo, clientID, expTime, auth.WithConfirmation(jkt))
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": string(token),
+		"token_type":   tokenType(jkt),
+		"expires_in":   int(expTime.Seconds()),
+	})
+}
+
+// Percorso: /device
+// Pagina di verifica dove l'utente approva o rifiuta la richiesta di un dispositivo.
+func HandleDeviceVerification(w http.ResponseWriter, r *http.Request) {
+	type deviceData struct {
+		pageInfo
+		UserCode   string
+		ClientName string
+		Confirm    bool
+		Done       bool
+		Approved   bool
+	}
+
+	// The user must be logged in
+	userInfo, err := currentUser(r)
+	if err != nil {
+		http.Redirect(w, r, loginURL(url.BaseURL()+r.URL.RequestURI()), http.StatusSeeOther)
+		return
+	}
+
+	data := deviceData{pageInfo: newPageInfo()}
+	data.CSRFToken = csrfToken(w, r)
+
+	if r.Method == "POST" {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Impossibile elaborare la richiesta!", http.StatusBadRequest)
+			return
+		}
+
+		data.UserCode = r.PostFormValue("user_code")
+
+		// The approval must come from the page itself
+		if !checkCSRF(r) {
+			data.Error = true
+			data.ErrorMessage = errCSRF.Error()
+			renderPage(w, http.StatusForbidden, "device.html", data)
+			return
+		}
+
+		if r.PostFormValue("action") == "approve" {
+			// The device's token outlives the browser session
+			userInfo.SessionID = ""
+			err = device.Approve(data.UserCode, userInfo)
+			data.Approved = true
+		} else {
+			err = device.Deny(data.UserCode)
+		}
+
+		if err != nil {
+			data.Error = true
+			data.ErrorMessage = err.Error()
+			renderPage(w, http.StatusBadRequest, "device.html", data)
+			return
+		}
+
+		data.Done = true
+		renderPage(w, http.StatusOK, "device.html", data)
+		return
+	}
+
+	data.UserCode = r.URL.Query().Get("user_code")
+
+	// Ask for confirmation if the code is already known
+	if data.UserCode != "" {
+		a, err := device.Lookup(data.UserCode)
+
+		if err != nil {
+			data.Error = true
+			data.ErrorMessage = err.Error()
+			renderPage(w, http.StatusBadRequest, "device.html", data)
+			return
+		}
+
+		data.UserCode = device.FormatUserCode(a.UserCode)
+		data.Confirm = true
+
+		if client, ok := config.GetClient(a.ClientID); ok && client.Name != "" {
+			data.ClientName = client.Name
+		} else {
+			data.ClientName = a.ClientID
+		}
+	}
+
+	renderPage(w, http.StatusOK, "device.html", data)
+}
@@ -0,0 +1,168 @@
+/*
+ * dpop.go
+ *
+ * Token vincolati a una chiave del client con DPoP (RFC 9449).
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"git.napaalm.xyz/napaalm/ssodav/internal/auth"
+	"git.napaalm.xyz/napaalm/ssodav/internal/config"
+	"git.napaalm.xyz/napaalm/ssodav/internal/url"
+	"git.napaalm.xyz/napaalm/ssodav/pkg/dpop"
+)
+
+const dpopNonceLifetime = 5 * time.Minute
+
+var (
+	errMissingProof = errors.New("Prova DPoP mancante")
+	errBoundToken   = errors.New("Token vincolato a una chiave DPoP")
+)
+
+var dpopValidator *dpop.Validator
+
+// Inizializza la verifica delle prove DPoP
+func InitializeDPoP() error {
+	dpopValidator = dpop.NewValidator()
+
+	if config.Config.DPoP.Nonce {
+		nonces, err := dpop.NewNonceSource(dpopNonceLifetime)
+		if err != nil {
+			return err
+		}
+
+		dpopValidator.Nonces = nonces
+	}
+
+	return nil
+}
+
+// Verifica la prova DPoP presentata per ottenere un token e restituisce
+// l'impronta della chiave a cui vincolarlo, oppure "" se la prova è assente
+// e non obbligatoria.
+func tokenBinding(w http.ResponseWriter, r *http.Request) (string, error) {
+	setDPoPNonce(w)
+
+	proofs := r.Header.Values(dpop.Header)
+
+	switch len(proofs) {
+	case 0:
+		if config.Config.DPoP.Required {
+			return "", errMissingProof
+		}
+
+		return "", nil
+	case 1:
+	default:
+		return "", dpop.ErrInvalidProof
+	}
+
+	p, err := dpopValidator.Verify(proofs[0], r.Method, url.BaseURL()+r.URL.Path, nil)
+	if err != nil {
+		return "", err
+	}
+
+	return p.Thumbprint, nil
+}
+
+// Verifica il token presentato con l'header Authorization (schema Bearer o DPoP)
+// per la richiesta indicata. I token vincolati a una chiave sono accettati solo
+// con lo schema DPoP e con una prova di possesso della stessa chiave.
+func authorizationUser(r *http.Request, method, target string, audiences ...string) (auth.UserInfo, error) {
+	scheme, token := splitAuthorization(r.Header.Get("Authorization"))
+
+	switch {
+	case strings.EqualFold(scheme, "Bearer"):
+		userInfo, err := parseToken([]byte(token), audiences...)
+		if err == nil && userInfo.KeyThumbprint != "" {
+			return auth.UserInfo{}, errBoundToken
+		}
+
+		return userInfo, err
+
+	case strings.EqualFold(scheme, dpop.Scheme):
+		userInfo, err := parseToken([]byte(token), audiences...)
+		if err != nil {
+			return auth.UserInfo{}, err
+		}
+
+		proofs := r.Header.Values(dpop.Header)
+		if len(proofs) != 1 {
+			return auth.UserInfo{}, errMissingProof
+		}
+
+		p, err := dpopValidator.Verify(proofs[0], method, target, []byte(token))
+		if err != nil {
+			return auth.UserInfo{}, err
+		}
+
+		if userInfo.KeyThumbprint == "" || userInfo.KeyThumbprint != p.Thumbprint {
+			return auth.UserInfo{}, dpop.ErrMismatch
+		}
+
+		return userInfo, nil
+	}
+
+	return auth.UserInfo{}, errors.New("Header Authorization non valido")
+}
+
+// Divide l'header Authorization in schema e credenziali
+func splitAuthorization(header string) (string, string) {
+	i := strings.IndexByte(header, ' ')
+	if i < 0 {
+		return header, ""
+	}
+
+	return header[:i], strings.TrimSpace(header[i+1:])
+}
+
+// Fornisce al client un nonce per le prove successive, se richiesti
+func setDPoPNonce(w http.ResponseWriter) {
+	if dpopValidator.Nonces != nil {
+		w.Header().Set(dpop.NonceHeader, dpopValidator.Nonces.New())
+	}
+}
+
+// Restituisce l'errore per una prova DPoP non valida (RFC 9449, sezione 8)
+func writeDPoPError(w http.ResponseWriter, err error) {
+	if err == dpop.ErrUseNonce {
+		setDPoPNonce(w)
+		writeOAuthError(w, http.StatusBadRequest, "use_dpop_nonce", "")
+		return
+	}
+
+	writeOAuthError(w, http.StatusBadRequest, "invalid_dpop_proof", err.Error())
+}
+
+// Tipo del token da indicare nelle risposte
+func tokenType(jkt string) string {
+	if jkt != "" {
+		return dpop.Scheme
+	}
+
+	return "bearer"
+}
@@ -0,0 +1,257 @@
+/*
+ * email.go
+ *
+ * Pagine dell'accesso con un codice o un link inviati per email.
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"git.napaalm.xyz/napaalm/ssodav/internal/auth"
+	"git.napaalm.xyz/napaalm/ssodav/internal/config"
+	"git.napaalm.xyz/napaalm/ssodav/internal/emaillogin"
+	"git.napaalm.xyz/napaalm/ssodav/internal/mail"
+	"git.napaalm.xyz/napaalm/ssodav/internal/mfa"
+	"git.napaalm.xyz/napaalm/ssodav/internal/url"
+)
+
+// Nome del cookie con l'ID dell'accesso in attesa del codice inviato per email
+const emailCookie = "sso_email"
+
+// Dati delle pagine dell'accesso via email
+type emailData struct {
+	pageInfo
+	Action string
+
+	// Indirizzo a cui è stato inviato il codice
+	Address string
+	Sent    bool
+
+	// Token del link da confermare
+	Token string
+}
+
+// Percorso: /email/login
+// Accesso senza password: l'utente inserisce il proprio indirizzo, riceve un
+// codice ed eventualmente un link e inserisce il codice in questa pagina. La
+// risposta è la stessa per gli indirizzi non abilitati, a cui non viene inviato nulla.
+func HandleEmailLogin(w http.ResponseWriter, r *http.Request) {
+	if !emaillogin.Enabled() {
+		http.NotFound(w, r)
+		return
+	}
+
+	next := url.SanitizeURL(r.URL.Query().Get("next"))
+	state, challenge := r.URL.Query().Get("state"), codeChallenge(r)
+
+	data := emailData{
+		pageInfo: newPageInfo(),
+		Action:   "/email/login?" + loginQuery(r),
+	}
+	data.CSRFToken = csrfToken(w, r)
+
+	id, _ := hostCookies.Get(r, emailCookie)
+	if login, err := emaillogin.Get(id); err == nil {
+		data.Address = login.Address
+		data.Sent = true
+	}
+
+	if r.Method != "POST" {
+		renderPage(w, http.StatusOK, "email.html", data)
+		return
+	}
+
+	render := func(status int, err error) {
+		data.Error = true
+		data.ErrorMessage = err.Error()
+		renderPage(w, status, "email.html", data)
+	}
+
+	if !checkCSRF(r) {
+		render(http.StatusForbidden, errCSRF)
+		return
+	}
+
+	// A code was sent to this browser
+	if code := r.PostFormValue("code"); code != "" {
+		if !data.Sent {
+			render(http.StatusUnauthorized, emaillogin.ErrNotFound)
+			return
+		}
+
+		login, err := emaillogin.Verify(id, code)
+		switch err {
+		case nil:
+			hostCookies.Clear(w, r, emailCookie)
+			completeEmailLogin(w, r, login)
+		case emaillogin.ErrInvalidCode:
+			render(http.StatusUnauthorized, err)
+		default:
+			hostCookies.Clear(w, r, emailCookie)
+			data.Sent = false
+			render(http.StatusUnauthorized, err)
+		}
+		return
+	}
+
+	address := strings.TrimSpace(r.PostFormValue("email"))
+	if address == "" {
+		render(http.StatusBadRequest, emaillogin.ErrInvalidAddress)
+		return
+	}
+
+	data.Address = address
+	data.Sent = false
+
+	// Every email counts against the limits of the address and of the client
+	if _, _, status, err := RateLimit(strings.ToLower(address), GetIP(r)); err != nil {
+		render(status, err)
+		return
+	}
+
+	userInfo, err := emaillogin.Resolve(address)
+	if err == emaillogin.ErrInvalidAddress {
+		render(http.StatusBadRequest, err)
+		return
+	}
+
+	id, code, token, err := emaillogin.Start(emaillogin.Login{
+		UserInfo:  userInfo,
+		Address:   address,
+		Remember:  r.PostFormValue("remember") == "on",
+		Next:      next,
+		State:     state,
+		Challenge: challenge,
+		ACR:       parseStepUp(r).acr,
+	})
+	if err != nil {
+		render(http.StatusServiceUnavailable, err)
+		return
+	}
+
+	// The email is sent in the background, so that the response time doesn't
+	// reveal whether the address is allowed
+	if userInfo.Username != "" {
+		go sendLoginEmail(address, code, token)
+	}
+
+	hostCookies.Set(w, r, emailCookie, id, time.Time{})
+
+	data.Sent = true
+	renderPage(w, http.StatusOK, "email.html", data)
+}
+
+// Percorso: /email/link
+// Conferma dell'accesso con il link ricevuto per email. Il link non accede da
+// solo, perché i programmi che controllano le email potrebbero aprirlo.
+func HandleEmailLink(w http.ResponseWriter, r *http.Request) {
+	if !emaillogin.Enabled() {
+		http.NotFound(w, r)
+		return
+	}
+
+	data := emailData{
+		pageInfo: newPageInfo(),
+		Action:   "/email/link",
+		Token:    r.FormValue("token"),
+	}
+	data.CSRFToken = csrfToken(w, r)
+
+	if r.Method != "POST" {
+		renderPage(w, http.StatusOK, "email.html", data)
+		return
+	}
+
+	if !checkCSRF(r) {
+		data.Error = true
+		data.ErrorMessage = errCSRF.Error()
+		renderPage(w, http.StatusForbidden, "email.html", data)
+		return
+	}
+
+	login, err := emaillogin.Redeem(data.Token)
+	if err != nil {
+		data.Action = "/email/login?" + nextQuery(login.Next, login.State, login.Challenge)
+		data.Token = ""
+		data.Error = true
+		data.ErrorMessage = err.Error()
+		renderPage(w, http.StatusUnauthorized, "email.html", data)
+		return
+	}
+
+	hostCookies.Clear(w, r, emailCookie)
+	completeEmailLogin(w, r, login)
+}
+
+// Apre la sessione dell'utente che ha usato il codice o il link, chiedendo il
+// secondo fattore a chi ne ha uno o se il servizio lo richiede. L'accesso è
+// appena avvenuto, quindi soddisfa sempre max_age.
+func completeEmailLogin(w http.ResponseWriter, r *http.Request, l emaillogin.Login) {
+	login := mfa.Login{
+		UserInfo:  l.UserInfo,
+		Methods:   []string{auth.MethodEmail},
+		Remember:  l.Remember,
+		Next:      l.Next,
+		State:     l.State,
+		Challenge: l.Challenge,
+	}
+
+	f, err := userFactors(login.UserInfo)
+	if err != nil {
+		renderLogin(w, r, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+
+	f, ok := stepUp{acr: l.ACR, maxAge: -1}.factors(f)
+	if !ok {
+		renderLogin(w, r, http.StatusForbidden, errStepUpNoMFA.Error())
+		return
+	}
+
+	if requireSecondFactor(w, r, login, f) {
+		return
+	}
+
+	completeLogin(w, r, login)
+}
+
+// Invia all'utente il codice e, se abilitato, il link per accedere
+func sendLoginEmail(address, code, token string) {
+	title := config.Config.General.PageTitle
+
+	body := fmt.Sprintf("Il codice per accedere a %s è %s.\n\n", title, code)
+
+	if emaillogin.LinkEnabled() {
+		body += fmt.Sprintf("Puoi anche accedere aprendo questo link:\n%s/email/link?token=%s\n\n", url.BaseURL(), token)
+	}
+
+	body += fmt.Sprintf("Il codice scade tra %.0f minuti. Se non hai chiesto tu di accedere, ignora questa email.\n", emaillogin.Expiry().Minutes())
+
+	if err := mail.Send(address, "Codice di accesso a "+title, body); err != nil {
+		log.Println("handlers: ", err.Error())
+	}
+}
@@ -0,0 +1,286 @@
+/*
+ * exchange.go
+ *
+ * Scambio dei token per conto degli utenti (RFC 8693).
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"git.napaalm.xyz/napaalm/ssodav/internal/audit"
+	"git.napaalm.xyz/napaalm/ssodav/internal/auth"
+	"git.napaalm.xyz/napaalm/ssodav/internal/config"
+	"git.napaalm.xyz/napaalm/ssodav/internal/policy"
+	"git.napaalm.xyz/napaalm/ssodav/internal/url"
+)
+
+const (
+	tokenExchangeGrantType = "urn:ietf:params:oauth:grant-type:token-exchange"
+	accessTokenType        = "urn:ietf:params:oauth:token-type:access_token"
+	jwtTokenType           = "urn:ietf:params:oauth:token-type:jwt"
+
+	// Non-standard type for impersonation, where the subject is just a username
+	usernameTokenType = "urn:ssodav:params:oauth:token-type:username"
+)
+
+var errScope = errors.New("Scope non consentito dal token originale")
+
+// Scambia il token di un utente con uno per un altro servizio, con scope uguale
+// o più ristretto. Il client deve essere confidenziale e abilitato allo scambio;
+// i token presentati devono essere destinati al client stesso o al servizio SSO.
+// Con actor_token il nuovo token riporta nella claim act l'utente che agisce,
+// che può anche indicare direttamente l'utente da impersonare se è un amministratore.
+func handleTokenExchangeGrant(w http.ResponseWriter, r *http.Request) {
+	clientID, ok := authenticateClient(r)
+	client, _ := config.GetClient(clientID)
+
+	if !ok || !client.TokenExchange {
+		w.Header().Set("WWW-Authenticate", `Basic realm="ssodav"`)
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "")
+		return
+	}
+
+	event := audit.Event{Type: audit.TokenExchange, Client: clientID, IP: GetIP(r)}
+
+	fail := func(status int, code, description string) {
+		event.Outcome = code
+		audit.Record(event)
+		writeOAuthError(w, status, code, description)
+	}
+
+	if requested := r.PostFormValue("requested_token_type"); requested != "" && !isAccessTokenType(requested) {
+		fail(http.StatusBadRequest, "invalid_request", "requested_token_type non supportato")
+		return
+	}
+
+	// The target service is given either as a client ID or as a URL
+	requested := r.PostFormValue("audience")
+	if requested == "" {
+		requested = r.PostFormValue("resource")
+	}
+
+	event.Audience = requested
+
+	audience := resolveAudience(requested)
+	if audience == "" || !exchangeAllowed(clientID, client.ExchangeAudiences, audience) {
+		fail(http.StatusBadRequest, "invalid_target", "Servizio non autorizzato")
+		return
+	}
+	event.Audience = audience
+
+	// Presented tokens must have been issued to the client or to the SSO service
+	audiences := []string{url.BaseURL(), clientID}
+
+	var (
+		actor    auth.UserInfo
+		userInfo auth.UserInfo
+		err      error
+	)
+
+	if actorToken := r.PostFormValue("actor_token"); actorToken != "" {
+		if !isAccessTokenType(r.PostFormValue("actor_token_type")) {
+			fail(http.StatusBadRequest, "invalid_request", "actor_token_type non supportato")
+			return
+		}
+
+		actor, err = parseToken([]byte(actorToken), audiences...)
+		if err != nil || actor.Actor != "" {
+			fail(http.StatusBadRequest, "invalid_grant", "actor_token non valido")
+			return
+		}
+
+		event.Actor = actor.Username
+	}
+
+	subjectToken := r.PostFormValue("subject_token")
+
+	switch subjectType := r.PostFormValue("subject_token_type"); {
+	case subjectType == usernameTokenType:
+		event.Type = audit.Impersonation
+		event.Subject = subjectToken
+
+		userInfo, err = impersonate(actor, subjectToken)
+		if err != nil {
+			fail(http.StatusBadRequest, "invalid_grant", err.Error())
+			return
+		}
+
+	case isAccessTokenType(subjectType):
+		userInfo, err = parseToken([]byte(subjectToken), audiences...)
+		if err != nil {
+			fail(http.StatusBadRequest, "invalid_grant", "subject_token non valido")
+			return
+		}
+		event.Subject = userInfo.Username
+
+		if actor.Username != "" {
+			// The original actor of an impersonated token can't be replaced
+			if userInfo.Actor != "" {
+				fail(http.StatusBadRequest, "invalid_grant", "subject_token già ottenuto per conto di un altro utente")
+				return
+			}
+
+			userInfo.Actor = actor.Username
+		}
+
+	default:
+		fail(http.StatusBadRequest, "invalid_request", "subject_token_type non supportato")
+		return
+	}
+
+	scope, err := narrowScope(userInfo.Scope, r.PostFormValue("scope"))
+	if err != nil {
+		fail(http.StatusBadRequest, "invalid_scope", err.Error())
+		return
+	}
+	userInfo.Scope = scope
+	event.Scope = scope
+
+	jkt, err := tokenBinding(w, r)
+	if err != nil {
+		event.Outcome = "invalid_dpop_proof"
+		audit.Record(event)
+		writeDPoPError(w, err)
+		return
+	}
+
+	// Sender-constrained tokens can only be exchanged by the key holder,
+	// whether they identify the subject or the actor
+	if userInfo.KeyThumbprint != "" && userInfo.KeyThumbprint != jkt {
+		fail(http.StatusBadRequest, "invalid_grant", "Prova DPoP mancante")
+		return
+	}
+
+	if actor.KeyThumbprint != "" && actor.KeyThumbprint != jkt {
+		fail(http.StatusBadRequest, "invalid_grant", "Prova DPoP mancante per actor_token")
+		return
+	}
+
+	// The new token never outlives the ones it was obtained from
+	expTime := exchangedTokenExpiry
+	if event.Type == audit.Impersonation {
+		expTime = impersonationExpiry()
+	}
+	expTime = capExpiry(expTime, userInfo.Expires)
+	expTime = capExpiry(expTime, actor.Expires)
+	expTime = policy.For(userInfo, audience, event.IP).CapToken(expTime)
+
+	token, err := auth.IssueToken(userInfo, audience, expTime, auth.WithConfirmation(jkt))
+	if err != nil {
+		fail(http.StatusInternalServerError, "server_error", "")
+		return
+	}
+
+	event.Outcome = audit.Success
+	audit.Record(event)
+
+	response := map[string]interface{}{
+		"access_token":      string(token),
+		"issued_token_type": accessTokenType,
+		"token_type":        tokenType(jkt),
+		"expires_in":        int(expTime.Seconds()),
+	}
+
+	if scope != "" {
+		response["scope"] = scope
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, response)
+}
+
+// Controlla se il tipo di token indicato è un token di accesso di ssodav
+func isAccessTokenType(tokenType string) bool {
+	return tokenType == accessTokenType || tokenType == jwtTokenType
+}
+
+// Restituisce l'audience di un token a partire dall'ID di un client
+// o dall'URL di un servizio, oppure "" se non è valida
+func resolveAudience(requested string) string {
+	if requested == "" {
+		return ""
+	}
+
+	if _, ok := config.GetClient(requested); ok {
+		return requested
+	}
+
+	return url.Origin(requested)
+}
+
+// Controlla se l'audience è tra quelle consentite a un client; senza una lista
+// di audience il client può ottenere token solo per sé stesso
+func exchangeAllowed(clientID string, allowed []string, audience string) bool {
+	if len(allowed) == 0 {
+		return audience == clientID
+	}
+
+	for _, a := range allowed {
+		if resolveAudience(a) == audience {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Restituisce lo scope richiesto se è compreso in quello concesso
+// (uno scope concesso vuoto non pone limitazioni)
+func narrowScope(granted, requested string) (string, error) {
+	if requested == "" {
+		return granted, nil
+	}
+
+	values := strings.Fields(requested)
+
+	if granted != "" {
+		allowed := make(map[string]bool)
+		for _, value := range strings.Fields(granted) {
+			allowed[value] = true
+		}
+
+		for _, value := range values {
+			if !allowed[value] {
+				return "", errScope
+			}
+		}
+	}
+
+	return strings.Join(values, " "), nil
+}
+
+// Riduce la durata di un token in modo che non superi la scadenza indicata
+func capExpiry(exp time.Duration, expires time.Time) time.Duration {
+	if expires.IsZero() {
+		return exp
+	}
+
+	if remaining := time.Until(expires); remaining < exp {
+		return remaining
+	}
+
+	return exp
+}
@@ -0,0 +1,115 @@
+/*
+ * forwardauth.go
+ *
+ * Endpoint di verifica per l'autenticazione delegata dei reverse proxy
+ * (Traefik ForwardAuth, nginx auth_request, Caddy forward_auth).
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+package handlers
+
+import (
+	"net/http"
+
+	"git.napaalm.xyz/napaalm/ssodav/internal/auth"
+	"git.napaalm.xyz/napaalm/ssodav/internal/url"
+)
+
+// Header con l'identità dell'utente autenticato
+const (
+	headerAuthUser   = "X-Auth-User"
+	headerAuthName   = "X-Auth-Name"
+	headerAuthGroups = "X-Auth-Groups"
+)
+
+// Percorso: /auth/verify
+// Verifica la sessione per conto di un reverse proxy.
+// Se l'utente è autenticato restituisce 200 con gli header dell'identità,
+// altrimenti reindirizza alla pagina di accesso (302) oppure, per nginx
+// o se richiesto con ?redirect=false, restituisce 401.
+func HandleForwardAuth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	original := originalURL(r)
+
+	// Bearer tokens can also be issued for the protected service
+	userInfo, err := requestUserAt(r, originalMethod(r), original, url.Origin(original))
+	if err == nil {
+		// The proxy can pass the renewed cookie on to the browser
+		// (e.g. nginx with auth_request_set and add_header Set-Cookie)
+		if r.Header.Get("Authorization") == "" {
+			renewSession(w, r)
+		}
+
+		setIdentityHeaders(w.Header(), userInfo)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	location := loginURL(original)
+
+	// nginx's auth_request can't forward redirects to the client
+	if r.Header.Get("X-Original-URL") != "" || r.URL.Query().Get("redirect") == "false" {
+		w.Header().Set("Location", location)
+		http.Error(w, "Autenticazione richiesta", http.StatusUnauthorized)
+		return
+	}
+
+	http.Redirect(w, r, location, http.StatusFound)
+}
+
+// Imposta gli header con l'identità dell'utente
+func setIdentityHeaders(h http.Header, userInfo auth.UserInfo) {
+	h.Set(headerAuthUser, userInfo.Username)
+	h.Set(headerAuthName, userInfo.FullName)
+	h.Set(headerAuthGroups, userInfo.Group)
+}
+
+// Restituisce il metodo della richiesta originale al reverse proxy
+func originalMethod(r *http.Request) string {
+	for _, header := range []string{"X-Original-Method", "X-Forwarded-Method"} {
+		if method := r.Header.Get(header); method != "" {
+			return method
+		}
+	}
+
+	return r.Method
+}
+
+// Ricostruisce l'URL originale richiesto al reverse proxy
+func originalURL(r *http.Request) string {
+	// nginx (proxy_set_header X-Original-URL $scheme://$http_host$request_uri)
+	if original := r.Header.Get("X-Original-URL"); original != "" {
+		return original
+	}
+
+	// Traefik and Caddy
+	host := r.Header.Get("X-Forwarded-Host")
+	if host == "" {
+		return ""
+	}
+
+	scheme := r.Header.Get("X-Forwarded-Proto")
+	if scheme == "" {
+		scheme = "https"
+	}
+
+	return scheme + "://" + host + r.Header.Get("X-Forwarded-Uri")
+}
@@ -28,23 +28,38 @@ package handlers
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"html/template"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	neturl "net/url"
 	"strings"
 	text_template "text/template"
 	"time"
 
+	"git.napaalm.xyz/napaalm/ssodav/internal/audit"
 	"git.napaalm.xyz/napaalm/ssodav/internal/auth"
 	"git.napaalm.xyz/napaalm/ssodav/internal/config"
+	"git.napaalm.xyz/napaalm/ssodav/internal/emaillogin"
+	"git.napaalm.xyz/napaalm/ssodav/internal/limiter"
+	"git.napaalm.xyz/napaalm/ssodav/internal/mfa"
+	"git.napaalm.xyz/napaalm/ssodav/internal/policy"
 	"git.napaalm.xyz/napaalm/ssodav/internal/rate"
+	"git.napaalm.xyz/napaalm/ssodav/internal/recovery"
+	"git.napaalm.xyz/napaalm/ssodav/internal/totp"
 	"git.napaalm.xyz/napaalm/ssodav/internal/url"
+	"git.napaalm.xyz/napaalm/ssodav/internal/webauthn"
+	"git.napaalm.xyz/napaalm/ssodav/pkg/dpop"
+	"git.napaalm.xyz/napaalm/ssodav/pkg/pkce"
 )
 
 type credentials struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
+	OTP      string `json:"otp"`
+	ClientID string `json:"client_id"`
 }
 
 var (
@@ -53,7 +68,14 @@ var (
 )
 
 const (
+	// Durata dei token ottenuti tramite /token/exchange
+	exchangedTokenExpiry = time.Hour
+
+	// Limitatori per utente e per indirizzo mantenuti se non specificato nella configurazione
+	defaultMaxLimiters = 100000
+
 	loginTemplatesDir = "web/ssodav-login-page"
+	pagesDir          = "web/pages"
 	openapiDir        = "web/openapi"
 
 	// Licenza AGPL3
@@ -61,20 +83,214 @@ const (
 	licenseName = "AGPL 3.0"
 )
 
-// Viene inizializzato nel momento in cui viene importato il package
 var (
-	loginTemplates   = template.Must(template.ParseFiles(loginTemplatesDir + "/index.html"))
-	openapiTemplates = text_template.Must(text_template.ParseFiles(openapiDir + "/openapi.yaml"))
+	loginTemplates   *template.Template
+	pageTemplates    *template.Template
+	openapiTemplates *text_template.Template
 	globalLimiter    *rate.Limiter
-	accountLimiters  map[string]*rate.Limiter
-	addressLimiters  map[string]*rate.Limiter
+	trustedProxies   []*net.IPNet
+	accountLimiters  *limiter.Registry
+	addressLimiters  *limiter.Registry
 )
 
+// Carica i template delle pagine
+func InitializeTemplates() error {
+	var err error
+
+	if loginTemplates, err = template.ParseFiles(loginTemplatesDir + "/index.html"); err != nil {
+		return err
+	}
+
+	if pageTemplates, err = template.ParseGlob(pagesDir + "/*.html"); err != nil {
+		return err
+	}
+
+	openapiTemplates, err = text_template.ParseFiles(openapiDir + "/openapi.yaml")
+	return err
+}
+
+// Dati comuni a tutte le pagine
+type pageInfo struct {
+	PageTitle    string
+	LicenseURL   string
+	LicenseName  string
+	SourceURL    string
+	Error        bool
+	ErrorMessage string
+
+	// Token da inviare nel campo csrf_token dei form
+	CSRFToken string
+}
+
+// Restituisce i dati comuni a tutte le pagine
+func newPageInfo() pageInfo {
+	return pageInfo{
+		PageTitle:   config.Config.General.PageTitle,
+		LicenseURL:  licenseURL,
+		LicenseName: licenseName,
+		SourceURL:   SourceURL,
+	}
+}
+
+// Visualizza una delle pagine in web/pages
+func renderPage(w http.ResponseWriter, status int, name string, data interface{}) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+
+	if err := pageTemplates.ExecuteTemplate(w, name, data); err != nil {
+		log.Println("handlers: ", err.Error())
+	}
+}
+
+// Visualizza la pagina di accesso con il messaggio d'errore, se presente. Il form
+// del template deve inviare CSRFToken nel campo csrf_token; PasskeyURL, EmailURL
+// e RecoveryURL, se non sono vuoti, sono le pagine per accedere con una passkey o
+// con un codice inviato per email e per reimpostare la password con un codice di
+// recupero.
+func renderLogin(w http.ResponseWriter, r *http.Request, status int, message string) {
+	type loginData struct {
+		pageInfo
+		PasskeyURL  string
+		EmailURL    string
+		RecoveryURL string
+	}
+
+	data := loginData{pageInfo: newPageInfo()}
+	data.CSRFToken = csrfToken(w, r)
+
+	query := loginQuery(r)
+
+	if webauthn.Passwordless() {
+		data.PasskeyURL = "/webauthn/login?" + query
+	}
+
+	if emaillogin.Enabled() {
+		data.EmailURL = "/email/login?" + query
+	}
+
+	if recovery.Enabled() {
+		data.RecoveryURL = "/recovery/reset"
+	}
+
+	data.Error = message != ""
+	data.ErrorMessage = message
+
+	w.WriteHeader(status)
+
+	if err := loginTemplates.ExecuteTemplate(w, "index.html", data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Restituisce un oggetto JSON
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	b, err := json.Marshal(v)
+
+	if err != nil {
+		log.Println("handlers: ", err.Error())
+		http.Error(w, "Error while encoding response", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+// Restituisce l'URL della pagina di accesso che reindirizza a next
+func loginURL(next string) string {
+	return url.BaseURL() + "/?next=" + neturl.QueryEscape(next)
+}
+
+// Come loginURL, con lo state e l'impronta PKCE inviati dal servizio se non
+// sono vuoti
+func loginURLWithState(next, state, challenge string) string {
+	return url.BaseURL() + "/?" + nextQuery(next, state, challenge)
+}
+
+// Restituisce la query string con next e, se non sono vuoti, state e l'impronta PKCE
+func nextQuery(next, state, challenge string) string {
+	query := "next=" + neturl.QueryEscape(next)
+	if state != "" {
+		query += "&state=" + neturl.QueryEscape(state)
+	}
+	if challenge != "" {
+		query += "&code_challenge=" + neturl.QueryEscape(challenge) + "&code_challenge_method=" + pkce.Method
+	}
+
+	return query
+}
+
+// Restituisce la query string da passare alle altre pagine di accesso: next,
+// state, l'impronta PKCE e i requisiti del servizio (acr_values e max_age)
+func loginQuery(r *http.Request) string {
+	q := r.URL.Query()
+	query := nextQuery(url.SanitizeURL(q.Get("next")), q.Get("state"), codeChallenge(r))
+
+	for _, key := range []string{"acr_values", "max_age"} {
+		if value := q.Get(key); value != "" {
+			query += "&" + key + "=" + neturl.QueryEscape(value)
+		}
+	}
+
+	return query
+}
+
+// Ottiene l'utente autenticato a partire dall'header Authorization o dal cookie di sessione.
+// Il token nell'header deve essere destinato al servizio SSO oppure all'audience indicata.
+func requestUser(r *http.Request, audience string) (auth.UserInfo, error) {
+	return requestUserAt(r, r.Method, url.BaseURL()+r.URL.Path, audience)
+}
+
+// Come requestUser, per una richiesta diretta al metodo e all'URL indicati
+// (a cui devono corrispondere le prove DPoP)
+func requestUserAt(r *http.Request, method, target, audience string) (auth.UserInfo, error) {
+	if r.Header.Get("Authorization") != "" {
+		audiences := []string{url.BaseURL()}
+		if audience != "" {
+			audiences = append(audiences, audience)
+		}
+
+		return authorizationUser(r, method, target, audiences...)
+	}
+
+	return currentUser(r)
+}
+
+// Determina l'audience di un token a partire dall'ID di un client registrato
+// o dall'URL di un servizio. Senza nessuno dei due il token è destinato al servizio SSO.
+func tokenAudience(clientID, next string) (string, error) {
+	if clientID != "" {
+		if _, ok := config.GetClient(clientID); !ok {
+			return "", errors.New("Client sconosciuto")
+		}
+
+		return clientID, nil
+	}
+
+	if next != "" {
+		origin := url.Origin(next)
+		if origin == "" {
+			return "", errors.New("Servizio non autorizzato")
+		}
+
+		return origin, nil
+	}
+
+	return url.BaseURL(), nil
+}
+
 // Inizializza i rate limiter
 func InitializeLimiters() {
 	globalLimiter = rate.NewLimiter(rate.Limit(config.Config.Limits.Rate), config.Config.Limits.Burst)
-	accountLimiters = make(map[string]*rate.Limiter)
-	addressLimiters = make(map[string]*rate.Limiter)
+
+	max := config.Config.Limits.MaxLimiters
+	if max <= 0 {
+		max = defaultMaxLimiters
+	}
+
+	accountLimiters = limiter.New(10*time.Minute, 5, max)
+	addressLimiters = limiter.New(time.Hour, 20, max)
 }
 
 // Handler per qualunque percorso diverso da tutti gli altri percorsi riconosciuti.
@@ -101,39 +317,84 @@ func HandleLogin(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// Ottiene l'indirizzo IP di una richiesta HTTP
+// Legge i reverse proxy fidati dalla configurazione
+func InitializeTrustedProxies() error {
+	trustedProxies = nil
+
+	for _, network := range config.Config.General.TrustedProxies {
+		n, err := policy.ParseNetwork(network)
+		if err != nil {
+			return fmt.Errorf("Proxy fidato \"%s\" non valido", network)
+		}
+
+		trustedProxies = append(trustedProxies, n)
+	}
+
+	return nil
+}
+
+// Ottiene l'indirizzo IP di una richiesta HTTP. L'header X-Forwarded-For è
+// considerato solo se la richiesta arriva da un proxy fidato.
 func GetIP(r *http.Request) string {
-	// Use forwarded address if present
-	if fwdAddr := r.Header.Get("X-Forwarded-For"); fwdAddr != "" {
-		// Get the first address in the header (see https://en.wikipedia.org/wiki/X-Forwarded-For)
-		ips := strings.Split(fwdAddr, ", ")
+	ip := remoteIP(r)
+	if !trustedProxy(ip) {
+		return ip
+	}
+
+	// Walk the header from the right: each trusted proxy appends the address it
+	// received the request from, while anything before may be made up by the client
+	// (see https://en.wikipedia.org/wiki/X-Forwarded-For)
+	var forwarded []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		for _, addr := range strings.Split(header, ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				forwarded = append(forwarded, addr)
+			}
+		}
+	}
 
-		if len(ips) > 1 {
-			return ips[0]
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip = forwarded[i]
+
+		if !trustedProxy(ip) {
+			break
 		}
+	}
+
+	return ip
+}
 
-		return fwdAddr
+// Restituisce l'indirizzo da cui proviene la connessione, senza la porta
+func remoteIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
 	}
 
-	// Return only the ip, not the port
-	return strings.Split(r.RemoteAddr, ":")[0]
+	return r.RemoteAddr
 }
 
-// Controlla ed eventualmente limita le richieste
-func RateLimit(username, ip string) (*rate.Reservation, *rate.Reservation, int, error) {
-	// Create the rate limiter instances if they're not present
-	if _, ok := addressLimiters[ip]; !ok {
-		addressLimiters[ip] = rate.NewLimiter(rate.Every(time.Duration(3600*1000000000)), 20)
+// Controlla se l'indirizzo appartiene a un proxy fidato
+func trustedProxy(ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
 	}
 
-	if _, ok := accountLimiters[username]; !ok {
-		accountLimiters[username] = rate.NewLimiter(rate.Every(time.Duration(600*1000000000)), 5)
+	for _, n := range trustedProxies {
+		if n.Contains(addr) {
+			return true
+		}
 	}
 
+	return false
+}
+
+// Controlla ed eventualmente limita le richieste
+func RateLimit(username, ip string) (*rate.Reservation, *rate.Reservation, int, error) {
 	// Check if allowed
 	globalAllow := globalLimiter.Allow()
-	accountReservation := accountLimiters[username].ReserveNow()
-	addressReservation := addressLimiters[ip].ReserveNow()
+	accountReservation := accountLimiters.Get(username).ReserveNow()
+	addressReservation := addressLimiters.Get(ip).ReserveNow()
 
 	if !globalAllow {
 		return nil, nil, http.StatusServiceUnavailable, errors.New("Server di autenticazione non disponibile. Riprova più tardi.")
@@ -151,11 +412,8 @@ func RateLimit(username, ip string) (*rate.Reservation, *rate.Reservation, int,
 }
 
 func HandleBrowserLogin(w http.ResponseWriter, r *http.Request) {
-	var (
-		expTime time.Duration
-		// Get URL to redirect to and sanitize it
-		nextURL = url.SanitizeURL(r.URL.Query().Get("next"))
-	)
+	// Get URL to redirect to and sanitize it
+	nextURL := url.SanitizeURL(r.URL.Query().Get("next"))
 
 	if r.Method == "POST" {
 		// Parse the form
@@ -168,23 +426,13 @@ func HandleBrowserLogin(w http.ResponseWriter, r *http.Request) {
 
 		// Check if it is a valid request
 		if err != nil || username == "" || password == "" {
-			// Set status code
-			w.WriteHeader(http.StatusBadRequest)
-
-			// Load page title from the configuration
-			pageTitle := config.Config.General.PageTitle
-
-			if errT := loginTemplates.ExecuteTemplate(w, "index.html", struct {
-				PageTitle    string
-				LicenseURL   string
-				LicenseName  string
-				SourceURL    string
-				Error        bool
-				ErrorMessage string
-			}{pageTitle, licenseURL, licenseName, SourceURL, true, "Impossibile elaborare la richiesta!"}); errT != nil {
-				http.Error(w, errT.Error(), http.StatusInternalServerError)
-			}
+			renderLogin(w, r, http.StatusBadRequest, "Impossibile elaborare la richiesta!")
+			return
+		}
 
+		// Forms posted by other sites are refused (login CSRF)
+		if !checkLoginCSRF(r) {
+			renderLogin(w, r, http.StatusForbidden, errCSRF.Error())
 			return
 		}
 
@@ -194,55 +442,44 @@ func HandleBrowserLogin(w http.ResponseWriter, r *http.Request) {
 		// Check the rate limiter
 		accountReservation, addressReservation, status, err := RateLimit(username, ip)
 		if err != nil {
-			// Set status code
-			w.WriteHeader(status)
-
-			// Load page title from the configuration
-			pageTitle := config.Config.General.PageTitle
-
-			if errT := loginTemplates.ExecuteTemplate(w, "index.html", struct {
-				PageTitle    string
-				LicenseURL   string
-				LicenseName  string
-				SourceURL    string
-				Error        bool
-				ErrorMessage string
-			}{pageTitle, licenseURL, licenseName, SourceURL, true, err.Error()}); errT != nil {
-				http.Error(w, errT.Error(), http.StatusInternalServerError)
-			}
-
+			renderLogin(w, r, status, err.Error())
 			return
 		}
 
-		// Set token/cookie expiration time
-		if remember == "on" {
-			expTime = 7 * 24 * time.Hour // 7 days
-		} else {
-			expTime = 24 * time.Hour // 1 day
+		// Check credentials
+		userInfo, err := auth.Authenticate(username, password)
+
+		// Authentication failure
+		if err != nil {
+			renderLogin(w, r, http.StatusUnauthorized, err.Error())
+			return
 		}
 
-		// Check credentials and generate a token
-		token, err := auth.AuthenticateUser(username, password, expTime)
+		login := mfa.Login{
+			UserInfo:  userInfo,
+			Methods:   []string{"pwd"},
+			Remember:  remember == "on",
+			Next:      nextURL,
+			State:     r.URL.Query().Get("state"),
+			Challenge: codeChallenge(r),
+		}
 
-		// Authentication failure
+		// Ask for the second factor if the user needs one or the service requires it
+		f, err := userFactors(userInfo)
 		if err != nil {
-			// Set 401 header
-			w.WriteHeader(http.StatusUnauthorized)
-
-			// Load page title from the configuration
-			pageTitle := config.Config.General.PageTitle
-
-			if errT := loginTemplates.ExecuteTemplate(w, "index.html", struct {
-				PageTitle    string
-				LicenseURL   string
-				LicenseName  string
-				SourceURL    string
-				Error        bool
-				ErrorMessage string
-			}{pageTitle, licenseURL, licenseName, SourceURL, true, err.Error()}); errT != nil {
-				http.Error(w, errT.Error(), http.StatusInternalServerError)
-			}
+			renderLogin(w, r, http.StatusServiceUnavailable, err.Error())
+			return
+		}
 
+		f, ok := parseStepUp(r).factors(f)
+		if !ok {
+			renderLogin(w, r, http.StatusForbidden, errStepUpNoMFA.Error())
+			return
+		}
+
+		// Until the second factor is verified the attempt counts against the
+		// limits, so that codes can't be guessed by logging in again and again
+		if requireSecondFactor(w, r, login, f) {
 			return
 		}
 
@@ -250,59 +487,23 @@ func HandleBrowserLogin(w http.ResponseWriter, r *http.Request) {
 		accountReservation.Cancel()
 		addressReservation.Cancel()
 
-		// Load cookie configuration
-		tld := config.Config.General.TLD
-		secure := config.Config.General.SecureCookies
-
-		// Create cookie
-		cookie := http.Cookie{
-			Name:   "access_token",
-			Value:  string(token),
-			Domain: tld,
-			MaxAge: int(expTime.Seconds()),
-			Secure: secure,
-		}
-		http.SetCookie(w, &cookie)
-
-		// Redirect after login
-		if nextURL != "" {
-			http.Redirect(w, r, nextURL, http.StatusSeeOther)
-		} else {
-			http.Redirect(w, r, "http://"+config.Config.General.TLD, http.StatusSeeOther)
-		}
-
+		completeLogin(w, r, login)
 		return
 	}
 
-	// Check if cookie is set and valid
-	cookie, err := r.Cookie("access_token")
-	if err == nil {
-		err = auth.VerifyToken([]byte(cookie.Value))
-	}
-
-	// If it is redirect
-	if err == nil {
-		if nextURL != "" {
-			http.Redirect(w, r, nextURL, http.StatusSeeOther)
-		} else {
-			http.Redirect(w, r, "http://"+config.Config.General.TLD, http.StatusSeeOther)
+	// Check if cookie is set and valid, if it is renew it and redirect
+	if s, err := renewSession(w, r); err == nil {
+		// The service may require a recent or stronger authentication
+		if stepUp := parseStepUp(r); !stepUp.satisfiedBy(s) {
+			requireStepUp(w, r, stepUp, s, nextURL)
+			return
 		}
+
+		redirectAfterLogin(w, r, nextURL, r.URL.Query().Get("state"), codeChallenge(r), s)
 		return
 	}
 
-	// Load page title from the configuration
-	pageTitle := config.Config.General.PageTitle
-
-	if err := loginTemplates.ExecuteTemplate(w, "index.html", struct {
-		PageTitle    string
-		LicenseURL   string
-		LicenseName  string
-		SourceURL    string
-		Error        bool
-		ErrorMessage string
-	}{pageTitle, licenseURL, licenseName, SourceURL, false, ""}); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-	}
+	renderLogin(w, r, http.StatusOK, "")
 }
 
 func HandleRestfulLogin(w http.ResponseWriter, r *http.Request) {
@@ -319,6 +520,20 @@ func HandleRestfulLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The token is valid only for the requesting service
+	audience, err := tokenAudience(cr.ClientID, r.URL.Query().Get("next"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Bind the token to the client's key if a DPoP proof is given
+	jkt, err := tokenBinding(w, r)
+	if err != nil {
+		writeDPoPError(w, err)
+		return
+	}
+
 	// Get client's IP address
 	ip := GetIP(r)
 
@@ -329,8 +544,8 @@ func HandleRestfulLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Check credentials and generate a token valid for a day
-	token, err := auth.AuthenticateUser(cr.Username, cr.Password, 24*time.Hour)
+	// Check credentials
+	userInfo, err := auth.Authenticate(cr.Username, cr.Password)
 
 	// Authentication failure
 	if err != nil {
@@ -338,14 +553,61 @@ func HandleRestfulLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	methods := []string{"pwd"}
+
+	// Users with a second factor must send the code along with the password;
+	// security keys can be used only from the browser
+	f, err := userFactors(userInfo)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	if f.needed() {
+		if f.webauthnRequired || (f.webauthn && !f.totp) {
+			http.Error(w, errWebAuthnBrowser.Error(), http.StatusForbidden)
+			return
+		}
+
+		if !f.totp {
+			http.Error(w, errTOTPNotEnrolled.Error(), http.StatusForbidden)
+			return
+		}
+
+		if err := totp.Verify(userInfo.Username, cr.OTP); err != nil {
+			status := http.StatusUnauthorized
+			if err != totp.ErrInvalidCode {
+				status = http.StatusServiceUnavailable
+			}
+
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		methods = append(methods, "otp")
+	}
+
 	// Cancel reservations on successful logins
 	accountReservation.Cancel()
 	addressReservation.Cancel()
 
+	// API logins don't create sessions, so that scripts can't crowd out the
+	// user's browser sessions: the token stands on its own until it expires
+	userInfo.Methods = methods
+	userInfo.AuthTime = time.Now()
+
+	expTime := policy.For(userInfo, audience, ip).TokenLifetime
+
+	token, err := auth.IssueToken(userInfo, audience, expTime, auth.WithConfirmation(jkt))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	// Return token in a JSON object
 	b, err := json.Marshal(map[string]string{
 		"access_token": string(token),
-		"type":         "bearer",
+		"type":         tokenType(jkt),
 	})
 
 	if err != nil {
@@ -357,32 +619,107 @@ func HandleRestfulLogin(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Percorso: /token/exchange
+// Rilascia all'utente autenticato un token per un altro servizio (audience),
+// indicato con l'URL o con l'ID del client.
+func HandleTokenExchange(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userInfo, err := requestUser(r, "")
+	if err == dpop.ErrUseNonce {
+		writeDPoPError(w, err)
+		return
+	} else if err != nil {
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_token", "")
+		return
+	}
+
+	// A token presented with DPoP keeps its binding, otherwise a new proof may be given
+	jkt := userInfo.KeyThumbprint
+	if jkt == "" {
+		if jkt, err = tokenBinding(w, r); err != nil {
+			writeDPoPError(w, err)
+			return
+		}
+	}
+
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "")
+		return
+	}
+
+	requested := r.PostFormValue("audience")
+	if requested == "" {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "audience mancante")
+		return
+	}
+
+	event := audit.Event{
+		Type:     audit.TokenExchange,
+		Actor:    userInfo.Actor,
+		Subject:  userInfo.Username,
+		Audience: requested,
+		Scope:    userInfo.Scope,
+		IP:       GetIP(r),
+	}
+
+	// The audience may be either a client ID or the URL of a service
+	audience := resolveAudience(requested)
+	if audience == "" {
+		event.Outcome = "invalid_target"
+		audit.Record(event)
+		writeOAuthError(w, http.StatusBadRequest, "invalid_target", "Servizio non autorizzato")
+		return
+	}
+	event.Audience = audience
+
+	// The new token never outlives the original one
+	expTime := capExpiry(exchangedTokenExpiry, userInfo.Expires)
+	expTime = policy.For(userInfo, audience, event.IP).CapToken(expTime)
+
+	token, err := auth.IssueToken(userInfo, audience, expTime, auth.WithConfirmation(jkt))
+	if err != nil {
+		event.Outcome = "server_error"
+		audit.Record(event)
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+
+	event.Outcome = audit.Success
+	audit.Record(event)
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": string(token),
+		"token_type":   tokenType(jkt),
+		"expires_in":   int(expTime.Seconds()),
+		"audience":     audience,
+	})
+}
+
 // Percorso: /logout
-// Endpoint di logout.
+// Endpoint di logout: dopo la conferma termina la sessione e disconnette le
+// applicazioni registrate.
 func HandleLogout(w http.ResponseWriter, r *http.Request) {
 	// Get URL to redirect to and sanitize it
 	nextURL := url.SanitizeURL(r.URL.Query().Get("next"))
 
-	// Load cookie configuration
-	tld := config.Config.General.TLD
-	secure := config.Config.General.SecureCookies
-
-	// Create cookie
-	cookie := http.Cookie{
-		Name:    "access_token",
-		Value:   "",
-		Expires: time.Unix(0, 0),
-		Domain:  tld,
-		Secure:  secure,
+	if nextURL == "" {
+		nextURL = "http://" + config.Config.General.TLD
 	}
-	http.SetCookie(w, &cookie)
 
-	// Redirect after login
-	if nextURL != "" {
-		http.Redirect(w, r, nextURL, http.StatusSeeOther)
-	} else {
-		http.Redirect(w, r, "http://"+config.Config.General.TLD, http.StatusSeeOther)
-	}
+	confirmLogout(w, r, nextURL)
+}
+
+// Percorso: /.well-known/jwks.json
+// Chiavi pubbliche per la verifica dei token firmati con RS256 o ES256.
+func HandleJWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	writeJSON(w, http.StatusOK, auth.PublicKeys())
 }
 
 // Favicon handler
@@ -398,29 +735,12 @@ func HandleSwaggerUI(w http.ResponseWriter, r *http.Request) {
 
 // openapi.yaml handler
 func HandleOpenAPI(w http.ResponseWriter, r *http.Request) {
-	var fqdn, url, scheme string
-
 	w.Header().Set("Content-Type", "application/yaml")
 
-	// Define URL
-	fqdn = config.Config.General.FQDN
-
-	if config.Config.General.SecureCookies {
-		scheme = "https://"
-	} else {
-		scheme = "http://"
-	}
-
-	url = scheme + fqdn
-
-	if fqdn == "localhost" {
-		url += config.Config.General.Port
-	}
-
 	if err := openapiTemplates.ExecuteTemplate(w, "openapi.yaml", struct {
 		Version string
 		URL     string
-	}{Version, url}); err != nil {
+	}{Version, url.BaseURL()}); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
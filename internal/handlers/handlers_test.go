@@ -0,0 +1,998 @@
+/*
+ * handlers_test.go
+ *
+ * File di test per il package handlers.
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+package handlers
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	neturl "net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"git.napaalm.xyz/napaalm/ssodav/internal/auth"
+	"git.napaalm.xyz/napaalm/ssodav/internal/cas"
+	"git.napaalm.xyz/napaalm/ssodav/internal/config"
+	"git.napaalm.xyz/napaalm/ssodav/internal/crossdomain"
+	"git.napaalm.xyz/napaalm/ssodav/internal/device"
+	"git.napaalm.xyz/napaalm/ssodav/internal/emaillogin"
+	"git.napaalm.xyz/napaalm/ssodav/internal/mfa"
+	"git.napaalm.xyz/napaalm/ssodav/internal/proxy"
+	"git.napaalm.xyz/napaalm/ssodav/internal/saml"
+	"git.napaalm.xyz/napaalm/ssodav/internal/session"
+	"git.napaalm.xyz/napaalm/ssodav/internal/url"
+	"git.napaalm.xyz/napaalm/ssodav/pkg/dpop"
+	"git.napaalm.xyz/napaalm/ssodav/pkg/jwk"
+	"git.napaalm.xyz/napaalm/ssodav/pkg/pkce"
+)
+
+var (
+	professor = auth.UserInfo{Username: "professor", FullName: "Hubert J. Farnsworth", Group: "Office Management"}
+	hermes    = auth.UserInfo{Username: "hermes", FullName: "Hermes Conrad", Group: "Bureaucrats"}
+)
+
+func TestMain(m *testing.M) {
+	if err := config.LoadConfig("config_test.toml"); err != nil {
+		panic(err)
+	}
+
+	// The login page lives in a separate repository
+	loginTemplates = template.Must(template.New("index.html").Parse(`{{.ErrorMessage}}<input name="csrf_token" value="{{.CSRFToken}}">`))
+	pageTemplates = template.Must(template.ParseGlob("../../" + pagesDir + "/*.html"))
+
+	for _, initialize := range []func() error{
+		auth.InitializeSigning,
+		session.Initialize,
+		InitializeTrustedProxies,
+		InitializeDPoP,
+		InitializeCookies,
+		InitializeCSRF,
+	} {
+		if err := initialize(); err != nil {
+			panic(err)
+		}
+	}
+	InitializeLimiters()
+	mfa.Initialize()
+	crossdomain.Initialize()
+
+	// Keep the audit records out of the test output
+	log.SetOutput(ioutil.Discard)
+
+	os.Exit(m.Run())
+}
+
+// Rilascia un token per il servizio SSO, vincolato alla chiave indicata se non è nil
+func issue(t *testing.T, userInfo auth.UserInfo, key *ecdsa.PrivateKey) string {
+	var opts []auth.TokenOption
+	if key != nil {
+		opts = append(opts, auth.WithConfirmation(thumbprint(t, key)))
+	}
+
+	token, err := auth.IssueToken(userInfo, url.BaseURL(), time.Hour, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(token)
+}
+
+func newKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+func thumbprint(t *testing.T, key *ecdsa.PrivateKey) string {
+	k, err := jwk.New(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jkt, err := k.Thumbprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return jkt
+}
+
+// Invia una richiesta al token endpoint, con una prova DPoP se key non è nil
+func tokenRequest(t *testing.T, form neturl.Values, key *ecdsa.PrivateKey) (int, map[string]interface{}) {
+	r := httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.SetBasicAuth("moodle", "GoodNewsEveryone")
+
+	if key != nil {
+		proof, err := dpop.NewProof(key, "POST", url.BaseURL()+"/token", nil, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set(dpop.Header, proof)
+	}
+
+	w := httptest.NewRecorder()
+	HandleToken(w, r)
+
+	var body map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &body)
+
+	return w.Code, body
+}
+
+func TestTokenExchange(t *testing.T) {
+	exchange := func(subject, actor string) neturl.Values {
+		form := neturl.Values{
+			"grant_type":         {tokenExchangeGrantType},
+			"audience":           {"moodle"},
+			"subject_token":      {subject},
+			"subject_token_type": {accessTokenType},
+		}
+
+		if actor != "" {
+			form.Set("actor_token", actor)
+			form.Set("actor_token_type", accessTokenType)
+		}
+
+		return form
+	}
+
+	if status, body := tokenRequest(t, exchange(issue(t, professor, nil), issue(t, hermes, nil)), nil); status != http.StatusOK {
+		t.Fatalf("exchange refused: %d %v", status, body)
+	} else {
+		userInfo, err := auth.ParseToken([]byte(body["access_token"].(string)), "moodle")
+		if err != nil || userInfo.Username != professor.Username || userInfo.Actor != hermes.Username {
+			t.Errorf("unexpected token %+v %v", userInfo, err)
+		}
+	}
+
+	// Only the client itself is an allowed audience by default
+	form := exchange(issue(t, professor, nil), "")
+	form.Set("audience", "https://app.example.org")
+	if status, body := tokenRequest(t, form, nil); status != http.StatusBadRequest || body["error"] != "invalid_target" {
+		t.Errorf("unexpected response to a foreign audience: %d %v", status, body)
+	}
+
+	// Bound tokens require a proof of the same key, whether they identify the subject or the actor
+	key, other := newKey(t), newKey(t)
+
+	cases := []struct {
+		name           string
+		subject, actor string
+		proof          *ecdsa.PrivateKey
+		allowed        bool
+	}{
+		{"bound subject without proof", issue(t, professor, key), "", nil, false},
+		{"bound subject with another key", issue(t, professor, key), "", other, false},
+		{"bound subject", issue(t, professor, key), "", key, true},
+		{"bound actor without proof", issue(t, professor, nil), issue(t, hermes, key), nil, false},
+		{"bound actor with another key", issue(t, professor, nil), issue(t, hermes, key), other, false},
+		{"bound actor", issue(t, professor, nil), issue(t, hermes, key), key, true},
+	}
+
+	for _, c := range cases {
+		status, body := tokenRequest(t, exchange(c.subject, c.actor), c.proof)
+
+		if c.allowed && status != http.StatusOK {
+			t.Errorf("%s: exchange refused: %d %v", c.name, status, body)
+		} else if !c.allowed && (status != http.StatusBadRequest || body["error"] != "invalid_grant") {
+			t.Errorf("%s: unexpected response %d %v", c.name, status, body)
+		}
+	}
+
+	// The client must authenticate
+	r := httptest.NewRequest("POST", "/token", strings.NewReader(exchange(issue(t, professor, nil), "").Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.SetBasicAuth("moodle", "wrong")
+
+	w := httptest.NewRecorder()
+	HandleToken(w, r)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("unauthenticated client got %d", w.Code)
+	}
+}
+
+// Invia il form della pagina di accesso con il token e gli header indicati
+func postLogin(token string, cookies []*http.Cookie, header http.Header) *httptest.ResponseRecorder {
+	form := neturl.Values{"username": {"professor"}, "password": {"professor"}}
+	if token != "" {
+		form.Set(csrfField, token)
+	}
+
+	r := httptest.NewRequest("POST", url.BaseURL()+"/", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	for name, values := range header {
+		r.Header[name] = values
+	}
+
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+
+	w := httptest.NewRecorder()
+	HandleBrowserLogin(w, r)
+
+	return w
+}
+
+func TestLoginCSRF(t *testing.T) {
+	config.Config.General.DummyAuth = true
+	defer func() {
+		config.Config.General.DummyAuth = false
+		config.Config.General.LegacyLoginTemplate = false
+		InitializeCSRF()
+	}()
+
+	// Unless the template is declared legacy, the form must send the token along with the cookie
+	if !loginCSRF {
+		t.Fatal("login token not required by default")
+	}
+
+	w := httptest.NewRecorder()
+	HandleBrowserLogin(w, httptest.NewRequest("GET", url.BaseURL()+"/", nil))
+
+	cookies := w.Result().Cookies()
+	token := csrfToken(httptest.NewRecorder(), requestWithCookies(cookies))
+
+	if !strings.Contains(w.Body.String(), token) {
+		t.Fatal("the login page doesn't include the token")
+	}
+
+	origin := http.Header{"Origin": {url.BaseURL()}}
+
+	if w := postLogin("", cookies, origin); w.Code != http.StatusForbidden {
+		t.Errorf("form without token: %d", w.Code)
+	}
+
+	if w := postLogin(token, nil, origin); w.Code != http.StatusForbidden {
+		t.Errorf("form without cookie: %d", w.Code)
+	}
+
+	if w := postLogin(token, cookies, nil); w.Code != http.StatusSeeOther && w.Code != http.StatusFound {
+		t.Errorf("valid form refused: %d %s", w.Code, w.Body.String())
+	}
+
+	// Older templates can't send the token: the form must come from the SSO service
+	config.Config.General.LegacyLoginTemplate = true
+	if err := InitializeCSRF(); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]struct {
+		header  http.Header
+		allowed bool
+	}{
+		"no header":           {nil, false},
+		"foreign origin":      {http.Header{"Origin": {"https://evil.example.com"}}, false},
+		"opaque origin":       {http.Header{"Origin": {"null"}}, false},
+		"subdomain referer":   {http.Header{"Referer": {"https://app.example.org/"}}, false},
+		"same origin":         {http.Header{"Origin": {url.BaseURL()}}, true},
+		"same-origin referer": {http.Header{"Referer": {url.BaseURL() + "/?next=https://app.example.org/"}}, true},
+	}
+
+	for name, c := range cases {
+		w := postLogin("", nil, c.header)
+
+		if c.allowed && w.Code == http.StatusForbidden {
+			t.Errorf("%s: login refused", name)
+		} else if !c.allowed && w.Code != http.StatusForbidden {
+			t.Errorf("%s: login allowed with status %d", name, w.Code)
+		}
+	}
+}
+
+func TestLogoutCSRF(t *testing.T) {
+	secret, _, _, err := session.Create(professor, "127.0.0.1", "curl", []string{"pwd"}, time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	current := &http.Cookie{Name: cookies.Name(sessionCookie), Value: secret}
+
+	logout := func(method string, form neturl.Values, sent ...*http.Cookie) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, url.BaseURL()+"/logout", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		for _, c := range sent {
+			r.AddCookie(c)
+		}
+
+		w := httptest.NewRecorder()
+		HandleLogout(w, r)
+
+		return w
+	}
+
+	// A link or a form from another site only shows the confirmation page
+	w := logout("GET", nil, current)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected response %d to a plain link", w.Code)
+	}
+
+	csrf := w.Result().Cookies()
+	token := csrfToken(httptest.NewRecorder(), requestWithCookies(csrf))
+
+	if w := logout("POST", neturl.Values{csrfField: {"forged"}}, append(csrf, current)...); w.Code != http.StatusForbidden {
+		t.Errorf("unexpected response %d to a forged form", w.Code)
+	}
+
+	if _, err := session.Get(secret); err != nil {
+		t.Fatal("session ended without confirmation")
+	}
+
+	// The confirmation form ends the session
+	if w := logout("POST", neturl.Values{csrfField: {token}}, append(csrf, current)...); w.Code != http.StatusSeeOther {
+		t.Errorf("unexpected response %d to the confirmation", w.Code)
+	}
+
+	if _, err := session.Get(secret); err == nil {
+		t.Error("session not ended")
+	}
+}
+
+func TestHostOnlyCookies(t *testing.T) {
+	w := httptest.NewRecorder()
+	csrfToken(w, httptest.NewRequest("GET", url.BaseURL()+"/", nil))
+
+	// The CSRF secret must not reach, nor be overwritten by, the services of the subdomains
+	c := w.Result().Cookies()
+	if len(c) != 1 || c[0].Name != "__Host-"+csrfCookie || c[0].Domain != "" || c[0].Path != "/" {
+		t.Errorf("unexpected CSRF cookie %v", c)
+	}
+
+	w = httptest.NewRecorder()
+	cookies.Set(w, httptest.NewRequest("GET", url.BaseURL()+"/", nil), sessionCookie, "secret", time.Time{})
+
+	if c := w.Result().Cookies(); len(c) != 1 || c[0].Domain != "example.org" {
+		t.Errorf("unexpected session cookie %v", c)
+	}
+}
+
+func requestWithCookies(cookies []*http.Cookie) *http.Request {
+	r := httptest.NewRequest("GET", url.BaseURL()+"/", nil)
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+
+	return r
+}
+
+func TestProxyCookies(t *testing.T) {
+	var received *http.Request
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+	}))
+	defer upstream.Close()
+
+	f, err := ioutil.TempFile("", "ssodav-handlers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	f.WriteString("[[Proxy]]\nhost=\"wiki.example.org\"\ndestinazione=\"" + upstream.URL + "\"\n")
+	f.Close()
+
+	if err := config.LoadConfig(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+	if err := proxy.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		config.Config.Proxy = nil
+		proxy.Initialize()
+	}()
+
+	secret, _, _, err := session.Create(professor, "127.0.0.1", "curl", []string{"pwd"}, time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("GET", "https://wiki.example.org/page", nil)
+	r.AddCookie(&http.Cookie{Name: cookies.Name(sessionCookie), Value: secret})
+	r.Header.Set("X-Auth-User", "hermes")
+	r.Header.Set("X-Forwarded-Proto", "http")
+	r.Header.Set("X-Forwarded-Host", "evil.example.com")
+	r.Header.Set("X-Forwarded-For", "10.1.2.3")
+
+	// Every cookie of the SSO service stays with it, the service's own are forwarded
+	for _, name := range []string{csrfCookie, mfaCookie, emailCookie + ".0", emailCookie + ".1", deviceCookie} {
+		r.AddCookie(&http.Cookie{Name: hostCookies.Name(name), Value: "x"})
+	}
+	r.AddCookie(&http.Cookie{Name: cookies.Name("wiki_session"), Value: "x"})
+
+	w := httptest.NewRecorder()
+	ProxyOr(http.NotFoundHandler()).ServeHTTP(w, r)
+
+	if received == nil {
+		t.Fatalf("request not forwarded: %d", w.Code)
+	}
+
+	if user := received.Header.Get("X-Auth-User"); user != professor.Username {
+		t.Errorf("unexpected identity %q", user)
+	}
+
+	// The forwarding headers of a client that isn't a trusted proxy are replaced
+	h := received.Header
+	if h.Get("X-Forwarded-Proto") != "https" || h.Get("X-Forwarded-Host") != "wiki.example.org" || h.Get("X-Forwarded-For") != "192.0.2.1" {
+		t.Errorf("unexpected forwarding headers %v", h)
+	}
+
+	var forwarded []string
+	for _, c := range received.Cookies() {
+		forwarded = append(forwarded, c.Name)
+	}
+
+	if len(forwarded) != 1 || forwarded[0] != "wiki_session" {
+		t.Errorf("unexpected cookies forwarded: %v", forwarded)
+	}
+}
+
+func TestDeviceAuthorizationRateLimit(t *testing.T) {
+	device.Initialize()
+
+	status := func() (int, string) {
+		r := httptest.NewRequest("POST", url.BaseURL()+"/device_authorization", strings.NewReader("client_id=tv"))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		HandleDeviceAuthorization(w, r)
+
+		var body map[string]string
+		json.Unmarshal(w.Body.Bytes(), &body)
+		return w.Code, body["error"]
+	}
+
+	// Use up the burst allowed to the address
+	for i := 0; i < 100; i++ {
+		if code, _ := status(); code != http.StatusOK {
+			break
+		}
+	}
+
+	// slow_down is reserved to the polling of the token endpoint
+	if code, errorCode := status(); code != http.StatusTooManyRequests || errorCode != "invalid_request" {
+		t.Errorf("unexpected response %d %s", code, errorCode)
+	}
+}
+
+func TestGetIP(t *testing.T) {
+	cases := []struct {
+		remote, forwarded, expected string
+	}{
+		// The header is ignored from anyone but a trusted proxy
+		{"203.0.113.7:4321", "198.51.100.1", "203.0.113.7"},
+		{"10.0.0.1:4321", "", "10.0.0.1"},
+		{"10.0.0.1:4321", "198.51.100.1", "198.51.100.1"},
+		// Addresses prepended by the client are skipped
+		{"10.0.0.1:4321", "192.0.2.66, 198.51.100.1", "198.51.100.1"},
+		// Chained trusted proxies are walked from the right
+		{"10.0.0.1:4321", "192.0.2.66, 198.51.100.1, 10.0.0.2", "198.51.100.1"},
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", url.BaseURL()+"/", nil)
+		r.RemoteAddr = c.remote
+		if c.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", c.forwarded)
+		}
+
+		if ip := GetIP(r); ip != c.expected {
+			t.Errorf("%s via %s: expected %s, got %s", c.forwarded, c.remote, c.expected, ip)
+		}
+	}
+}
+
+func TestStepUp(t *testing.T) {
+	next := "https://moodle.example.org/"
+
+	login := func(userInfo auth.UserInfo, methods []string, query string) *httptest.ResponseRecorder {
+		secret, _, _, err := session.Create(userInfo, "127.0.0.1", "curl", methods, time.Hour, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r := httptest.NewRequest("GET", url.BaseURL()+"/login?next="+neturl.QueryEscape(next)+query, nil)
+		r.AddCookie(&http.Cookie{Name: cookies.Name(sessionCookie), Value: secret})
+
+		w := httptest.NewRecorder()
+		HandleLogin(w, r)
+		return w
+	}
+
+	impersonated := professor
+	impersonated.Actor = "hermes"
+
+	multiFactor := "&acr_values=" + neturl.QueryEscape(auth.ACRMultiFactor)
+
+	cases := []struct {
+		name     string
+		userInfo auth.UserInfo
+		methods  []string
+		query    string
+		status   int
+		message  string
+	}{
+		{"no requirements", professor, []string{"pwd"}, "", http.StatusSeeOther, ""},
+		{"recent enough", professor, []string{"pwd"}, "&max_age=3600", http.StatusSeeOther, ""},
+		{"too old", professor, []string{"pwd"}, "&max_age=0", http.StatusOK, errStepUp.Error()},
+		{"impersonated", impersonated, []string{"pwd"}, "&max_age=3600" + multiFactor, http.StatusOK, errStepUp.Error()},
+		{"second factor used", professor, []string{"pwd", "otp"}, multiFactor, http.StatusSeeOther, ""},
+		// Without TOTP the user has no way to reach the required level
+		{"second factor unavailable", professor, []string{"pwd"}, multiFactor, http.StatusForbidden, errStepUpNoMFA.Error()},
+	}
+
+	for _, c := range cases {
+		w := login(c.userInfo, c.methods, c.query)
+
+		if w.Code != c.status || !strings.Contains(w.Body.String(), template.HTMLEscapeString(c.message)) {
+			t.Errorf("%s: unexpected response %d %q", c.name, w.Code, w.Body.String())
+		}
+
+		if c.status == http.StatusSeeOther && w.Header().Get("Location") != next {
+			t.Errorf("%s: redirected to %q", c.name, w.Header().Get("Location"))
+		}
+	}
+}
+
+// Invia una richiesta di verifica come farebbe un reverse proxy per l'URL indicato
+func forwardAuth(original string, header http.Header, query string) *httptest.ResponseRecorder {
+	u, _ := neturl.Parse(original)
+
+	r := httptest.NewRequest("GET", url.BaseURL()+"/auth/verify"+query, nil)
+	r.Header.Set("X-Forwarded-Proto", u.Scheme)
+	r.Header.Set("X-Forwarded-Host", u.Host)
+	r.Header.Set("X-Forwarded-Uri", u.RequestURI())
+
+	for name, values := range header {
+		for _, value := range values {
+			r.Header.Add(name, value)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	HandleForwardAuth(w, r)
+
+	return w
+}
+
+func TestForwardAuth(t *testing.T) {
+	original := "https://app.example.org/grades?class=3B"
+
+	secret, _, _, err := session.Create(professor, "127.0.0.1", "curl", []string{"pwd"}, time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Authenticated users are let through with their identity
+	r := httptest.NewRequest("GET", url.BaseURL()+"/auth/verify", nil)
+	r.Header.Set("X-Forwarded-Host", "app.example.org")
+	r.Header.Set("X-Forwarded-Uri", "/grades")
+	r.AddCookie(&http.Cookie{Name: cookies.Name(sessionCookie), Value: secret})
+
+	w := httptest.NewRecorder()
+	HandleForwardAuth(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("authenticated request refused: %d", w.Code)
+	}
+
+	h := w.Header()
+	if h.Get(headerAuthUser) != professor.Username || h.Get(headerAuthName) != professor.FullName || h.Get(headerAuthGroups) != professor.Group {
+		t.Errorf("unexpected identity headers %v", h)
+	}
+
+	// Anonymous users are sent to the login page, unless the proxy can't forward redirects
+	location := loginURL(original)
+
+	if w := forwardAuth(original, nil, ""); w.Code != http.StatusFound || w.Header().Get("Location") != location {
+		t.Errorf("unexpected response %d to Traefik: %s", w.Code, w.Header().Get("Location"))
+	}
+
+	if w := forwardAuth(original, nil, "?redirect=false"); w.Code != http.StatusUnauthorized || w.Header().Get("Location") != location {
+		t.Errorf("unexpected response %d with redirect=false", w.Code)
+	}
+
+	nginx := http.Header{"X-Original-URL": {original}}
+	if w := forwardAuth("https://example.org/", nginx, ""); w.Code != http.StatusUnauthorized || w.Header().Get("Location") != location {
+		t.Errorf("unexpected response %d to nginx: %s", w.Code, w.Header().Get("Location"))
+	}
+
+	// Bearer tokens are accepted only by the service they were issued for
+	token, err := auth.IssueToken(professor, "https://app.example.org", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bearer := http.Header{"Authorization": {"Bearer " + string(token)}}
+
+	if w := forwardAuth(original, bearer, ""); w.Code != http.StatusOK || w.Header().Get(headerAuthUser) != professor.Username {
+		t.Errorf("token for the service refused: %d", w.Code)
+	}
+
+	if w := forwardAuth("https://example.org/", bearer, "?redirect=false"); w.Code != http.StatusUnauthorized {
+		t.Errorf("token for another service accepted: %d", w.Code)
+	}
+
+	// DPoP proofs must match the method of the original request
+	key := newKey(t)
+
+	token, err = auth.IssueToken(professor, "https://app.example.org", time.Hour, auth.WithConfirmation(thumbprint(t, key)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bound := func(method string) http.Header {
+		proof, err := dpop.NewProof(key, method, original, token, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return http.Header{
+			"Authorization":      {dpop.Scheme + " " + string(token)},
+			dpop.Header:          {proof},
+			"X-Forwarded-Method": {"POST"},
+		}
+	}
+
+	if w := forwardAuth(original, bound("POST"), ""); w.Code != http.StatusOK {
+		t.Errorf("proof for the original method refused: %d", w.Code)
+	}
+
+	if w := forwardAuth(original, bound("GET"), "?redirect=false"); w.Code != http.StatusUnauthorized {
+		t.Errorf("proof for the method of the verification request accepted: %d", w.Code)
+	}
+}
+
+func TestSecondFactorState(t *testing.T) {
+	next := "https://app.example.org/sso/callback?next=%2Fgrades"
+	verifier, _ := pkce.NewVerifier()
+	challenge := pkce.Challenge(verifier)
+
+	// The state and the PKCE challenge sent by the service survive the second step of the login
+	w := httptest.NewRecorder()
+	beginSecondFactor(w, httptest.NewRequest("POST", url.BaseURL()+"/?"+nextQuery(next, "xyz", challenge), nil), mfa.Login{
+		UserInfo:  professor,
+		Methods:   []string{"pwd"},
+		Next:      next,
+		State:     "xyz",
+		Challenge: challenge,
+	}, "/totp")
+
+	id, login, err := pendingLogin(requestWithCookies(w.Result().Cookies()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	finishLogin(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil), id)
+
+	w = httptest.NewRecorder()
+	completeLogin(w, httptest.NewRequest("POST", url.BaseURL()+"/totp", nil), login)
+
+	location, err := neturl.Parse(w.Header().Get("Location"))
+	if err != nil || w.Code != http.StatusSeeOther {
+		t.Fatalf("unexpected response %d", w.Code)
+	}
+
+	query := location.Query()
+	if query.Get("state") != "xyz" || query.Get("code") == "" {
+		t.Fatalf("state or code missing from %q", location)
+	}
+
+	// The code is bound to the challenge
+	if _, _, err := crossdomain.Redeem(query.Get("code"), "https://app.example.org", verifier); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRedirectAfterLogin(t *testing.T) {
+	_, s, _, err := session.Create(professor, "127.0.0.1", "curl", []string{"pwd"}, time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	challenge := pkce.Challenge("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk")
+
+	cases := []struct {
+		next      string
+		challenge string
+		code      bool
+	}{
+		{"https://app.example.org/sso/callback?next=%2Fgrades", challenge, true},
+		// Codes are issued only to the registered receivers
+		{"https://app.example.org/grades", challenge, false},
+		{"https://example.org/sso/callback", challenge, false},
+		// and only bound to a challenge
+		{"https://app.example.org/sso/callback", "", false},
+	}
+
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		redirectAfterLogin(w, httptest.NewRequest("GET", url.BaseURL()+"/", nil), c.next, "xyz", c.challenge, s)
+
+		location, _ := neturl.Parse(w.Header().Get("Location"))
+		if (location.Query().Get("code") != "") != c.code {
+			t.Errorf("%s: unexpected redirect to %q", c.next, location)
+		}
+	}
+}
+
+func TestEmailLoginStepUp(t *testing.T) {
+	next := "https://app.example.org/"
+
+	// A code sent by email is a single factor
+	w := httptest.NewRecorder()
+	completeEmailLogin(w, httptest.NewRequest("POST", url.BaseURL()+"/email/login", nil), emaillogin.Login{
+		UserInfo: professor,
+		Next:     next,
+		ACR:      auth.ACRMultiFactor,
+	})
+
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), template.HTMLEscapeString(errStepUpNoMFA.Error())) {
+		t.Errorf("multi-factor requirement ignored: %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	completeEmailLogin(w, httptest.NewRequest("POST", url.BaseURL()+"/email/login", nil), emaillogin.Login{UserInfo: professor, Next: next})
+
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != next {
+		t.Fatalf("unexpected response %d", w.Code)
+	}
+
+	s, err := currentSession(requestWithCookies(w.Result().Cookies()))
+	if err != nil || len(s.Methods) != 1 || s.Methods[0] != auth.MethodEmail || auth.ACR(s.Methods) != auth.ACRSingleFactor {
+		t.Errorf("unexpected session %+v %v", s, err)
+	}
+}
+
+// Configura l'identity provider SAML con un service provider di test
+func setupSAML(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssodav-saml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), NotBefore: time.Now(), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string][]byte{
+		"key.pem":  pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}),
+		"cert.pem": pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		"sp.xml": []byte(`<EntityDescriptor xmlns="urn:oasis:names:tc:SAML:2.0:metadata" entityID="https://elearning.example.org/sp"><SPSSODescriptor>` +
+			`<AssertionConsumerService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST" Location="https://elearning.example.org/acs" index="0"/>` +
+			`</SPSSODescriptor></EntityDescriptor>`),
+	}
+
+	for name, b := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), b, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	config.Config.SAML.PrivateKey = filepath.Join(dir, "key.pem")
+	config.Config.SAML.Certificate = filepath.Join(dir, "cert.pem")
+	config.Config.SAML.SPMetadata = []string{filepath.Join(dir, "sp.xml")}
+
+	if err := saml.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSAMLIdPInitiated(t *testing.T) {
+	setupSAML(t)
+
+	secret, _, _, err := session.Create(professor, "127.0.0.1", "curl", []string{"pwd"}, time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	current := &http.Cookie{Name: cookies.Name(sessionCookie), Value: secret}
+
+	idp := func(method string, form neturl.Values, sent ...*http.Cookie) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, url.BaseURL()+"/saml/idp", strings.NewReader(form.Encode()))
+		if method == "GET" {
+			r.URL.RawQuery = form.Encode()
+		}
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		for _, c := range sent {
+			r.AddCookie(c)
+		}
+
+		w := httptest.NewRecorder()
+		HandleSAMLIdPInitiated(w, r)
+
+		return w
+	}
+
+	form := neturl.Values{"sp": {"https://elearning.example.org/sp"}, "RelayState": {"https://app.example.org/course"}}
+
+	// A link only shows the confirmation page
+	w := idp("GET", form, current)
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "SAMLResponse") {
+		t.Fatalf("assertion sent without confirmation: %d", w.Code)
+	}
+
+	csrf := w.Result().Cookies()
+	form.Set(csrfField, csrfToken(httptest.NewRecorder(), requestWithCookies(csrf)))
+
+	if w := idp("POST", neturl.Values{"sp": form["sp"]}, current); w.Code != http.StatusForbidden || strings.Contains(w.Body.String(), "SAMLResponse") {
+		t.Errorf("assertion sent without the CSRF token: %d", w.Code)
+	}
+
+	if w := idp("POST", form, append(csrf, current)...); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "SAMLResponse") {
+		t.Errorf("assertion not sent after the confirmation: %d", w.Code)
+	}
+
+	// RelayState can only point to the authorized sites
+	form.Set("RelayState", "https://evil.example.com/")
+	if w := idp("POST", form, append(csrf, current)...); w.Code != http.StatusBadRequest {
+		t.Errorf("foreign RelayState accepted: %d", w.Code)
+	}
+}
+
+func TestCASRenew(t *testing.T) {
+	config.Config.CAS.Services = []string{"https://moodle.example.org/"}
+	defer func() { config.Config.CAS.Services = nil }()
+	cas.Initialize()
+
+	service := "https://moodle.example.org/login"
+
+	secret, s, _, err := session.Create(professor, "127.0.0.1", "curl", []string{"pwd"}, time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	casLogin := func(target string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", target, nil)
+		r.AddCookie(&http.Cookie{Name: cookies.Name(sessionCookie), Value: secret})
+
+		w := httptest.NewRecorder()
+		HandleCASLogin(w, r)
+		return w
+	}
+
+	validate := func(location string, renew bool) string {
+		u, _ := neturl.Parse(location)
+		query := "?service=" + neturl.QueryEscape(service) + "&ticket=" + neturl.QueryEscape(u.Query().Get("ticket"))
+		if renew {
+			query += "&renew=true"
+		}
+
+		w := httptest.NewRecorder()
+		HandleCASServiceValidate(w, httptest.NewRequest("GET", url.BaseURL()+"/cas/serviceValidate"+query, nil))
+		return w.Body.String()
+	}
+
+	// A ticket from the existing session doesn't satisfy renew
+	w := casLogin(url.BaseURL() + "/cas/login?service=" + neturl.QueryEscape(service))
+	if body := validate(w.Header().Get("Location"), true); !strings.Contains(body, `code="INVALID_TICKET"`) {
+		t.Errorf("ticket from the session accepted with renew: %s", body)
+	}
+
+	// With renew the existing session leads to the login page
+	w = casLogin(url.BaseURL() + "/cas/login?renew=true&service=" + neturl.QueryEscape(service))
+	login, err := neturl.Parse(w.Header().Get("Location"))
+	if err != nil || w.Code != http.StatusSeeOther || login.Query().Get("max_age") != "0" {
+		t.Fatalf("unexpected response %d to %q", w.Code, w.Header().Get("Location"))
+	}
+
+	next := login.Query().Get("next")
+
+	// Coming back without authenticating again isn't enough
+	if w := casLogin(next); strings.Contains(w.Header().Get("Location"), "ticket=") {
+		t.Errorf("ticket issued without a new authentication: %q", w.Header().Get("Location"))
+	}
+
+	// After a new authentication the login ticket is redeemed
+	w = casLogin(url.BaseURL() + "/cas/login?renew=true&service=" + neturl.QueryEscape(service))
+	login, _ = neturl.Parse(w.Header().Get("Location"))
+
+	if _, err := session.Reauthenticate(s.ID, []string{"pwd"}); err != nil {
+		t.Fatal(err)
+	}
+
+	w = casLogin(login.Query().Get("next"))
+	if body := validate(w.Header().Get("Location"), true); !strings.Contains(body, "<cas:user>professor</cas:user>") {
+		t.Errorf("renewed ticket rejected: %s", body)
+	}
+}
+
+func TestCrossDomainPKCE(t *testing.T) {
+	const receiver = "https://app.example.org/sso/callback"
+
+	secret, _, _, err := session.Create(professor, "127.0.0.1", "curl", []string{"pwd"}, time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verifier, _ := pkce.NewVerifier()
+
+	authorize := func(query string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", url.BaseURL()+"/crossdomain?redirect_uri="+neturl.QueryEscape(receiver)+query, nil)
+		r.AddCookie(&http.Cookie{Name: cookies.Name(sessionCookie), Value: secret})
+
+		w := httptest.NewRecorder()
+		HandleCrossDomain(w, r)
+		return w
+	}
+
+	redeem := func(w *httptest.ResponseRecorder, verifier string) int {
+		location, _ := neturl.Parse(w.Header().Get("Location"))
+
+		form := neturl.Values{"code": {location.Query().Get("code")}, "redirect_uri": {receiver}, "code_verifier": {verifier}}
+		r := httptest.NewRequest("POST", url.BaseURL()+"/crossdomain/token", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		rec := httptest.NewRecorder()
+		HandleCrossDomainToken(rec, r)
+		return rec.Code
+	}
+
+	// Codes are issued only for a S256 challenge
+	for _, query := range []string{"", "&code_challenge=" + verifier + "&code_challenge_method=plain"} {
+		if w := authorize(query); w.Code != http.StatusBadRequest {
+			t.Errorf("%q: expected 400, got %d", query, w.Code)
+		}
+	}
+
+	pkceQuery := "&code_challenge=" + pkce.Challenge(verifier) + "&code_challenge_method=" + pkce.Method
+
+	// An intercepted code can't be redeemed without the verifier
+	if code := redeem(authorize(pkceQuery), ""); code != http.StatusBadRequest {
+		t.Errorf("code redeemed without the verifier: %d", code)
+	}
+
+	if code := redeem(authorize(pkceQuery), verifier); code != http.StatusOK {
+		t.Errorf("code not redeemed with the verifier: %d", code)
+	}
+}
@@ -0,0 +1,189 @@
+/*
+ * impersonate.go
+ *
+ * Impersonificazione degli utenti da parte degli amministratori.
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"git.napaalm.xyz/napaalm/ssodav/internal/audit"
+	"git.napaalm.xyz/napaalm/ssodav/internal/auth"
+	"git.napaalm.xyz/napaalm/ssodav/internal/config"
+	"git.napaalm.xyz/napaalm/ssodav/internal/session"
+	"git.napaalm.xyz/napaalm/ssodav/internal/url"
+)
+
+const defaultImpersonationExpiry = time.Hour
+
+var (
+	errImpersonationDisabled = errors.New("Impersonificazione non abilitata")
+	errNotAdministrator      = errors.New("Utente non autorizzato all'impersonificazione")
+	errProtectedUser         = errors.New("Impossibile impersonificare un amministratore")
+)
+
+// Controlla se l'utente è un amministratore
+func isAdministrator(userInfo auth.UserInfo) bool {
+	cfg := config.Config.Admins
+
+	for _, username := range cfg.Users {
+		if userInfo.Username == username {
+			return true
+		}
+	}
+
+	for _, group := range cfg.Groups {
+		if userInfo.Group == group {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Restituisce le informazioni sull'utente da impersonare per conto di un amministratore.
+// Gli amministratori non possono essere impersonificati, né si può impersonificare
+// mentre si agisce già per conto di un altro utente.
+func impersonate(admin auth.UserInfo, username string) (auth.UserInfo, error) {
+	if !config.Config.Impersonation.Enabled {
+		return auth.UserInfo{}, errImpersonationDisabled
+	}
+
+	if admin.Username == "" || admin.Actor != "" || !isAdministrator(admin) {
+		return auth.UserInfo{}, errNotAdministrator
+	}
+
+	userInfo, err := auth.LookupUser(username)
+	if err != nil {
+		return auth.UserInfo{}, err
+	}
+
+	if isAdministrator(userInfo) {
+		return auth.UserInfo{}, errProtectedUser
+	}
+
+	userInfo.Actor = admin.Username
+	return userInfo, nil
+}
+
+// Durata delle sessioni impersonificate
+func impersonationExpiry() time.Duration {
+	if exp := config.Config.Impersonation.Expiry.Duration; exp > 0 {
+		return exp
+	}
+
+	return defaultImpersonationExpiry
+}
+
+// Percorso: /impersonate
+// Pagina dove un amministratore sceglie l'utente da impersonificare. La sessione
+// dell'amministratore viene sostituita da una dell'utente, i cui token riportano
+// l'amministratore nella claim act; per terminarla basta uscire.
+func HandleImpersonation(w http.ResponseWriter, r *http.Request) {
+	type impersonationData struct {
+		pageInfo
+		Next   string
+		Expiry time.Duration
+	}
+
+	current, err := currentSession(r)
+	if err != nil {
+		http.Redirect(w, r, loginURL(url.BaseURL()+r.URL.RequestURI()), http.StatusSeeOther)
+		return
+	}
+
+	admin := current.UserInfo()
+
+	data := impersonationData{
+		pageInfo: newPageInfo(),
+		Next:     url.SanitizeURL(r.FormValue("next")),
+		Expiry:   impersonationExpiry(),
+	}
+	data.CSRFToken = csrfToken(w, r)
+
+	if admin.Actor != "" || !isAdministrator(admin) {
+		data.Error = true
+		data.ErrorMessage = errNotAdministrator.Error()
+		renderPage(w, http.StatusForbidden, "impersonate.html", data)
+		return
+	}
+
+	if r.Method != "POST" {
+		renderPage(w, http.StatusOK, "impersonate.html", data)
+		return
+	}
+
+	if !checkCSRF(r) {
+		data.Error = true
+		data.ErrorMessage = errCSRF.Error()
+		renderPage(w, http.StatusForbidden, "impersonate.html", data)
+		return
+	}
+
+	event := audit.Event{
+		Type:     audit.Impersonation,
+		Actor:    admin.Username,
+		Subject:  r.PostFormValue("username"),
+		Audience: url.BaseURL(),
+		IP:       GetIP(r),
+	}
+
+	userInfo, err := impersonate(admin, event.Subject)
+	if err != nil {
+		event.Outcome = "access_denied"
+		audit.Record(event)
+
+		data.Error = true
+		data.ErrorMessage = err.Error()
+		renderPage(w, http.StatusBadRequest, "impersonate.html", data)
+		return
+	}
+
+	// The session can't last longer than the administrator's
+	expTime := capExpiry(data.Expiry, admin.Expires)
+
+	// The administrator's session is replaced by the impersonated one
+	_, idle := session.Lifetime(false)
+
+	if _, err := startSession(w, r, userInfo, current.Methods, expTime, idle); err != nil {
+		event.Outcome = "server_error"
+		audit.Record(event)
+
+		http.Error(w, "Impossibile creare la sessione", http.StatusInternalServerError)
+		return
+	}
+	if session.Delete(current.ID) == nil {
+		notifyLogout(current)
+	}
+
+	event.Outcome = audit.Success
+	audit.Record(event)
+
+	if data.Next != "" {
+		http.Redirect(w, r, data.Next, http.StatusSeeOther)
+	} else {
+		http.Redirect(w, r, "http://"+config.Config.General.TLD, http.StatusSeeOther)
+	}
+}
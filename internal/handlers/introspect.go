@@ -0,0 +1,113 @@
+/*
+ * introspect.go
+ *
+ * Endpoint di introspezione dei token (RFC 7662).
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+package handlers
+
+import (
+	"crypto/subtle"
+	"net/http"
+	neturl "net/url"
+
+	"git.napaalm.xyz/napaalm/ssodav/internal/auth"
+	"git.napaalm.xyz/napaalm/ssodav/internal/config"
+	"git.napaalm.xyz/napaalm/ssodav/internal/session"
+)
+
+// Percorso: /introspect
+// Restituisce lo stato e le claim di un token (anche cifrato) a un client autenticato.
+// I token destinati ad altri servizi risultano non attivi, a meno che il client
+// non sia abilitato all'introspezione di qualunque token.
+func HandleIntrospection(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "")
+		return
+	}
+
+	clientID, ok := authenticateClient(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="ssodav"`)
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "")
+		return
+	}
+
+	token := r.PostFormValue("token")
+	if token == "" {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "token mancante")
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+
+	claims, err := auth.Introspect([]byte(token))
+
+	// Tokens obtained from a session are revoked with it
+	if sid, ok := claims["sid"].(string); ok && !session.Active(sid) {
+		err = errSessionEnded
+	}
+
+	// Don't reveal the claims of tokens meant for someone else
+	if client, _ := config.GetClient(clientID); err == nil && claims["aud"] != clientID && !client.Introspection {
+		err = auth.ErrInvalidAudience
+	}
+
+	if err != nil {
+		writeJSON(w, http.StatusOK, map[string]bool{"active": false})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, claims)
+}
+
+// Autentica un client confidenziale tramite HTTP Basic oppure con
+// client_id e client_secret nel corpo della richiesta (RFC 6749, sezione 2.3.1)
+func authenticateClient(r *http.Request) (string, bool) {
+	id, secret, ok := r.BasicAuth()
+
+	if ok {
+		// The credentials are form-urlencoded before being put in the header
+		var errID, errSecret error
+		id, errID = neturl.QueryUnescape(id)
+		secret, errSecret = neturl.QueryUnescape(secret)
+
+		if errID != nil || errSecret != nil {
+			return "", false
+		}
+	} else {
+		id = r.PostFormValue("client_id")
+		secret = r.PostFormValue("client_secret")
+	}
+
+	client, found := config.GetClient(id)
+	if !found || client.Secret == "" || subtle.ConstantTimeCompare([]byte(client.Secret), []byte(secret)) != 1 {
+		return "", false
+	}
+
+	return client.ID, true
+}
@@ -0,0 +1,195 @@
+/*
+ * knowndevices.go
+ *
+ * Riconoscimento dei dispositivi degli utenti e avvisi per quelli nuovi.
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"git.napaalm.xyz/napaalm/ssodav/internal/audit"
+	"git.napaalm.xyz/napaalm/ssodav/internal/auth"
+	"git.napaalm.xyz/napaalm/ssodav/internal/config"
+	"git.napaalm.xyz/napaalm/ssodav/internal/knowndevices"
+	"git.napaalm.xyz/napaalm/ssodav/internal/mail"
+	"git.napaalm.xyz/napaalm/ssodav/internal/url"
+)
+
+// Nome del cookie con l'identificatore firmato del dispositivo
+const deviceCookie = "sso_device"
+
+// Dispositivo come restituito dalle API
+type deviceInfo struct {
+	knowndevices.Device
+	Current bool `json:"current"`
+}
+
+// Registra il dispositivo da cui l'utente ha completato l'accesso, impostando
+// il cookie se il browser non ne ha uno valido, e avvisa l'utente se il
+// dispositivo è nuovo. Il primo dispositivo di un utente non viene segnalato.
+func trackDevice(w http.ResponseWriter, r *http.Request, userInfo auth.UserInfo) {
+	if !knowndevices.Enabled() {
+		return
+	}
+
+	cookie, _ := hostCookies.Get(r, deviceCookie)
+
+	id, ok := knowndevices.Identify(cookie)
+	if !ok {
+		var err error
+		if id, cookie, err = knowndevices.NewCookie(); err != nil {
+			log.Println("handlers: ", err.Error())
+			return
+		}
+	}
+
+	// Every login extends the cookie
+	hostCookies.Set(w, r, deviceCookie, cookie, time.Now().Add(knowndevices.Lifetime()))
+
+	known := len(knowndevices.List(userInfo.Username))
+
+	d, isNew, err := knowndevices.Seen(userInfo.Username, id, GetIP(r), r.UserAgent())
+	if err != nil || !isNew {
+		return
+	}
+
+	audit.Record(audit.Event{
+		Type:     audit.NewDevice,
+		Subject:  userInfo.Username,
+		Audience: url.BaseURL(),
+		IP:       d.IP,
+		Outcome:  audit.Success,
+	})
+
+	if known > 0 {
+		go notifyNewDevice(userInfo, d)
+	}
+}
+
+// Avvisa l'utente per email dell'accesso da un nuovo dispositivo
+func notifyNewDevice(userInfo auth.UserInfo, d knowndevices.Device) {
+	if !mail.Enabled() {
+		return
+	}
+
+	address := knowndevices.NotificationAddress(userInfo)
+	if address == "" {
+		return
+	}
+
+	title := config.Config.General.PageTitle
+
+	body := fmt.Sprintf("È stato effettuato un accesso a %s con l'account %s da un dispositivo che non avevi mai usato.\n\n", title, userInfo.Username)
+	body += fmt.Sprintf("Data: %s\nIndirizzo IP: %s\nBrowser: %s\n\n", d.FirstSeen.Format("02/01/2006 15:04"), d.IP, d.UserAgent)
+	body += "Se sei stato tu, puoi ignorare questa email. Altrimenti cambia subito la password e termina le sessioni aperte.\n"
+
+	if err := mail.Send(address, "Nuovo accesso a "+title, body); err != nil {
+		log.Println("handlers: ", err.Error())
+	}
+}
+
+// Percorsi: /devices e /devices/{id}
+// Elenca (GET) o dimentica (DELETE) i dispositivi dell'utente autenticato, che
+// al prossimo accesso da quei dispositivi riceverà un avviso. Gli amministratori
+// possono gestire i dispositivi degli altri utenti con ?user=.
+func HandleDevices(w http.ResponseWriter, r *http.Request) {
+	userInfo, err := requestUser(r, "")
+	if err != nil {
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_token", "")
+		return
+	}
+
+	// Impersonated sessions can't be used to manage the user's devices
+	if userInfo.Actor != "" {
+		writeOAuthError(w, http.StatusForbidden, "access_denied", "")
+		return
+	}
+
+	if !knowndevices.Enabled() {
+		http.NotFound(w, r)
+		return
+	}
+
+	username := userInfo.Username
+	if user := r.URL.Query().Get("user"); user != "" && user != username {
+		if !isAdministrator(userInfo) {
+			writeOAuthError(w, http.StatusForbidden, "access_denied", "")
+			return
+		}
+
+		username = user
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/devices"), "/")
+
+	event := audit.Event{
+		Type:    audit.DeviceRemoval,
+		Actor:   userInfo.Username,
+		Subject: username,
+		IP:      GetIP(r),
+		Outcome: audit.Success,
+	}
+
+	switch {
+	case r.Method == "GET" && id == "":
+		cookie, _ := hostCookies.Get(r, deviceCookie)
+		current, _ := knowndevices.Identify(cookie)
+
+		list := []deviceInfo{}
+		for _, d := range knowndevices.List(username) {
+			list = append(list, deviceInfo{Device: d, Current: d.ID == current && username == userInfo.Username})
+		}
+
+		w.Header().Set("Cache-Control", "no-store")
+		writeJSON(w, http.StatusOK, map[string]interface{}{"devices": list})
+
+	case r.Method == "DELETE" && id == "":
+		n, err := knowndevices.ForgetAll(username)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		audit.Record(event)
+		writeJSON(w, http.StatusOK, map[string]interface{}{"forgotten": n})
+
+	case r.Method == "DELETE":
+		switch err := knowndevices.Forget(username, id); err {
+		case nil:
+			audit.Record(event)
+			w.WriteHeader(http.StatusNoContent)
+		case knowndevices.ErrNotFound:
+			http.NotFound(w, r)
+		default:
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		}
+
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
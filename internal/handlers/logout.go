@@ -0,0 +1,171 @@
+/*
+ * logout.go
+ *
+ * Disconnessione unica da tutte le applicazioni registrate.
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+package handlers
+
+import (
+	"log"
+	"net/http"
+
+	"git.napaalm.xyz/napaalm/ssodav/internal/auth"
+	"git.napaalm.xyz/napaalm/ssodav/internal/logout"
+	"git.napaalm.xyz/napaalm/ssodav/internal/session"
+)
+
+// Termina la sessione corrente dopo la conferma dell'utente, data con il form della
+// pagina di conferma, oppure subito se la richiesta presenta in id_token_hint un
+// token della sessione stessa (il servizio che l'ha ricevuto chiede la disconnessione).
+// Un link o un'immagine in un altro sito non bastano quindi a disconnettere l'utente.
+func confirmLogout(w http.ResponseWriter, r *http.Request, next string) {
+	type confirmData struct {
+		pageInfo
+		Username string
+		Action   string
+		Next     string
+	}
+
+	s, err := currentSession(r)
+	if err != nil {
+		// Nothing to end, but stale cookies are still removed
+		singleLogout(w, r, next)
+		return
+	}
+
+	if (r.Method == "POST" && checkCSRF(r)) || (r.Method != "POST" && logoutHint(r, s)) {
+		singleLogout(w, r, next)
+		return
+	}
+
+	data := confirmData{
+		pageInfo: newPageInfo(),
+		Username: s.Username,
+		Action:   r.URL.RequestURI(),
+		Next:     next,
+	}
+	data.CSRFToken = csrfToken(w, r)
+
+	status := http.StatusOK
+	if r.Method == "POST" {
+		status = http.StatusForbidden
+		data.Error = true
+		data.ErrorMessage = errCSRF.Error()
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	renderPage(w, status, "logout_confirm.html", data)
+}
+
+// Controlla se id_token_hint contiene un token valido rilasciato nella sessione s
+func logoutHint(r *http.Request, s session.Session) bool {
+	hint := r.URL.Query().Get("id_token_hint")
+	if hint == "" {
+		return false
+	}
+
+	claims, err := auth.Introspect([]byte(hint))
+	if err != nil {
+		return false
+	}
+
+	sid, _ := claims["sid"].(string)
+	return sid != "" && sid == s.ID
+}
+
+// Termina la sessione corrente e avvisa le applicazioni registrate. Se ce ne sono
+// viene mostrata la pagina con lo stato delle notifiche, che carica gli iframe
+// front-channel e prosegue verso next quando tutte hanno risposto.
+func singleLogout(w http.ResponseWriter, r *http.Request, next string) {
+	type logoutData struct {
+		pageInfo
+		ID            string
+		Next          string
+		Notifications []logout.Notification
+	}
+
+	s, err := currentSession(r)
+	endSession(w, r)
+
+	if err != nil || !logout.Enabled() {
+		http.Redirect(w, r, next, http.StatusSeeOther)
+		return
+	}
+
+	l, err := logout.Start(s.Username, s.ID, true)
+	if err != nil || len(l.Notifications) == 0 {
+		http.Redirect(w, r, next, http.StatusSeeOther)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	renderPage(w, http.StatusOK, "logout.html", logoutData{
+		pageInfo:      newPageInfo(),
+		ID:            l.ID,
+		Next:          next,
+		Notifications: l.Notifications,
+	})
+}
+
+// Avvisa le applicazioni della fine di sessioni terminate senza il browser
+// dell'utente (solo back-channel)
+func notifyLogout(sessions ...session.Session) {
+	for _, s := range sessions {
+		if _, err := logout.Start(s.Username, s.ID, false); err != nil {
+			log.Println("logout: ", err.Error())
+		}
+	}
+}
+
+// Percorso: /logout/status
+// GET restituisce lo stato delle notifiche di una disconnessione (parametro id);
+// POST conferma il caricamento dell'iframe front-channel dell'applicazione client_id.
+func HandleLogoutStatus(w http.ResponseWriter, r *http.Request) {
+	id := r.FormValue("id")
+
+	switch r.Method {
+	case "GET":
+		l, err := logout.Status(id)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Cache-Control", "no-store")
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"complete":      l.Complete(),
+			"notifications": l.Notifications,
+		})
+
+	case "POST":
+		if err := logout.Acknowledge(id, r.FormValue("client_id")); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
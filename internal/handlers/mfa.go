@@ -0,0 +1,183 @@
+/*
+ * mfa.go
+ *
+ * Secondo passaggio dell'accesso.
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"git.napaalm.xyz/napaalm/ssodav/internal/auth"
+	"git.napaalm.xyz/napaalm/ssodav/internal/config"
+	"git.napaalm.xyz/napaalm/ssodav/internal/mfa"
+	"git.napaalm.xyz/napaalm/ssodav/internal/policy"
+	"git.napaalm.xyz/napaalm/ssodav/internal/session"
+	"git.napaalm.xyz/napaalm/ssodav/internal/totp"
+	"git.napaalm.xyz/napaalm/ssodav/internal/url"
+	"git.napaalm.xyz/napaalm/ssodav/internal/webauthn"
+)
+
+// Nome del cookie con l'ID dell'accesso in attesa del secondo fattore
+const mfaCookie = "sso_mfa"
+
+// Secondi fattori configurati dall'utente o obbligatori per il suo gruppo
+type factors struct {
+	totp, totpRequired         bool
+	webauthn, webauthnRequired bool
+}
+
+// Restituisce i secondi fattori dell'utente
+func userFactors(userInfo auth.UserInfo) (factors, error) {
+	var f factors
+
+	if totp.Enabled() {
+		enrolled, err := totp.Enrolled(userInfo.Username)
+		if err != nil {
+			return f, err
+		}
+
+		f.totp, f.totpRequired = enrolled, totp.Required(userInfo)
+	}
+
+	if webauthn.Enabled() {
+		f.webauthn = len(webauthn.Credentials(userInfo.Username)) > 0
+		f.webauthnRequired = webauthn.Required(userInfo)
+	}
+
+	return f, nil
+}
+
+// Indica se l'utente deve usare un secondo fattore dopo la password
+func (f factors) needed() bool {
+	return f.totp || f.totpRequired || f.webauthn || f.webauthnRequired
+}
+
+// Indica se la sessione è stata aperta con un secondo fattore o con una passkey
+func strongSession(s session.Session) bool {
+	return hasMethod(s.Methods, "otp") || hasMethod(s.Methods, "hwk")
+}
+
+// Avvia il secondo passaggio dell'accesso, se l'utente ne ha bisogno. Le chiavi
+// di sicurezza hanno la precedenza sui codici TOTP.
+func requireSecondFactor(w http.ResponseWriter, r *http.Request, login mfa.Login, f factors) bool {
+	switch {
+	case f.webauthn || f.webauthnRequired:
+		beginSecondFactor(w, r, login, "/webauthn/login")
+	case f.totp || f.totpRequired:
+		beginTOTP(w, r, login, f.totp)
+	default:
+		return false
+	}
+
+	return true
+}
+
+// Registra l'accesso in attesa del secondo fattore e reindirizza il browser
+// alla pagina in cui inserirlo
+func beginSecondFactor(w http.ResponseWriter, r *http.Request, login mfa.Login, page string) {
+	id, err := mfa.Start(login)
+	if err == mfa.ErrTooManyRequests {
+		renderLogin(w, r, http.StatusServiceUnavailable, err.Error())
+		return
+	} else if err != nil {
+		log.Println("handlers: ", err.Error())
+		http.Error(w, "Impossibile avviare l'accesso", http.StatusInternalServerError)
+		return
+	}
+
+	// The cookie lasts until the browser is closed, the login expires much earlier
+	hostCookies.Set(w, r, mfaCookie, id, time.Time{})
+	http.Redirect(w, r, page, http.StatusSeeOther)
+}
+
+// Restituisce l'accesso in attesa del browser e il suo ID
+func pendingLogin(r *http.Request) (string, mfa.Login, error) {
+	id, err := hostCookies.Get(r, mfaCookie)
+	if err != nil {
+		return "", mfa.Login{}, mfa.ErrNotFound
+	}
+
+	login, err := mfa.Get(id)
+	return id, login, err
+}
+
+// Conclude l'accesso in attesa del browser, che non può più essere usato
+func finishLogin(w http.ResponseWriter, r *http.Request, id string) {
+	mfa.Finish(id)
+	hostCookies.Clear(w, r, mfaCookie)
+}
+
+// Crea la sessione dell'utente che ha completato l'accesso e lo reindirizza
+// al servizio da cui proviene. Se il browser ha già una sessione dello stesso
+// utente, questa viene mantenuta con i nuovi metodi di autenticazione. Il
+// dispositivo viene registrato tra quelli conosciuti.
+func completeLogin(w http.ResponseWriter, r *http.Request, login mfa.Login) {
+	trackDevice(w, r, login.UserInfo)
+
+	if s, err := currentSession(r); err == nil && s.Username == login.UserInfo.Username && s.Actor == "" {
+		if s, err := session.Reauthenticate(s.ID, login.Methods); err == nil {
+			redirectAfterLogin(w, r, login.Next, login.State, login.Challenge, s)
+			return
+		}
+	}
+
+	// Set session lifetime and idle timeout according to the policies
+	lifetime, idle := policy.For(login.UserInfo, url.Origin(login.Next), GetIP(r)).Session(login.Remember)
+
+	// Start a session on the server
+	s, err := startSession(w, r, login.UserInfo, login.Methods, lifetime, idle)
+	if err != nil {
+		log.Println("handlers: ", err.Error())
+		http.Error(w, "Impossibile creare la sessione", http.StatusInternalServerError)
+		return
+	}
+
+	redirectAfterLogin(w, r, login.Next, login.State, login.Challenge, s)
+}
+
+// Reindirizza l'utente al servizio da cui proviene, o al sito principale. Se il
+// servizio ha chiesto l'accesso con state e un'impronta PKCE (come il middleware
+// di pkg/verifier) e next è uno dei ricevitori registrati, riceve insieme a state
+// un codice monouso da scambiare con /crossdomain/token presentando il segreto
+// dell'impronta: il token ottenuto vale solo per l'origine di next.
+func redirectAfterLogin(w http.ResponseWriter, r *http.Request, next, state, challenge string, s session.Session) {
+	if next == "" {
+		http.Redirect(w, r, "http://"+config.Config.General.TLD, http.StatusSeeOther)
+		return
+	}
+
+	if state != "" && challenge != "" && url.Receiver(next) {
+		// Without a code the service simply starts the login again
+		if code, err := newServiceCode(r, s, url.Origin(next), challenge); err == nil {
+			next = addQueryParam(addQueryParam(next, "code", code), "state", state)
+		} else {
+			log.Println("handlers: ", err.Error())
+		}
+
+		w.Header().Set("Cache-Control", "no-store")
+	}
+
+	http.Redirect(w, r, next, http.StatusSeeOther)
+}
@@ -0,0 +1,72 @@
+/*
+ * proxy.go
+ *
+ * Autenticazione delle richieste al reverse proxy integrato.
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+package handlers
+
+import (
+	"net/http"
+
+	"git.napaalm.xyz/napaalm/ssodav/internal/config"
+	"git.napaalm.xyz/napaalm/ssodav/internal/proxy"
+)
+
+// Restituisce un handler che inoltra le richieste per i percorsi del proxy
+// integrato, se l'utente è autenticato, e passa tutte le altre a next.
+func ProxyOr(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := proxy.Match(r)
+		if route == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		userInfo, err := currentUser(r)
+		if err != nil {
+			// Only page navigations can go through the login page
+			if r.Method != "GET" || r.Header.Get("Upgrade") != "" {
+				http.Error(w, "Autenticazione richiesta", http.StatusUnauthorized)
+				return
+			}
+
+			scheme := "http://"
+			if r.TLS != nil || config.Config.General.SecureCookies {
+				scheme = "https://"
+			}
+
+			http.Redirect(w, r, loginURL(scheme+r.Host+r.URL.RequestURI()), http.StatusFound)
+			return
+		}
+
+		// Replace whatever identity the client tried to send with the real one
+		proxy.StripIdentity(r, isServerCookie)
+		if !trustedProxy(remoteIP(r)) {
+			proxy.StripForwarding(r)
+		}
+
+		identity := make(http.Header)
+		setIdentityHeaders(identity, userInfo)
+
+		route.ServeHTTP(w, proxy.WithIdentity(r, identity))
+	})
+}
@@ -0,0 +1,248 @@
+/*
+ * recovery.go
+ *
+ * Pagine dei codici di recupero e della reimpostazione della password.
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"git.napaalm.xyz/napaalm/ssodav/internal/audit"
+	"git.napaalm.xyz/napaalm/ssodav/internal/auth"
+	"git.napaalm.xyz/napaalm/ssodav/internal/recovery"
+	"git.napaalm.xyz/napaalm/ssodav/internal/session"
+	"git.napaalm.xyz/napaalm/ssodav/internal/url"
+)
+
+var errPasswordMismatch = errors.New("Le due password non coincidono")
+
+// Dati delle pagine dei codici di recupero
+type recoveryData struct {
+	pageInfo
+	Username string
+
+	// Gestione dei codici dell'utente autenticato
+	Manage    bool
+	Remaining int
+	Generated time.Time
+	Codes     []string
+
+	// Password reimpostata
+	Done     bool
+	LoginURL string
+}
+
+// Percorso: /recovery
+// Pagina dove l'utente autenticato genera nuovi codici di recupero, che
+// sostituiscono i precedenti. Per generarli va inserita la password.
+func HandleRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	s, err := currentSession(r)
+	if err != nil {
+		http.Redirect(w, r, loginURL(url.BaseURL()+r.URL.RequestURI()), http.StatusSeeOther)
+		return
+	}
+
+	userInfo := s.UserInfo()
+
+	data := recoveryData{
+		pageInfo: newPageInfo(),
+		Username: userInfo.Username,
+		Manage:   true,
+	}
+	data.CSRFToken = csrfToken(w, r)
+	data.Remaining, data.Generated = recovery.Remaining(userInfo.Username)
+
+	// Impersonating administrators can't obtain the user's codes
+	if userInfo.Actor != "" || !recovery.Enabled() {
+		data.Error = true
+		data.ErrorMessage = "Operazione non consentita"
+		renderPage(w, http.StatusForbidden, "recovery.html", data)
+		return
+	}
+
+	if r.Method != "POST" {
+		renderPage(w, http.StatusOK, "recovery.html", data)
+		return
+	}
+
+	if !checkCSRF(r) {
+		data.Error = true
+		data.ErrorMessage = errCSRF.Error()
+		renderPage(w, http.StatusForbidden, "recovery.html", data)
+		return
+	}
+
+	event := audit.Event{
+		Type:     audit.RecoveryCodes,
+		Subject:  userInfo.Username,
+		Audience: url.BaseURL(),
+		IP:       GetIP(r),
+	}
+
+	accountReservation, addressReservation, status, err := RateLimit(userInfo.Username, event.IP)
+	if err != nil {
+		data.Error = true
+		data.ErrorMessage = err.Error()
+		renderPage(w, status, "recovery.html", data)
+		return
+	}
+
+	// A stolen session isn't enough to obtain codes
+	if _, err := auth.Authenticate(userInfo.Username, r.PostFormValue("password")); err != nil {
+		event.Outcome = "access_denied"
+		audit.Record(event)
+
+		data.Error = true
+		data.ErrorMessage = err.Error()
+		renderPage(w, http.StatusUnauthorized, "recovery.html", data)
+		return
+	}
+
+	accountReservation.Cancel()
+	addressReservation.Cancel()
+
+	codes, err := recovery.Generate(userInfo.Username)
+	if err != nil {
+		event.Outcome = "server_error"
+		audit.Record(event)
+
+		data.Error = true
+		data.ErrorMessage = err.Error()
+		renderPage(w, http.StatusServiceUnavailable, "recovery.html", data)
+		return
+	}
+
+	event.Outcome = audit.Success
+	audit.Record(event)
+
+	// The codes are shown only once
+	w.Header().Set("Cache-Control", "no-store")
+
+	data.Codes = codes
+	data.Remaining, data.Generated = recovery.Remaining(userInfo.Username)
+	renderPage(w, http.StatusOK, "recovery.html", data)
+}
+
+// Percorso: /recovery/reset
+// Reimpostazione della password con il nome utente e un codice di recupero,
+// raggiungibile dalla pagina di accesso. Le sessioni dell'utente vengono terminate.
+func HandlePasswordReset(w http.ResponseWriter, r *http.Request) {
+	data := recoveryData{
+		pageInfo: newPageInfo(),
+		LoginURL: loginURL(""),
+	}
+	data.CSRFToken = csrfToken(w, r)
+
+	if !recovery.Enabled() {
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.Method != "POST" {
+		renderPage(w, http.StatusOK, "recovery.html", data)
+		return
+	}
+
+	render := func(status int, err error) {
+		data.Error = true
+		data.ErrorMessage = err.Error()
+		renderPage(w, status, "recovery.html", data)
+	}
+
+	data.Username = r.PostFormValue("username")
+	code := r.PostFormValue("code")
+	password := r.PostFormValue("password")
+
+	if data.Username == "" || code == "" || password == "" {
+		render(http.StatusBadRequest, errors.New("Impossibile elaborare la richiesta!"))
+		return
+	}
+
+	if !checkCSRF(r) {
+		render(http.StatusForbidden, errCSRF)
+		return
+	}
+
+	if password != r.PostFormValue("confirm") {
+		render(http.StatusBadRequest, errPasswordMismatch)
+		return
+	}
+
+	if err := recovery.CheckPassword(password); err != nil {
+		render(http.StatusBadRequest, err)
+		return
+	}
+
+	event := audit.Event{
+		Type:     audit.PasswordReset,
+		Subject:  data.Username,
+		Audience: url.BaseURL(),
+		IP:       GetIP(r),
+	}
+
+	// Codes are guessed like passwords, so they share the same limits
+	accountReservation, addressReservation, status, err := RateLimit(data.Username, event.IP)
+	if err != nil {
+		event.Outcome = "rate_limited"
+		audit.Record(event)
+
+		render(status, err)
+		return
+	}
+
+	// The code is consumed only once the new password has been set
+	err = recovery.Redeem(data.Username, code, func() error {
+		accountReservation.Cancel()
+		addressReservation.Cancel()
+
+		return auth.SetPassword(data.Username, password)
+	})
+
+	if err == recovery.ErrInvalidCode {
+		event.Outcome = "invalid_code"
+		audit.Record(event)
+
+		render(http.StatusUnauthorized, err)
+		return
+	} else if err != nil {
+		log.Println("handlers: ", err.Error())
+
+		event.Outcome = "server_error"
+		audit.Record(event)
+
+		render(http.StatusInternalServerError, errors.New("Impossibile reimpostare la password. Il codice è ancora valido: riprova più tardi."))
+		return
+	}
+
+	// Whoever knew the old password is logged out
+	notifyLogout(session.DeleteUser(data.Username)...)
+
+	event.Outcome = audit.Success
+	audit.Record(event)
+
+	data.Done = true
+	renderPage(w, http.StatusOK, "recovery.html", data)
+}
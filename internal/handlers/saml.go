@@ -0,0 +1,196 @@
+/*
+ * saml.go
+ *
+ * Handler per l'identity provider SAML 2.0.
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+package handlers
+
+import (
+	"encoding/base64"
+	"log"
+	"net/http"
+	neturl "net/url"
+
+	"git.napaalm.xyz/napaalm/ssodav/internal/auth"
+	"git.napaalm.xyz/napaalm/ssodav/internal/saml"
+	"git.napaalm.xyz/napaalm/ssodav/internal/url"
+)
+
+// Percorso: /saml/metadata
+// Metadati dell'identity provider.
+func HandleSAMLMetadata(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/samlmetadata+xml")
+	w.Write(saml.Metadata())
+}
+
+// Percorso: /saml/sso
+// SSO avviato dal service provider, con binding HTTP-Redirect oppure HTTP-POST.
+func HandleSAMLSSO(w http.ResponseWriter, r *http.Request) {
+	var (
+		req        *saml.AuthnRequest
+		relayState string
+		err        error
+	)
+
+	switch r.Method {
+	case "GET":
+		req, err = saml.ParseRedirectRequest(r.URL.Query().Get("SAMLRequest"))
+		relayState = r.URL.Query().Get("RelayState")
+	case "POST":
+		if err = r.ParseForm(); err == nil {
+			req, err = saml.ParsePostRequest(r.PostFormValue("SAMLRequest"))
+			relayState = r.PostFormValue("RelayState")
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Metodo non consentito", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, saml.ErrInvalidRequest.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sp, ok := saml.GetServiceProvider(req.Issuer)
+	if !ok {
+		http.Error(w, saml.ErrUnknownServiceProvider.Error(), http.StatusForbidden)
+		return
+	}
+
+	acsURL, err := sp.AssertionConsumerService(req.AssertionConsumerServiceURL)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	// If the user isn't logged in go through the login page and come back here
+	// with the request encoded for the HTTP-Redirect binding
+	userInfo, err := currentUser(r)
+	if err != nil {
+		encoded, err := req.RedirectEncoding()
+		if err != nil {
+			log.Println("handlers: ", err.Error())
+			http.Error(w, "Errore interno", http.StatusInternalServerError)
+			return
+		}
+
+		query := neturl.Values{}
+		query.Set("SAMLRequest", encoded)
+		if relayState != "" {
+			query.Set("RelayState", relayState)
+		}
+
+		http.Redirect(w, r, loginURL(url.BaseURL()+"/saml/sso?"+query.Encode()), http.StatusSeeOther)
+		return
+	}
+
+	postSAMLResponse(w, sp, acsURL, req.ID, relayState, userInfo)
+}
+
+// Percorso: /saml/idp
+// SSO avviato dall'identity provider: dopo la conferma dell'utente, data con il
+// form della pagina, invia un'asserzione non sollecitata al service provider
+// indicato. RelayState deve essere un URL accettato come next.
+func HandleSAMLIdPInitiated(w http.ResponseWriter, r *http.Request) {
+	type confirmData struct {
+		pageInfo
+		Username        string
+		ServiceProvider string
+		RelayState      string
+	}
+
+	if r.Method != "GET" && r.Method != "POST" {
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Metodo non consentito", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sp, ok := saml.GetServiceProvider(r.FormValue("sp"))
+	if !ok {
+		http.Error(w, saml.ErrUnknownServiceProvider.Error(), http.StatusNotFound)
+		return
+	}
+
+	relayState := r.FormValue("RelayState")
+	if relayState != "" {
+		if relayState = url.SanitizeURL(relayState); relayState == "" {
+			http.Error(w, "RelayState non valido", http.StatusBadRequest)
+			return
+		}
+	}
+
+	userInfo, err := currentUser(r)
+	if err != nil {
+		query := neturl.Values{"sp": {sp.EntityID}}
+		if relayState != "" {
+			query.Set("RelayState", relayState)
+		}
+
+		http.Redirect(w, r, loginURL(url.BaseURL()+"/saml/idp?"+query.Encode()), http.StatusSeeOther)
+		return
+	}
+
+	// A link from another site only shows the confirmation page
+	if r.Method == "POST" && checkCSRF(r) {
+		acsURL, _ := sp.AssertionConsumerService("")
+		postSAMLResponse(w, sp, acsURL, "", relayState, userInfo)
+		return
+	}
+
+	data := confirmData{
+		pageInfo:        newPageInfo(),
+		Username:        userInfo.Username,
+		ServiceProvider: sp.EntityID,
+		RelayState:      relayState,
+	}
+	data.CSRFToken = csrfToken(w, r)
+
+	status := http.StatusOK
+	if r.Method == "POST" {
+		status = http.StatusForbidden
+		data.Error = true
+		data.ErrorMessage = errCSRF.Error()
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	renderPage(w, status, "saml_confirm.html", data)
+}
+
+// Invia la risposta al service provider tramite il binding HTTP-POST
+func postSAMLResponse(w http.ResponseWriter, sp *saml.ServiceProvider, acsURL, inResponseTo, relayState string, userInfo auth.UserInfo) {
+	response, err := saml.NewResponse(sp, acsURL, inResponseTo, userInfo)
+	if err != nil {
+		log.Println("handlers: ", err.Error())
+		http.Error(w, "Errore interno", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+
+	renderPage(w, http.StatusOK, "saml_post.html", struct {
+		pageInfo
+		ACSURL       string
+		SAMLResponse string
+		RelayState   string
+	}{newPageInfo(), acsURL, base64.StdEncoding.EncodeToString(response), relayState})
+}
@@ -0,0 +1,274 @@
+/*
+ * sessions.go
+ *
+ * Sessioni degli utenti e API per gestirle.
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"git.napaalm.xyz/napaalm/ssodav/internal/audit"
+	"git.napaalm.xyz/napaalm/ssodav/internal/auth"
+	"git.napaalm.xyz/napaalm/ssodav/internal/session"
+	"git.napaalm.xyz/napaalm/ssodav/internal/url"
+)
+
+var errSessionEnded = errors.New("Sessione terminata")
+
+// Ottiene la sessione dell'utente a partire dal cookie di sessione
+func currentSession(r *http.Request) (session.Session, error) {
+	secret, err := cookies.Get(r, sessionCookie)
+	if err != nil {
+		return session.Session{}, err
+	}
+
+	return session.Get(secret)
+}
+
+// Ottiene l'utente autenticato a partire dal cookie di sessione
+func currentUser(r *http.Request) (auth.UserInfo, error) {
+	s, err := currentSession(r)
+	if err != nil {
+		return auth.UserInfo{}, err
+	}
+
+	return s.UserInfo(), nil
+}
+
+// Crea una sessione per l'utente e ne imposta il cookie, valido per tutti i servizi
+// del dominio. La sessione dura al massimo lifetime e scade dopo idle di inattività.
+func startSession(w http.ResponseWriter, r *http.Request, userInfo auth.UserInfo, methods []string, lifetime, idle time.Duration) (session.Session, error) {
+	secret, s, evicted, err := session.Create(userInfo, GetIP(r), r.UserAgent(), methods, lifetime, idle)
+	if err != nil {
+		return session.Session{}, err
+	}
+
+	// The services still using the sessions dropped to make room are logged out
+	notifyLogout(evicted...)
+
+	setSessionCookie(w, r, secret, s)
+	return s, nil
+}
+
+// Rinnova il cookie della sessione corrente, che con l'attività dell'utente
+// scade più tardi
+func renewSession(w http.ResponseWriter, r *http.Request) (session.Session, error) {
+	secret, err := cookies.Get(r, sessionCookie)
+	if err != nil {
+		return session.Session{}, err
+	}
+
+	s, err := session.Get(secret)
+	if err != nil {
+		return session.Session{}, err
+	}
+
+	setSessionCookie(w, r, secret, s)
+	return s, nil
+}
+
+// Imposta il cookie di sessione, che scade insieme alla sessione
+func setSessionCookie(w http.ResponseWriter, r *http.Request, secret string, s session.Session) {
+	cookies.Set(w, r, sessionCookie, secret, s.Deadline())
+}
+
+// Percorso: /keepalive
+// Segnala l'attività dell'utente: rinnova il cookie di sessione e ne restituisce la
+// scadenza. Le applicazioni dei domini autorizzati possono chiamarlo dal browser
+// (CORS con credenziali) per non far scadere la sessione mentre sono in uso.
+func HandleKeepAlive(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	if origin := r.Header.Get("Origin"); origin != "" && url.Origin(origin) == origin {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+		w.Header().Add("Vary", "Origin")
+	}
+
+	switch r.Method {
+	case "GET", "POST":
+	case "OPTIONS":
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s, err := renewSession(w, r)
+	if err != nil {
+		writeJSON(w, http.StatusUnauthorized, map[string]interface{}{"active": false})
+		return
+	}
+
+	deadline := s.Deadline()
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"active":     true,
+		"expires":    deadline,
+		"expires_in": int(time.Until(deadline).Seconds()),
+	})
+}
+
+// Termina la sessione corrente, se presente, ed elimina il cookie di sessione
+func endSession(w http.ResponseWriter, r *http.Request) {
+	if s, err := currentSession(r); err == nil {
+		session.Delete(s.ID)
+	}
+
+	cookies.Clear(w, r, sessionCookie)
+}
+
+// Verifica un token come auth.ParseToken; i token ottenuti da una sessione
+// non sono più validi quando questa viene terminata
+func parseToken(token []byte, audiences ...string) (auth.UserInfo, error) {
+	userInfo, err := auth.ParseToken(token, audiences...)
+	if err != nil {
+		return auth.UserInfo{}, err
+	}
+
+	if userInfo.SessionID != "" && !session.Active(userInfo.SessionID) {
+		return auth.UserInfo{}, errSessionEnded
+	}
+
+	return userInfo, nil
+}
+
+// Sessione come restituita dalle API
+type sessionInfo struct {
+	ID       string    `json:"id"`
+	Username string    `json:"username"`
+	Actor    string    `json:"actor,omitempty"`
+	Created  time.Time `json:"created"`
+	LastSeen time.Time `json:"last_seen"`
+	Expires  time.Time `json:"expires"`
+
+	// Scadenza per inattività, se prevista
+	IdleExpires *time.Time `json:"idle_expires,omitempty"`
+
+	IP        string   `json:"ip"`
+	UserAgent string   `json:"user_agent"`
+	Methods   []string `json:"methods"`
+	Current   bool     `json:"current"`
+
+	// Ultima autenticazione dell'utente
+	AuthTime time.Time `json:"auth_time"`
+}
+
+// Percorsi: /sessions e /sessions/{id}
+// Elenca (GET) o termina (DELETE) le sessioni dell'utente autenticato.
+// Gli amministratori possono gestire le sessioni degli altri utenti con ?user=.
+func HandleSessions(w http.ResponseWriter, r *http.Request) {
+	userInfo, err := requestUser(r, "")
+	if err != nil {
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_token", "")
+		return
+	}
+
+	// Impersonated sessions can't be used to manage the user's sessions
+	if userInfo.Actor != "" {
+		writeOAuthError(w, http.StatusForbidden, "access_denied", "")
+		return
+	}
+
+	username := userInfo.Username
+	if user := r.URL.Query().Get("user"); user != "" && user != username {
+		if !isAdministrator(userInfo) {
+			writeOAuthError(w, http.StatusForbidden, "access_denied", "")
+			return
+		}
+
+		username = user
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/sessions"), "/")
+
+	event := audit.Event{
+		Type:    audit.SessionTermination,
+		Actor:   userInfo.Username,
+		Subject: username,
+		IP:      GetIP(r),
+		Outcome: audit.Success,
+	}
+
+	switch {
+	case r.Method == "GET" && id == "":
+		list := []sessionInfo{}
+
+		for _, s := range session.List(username) {
+			info := sessionInfo{
+				ID:        s.ID,
+				Username:  s.Username,
+				Actor:     s.Actor,
+				Created:   s.Created,
+				LastSeen:  s.LastSeen,
+				Expires:   s.Expires,
+				IP:        s.IP,
+				UserAgent: s.UserAgent,
+				Methods:   s.Methods,
+				Current:   s.ID == userInfo.SessionID,
+				AuthTime:  s.AuthenticatedAt(),
+			}
+
+			if s.IdleTimeout > 0 {
+				idle := s.LastSeen.Add(s.IdleTimeout)
+				info.IdleExpires = &idle
+			}
+
+			list = append(list, info)
+		}
+
+		w.Header().Set("Cache-Control", "no-store")
+		writeJSON(w, http.StatusOK, map[string]interface{}{"sessions": list})
+
+	case r.Method == "DELETE" && id == "":
+		deleted := session.DeleteUser(username)
+		audit.Record(event)
+		notifyLogout(deleted...)
+
+		writeJSON(w, http.StatusOK, map[string]interface{}{"terminated": len(deleted)})
+
+	case r.Method == "DELETE":
+		// Sessions of other users are reported as missing
+		s, err := session.Lookup(id)
+		if err != nil || s.Username != username {
+			http.NotFound(w, r)
+			return
+		}
+
+		session.Delete(id)
+		audit.Record(event)
+		notifyLogout(s)
+
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
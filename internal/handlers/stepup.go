@@ -0,0 +1,130 @@
+/*
+ * stepup.go
+ *
+ * Nuova autenticazione richiesta dai servizi (acr_values e max_age).
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.napaalm.xyz/napaalm/ssodav/internal/auth"
+	"git.napaalm.xyz/napaalm/ssodav/internal/mfa"
+	"git.napaalm.xyz/napaalm/ssodav/internal/session"
+	"git.napaalm.xyz/napaalm/ssodav/internal/totp"
+)
+
+var (
+	errStepUp      = errors.New("Il servizio richiede di accedere di nuovo.")
+	errStepUpNoMFA = errors.New("Il servizio richiede la verifica in due passaggi, che non è disponibile per il tuo account.")
+)
+
+// Requisiti indicati dal servizio che reindirizza alla pagina di accesso, come
+// nei parametri acr_values e max_age di OpenID Connect
+type stepUp struct {
+	// Livello di garanzia minimo, vuoto se non richiesto
+	acr string
+
+	// Tempo massimo trascorso dall'ultima autenticazione, negativo se non richiesto
+	maxAge time.Duration
+}
+
+// Legge i requisiti dai parametri della richiesta
+func parseStepUp(r *http.Request) stepUp {
+	q := r.URL.Query()
+
+	s := stepUp{
+		acr:    auth.RequiredACR(strings.Fields(q.Get("acr_values"))),
+		maxAge: -1,
+	}
+
+	if seconds, err := strconv.Atoi(q.Get("max_age")); err == nil && seconds >= 0 {
+		s.maxAge = time.Duration(seconds) * time.Second
+	}
+
+	return s
+}
+
+// Indica se l'ultima autenticazione è abbastanza recente
+func (s stepUp) recent(authTime time.Time) bool {
+	return s.maxAge < 0 || time.Since(authTime) <= s.maxAge
+}
+
+// Indica se la sessione soddisfa i requisiti
+func (s stepUp) satisfiedBy(sess session.Session) bool {
+	return s.recent(sess.AuthenticatedAt()) && auth.SatisfiesACR(sess.Methods, s.acr)
+}
+
+// Aggiunge ai secondi fattori dell'utente quello richiesto dal servizio: chi
+// non ne ha ancora uno configura la verifica TOTP. Restituisce false se il
+// livello richiesto non può essere raggiunto.
+func (s stepUp) factors(f factors) (factors, bool) {
+	if s.acr != auth.ACRMultiFactor || f.needed() {
+		return f, true
+	}
+
+	if !totp.Enabled() {
+		return f, false
+	}
+
+	f.totpRequired = true
+	return f, true
+}
+
+// Chiede una nuova autenticazione all'utente con una sessione che non soddisfa
+// i requisiti del servizio. Se l'ultima autenticazione è abbastanza recente
+// basta il secondo fattore, altrimenti viene mostrata la pagina di accesso.
+func requireStepUp(w http.ResponseWriter, r *http.Request, s stepUp, sess session.Session, next string) {
+	// Impersonating administrators can't authenticate as the user
+	if !s.recent(sess.AuthenticatedAt()) || sess.Actor != "" {
+		renderLogin(w, r, http.StatusOK, errStepUp.Error())
+		return
+	}
+
+	f, err := userFactors(sess.UserInfo())
+	if err != nil {
+		renderLogin(w, r, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+
+	f, ok := s.factors(f)
+	if !ok {
+		renderLogin(w, r, http.StatusForbidden, errStepUpNoMFA.Error())
+		return
+	}
+
+	login := mfa.Login{
+		UserInfo:  sess.UserInfo(),
+		Methods:   sess.Methods,
+		Next:      next,
+		State:     r.URL.Query().Get("state"),
+		Challenge: codeChallenge(r),
+	}
+
+	if !requireSecondFactor(w, r, login, f) {
+		renderLogin(w, r, http.StatusOK, errStepUp.Error())
+	}
+}
@@ -0,0 +1,259 @@
+/*
+ * totp.go
+ *
+ * Pagine della verifica in due passaggi con codici TOTP.
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+package handlers
+
+import (
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	neturl "net/url"
+
+	"git.napaalm.xyz/napaalm/ssodav/internal/mfa"
+	"git.napaalm.xyz/napaalm/ssodav/internal/qr"
+	"git.napaalm.xyz/napaalm/ssodav/internal/totp"
+	"git.napaalm.xyz/napaalm/ssodav/internal/url"
+	"git.napaalm.xyz/napaalm/ssodav/internal/webauthn"
+)
+
+var (
+	errTOTPNotEnrolled = errors.New("La verifica in due passaggi è obbligatoria per il tuo account: configurala dalla pagina di accesso.")
+	errTOTPReenroll    = errors.New("Per configurare un nuovo dispositivo esci e accedi di nuovo con la verifica in due passaggi.")
+)
+
+// Dati della pagina di verifica
+type totpData struct {
+	pageInfo
+	Username string
+
+	// Configurazione di un nuovo segreto
+	Enroll bool
+	QRCode template.HTML
+	Key    string
+
+	// Configurazione volontaria completata
+	Done bool
+	Next string
+
+	// Accesso scaduto, da ricominciare dall'indirizzo indicato
+	Expired    bool
+	RestartURL string
+}
+
+// Avvia il secondo passaggio dell'accesso; chi non ha ancora configurato la
+// verifica riceve un nuovo segreto da attivare
+func beginTOTP(w http.ResponseWriter, r *http.Request, login mfa.Login, enrolled bool) {
+	if !enrolled {
+		secret, err := totp.NewSecret()
+		if err != nil {
+			log.Println("handlers: ", err.Error())
+			http.Error(w, "Impossibile avviare l'accesso", http.StatusInternalServerError)
+			return
+		}
+
+		login.Secret = secret
+	}
+
+	beginSecondFactor(w, r, login, "/totp")
+}
+
+// Percorso: /totp
+// Secondo passaggio dell'accesso: l'utente inserisce il codice generato dall'app
+// di autenticazione, dopo aver eventualmente attivato il segreto con il codice QR.
+func HandleTOTP(w http.ResponseWriter, r *http.Request) {
+	id, login, err := pendingLogin(r)
+
+	data := totpData{
+		pageInfo:   newPageInfo(),
+		Username:   login.UserInfo.Username,
+		Enroll:     login.Secret != nil,
+		Next:       login.Next,
+		RestartURL: loginURLWithState(login.Next, login.State, login.Challenge),
+	}
+	data.CSRFToken = csrfToken(w, r)
+
+	// Voluntary enrollments belong to the session that started them
+	if err == nil && login.SessionID != "" {
+		data.RestartURL = "/totp/enroll?next=" + neturl.QueryEscape(login.Next)
+
+		if s, serr := currentSession(r); serr != nil || s.ID != login.SessionID {
+			err = mfa.ErrNotFound
+		}
+	}
+
+	// Users who must use a security key can't fall back to codes
+	if err == nil && webauthn.Enabled() && webauthn.Required(login.UserInfo) {
+		err = errWebAuthnRequired
+	}
+
+	if err != nil {
+		data.Expired = true
+		data.Error = true
+		data.ErrorMessage = err.Error()
+		renderPage(w, http.StatusUnauthorized, "totp.html", data)
+		return
+	}
+
+	if data.Enroll {
+		if err := setEnrollment(&data, login); err != nil {
+			log.Println("handlers: ", err.Error())
+			http.Error(w, "Impossibile generare il codice QR", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if r.Method != "POST" {
+		renderPage(w, http.StatusOK, "totp.html", data)
+		return
+	}
+
+	if !checkCSRF(r) {
+		data.Error = true
+		data.ErrorMessage = errCSRF.Error()
+		renderPage(w, http.StatusForbidden, "totp.html", data)
+		return
+	}
+
+	code := r.PostFormValue("code")
+
+	if data.Enroll {
+		err = totp.Enroll(login.UserInfo.Username, login.Secret, code)
+	} else {
+		err = totp.Verify(login.UserInfo.Username, code)
+	}
+
+	switch err {
+	case nil:
+	case totp.ErrInvalidCode:
+		status := http.StatusUnauthorized
+
+		if ferr := mfa.Fail(id); ferr != nil {
+			finishLogin(w, r, id)
+
+			status = http.StatusTooManyRequests
+			data.Expired = true
+			err = ferr
+		}
+
+		data.Error = true
+		data.ErrorMessage = err.Error()
+		renderPage(w, status, "totp.html", data)
+		return
+	default:
+		data.Error = true
+		data.ErrorMessage = err.Error()
+		renderPage(w, http.StatusServiceUnavailable, "totp.html", data)
+		return
+	}
+
+	finishLogin(w, r, id)
+
+	// Voluntary enrollments don't start a new session
+	if login.SessionID != "" {
+		data.Done = true
+		data.Enroll = false
+		renderPage(w, http.StatusOK, "totp.html", data)
+		return
+	}
+
+	login.Methods = append(login.Methods, "otp")
+	completeLogin(w, r, login)
+}
+
+// Percorso: /totp/enroll
+// Configurazione volontaria della verifica da parte di un utente autenticato.
+// Chi l'ha già configurata può sostituire il dispositivo solo da una sessione
+// aperta con il codice di verifica.
+func HandleTOTPEnroll(w http.ResponseWriter, r *http.Request) {
+	next := url.SanitizeURL(r.URL.Query().Get("next"))
+
+	s, err := currentSession(r)
+	if err != nil {
+		http.Redirect(w, r, loginURL(url.BaseURL()+r.URL.RequestURI()), http.StatusSeeOther)
+		return
+	}
+
+	userInfo := s.UserInfo()
+
+	data := totpData{
+		pageInfo:   newPageInfo(),
+		Username:   userInfo.Username,
+		Next:       next,
+		Expired:    true,
+		RestartURL: next,
+	}
+	data.Error = true
+
+	// Impersonating administrators can't change the user's second factor
+	if userInfo.Actor != "" || !totp.Enabled() {
+		data.ErrorMessage = "Operazione non consentita"
+		renderPage(w, http.StatusForbidden, "totp.html", data)
+		return
+	}
+
+	enrolled, err := totp.Enrolled(userInfo.Username)
+	if err != nil {
+		data.ErrorMessage = err.Error()
+		renderPage(w, http.StatusServiceUnavailable, "totp.html", data)
+		return
+	}
+
+	if enrolled && !strongSession(s) {
+		data.ErrorMessage = errTOTPReenroll.Error()
+		renderPage(w, http.StatusForbidden, "totp.html", data)
+		return
+	}
+
+	beginTOTP(w, r, mfa.Login{
+		UserInfo:  userInfo,
+		Methods:   s.Methods,
+		Next:      next,
+		SessionID: s.ID,
+	}, false)
+}
+
+// Aggiunge alla pagina il codice QR e il segreto da inserire nell'app
+func setEnrollment(data *totpData, login mfa.Login) error {
+	code, err := qr.Encode([]byte(totp.URI(login.Secret, login.UserInfo.Username)))
+	if err != nil {
+		return err
+	}
+
+	// The SVG is generated by the server and contains only the modules
+	data.QRCode = template.HTML(code.SVG())
+	data.Key = totp.FormatSecret(login.Secret)
+	return nil
+}
+
+// Controlla se tra i metodi di autenticazione c'è quello indicato
+func hasMethod(methods []string, method string) bool {
+	for _, m := range methods {
+		if m == method {
+			return true
+		}
+	}
+
+	return false
+}
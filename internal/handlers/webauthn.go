@@ -0,0 +1,281 @@
+/*
+ * webauthn.go
+ *
+ * Pagine delle chiavi di sicurezza e delle passkey.
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"git.napaalm.xyz/napaalm/ssodav/internal/auth"
+	"git.napaalm.xyz/napaalm/ssodav/internal/mfa"
+	"git.napaalm.xyz/napaalm/ssodav/internal/url"
+	"git.napaalm.xyz/napaalm/ssodav/internal/webauthn"
+)
+
+var (
+	errWebAuthnRequired = errors.New("Il tuo account richiede una chiave di sicurezza.")
+	errWebAuthnBrowser  = errors.New("Il tuo account richiede una chiave di sicurezza: accedi dalla pagina di accesso.")
+	errWebAuthnReauth   = errors.New("Per modificare le chiavi di sicurezza esci e accedi di nuovo con la verifica in due passaggi.")
+)
+
+// Dati delle pagine delle chiavi di sicurezza
+type webauthnData struct {
+	pageInfo
+	Username string
+
+	// Opzioni della cerimonia da avviare nel browser e pagina a cui inviarne l'esito
+	Creation *webauthn.CreationOptions
+	Request  *webauthn.RequestOptions
+	Action   string
+
+	// Gestione delle chiavi dell'utente autenticato
+	Manage      bool
+	Credentials []webauthn.Credential
+	Message     string
+	Next        string
+
+	// Pagina per usare invece un codice TOTP
+	TOTPURL string
+
+	// Accesso scaduto, da ricominciare dall'indirizzo indicato
+	Expired    bool
+	RestartURL string
+}
+
+// Percorso: /webauthn/login
+// Secondo passaggio dell'accesso con una chiave di sicurezza, che chi non ne ha
+// ancora una ma è obbligato a usarla registra in questo momento. Senza un
+// accesso in attesa, se abilitato, l'utente accede con una passkey.
+func HandleWebAuthnLogin(w http.ResponseWriter, r *http.Request) {
+	id, login, err := pendingLogin(r)
+
+	// Pending logins of voluntary TOTP enrollments aren't logins
+	if err == nil && login.SessionID != "" {
+		err = mfa.ErrNotFound
+	}
+
+	pending := err == nil
+	next, state, challenge := login.Next, login.State, login.Challenge
+	if !pending {
+		next = url.SanitizeURL(r.URL.Query().Get("next"))
+		state = r.URL.Query().Get("state")
+		challenge = codeChallenge(r)
+	}
+
+	data := webauthnData{
+		pageInfo:   newPageInfo(),
+		Username:   login.UserInfo.Username,
+		Action:     "/webauthn/login?" + nextQuery(next, state, challenge),
+		RestartURL: loginURLWithState(next, state, challenge),
+	}
+	data.CSRFToken = csrfToken(w, r)
+
+	if !pending && !webauthn.Passwordless() {
+		renderWebAuthnError(w, http.StatusUnauthorized, data, err)
+		return
+	}
+
+	if pending {
+		if f, err := userFactors(login.UserInfo); err == nil && f.totp && !f.webauthnRequired {
+			data.TOTPURL = "/totp"
+		}
+	}
+
+	status := http.StatusOK
+
+	if r.Method == "POST" {
+		if !checkCSRF(r) {
+			data.Error = true
+			data.ErrorMessage = errCSRF.Error()
+			status = http.StatusForbidden
+		} else if !pending {
+			response := []byte(r.PostFormValue("credential"))
+
+			assertion, err := webauthn.FinishLogin("", response)
+			if err == nil {
+				// Passkeys replace the password: the user must still exist
+				userInfo, err := auth.LookupUser(assertion.Username)
+				if err != nil {
+					renderWebAuthnError(w, http.StatusUnauthorized, data, err)
+					return
+				}
+
+				completeLogin(w, r, mfa.Login{UserInfo: userInfo, Methods: []string{"hwk", "mfa"}, Next: next, State: state, Challenge: challenge})
+				return
+			}
+
+			data.Error = true
+			data.ErrorMessage = err.Error()
+			status = http.StatusUnauthorized
+		} else {
+			response := []byte(r.PostFormValue("credential"))
+
+			if len(webauthn.Credentials(login.UserInfo.Username)) > 0 {
+				_, err = webauthn.FinishLogin(id, response)
+			} else {
+				_, err = webauthn.FinishRegistration(login.UserInfo.Username, id, r.PostFormValue("name"), response)
+			}
+
+			if err == nil {
+				finishLogin(w, r, id)
+
+				login.Methods = append(login.Methods, "hwk")
+				completeLogin(w, r, login)
+				return
+			}
+
+			if ferr := mfa.Fail(id); ferr != nil {
+				finishLogin(w, r, id)
+				renderWebAuthnError(w, http.StatusTooManyRequests, data, ferr)
+				return
+			}
+
+			data.Error = true
+			data.ErrorMessage = err.Error()
+			status = http.StatusUnauthorized
+		}
+	}
+
+	// A new ceremony for each page
+	switch {
+	case !pending:
+		options, err := webauthn.BeginLogin("", "")
+		if err != nil {
+			renderWebAuthnError(w, http.StatusServiceUnavailable, data, err)
+			return
+		}
+		data.Request = &options
+	case len(webauthn.Credentials(login.UserInfo.Username)) > 0:
+		options, err := webauthn.BeginLogin(login.UserInfo.Username, id)
+		if err != nil {
+			renderWebAuthnError(w, http.StatusServiceUnavailable, data, err)
+			return
+		}
+		data.Request = &options
+	case webauthn.Required(login.UserInfo):
+		options, err := webauthn.BeginRegistration(login.UserInfo.Username, login.UserInfo.FullName, id)
+		if err != nil {
+			renderWebAuthnError(w, http.StatusServiceUnavailable, data, err)
+			return
+		}
+		data.Creation = &options
+	default:
+		renderWebAuthnError(w, http.StatusUnauthorized, data, mfa.ErrNotFound)
+		return
+	}
+
+	renderPage(w, status, "webauthn.html", data)
+}
+
+// Percorso: /webauthn
+// Gestione delle chiavi di sicurezza dell'utente autenticato, che può
+// registrarne di nuove ed eliminarle. Chi ha già un secondo fattore deve
+// averlo usato per aprire la sessione.
+func HandleWebAuthn(w http.ResponseWriter, r *http.Request) {
+	next := url.SanitizeURL(r.FormValue("next"))
+
+	s, err := currentSession(r)
+	if err != nil {
+		http.Redirect(w, r, loginURL(url.BaseURL()+r.URL.RequestURI()), http.StatusSeeOther)
+		return
+	}
+
+	userInfo := s.UserInfo()
+
+	data := webauthnData{
+		pageInfo:   newPageInfo(),
+		Username:   userInfo.Username,
+		Action:     "/webauthn",
+		Manage:     true,
+		Next:       next,
+		RestartURL: next,
+	}
+	data.CSRFToken = csrfToken(w, r)
+
+	// Impersonating administrators can't change the user's keys
+	if userInfo.Actor != "" || !webauthn.Enabled() {
+		renderWebAuthnError(w, http.StatusForbidden, data, errors.New("Operazione non consentita"))
+		return
+	}
+
+	f, err := userFactors(userInfo)
+	if err != nil {
+		renderWebAuthnError(w, http.StatusServiceUnavailable, data, err)
+		return
+	}
+
+	editable := !(f.totp || f.webauthn) || strongSession(s)
+	status := http.StatusOK
+
+	if r.Method == "POST" {
+		switch {
+		case !checkCSRF(r):
+			err = errCSRF
+			status = http.StatusForbidden
+		case !editable:
+			err = errWebAuthnReauth
+			status = http.StatusForbidden
+		case r.PostFormValue("action") == "delete":
+			if err = webauthn.Remove(userInfo.Username, r.PostFormValue("id")); err == nil {
+				data.Message = "Chiave di sicurezza eliminata."
+			}
+		default:
+			if _, err = webauthn.FinishRegistration(userInfo.Username, s.ID, r.PostFormValue("name"), []byte(r.PostFormValue("credential"))); err == nil {
+				data.Message = "Chiave di sicurezza registrata! Dal prossimo accesso ti verrà chiesta dopo la password."
+			}
+		}
+
+		if err != nil {
+			data.Error = true
+			data.ErrorMessage = err.Error()
+
+			if status == http.StatusOK {
+				status = http.StatusBadRequest
+			}
+		}
+	}
+
+	data.Credentials = webauthn.Credentials(userInfo.Username)
+
+	if !editable {
+		data.Error = true
+		data.ErrorMessage = errWebAuthnReauth.Error()
+	} else if options, err := webauthn.BeginRegistration(userInfo.Username, userInfo.FullName, s.ID); err == nil {
+		data.Creation = &options
+	} else if err != webauthn.ErrTooManyKeys {
+		renderWebAuthnError(w, http.StatusServiceUnavailable, data, err)
+		return
+	}
+
+	renderPage(w, status, "webauthn.html", data)
+}
+
+// Visualizza la pagina con un errore che impedisce di proseguire
+func renderWebAuthnError(w http.ResponseWriter, status int, data webauthnData, err error) {
+	data.Expired = true
+	data.Error = true
+	data.ErrorMessage = err.Error()
+	renderPage(w, status, "webauthn.html", data)
+}
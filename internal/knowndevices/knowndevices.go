@@ -0,0 +1,344 @@
+/*
+ * knowndevices.go
+ *
+ * Dispositivi da cui gli utenti hanno effettuato l'accesso.
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+// Package per i dispositivi (browser) da cui gli utenti hanno effettuato
+// l'accesso. Ogni browser riceve un cookie di lunga durata con un identificatore
+// firmato dal server, così che conoscere l'identificatore (ad esempio dall'elenco
+// dei dispositivi) non basti per farsi riconoscere.
+package knowndevices
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"git.napaalm.xyz/napaalm/ssodav/internal/auth"
+	"git.napaalm.xyz/napaalm/ssodav/internal/config"
+)
+
+const (
+	// I browser non accettano cookie più lunghi di 400 giorni
+	defaultLifetime   = 400 * 24 * time.Hour
+	defaultMaxPerUser = 20
+	defaultAttribute  = "mail"
+
+	minKeySize = 16
+	idSize     = 16
+)
+
+var (
+	ErrNotFound = errors.New("Dispositivo non trovato")
+	ErrStore    = errors.New("Dispositivi non disponibili. Riprova più tardi.")
+)
+
+// Dispositivo da cui un utente ha effettuato l'accesso
+type Device struct {
+	ID        string    `json:"id"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+
+	// Indirizzo e browser dell'ultimo accesso
+	IP        string `json:"ip"`
+	UserAgent string `json:"user_agent"`
+}
+
+var (
+	mutex      sync.Mutex
+	path       string
+	key        []byte
+	maxPerUser int
+	devices    map[string][]*Device
+)
+
+// Carica la chiave e i dispositivi dai file indicati nella configurazione
+func Initialize() error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	devices = nil
+
+	c := config.Config.KnownDevices
+	if !c.Enabled {
+		return nil
+	}
+
+	if c.File == "" {
+		return errors.New("File dei dispositivi conosciuti non configurato")
+	}
+
+	if c.Key == "" {
+		return errors.New("Chiave dei dispositivi conosciuti non configurata")
+	}
+
+	b, err := ioutil.ReadFile(c.Key)
+	if err != nil {
+		return fmt.Errorf("Impossibile leggere la chiave dei dispositivi conosciuti: %v", err)
+	}
+
+	k := bytes.TrimSpace(b)
+	if len(k) < minKeySize {
+		return errors.New("Chiave dei dispositivi conosciuti troppo corta")
+	}
+
+	loaded := make(map[string][]*Device)
+
+	b, err = ioutil.ReadFile(c.File)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Impossibile leggere i dispositivi conosciuti: %v", err)
+	} else if err == nil {
+		if err := json.Unmarshal(b, &loaded); err != nil {
+			return fmt.Errorf("Impossibile leggere i dispositivi conosciuti: %v", err)
+		}
+	}
+
+	if maxPerUser = c.MaxPerUser; maxPerUser <= 0 {
+		maxPerUser = defaultMaxPerUser
+	}
+
+	path = c.File
+	key = k
+	devices = loaded
+	return nil
+}
+
+// Indica se i dispositivi vengono riconosciuti
+func Enabled() bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	return devices != nil
+}
+
+// Durata del cookie con l'identificatore del dispositivo
+func Lifetime() time.Duration {
+	if d := config.Config.KnownDevices.Lifetime.Duration; d > 0 {
+		return d
+	}
+
+	return defaultLifetime
+}
+
+// Crea un identificatore per un nuovo dispositivo e restituisce anche il valore
+// firmato da inserire nel cookie
+func NewCookie() (string, string, error) {
+	b := make([]byte, idSize)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+
+	id := base64.RawURLEncoding.EncodeToString(b)
+	return id, id + "." + sign(id), nil
+}
+
+// Controlla la firma del cookie e restituisce l'identificatore del dispositivo
+func Identify(cookie string) (string, bool) {
+	i := strings.LastIndex(cookie, ".")
+	if i < 0 || !hmac.Equal([]byte(cookie[i+1:]), []byte(sign(cookie[:i]))) {
+		return "", false
+	}
+
+	return cookie[:i], true
+}
+
+// Registra un accesso dell'utente dal dispositivo e indica se è la prima volta.
+// Oltre il limite vengono dimenticati i dispositivi usati meno di recente.
+func Seen(username, id, ip, userAgent string) (Device, bool, error) {
+	now := time.Now()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if devices == nil {
+		return Device{}, false, ErrStore
+	}
+
+	previous := devices[username]
+
+	d, known := find(previous, id)
+	if !known {
+		d = &Device{ID: id, FirstSeen: now}
+	}
+
+	updated := *d
+	updated.LastSeen = now
+	updated.IP = ip
+	updated.UserAgent = userAgent
+
+	list := []*Device{&updated}
+	for _, other := range previous {
+		if other.ID != id && len(list) < maxPerUser {
+			list = append(list, other)
+		}
+	}
+
+	devices[username] = list
+
+	if err := save(); err != nil {
+		log.Println("knowndevices: ", err.Error())
+		devices[username] = previous
+		return Device{}, false, ErrStore
+	}
+
+	return updated, !known, nil
+}
+
+// Restituisce i dispositivi dell'utente, dal più recente
+func List(username string) []Device {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	var list []Device
+	for _, d := range devices[username] {
+		list = append(list, *d)
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].LastSeen.After(list[j].LastSeen) })
+	return list
+}
+
+// Dimentica un dispositivo dell'utente, che al prossimo accesso sarà considerato nuovo
+func Forget(username, id string) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	previous := devices[username]
+	if _, ok := find(previous, id); !ok {
+		return ErrNotFound
+	}
+
+	var list []*Device
+	for _, d := range previous {
+		if d.ID != id {
+			list = append(list, d)
+		}
+	}
+
+	setDevices(username, list)
+
+	if err := save(); err != nil {
+		log.Println("knowndevices: ", err.Error())
+		devices[username] = previous
+		return ErrStore
+	}
+
+	return nil
+}
+
+// Dimentica tutti i dispositivi dell'utente e restituisce quanti erano
+func ForgetAll(username string) (int, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	previous := devices[username]
+	if len(previous) == 0 {
+		return 0, nil
+	}
+
+	delete(devices, username)
+
+	if err := save(); err != nil {
+		log.Println("knowndevices: ", err.Error())
+		devices[username] = previous
+		return 0, ErrStore
+	}
+
+	return len(previous), nil
+}
+
+// Restituisce l'indirizzo email a cui avvisare l'utente dei nuovi dispositivi,
+// vuoto se gli avvisi non sono abilitati o l'utente non ha un indirizzo
+func NotificationAddress(userInfo auth.UserInfo) string {
+	c := config.Config.KnownDevices
+	if !c.Notify {
+		return ""
+	}
+
+	attribute := c.Attribute
+	if attribute == "" {
+		attribute = defaultAttribute
+	}
+
+	if address := userInfo.Attribute(attribute); address != "" || config.Config.General.DummyAuth {
+		return address
+	}
+
+	values, err := auth.UserAttribute(userInfo.Username, attribute)
+	if err != nil || len(values) == 0 {
+		return ""
+	}
+
+	return values[0]
+}
+
+func find(list []*Device, id string) (*Device, bool) {
+	for _, d := range list {
+		if d.ID == id {
+			return d, true
+		}
+	}
+
+	return nil, false
+}
+
+func setDevices(username string, list []*Device) {
+	if len(list) == 0 {
+		delete(devices, username)
+	} else {
+		devices[username] = list
+	}
+}
+
+func sign(id string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("device:" + id))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Scrive i dispositivi nel file, sostituendolo in modo atomico
+func save() error {
+	b, err := json.Marshal(devices)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
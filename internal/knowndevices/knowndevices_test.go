@@ -0,0 +1,142 @@
+/*
+ * knowndevices_test.go
+ *
+ * File di test per il package knowndevices.
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+package knowndevices
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"git.napaalm.xyz/napaalm/ssodav/internal/auth"
+	"git.napaalm.xyz/napaalm/ssodav/internal/config"
+)
+
+func TestDevices(t *testing.T) {
+	dir, err := ioutil.TempDir("", "knowndevices")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key := filepath.Join(dir, "devices.key")
+	if err := ioutil.WriteFile(key, []byte("0123456789abcdef0123456789abcdef\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config.Config.KnownDevices.Enabled = true
+	config.Config.KnownDevices.File = filepath.Join(dir, "devices.json")
+	config.Config.KnownDevices.Key = key
+	config.Config.KnownDevices.MaxPerUser = 2
+
+	if err := Initialize(); err != nil {
+		t.Fatal(err)
+	}
+
+	id, cookie, err := NewCookie()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, ok := Identify(cookie); !ok || got != id {
+		t.Errorf("cookie %q not recognized", cookie)
+	}
+
+	// The identifier alone isn't enough
+	for _, forged := range []string{id, id + ".", id + "x." + cookie[len(id)+1:]} {
+		if _, ok := Identify(forged); ok {
+			t.Errorf("forged cookie %q accepted", forged)
+		}
+	}
+
+	if _, isNew, err := Seen("fry", id, "127.0.0.1", "curl"); !isNew || err != nil {
+		t.Errorf("device not new: %v", err)
+	}
+
+	d, isNew, err := Seen("fry", id, "127.0.0.2", "firefox")
+	if isNew || err != nil || d.IP != "127.0.0.2" || d.LastSeen.Before(d.FirstSeen) {
+		t.Errorf("unexpected device %+v: %v", d, err)
+	}
+
+	// Devices are per user
+	if _, isNew, _ := Seen("professor", id, "127.0.0.1", "curl"); !isNew {
+		t.Error("device shared between users")
+	}
+
+	// The least recently used devices are forgotten
+	second, _, _ := NewCookie()
+	third, _, _ := NewCookie()
+	Seen("fry", second, "127.0.0.1", "chromium")
+	Seen("fry", third, "127.0.0.1", "safari")
+
+	list := List("fry")
+	if len(list) != 2 || list[0].ID != third || list[1].ID != second {
+		t.Errorf("unexpected devices %+v", list)
+	}
+
+	// Devices survive a restart, the cookies too
+	if err := Initialize(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(List("fry")) != 2 {
+		t.Error("devices lost")
+	}
+
+	if _, ok := Identify(cookie); !ok {
+		t.Error("cookie not recognized after a restart")
+	}
+
+	if err := Forget("fry", second); err != nil || len(List("fry")) != 1 {
+		t.Errorf("device not forgotten: %v", err)
+	}
+
+	if err := Forget("fry", id); err != ErrNotFound {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	if n, err := ForgetAll("fry"); n != 1 || err != nil || len(List("fry")) != 0 {
+		t.Errorf("devices not forgotten: %d %v", n, err)
+	}
+
+	// Notifications go to the address of the user
+	config.Config.KnownDevices.Notify = true
+	config.Config.General.DummyAuth = true
+
+	if address := NotificationAddress(auth.UserInfo{Username: "fry", Attributes: map[string][]string{"mail": {"fry@example.org"}}}); address != "fry@example.org" {
+		t.Errorf("unexpected address %q", address)
+	}
+
+	// A missing key is reported
+	config.Config.KnownDevices.Key = filepath.Join(dir, "missing.key")
+	if err := Initialize(); err == nil {
+		t.Error("missing key accepted")
+	}
+
+	config.Config.KnownDevices.Enabled = false
+	if err := Initialize(); err != nil || Enabled() {
+		t.Error("known devices not disabled")
+	}
+}
@@ -0,0 +1,159 @@
+/*
+ * limiter.go
+ *
+ * Registro concorrente e limitato di rate limiter indicizzati per chiave.
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+// Package per la gestione di rate limiter per utente, indirizzo o altra chiave.
+package limiter
+
+import (
+	"container/list"
+	"hash/maphash"
+	"sync"
+	"time"
+
+	"git.napaalm.xyz/napaalm/ssodav/internal/rate"
+)
+
+// Numero di partizioni del registro, ciascuna con il proprio lock
+const shards = 16
+
+// Registro di rate limiter, sicuro per l'uso concorrente.
+// I limitatori inutilizzati per il tempo necessario a riempirsi vengono rimossi,
+// dato che sono equivalenti a limitatori nuovi. Gli altri non vengono mai
+// rimossi, perché non si possa azzerare il limite di una chiave creandone molte
+// altre: raggiunto il numero massimo di voci, le nuove chiavi condividono il
+// limitatore di riserva della propria partizione, così che riempire il registro
+// non conceda richieste illimitate alle chiavi che non vi trovano posto.
+type Registry struct {
+	interval time.Duration
+	burst    int
+	ttl      time.Duration
+	max      int
+	seed     maphash.Seed
+	shards   [shards]shard
+
+	// Replaced in tests
+	now func() time.Time
+}
+
+type shard struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+
+	// Limitatore delle chiavi che non trovano posto nella partizione
+	overflow *rate.Limiter
+}
+
+type entry struct {
+	key      string
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// Crea un registro di limitatori che consentono una richiesta ogni interval
+// con raffiche di al più burst richieste, mantenendone al più max.
+func New(interval time.Duration, burst, max int) *Registry {
+	perShard := (max + shards - 1) / shards
+	if perShard < 1 {
+		perShard = 1
+	}
+
+	r := &Registry{
+		interval: interval,
+		burst:    burst,
+		ttl:      interval * time.Duration(burst),
+		max:      perShard,
+		seed:     maphash.MakeSeed(),
+		now:      time.Now,
+	}
+
+	for i := range r.shards {
+		r.shards[i].entries = make(map[string]*list.Element)
+		r.shards[i].lru = list.New()
+		r.shards[i].overflow = rate.NewLimiter(rate.Every(interval), burst)
+	}
+
+	return r
+}
+
+// Restituisce il limitatore associato alla chiave, creandolo se necessario,
+// oppure quello di riserva se la partizione è piena
+func (r *Registry) Get(key string) *rate.Limiter {
+	s := r.shard(key)
+	now := r.now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if el, ok := s.entries[key]; ok {
+		e := el.Value.(*entry)
+		e.lastSeen = now
+		s.lru.MoveToFront(el)
+		return e.limiter
+	}
+
+	// Drop the limiters that are full again, the least recently used being at the back
+	for el := s.lru.Back(); el != nil; el = s.lru.Back() {
+		e := el.Value.(*entry)
+		if now.Sub(e.lastSeen) < r.ttl {
+			break
+		}
+
+		s.lru.Remove(el)
+		delete(s.entries, e.key)
+	}
+
+	if s.lru.Len() >= r.max {
+		return s.overflow
+	}
+
+	limiter := rate.NewLimiter(rate.Every(r.interval), r.burst)
+	s.entries[key] = s.lru.PushFront(&entry{key: key, limiter: limiter, lastSeen: now})
+
+	return limiter
+}
+
+// Restituisce il numero di limitatori presenti nel registro
+func (r *Registry) Len() int {
+	n := 0
+
+	for i := range r.shards {
+		s := &r.shards[i]
+		s.mu.Lock()
+		n += s.lru.Len()
+		s.mu.Unlock()
+	}
+
+	return n
+}
+
+// Seleziona la partizione di una chiave; il seme casuale impedisce di
+// concentrare le chiavi di un attaccante in un'unica partizione
+func (r *Registry) shard(key string) *shard {
+	var h maphash.Hash
+	h.SetSeed(r.seed)
+	h.WriteString(key)
+
+	return &r.shards[h.Sum64()%shards]
+}
@@ -0,0 +1,170 @@
+/*
+ * limiter_test.go
+ *
+ * File di test per il package limiter.
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+package limiter
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRegistry(t *testing.T) {
+	r := New(time.Minute, 3, 1000)
+
+	// The same key always gets the same limiter
+	if r.Get("professor") != r.Get("professor") || r.Get("professor") == r.Get("fry") {
+		t.Fatal("unexpected limiter identity")
+	}
+
+	l := r.Get("professor")
+	for i := 0; i < 3; i++ {
+		if !l.Allow() {
+			t.Fatalf("request %d refused", i)
+		}
+	}
+
+	if r.Get("professor").Allow() {
+		t.Error("burst exceeded")
+	}
+
+	if !r.Get("fry").Allow() {
+		t.Error("limiters shared between keys")
+	}
+}
+
+func TestEviction(t *testing.T) {
+	now := time.Now()
+	r := New(time.Minute, 3, 100000)
+	r.now = func() time.Time { return now }
+
+	limited := r.Get("professor")
+	limited.Allow()
+
+	// Limiters in use are kept
+	now = now.Add(2 * time.Minute)
+	if r.Get("professor") != limited {
+		t.Fatal("limiter in use evicted")
+	}
+
+	// Idle limiters are dropped once they would be full again
+	now = now.Add(3*time.Minute + time.Second)
+	for i := 0; i < 1000; i++ {
+		r.Get(strconv.Itoa(i))
+	}
+
+	if n := r.Len(); n != 1000 {
+		t.Errorf("idle limiter kept: %d limiters", n)
+	}
+
+	// The number of limiters never exceeds the cap
+	r = New(time.Minute, 3, 32)
+	for i := 0; i < 10000; i++ {
+		r.Get("user" + strconv.Itoa(i))
+	}
+
+	if n := r.Len(); n > 32 || n == 0 {
+		t.Errorf("unexpected number of limiters %d", n)
+	}
+
+}
+
+func TestSpraying(t *testing.T) {
+	r := New(time.Minute, 3, 32)
+
+	exhausted := r.Get("professor")
+	for exhausted.Allow() {
+	}
+
+	// Creating many other keys doesn't reset the limit of an exhausted key
+	for i := 0; i < 10000; i++ {
+		r.Get("spray" + strconv.Itoa(i)).Allow()
+	}
+
+	if l := r.Get("professor"); l != exhausted || l.Allow() {
+		t.Error("exhausted limiter reset")
+	}
+
+	// Keys that don't fit in a full registry are still throttled
+	allowed := 0
+	for i := 0; i < 3; i++ {
+		if r.Get("late").Allow() {
+			allowed++
+		}
+	}
+
+	if allowed != 0 || r.Get("late").Allow() {
+		t.Error("key over the cap not throttled")
+	}
+
+	for i := 0; i < 1000; i++ {
+		if r.Get("late" + strconv.Itoa(i)).Allow() {
+			t.Fatalf("key over the cap allowed")
+		}
+	}
+
+	if n := r.Len(); n > 32 {
+		t.Errorf("unexpected number of limiters %d", n)
+	}
+}
+
+func TestConcurrency(t *testing.T) {
+	r := New(time.Hour, 5, 1024)
+
+	var wg sync.WaitGroup
+	allowed := make([]int, 8)
+
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+
+		go func(g int) {
+			defer wg.Done()
+
+			for i := 0; i < 1000; i++ {
+				r.Get("spray" + strconv.Itoa(g*1000+i))
+
+				if r.Get("shared").Allow() {
+					allowed[g]++
+				}
+			}
+		}(g)
+	}
+
+	wg.Wait()
+
+	total := 0
+	for _, n := range allowed {
+		total += n
+	}
+
+	// The shared limiter is never evicted while in use, so its burst holds
+	if total != 5 {
+		t.Errorf("%d requests allowed on the shared limiter", total)
+	}
+
+	if n := r.Len(); n > 1024 {
+		t.Errorf("unexpected number of limiters %d", n)
+	}
+}
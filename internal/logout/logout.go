@@ -0,0 +1,297 @@
+/*
+ * logout.go
+ *
+ * Disconnessione delle applicazioni registrate all'uscita dell'utente.
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+// Package per la disconnessione unica (single logout): alla fine di una sessione
+// vengono avvisate tutte le applicazioni registrate, dal browser tramite iframe
+// (front-channel) e dal server con un logout token firmato (back-channel), come
+// previsto dalle specifiche OpenID Connect Front-Channel e Back-Channel Logout.
+package logout
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	neturl "net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"git.napaalm.xyz/napaalm/ssodav/internal/auth"
+	"git.napaalm.xyz/napaalm/ssodav/internal/config"
+)
+
+// Canali di notifica
+const (
+	FrontChannel = "frontchannel"
+	BackChannel  = "backchannel"
+)
+
+// Stato delle notifiche
+const (
+	StatusPending      = "pending"
+	StatusAcknowledged = "acknowledged"
+	StatusFailed       = "failed"
+)
+
+const (
+	// Durata dello stato di una disconnessione
+	recordLifetime = 10 * time.Minute
+
+	// Tempo massimo di attesa della risposta di un'applicazione
+	requestTimeout = 5 * time.Second
+)
+
+var ErrNotFound = errors.New("Disconnessione non trovata oppure scaduta")
+
+// Notifica della disconnessione a un'applicazione
+type Notification struct {
+	ClientID string `json:"client_id"`
+	Name     string `json:"name"`
+	Channel  string `json:"channel"`
+	Status   string `json:"status"`
+
+	// URL da caricare nell'iframe, solo per il front-channel
+	URL string `json:"-"`
+}
+
+// Disconnessione in corso o conclusa
+type Logout struct {
+	ID            string
+	Username      string
+	SessionID     string
+	Notifications []Notification
+
+	expires time.Time
+}
+
+// Indica se tutte le applicazioni hanno risposto
+func (l Logout) Complete() bool {
+	for _, n := range l.Notifications {
+		if n.Status == StatusPending {
+			return false
+		}
+	}
+
+	return true
+}
+
+var (
+	mutex   sync.Mutex
+	logouts map[string]*Logout
+
+	// Redirects aren't followed: the application must answer by itself
+	client = &http.Client{
+		Timeout: requestTimeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+)
+
+// Inizializza l'archivio delle disconnessioni
+func Initialize() {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	logouts = make(map[string]*Logout)
+}
+
+// Indica se almeno un'applicazione va avvisata all'uscita degli utenti
+func Enabled() bool {
+	for _, c := range config.Config.Clients {
+		if c.FrontChannelLogout != "" || c.BackChannelLogout != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Avvia la disconnessione delle applicazioni dalla sessione sessionID dell'utente:
+// le notifiche back-channel partono subito, quelle front-channel (se frontChannel
+// è vero) vanno caricate dal browser e confermate con Acknowledge.
+func Start(username, sessionID string, frontChannel bool) (Logout, error) {
+	id, err := randomID()
+	if err != nil {
+		return Logout{}, err
+	}
+
+	l := &Logout{
+		ID:        id,
+		Username:  username,
+		SessionID: sessionID,
+		expires:   time.Now().Add(recordLifetime),
+	}
+
+	for _, c := range config.Config.Clients {
+		if frontChannel && c.FrontChannelLogout != "" {
+			l.Notifications = append(l.Notifications, Notification{
+				ClientID: c.ID,
+				Name:     c.Name,
+				Channel:  FrontChannel,
+				Status:   StatusPending,
+				URL:      frontChannelURL(c.FrontChannelLogout, sessionID),
+			})
+		}
+
+		if c.BackChannelLogout != "" {
+			l.Notifications = append(l.Notifications, Notification{
+				ClientID: c.ID,
+				Name:     c.Name,
+				Channel:  BackChannel,
+				Status:   StatusPending,
+				URL:      c.BackChannelLogout,
+			})
+		}
+	}
+
+	mutex.Lock()
+	sweep(time.Now())
+	logouts[id] = l
+	result := l.copy()
+	mutex.Unlock()
+
+	for i, n := range result.Notifications {
+		if n.Channel == BackChannel {
+			go notify(id, i, username, sessionID, n)
+		}
+	}
+
+	return result, nil
+}
+
+// Restituisce lo stato di una disconnessione
+func Status(id string) (Logout, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	l, ok := logouts[id]
+	if !ok || time.Now().After(l.expires) {
+		return Logout{}, ErrNotFound
+	}
+
+	return l.copy(), nil
+}
+
+// Registra il caricamento dell'iframe front-channel di un'applicazione
+func Acknowledge(id, clientID string) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	l, ok := logouts[id]
+	if !ok || time.Now().After(l.expires) {
+		return ErrNotFound
+	}
+
+	for i, n := range l.Notifications {
+		if n.ClientID == clientID && n.Channel == FrontChannel {
+			l.Notifications[i].Status = StatusAcknowledged
+			return nil
+		}
+	}
+
+	return ErrNotFound
+}
+
+// Invia il logout token a un'applicazione e ne registra l'esito
+func notify(id string, i int, username, sessionID string, n Notification) {
+	status := StatusAcknowledged
+
+	if err := post(n.URL, username, sessionID, n.ClientID); err != nil {
+		log.Printf("logout: notification to %s failed: %s", n.ClientID, err.Error())
+		status = StatusFailed
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if l, ok := logouts[id]; ok {
+		l.Notifications[i].Status = status
+	}
+}
+
+func post(url, username, sessionID, clientID string) error {
+	token, err := auth.IssueLogoutToken(username, sessionID, clientID)
+	if err != nil {
+		return err
+	}
+
+	form := neturl.Values{"logout_token": {string(token)}}
+
+	resp, err := client.Post(url, "application/x-www-form-urlencoded", strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// Aggiunge all'URL front-channel l'emittente e la sessione
+func frontChannelURL(rawURL, sessionID string) string {
+	u, err := neturl.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+
+	query := u.Query()
+	query.Set("iss", config.Config.General.FQDN)
+	if sessionID != "" {
+		query.Set("sid", sessionID)
+	}
+	u.RawQuery = query.Encode()
+
+	return u.String()
+}
+
+func (l *Logout) copy() Logout {
+	c := *l
+	c.Notifications = append([]Notification(nil), l.Notifications...)
+	return c
+}
+
+// Rimuove le disconnessioni scadute
+func sweep(now time.Time) {
+	for id, l := range logouts {
+		if now.After(l.expires) {
+			delete(logouts, id)
+		}
+	}
+}
+
+func randomID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,145 @@
+/*
+ * logout_test.go
+ *
+ * File di test per il package logout.
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+package logout
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	neturl "net/url"
+	"testing"
+	"time"
+
+	"git.napaalm.xyz/napaalm/ssodav/internal/auth"
+	"git.napaalm.xyz/napaalm/ssodav/internal/config"
+	"git.napaalm.xyz/napaalm/ssodav/pkg/verifier"
+	"github.com/BurntSushi/toml"
+)
+
+func TestLogout(t *testing.T) {
+	config.Config.General.FQDN = "sso.example.org"
+	config.Config.General.JWTSecret = "secret"
+	config.Config.General.JWTAlgorithm = "HS256"
+
+	if err := auth.InitializeSigning(); err != nil {
+		t.Fatal(err)
+	}
+
+	v := verifier.NewHMAC([]byte("secret"), "moodle")
+	received := make(chan *verifier.LogoutClaims, 1)
+
+	moodle := httptest.NewServer(v.LogoutHandler(func(c *verifier.LogoutClaims) { received <- c }))
+	defer moodle.Close()
+
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "", http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+
+	config.Config.Clients = nil
+	Initialize()
+
+	if Enabled() {
+		t.Error("logout enabled without applications")
+	}
+
+	clients := fmt.Sprintf(`
+[[Client]]
+id="moodle"
+nome="Moodle"
+logout_frontchannel="https://moodle.example.org/logout?a=1"
+logout_backchannel="%s"
+
+[[Client]]
+id="wiki"
+logout_backchannel="%s"
+
+[[Client]]
+id="aula-magna-tv"
+`, moodle.URL, broken.URL)
+
+	if _, err := toml.Decode(clients, &config.Config); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := Start("professor", "session-id", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(l.Notifications) != 3 || l.Complete() {
+		t.Fatalf("unexpected notifications %+v", l.Notifications)
+	}
+
+	// The front-channel URL carries the issuer and the session
+	front, _ := neturl.Parse(l.Notifications[0].URL)
+	if l.Notifications[0].Channel != FrontChannel || front.Query().Get("a") != "1" ||
+		front.Query().Get("iss") != "sso.example.org" || front.Query().Get("sid") != "session-id" {
+		t.Errorf("unexpected front-channel notification %+v", l.Notifications[0])
+	}
+
+	select {
+	case c := <-received:
+		if c.Username != "professor" || c.SessionID != "session-id" {
+			t.Errorf("unexpected logout token %+v", c)
+		}
+	case <-time.After(requestTimeout):
+		t.Fatal("back-channel notification not received")
+	}
+
+	if err := Acknowledge(l.ID, "moodle"); err != nil {
+		t.Error(err)
+	}
+
+	if err := Acknowledge(l.ID, "wiki"); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+
+	// Wait for both back-channel results
+	deadline := time.Now().Add(requestTimeout)
+	for !l.Complete() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+
+		if l, err = Status(l.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := []string{StatusAcknowledged, StatusAcknowledged, StatusFailed}
+	for i, n := range l.Notifications {
+		if n.Status != expected[i] {
+			t.Errorf("%s %s: expected %s, got %s", n.ClientID, n.Channel, expected[i], n.Status)
+		}
+	}
+
+	// Without the browser only the back-channel is used
+	if l, _ := Start("professor", "session-id", false); len(l.Notifications) != 2 {
+		t.Errorf("unexpected notifications %+v", l.Notifications)
+	}
+
+	if _, err := Status("unknown"); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,205 @@
+/*
+ * mail.go
+ *
+ * Invio delle email tramite il server SMTP configurato.
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+// Package per l'invio di email di solo testo tramite il server SMTP indicato
+// nella configurazione.
+package mail
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	netmail "net/mail"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"git.napaalm.xyz/napaalm/ssodav/internal/config"
+)
+
+// Tempo massimo per la consegna di un messaggio al server
+const timeout = 10 * time.Second
+
+var ErrNotConfigured = errors.New("Server SMTP non configurato")
+
+var (
+	// Mittente dei messaggi, nil se il server non è configurato
+	sender *netmail.Address
+
+	// Configurazione TLS usata per la connessione al server
+	tlsConfig *tls.Config
+)
+
+// Legge la configurazione del server SMTP, che è facoltativo
+func Initialize() error {
+	sender = nil
+
+	c := config.Config.SMTP
+	if c.Server == "" {
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(c.Server)
+	if err != nil {
+		return fmt.Errorf("Indirizzo del server SMTP \"%s\" non valido", c.Server)
+	}
+
+	switch c.Security {
+	case "", "starttls", "tls", "nessuna":
+	default:
+		return fmt.Errorf("Valore di sicurezza \"%s\" del server SMTP non valido", c.Security)
+	}
+
+	from, err := netmail.ParseAddress(c.From)
+	if err != nil {
+		return fmt.Errorf("Mittente \"%s\" non valido", c.From)
+	}
+
+	tlsConfig = &tls.Config{ServerName: host}
+	sender = from
+	return nil
+}
+
+// Indica se il server SMTP è configurato
+func Enabled() bool {
+	return sender != nil
+}
+
+// Invia un messaggio di solo testo al destinatario
+func Send(to, subject, body string) error {
+	if sender == nil {
+		return ErrNotConfigured
+	}
+
+	rcpt, err := netmail.ParseAddress(to)
+	if err != nil {
+		return err
+	}
+
+	msg, err := message(rcpt, subject, body)
+	if err != nil {
+		return err
+	}
+
+	return deliver(rcpt.Address, msg)
+}
+
+// Compone il messaggio con le intestazioni e il corpo in quoted-printable
+func message(rcpt *netmail.Address, subject, body string) ([]byte, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	domain := sender.Address[strings.LastIndex(sender.Address, "@")+1:]
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", sender.String())
+	fmt.Fprintf(&b, "To: %s\r\n", rcpt.String())
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-ID: <%s@%s>\r\n", hex.EncodeToString(id), domain)
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+
+	w := quotedprintable.NewWriter(&b)
+	if _, err := w.Write([]byte(body)); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
+
+// Consegna il messaggio al server SMTP
+func deliver(to string, msg []byte) error {
+	c := config.Config.SMTP
+	dialer := &net.Dialer{Timeout: timeout}
+
+	var conn net.Conn
+	var err error
+
+	if c.Security == "tls" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", c.Server, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", c.Server)
+	}
+	if err != nil {
+		return err
+	}
+
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	client, err := smtp.NewClient(conn, tlsConfig.ServerName)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	// Never fall back to plain text when STARTTLS is expected
+	if c.Security == "" || c.Security == "starttls" {
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+
+	if c.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", c.Username, c.Password, tlsConfig.ServerName)); err != nil {
+			return err
+		}
+	}
+
+	if err := client.Mail(sender.Address); err != nil {
+		return err
+	}
+
+	if err := client.Rcpt(to); err != nil {
+		return err
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
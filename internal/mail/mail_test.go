@@ -0,0 +1,145 @@
+/*
+ * mail_test.go
+ *
+ * File di test per il package mail.
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+package mail
+
+import (
+	"bufio"
+	"io/ioutil"
+	"mime/quotedprintable"
+	"net"
+	"strings"
+	"testing"
+
+	"git.napaalm.xyz/napaalm/ssodav/internal/config"
+)
+
+// Server SMTP minimale che accetta un messaggio e lo invia sul canale
+func fakeServer(t *testing.T, messages chan<- string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		defer l.Close()
+
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		r := bufio.NewReader(conn)
+		reply := func(s string) { conn.Write([]byte(s + "\r\n")) }
+
+		reply("220 localhost ESMTP")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+
+			switch cmd := strings.ToUpper(strings.TrimSpace(line)); {
+			case strings.HasPrefix(cmd, "EHLO"):
+				reply("250 localhost")
+			case cmd == "DATA":
+				reply("354 go ahead")
+
+				var msg strings.Builder
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil || line == ".\r\n" {
+						break
+					}
+					msg.WriteString(line)
+				}
+
+				messages <- msg.String()
+				reply("250 queued")
+			case cmd == "QUIT":
+				reply("221 bye")
+				return
+			default:
+				reply("250 ok")
+			}
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func TestSend(t *testing.T) {
+	messages := make(chan string, 1)
+
+	config.Config.SMTP.Server = fakeServer(t, messages)
+	config.Config.SMTP.Security = "nessuna"
+	config.Config.SMTP.From = "SSO Scuola <sso@example.org>"
+
+	if err := Initialize(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Send("relatore@example.net", "Codice di accesso", "Il codice è 123456.\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := <-messages
+
+	for _, header := range []string{
+		"From: \"SSO Scuola\" <sso@example.org>\r\n",
+		"To: <relatore@example.net>\r\n",
+		"Subject: Codice di accesso\r\n",
+		"Content-Transfer-Encoding: quoted-printable\r\n",
+	} {
+		if !strings.Contains(msg, header) {
+			t.Errorf("header %q missing in\n%s", header, msg)
+		}
+	}
+
+	body, err := ioutil.ReadAll(quotedprintable.NewReader(strings.NewReader(msg[strings.Index(msg, "\r\n\r\n")+4:])))
+	if err != nil || string(body) != "Il codice è 123456.\r\n" {
+		t.Errorf("unexpected body %q: %v", body, err)
+	}
+
+	// Invalid recipients are refused before connecting
+	if err := Send("relatore@example.net\r\nBcc: fry@example.org", "x", "x"); err == nil {
+		t.Error("invalid recipient accepted")
+	}
+
+	// Invalid configurations are reported
+	config.Config.SMTP.Security = "ssl"
+	if err := Initialize(); err == nil {
+		t.Error("invalid security accepted")
+	}
+
+	config.Config.SMTP.Server = ""
+	if err := Initialize(); err != nil || Enabled() {
+		t.Error("SMTP not disabled")
+	}
+
+	if err := Send("relatore@example.net", "x", "x"); err != ErrNotConfigured {
+		t.Errorf("unexpected error %v", err)
+	}
+}
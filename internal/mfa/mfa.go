@@ -0,0 +1,170 @@
+/*
+ * mfa.go
+ *
+ * Accessi in attesa del secondo fattore di autenticazione.
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+// Package per gli accessi in attesa del secondo fattore: dopo la verifica della
+// password il server conserva l'utente in un accesso identificato da un ID
+// casuale, che il browser presenta insieme al codice di verifica.
+package mfa
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"sync"
+	"time"
+
+	"git.napaalm.xyz/napaalm/ssodav/internal/auth"
+)
+
+const (
+	// Tempo a disposizione per inserire il codice
+	loginLifetime = 5 * time.Minute
+
+	// Tentativi a disposizione per ogni accesso
+	maxAttempts = 5
+
+	// Numero massimo di accessi in attesa
+	maxPending = 10000
+)
+
+var (
+	ErrNotFound        = errors.New("Accesso scaduto. Inserisci di nuovo le credenziali.")
+	ErrTooManyAttempts = errors.New("Hai superato il numero massimo di tentativi. Inserisci di nuovo le credenziali.")
+	ErrTooManyRequests = errors.New("Troppe richieste di accesso. Riprova più tardi.")
+)
+
+// Accesso in attesa del secondo fattore
+type Login struct {
+	UserInfo auth.UserInfo
+
+	// Metodi di autenticazione già verificati
+	Methods []string
+
+	// Opzioni della pagina di accesso
+	Remember bool
+	Next     string
+
+	// State inviato dal servizio con la richiesta di accesso e impronta PKCE
+	// a cui legare il codice monouso
+	State     string
+	Challenge string
+
+	// Segreto proposto all'utente che sta configurando la verifica
+	Secret []byte
+
+	// Sessione da cui l'utente ha chiesto di configurare la verifica, vuota
+	// se si tratta di un accesso
+	SessionID string
+
+	attempts int
+	expires  time.Time
+}
+
+var (
+	mutex  sync.Mutex
+	logins map[string]*Login
+)
+
+// Inizializza l'archivio degli accessi
+func Initialize() {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	logins = make(map[string]*Login)
+}
+
+// Registra un accesso e ne restituisce l'ID
+func Start(login Login) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	id := base64.RawURLEncoding.EncodeToString(b)
+	now := time.Now()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	sweep(now)
+
+	if len(logins) >= maxPending {
+		return "", ErrTooManyRequests
+	}
+
+	login.attempts = 0
+	login.expires = now.Add(loginLifetime)
+	logins[id] = &login
+
+	return id, nil
+}
+
+// Restituisce una copia dell'accesso
+func Get(id string) (Login, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	l, ok := logins[id]
+	if !ok || time.Now().After(l.expires) {
+		delete(logins, id)
+		return Login{}, ErrNotFound
+	}
+
+	return *l, nil
+}
+
+// Registra un tentativo fallito; superato il limite l'accesso viene eliminato
+func Fail(id string) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	l, ok := logins[id]
+	if !ok {
+		return ErrNotFound
+	}
+
+	if l.attempts++; l.attempts >= maxAttempts {
+		delete(logins, id)
+		return ErrTooManyAttempts
+	}
+
+	return nil
+}
+
+// Conclude l'accesso, che non può più essere usato
+func Finish(id string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	delete(logins, id)
+}
+
+// Elimina gli accessi scaduti
+func sweep(now time.Time) {
+	for id, l := range logins {
+		if now.After(l.expires) {
+			delete(logins, id)
+		}
+	}
+}
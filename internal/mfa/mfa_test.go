@@ -0,0 +1,77 @@
+/*
+ * mfa_test.go
+ *
+ * File di test per il package mfa.
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+package mfa
+
+import (
+	"testing"
+	"time"
+
+	"git.napaalm.xyz/napaalm/ssodav/internal/auth"
+)
+
+func TestLogins(t *testing.T) {
+	Initialize()
+
+	id, err := Start(Login{UserInfo: auth.UserInfo{Username: "professor"}, Methods: []string{"pwd"}, Next: "http://example.org", Secret: []byte("secret")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := Get(id)
+	if err != nil || l.UserInfo.Username != "professor" || string(l.Secret) != "secret" || l.Next != "http://example.org" {
+		t.Errorf("unexpected login %+v %v", l, err)
+	}
+
+	// Too many attempts
+	for i := 1; i < maxAttempts; i++ {
+		if err := Fail(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := Fail(id); err != ErrTooManyAttempts {
+		t.Errorf("expected ErrTooManyAttempts, got %v", err)
+	}
+
+	if _, err := Get(id); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+
+	// Finished logins
+	id, _ = Start(Login{})
+	Finish(id)
+
+	if _, err := Get(id); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+
+	// Expired logins
+	id, _ = Start(Login{})
+	logins[id].expires = time.Now().Add(-time.Second)
+
+	if _, err := Get(id); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
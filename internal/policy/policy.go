@@ -0,0 +1,205 @@
+/*
+ * policy.go
+ *
+ * Politiche sulla durata delle sessioni e dei token.
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+// Package per la scelta della durata delle sessioni e dei token secondo le
+// politiche configurate, in base al gruppo dell'utente, al servizio richiesto
+// e all'indirizzo di provenienza.
+package policy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"git.napaalm.xyz/napaalm/ssodav/internal/auth"
+	"git.napaalm.xyz/napaalm/ssodav/internal/config"
+	"git.napaalm.xyz/napaalm/ssodav/internal/session"
+)
+
+// Durata predefinita dei token rilasciati all'accesso
+const defaultTokenLifetime = 24 * time.Hour
+
+// Politica applicata a una richiesta
+type Policy struct {
+	// Nome della politica configurata, vuoto se non se ne applica nessuna
+	Name string
+
+	MaxLifetime         time.Duration
+	IdleTimeout         time.Duration
+	RememberMaxLifetime time.Duration
+	RememberIdleTimeout time.Duration
+	RememberAllowed     bool
+
+	TokenLifetime time.Duration
+
+	// Indica se la durata dei token è stata scelta dalla politica
+	tokenLifetimeSet bool
+}
+
+// Reti delle politiche configurate, nello stesso ordine
+var networks [][]*net.IPNet
+
+// Legge le reti delle politiche configurate
+func Initialize() error {
+	parsed := make([][]*net.IPNet, len(config.Config.Policies))
+
+	for i, p := range config.Config.Policies {
+		for _, network := range p.Networks {
+			n, err := ParseNetwork(network)
+			if err != nil {
+				return fmt.Errorf("Rete \"%s\" non valida nella politica \"%s\"", network, p.Name)
+			}
+
+			parsed[i] = append(parsed[i], n)
+		}
+	}
+
+	networks = parsed
+	return nil
+}
+
+// Restituisce la politica per l'accesso dell'utente al servizio audience (origine
+// o ID del client, anche vuoto) dall'indirizzo ip
+func For(userInfo auth.UserInfo, audience, ip string) Policy {
+	maxLifetime, idle := session.Lifetime(false)
+	rememberMaxLifetime, rememberIdle := session.Lifetime(true)
+
+	result := Policy{
+		MaxLifetime:         maxLifetime,
+		IdleTimeout:         idle,
+		RememberMaxLifetime: rememberMaxLifetime,
+		RememberIdleTimeout: rememberIdle,
+		RememberAllowed:     true,
+		TokenLifetime:       defaultTokenLifetime,
+	}
+
+	addr := net.ParseIP(ip)
+
+	for i, p := range config.Config.Policies {
+		if !contains(p.Groups, userInfo.Group) || !contains(p.Audiences, audience) || !inNetworks(i, addr) {
+			continue
+		}
+
+		result.Name = p.Name
+		set(&result.MaxLifetime, p.MaxLifetime.Duration)
+		set(&result.IdleTimeout, p.IdleTimeout.Duration)
+		set(&result.RememberMaxLifetime, p.RememberMaxLifetime.Duration)
+		set(&result.RememberIdleTimeout, p.RememberIdleTimeout.Duration)
+
+		if p.Remember != nil {
+			result.RememberAllowed = *p.Remember
+		}
+
+		if p.TokenLifetime.Duration > 0 {
+			result.TokenLifetime = p.TokenLifetime.Duration
+			result.tokenLifetimeSet = true
+		}
+
+		break
+	}
+
+	return result
+}
+
+// Restituisce la durata massima e quella di inattività della sessione; la
+// richiesta di ricordare l'accesso viene ignorata se la politica non la consente
+func (p Policy) Session(remember bool) (time.Duration, time.Duration) {
+	if remember && p.RememberAllowed {
+		return p.RememberMaxLifetime, p.RememberIdleTimeout
+	}
+
+	return p.MaxLifetime, p.IdleTimeout
+}
+
+// Limita la durata di un token alla durata scelta dalla politica, se presente
+func (p Policy) CapToken(exp time.Duration) time.Duration {
+	if p.tokenLifetimeSet && p.TokenLifetime < exp {
+		return p.TokenLifetime
+	}
+
+	return exp
+}
+
+// Controlla se l'indirizzo appartiene a una delle reti della politica i
+// (sempre vero se la politica non ne indica)
+func inNetworks(i int, addr net.IP) bool {
+	if len(config.Config.Policies[i].Networks) == 0 {
+		return true
+	}
+
+	if addr == nil || i >= len(networks) {
+		return false
+	}
+
+	for _, n := range networks[i] {
+		if n.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Accetta una rete in notazione CIDR oppure un singolo indirizzo
+func ParseNetwork(network string) (*net.IPNet, error) {
+	if !strings.Contains(network, "/") {
+		ip := net.ParseIP(network)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address %s", network)
+		}
+
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 8 * net.IPv4len
+		}
+
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+
+	_, n, err := net.ParseCIDR(network)
+	return n, err
+}
+
+// Controlla se value è tra i valori (sempre vero se non ce ne sono)
+func contains(values []string, value string) bool {
+	if len(values) == 0 {
+		return true
+	}
+
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+func set(d *time.Duration, value time.Duration) {
+	if value > 0 {
+		*d = value
+	}
+}
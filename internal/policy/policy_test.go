@@ -0,0 +1,117 @@
+/*
+ * policy_test.go
+ *
+ * File di test per il package policy.
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+package policy
+
+import (
+	"testing"
+	"time"
+
+	"git.napaalm.xyz/napaalm/ssodav/internal/auth"
+	"git.napaalm.xyz/napaalm/ssodav/internal/config"
+	"github.com/BurntSushi/toml"
+)
+
+const testPolicies = `
+[Sessioni]
+durata_massima="12h"
+inattivita="1h"
+
+[[Politica]]
+nome="laboratori"
+gruppi=["Studenti"]
+reti=["10.1.0.0/16", "192.168.1.10"]
+durata_massima="1h"
+inattivita="15m"
+ricordami=false
+durata_token="1h"
+
+[[Politica]]
+nome="moodle"
+audience=["https://moodle.example.org", "aula-magna-tv"]
+durata_massima_ricordami="720h"
+`
+
+func TestPolicies(t *testing.T) {
+	config.Config.Policies = nil
+
+	if _, err := toml.Decode(testPolicies, &config.Config); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Initialize(); err != nil {
+		t.Fatal(err)
+	}
+
+	student := auth.UserInfo{Username: "fry", Group: "Studenti"}
+	staff := auth.UserInfo{Username: "professor", Group: "Office Management"}
+
+	// Students in the labs
+	p := For(student, "https://moodle.example.org", "10.1.2.3")
+	if p.Name != "laboratori" {
+		t.Fatalf("expected the lab policy, got %q", p.Name)
+	}
+
+	if lifetime, idle := p.Session(true); lifetime != time.Hour || idle != 15*time.Minute {
+		t.Errorf("remember me not ignored: %v %v", lifetime, idle)
+	}
+
+	if p.TokenLifetime != time.Hour || p.CapToken(24*time.Hour) != time.Hour || p.CapToken(time.Minute) != time.Minute {
+		t.Errorf("unexpected token lifetime %v", p.TokenLifetime)
+	}
+
+	if p := For(student, "", "192.168.1.10"); p.Name != "laboratori" {
+		t.Errorf("expected the lab policy for a single address, got %q", p.Name)
+	}
+
+	// The first applicable policy wins, the others only apply outside the labs
+	p = For(student, "https://moodle.example.org", "10.2.0.1")
+	if p.Name != "moodle" || !p.RememberAllowed {
+		t.Fatalf("expected the moodle policy, got %q", p.Name)
+	}
+
+	if lifetime, idle := p.Session(true); lifetime != 720*time.Hour || idle != 3*24*time.Hour {
+		t.Errorf("unexpected remember me lifetime %v %v", lifetime, idle)
+	}
+
+	if lifetime, idle := p.Session(false); lifetime != 12*time.Hour || idle != time.Hour {
+		t.Errorf("unexpected lifetime %v %v", lifetime, idle)
+	}
+
+	// Without an applicable policy the session settings are used
+	p = For(staff, "https://example.org", "10.1.2.3")
+	if p.Name != "" || p.TokenLifetime != defaultTokenLifetime || p.CapToken(48*time.Hour) != 48*time.Hour {
+		t.Errorf("unexpected policy %+v", p)
+	}
+
+	if p := For(student, "", "not an address"); p.Name != "" {
+		t.Errorf("unexpected policy %q for an invalid address", p.Name)
+	}
+
+	// Invalid networks are reported
+	config.Config.Policies[0].Networks = []string{"10.1.0.0/33"}
+	if err := Initialize(); err == nil {
+		t.Error("invalid network accepted")
+	}
+}
@@ -0,0 +1,251 @@
+/*
+ * proxy.go
+ *
+ * Reverse proxy integrato per applicazioni senza autenticazione propria.
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+// Package per il reverse proxy integrato.
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+
+	"git.napaalm.xyz/napaalm/ssodav/internal/config"
+)
+
+// Prefisso degli header con l'identità dell'utente, che il client non può impostare
+const identityHeaderPrefix = "X-Auth-"
+
+// Percorso servito dal proxy
+type Route struct {
+	Host        string
+	Path        string
+	StripPrefix bool
+
+	backend *url.URL
+	proxy   *httputil.ReverseProxy
+}
+
+var routes []*Route
+
+// Chiave del contesto con gli header d'identità da inviare al backend
+type identityKey struct{}
+
+// Header con cui i reverse proxy indicano il client e l'URL originale
+var forwardingHeaders = []string{"Forwarded", "X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto"}
+
+// Trasporto che imposta gli header d'identità e di inoltro subito prima dell'invio al backend
+type identityTransport struct {
+	http.RoundTripper
+}
+
+// Inizializza i percorsi a partire dalla configurazione
+func Initialize() error {
+	routes = nil
+
+	for _, cfg := range config.Config.Proxy {
+		backend, err := url.Parse(cfg.Backend)
+		if err != nil || !backend.IsAbs() {
+			return fmt.Errorf("proxy: invalid backend %q", cfg.Backend)
+		}
+
+		if cfg.Host == "" {
+			return fmt.Errorf("proxy: missing host for backend %q", cfg.Backend)
+		}
+
+		route := &Route{
+			Host:        strings.ToLower(cfg.Host),
+			Path:        cfg.Path,
+			StripPrefix: cfg.StripPrefix,
+			backend:     backend,
+		}
+
+		if route.Path == "" {
+			route.Path = "/"
+		}
+
+		route.proxy = &httputil.ReverseProxy{
+			Director: route.direct,
+
+			// Flush immediately to support streaming responses
+			FlushInterval: -1,
+
+			Transport: identityTransport{http.DefaultTransport},
+
+			ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+				log.Println("proxy: ", err.Error())
+				http.Error(w, "Servizio non raggiungibile", http.StatusBadGateway)
+			},
+		}
+
+		routes = append(routes, route)
+	}
+
+	return nil
+}
+
+// Restituisce vero se è configurato almeno un percorso
+func Enabled() bool {
+	return len(routes) > 0
+}
+
+// Cerca il percorso corrispondente alla richiesta (quello con il prefisso più lungo)
+func Match(r *http.Request) *Route {
+	var match *Route
+
+	host := strings.ToLower(r.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	for _, route := range routes {
+		if route.Host != host || !hasPathPrefix(r.URL.Path, route.Path) {
+			continue
+		}
+
+		if match == nil || len(route.Path) > len(match.Path) {
+			match = route
+		}
+	}
+
+	return match
+}
+
+// Inoltra la richiesta al backend. Le connessioni WebSocket sono gestite da httputil.
+func (route *Route) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	route.proxy.ServeHTTP(w, r)
+}
+
+// Riscrive la richiesta verso il backend
+func (route *Route) direct(r *http.Request) {
+	path := r.URL.Path
+
+	if route.StripPrefix {
+		path = "/" + strings.TrimPrefix(strings.TrimPrefix(path, strings.TrimSuffix(route.Path, "/")), "/")
+	}
+
+	r.URL.Scheme = route.backend.Scheme
+	r.URL.Host = route.backend.Host
+	r.URL.Path = singleJoiningSlash(route.backend.Path, path)
+	r.URL.RawPath = ""
+
+	if route.backend.RawQuery != "" && r.URL.RawQuery != "" {
+		r.URL.RawQuery = route.backend.RawQuery + "&" + r.URL.RawQuery
+	} else if route.backend.RawQuery != "" {
+		r.URL.RawQuery = route.backend.RawQuery
+	}
+
+	// Don't let the standard library add a default User-Agent
+	if _, ok := r.Header["User-Agent"]; !ok {
+		r.Header.Set("User-Agent", "")
+	}
+}
+
+// Associa alla richiesta gli header d'identità da inviare al backend
+func WithIdentity(r *http.Request, identity http.Header) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), identityKey{}, identity))
+}
+
+// Invia la richiesta al backend con i soli header d'identità associati con WithIdentity
+func (t identityTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	// ReverseProxy removes the hop-by-hop headers after the Director has run, so the
+	// client could use the Connection header to tamper with the headers set there
+	stripIdentityHeaders(r.Header)
+
+	r.Header.Set("X-Forwarded-Host", r.Host)
+	if r.TLS != nil {
+		r.Header.Set("X-Forwarded-Proto", "https")
+	} else if r.Header.Get("X-Forwarded-Proto") == "" {
+		r.Header.Set("X-Forwarded-Proto", "http")
+	}
+
+	if identity, ok := r.Context().Value(identityKey{}).(http.Header); ok {
+		for name, values := range identity {
+			r.Header[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+
+	return t.RoundTripper.RoundTrip(r)
+}
+
+// Rimuove dalla richiesta gli header d'identità impostati dal client e i cookie per cui
+// isServerCookie è vero (quelli del servizio SSO, come il cookie di sessione), che non
+// devono arrivare al backend
+func StripIdentity(r *http.Request, isServerCookie func(name string) bool) {
+	stripIdentityHeaders(r.Header)
+
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+
+	for _, cookie := range cookies {
+		if !isServerCookie(cookie.Name) {
+			r.AddCookie(cookie)
+		}
+	}
+}
+
+// Rimuove gli header di inoltro impostati dal client, che non proviene da un
+// reverse proxy fidato: il backend riceve quelli ricavati dalla connessione
+func StripForwarding(r *http.Request) {
+	for _, name := range forwardingHeaders {
+		r.Header.Del(name)
+	}
+}
+
+// Rimuove gli header d'identità, anche scritti con "_" al posto di "-", che
+// CGI, PHP e WSGI confondono con gli originali (HTTP_X_AUTH_USER)
+func stripIdentityHeaders(h http.Header) {
+	for name := range h {
+		if strings.HasPrefix(http.CanonicalHeaderKey(strings.ReplaceAll(name, "_", "-")), identityHeaderPrefix) {
+			delete(h, name)
+		}
+	}
+}
+
+// Controlla se il percorso inizia con il prefisso, considerando solo segmenti interi
+func hasPathPrefix(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+
+	return strings.HasSuffix(prefix, "/") || len(path) == len(prefix) || path[len(prefix)] == '/'
+}
+
+func singleJoiningSlash(a, b string) string {
+	aslash := strings.HasSuffix(a, "/")
+	bslash := strings.HasPrefix(b, "/")
+
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash:
+		return a + "/" + b
+	}
+
+	return a + b
+}
@@ -0,0 +1,190 @@
+/*
+ * proxy_test.go
+ *
+ * File di test per il package proxy.
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"git.napaalm.xyz/napaalm/ssodav/internal/config"
+)
+
+// Carica una configurazione con i percorsi indicati
+func loadRoutes(t *testing.T, toml string) {
+	f, err := ioutil.TempFile("", "ssodav-proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	f.WriteString(toml)
+	f.Close()
+
+	config.Config.Proxy = nil
+	if err := config.LoadConfig(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Initialize(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	loadRoutes(t, `
+[[Proxy]]
+host="wiki.example.org"
+destinazione="http://127.0.0.1:3000"
+
+[[Proxy]]
+host="wiki.example.org"
+percorso="/api"
+destinazione="http://127.0.0.1:3001"
+`)
+
+	cases := map[string]string{
+		"http://wiki.example.org/page":       "/",
+		"http://WIKI.example.org:8080/api/x": "/api",
+		"http://wiki.example.org/api":        "/api",
+		"http://wiki.example.org/apix":       "/",
+		"http://other.example.org/":          "",
+	}
+
+	for target, expected := range cases {
+		route := Match(httptest.NewRequest("GET", target, nil))
+
+		if route == nil && expected != "" || route != nil && route.Path != expected {
+			t.Errorf("%s: expected route %q, got %+v", target, expected, route)
+		}
+	}
+}
+
+func TestForward(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var underscored []string
+		for name := range r.Header {
+			if strings.Contains(name, "_") {
+				underscored = append(underscored, name)
+			}
+		}
+
+		w.Write([]byte(r.URL.Path + "|" + r.Header.Get("X-Auth-User") + "|" + r.Header.Get("X-Auth-Spoof") + "|" + r.Header.Get("Cookie") + strings.Join(underscored, ",")))
+	}))
+	defer backend.Close()
+
+	loadRoutes(t, `
+[[Proxy]]
+host="wiki.example.org"
+percorso="/wiki/"
+destinazione="`+backend.URL+`/base"
+rimuovi_percorso=true
+`)
+
+	r := httptest.NewRequest("GET", "http://wiki.example.org/wiki/page", nil)
+	r.Header.Set("X-Auth-User", "spoofed")
+	r.Header.Set("X-Auth-Spoof", "spoofed")
+	r.Header.Set("Cookie", "sso_session.0=sec; theme=dark; sso_session.1=ret")
+
+	StripIdentity(r, func(name string) bool {
+		return name == "sso_session.0" || name == "sso_session.1"
+	})
+
+	w := httptest.NewRecorder()
+	Match(r).ServeHTTP(w, WithIdentity(r, http.Header{"X-Auth-User": {"professor"}}))
+
+	body, _ := ioutil.ReadAll(w.Result().Body)
+	if expected := "/base/page|professor||theme=dark"; string(body) != expected {
+		t.Errorf("expected %q, got %q", expected, body)
+	}
+
+	// The forwarding headers are set from the connection
+	forwarded := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Forwarded-Proto") + "|" + r.Header.Get("X-Forwarded-Host") + "|" + r.Header.Get("Forwarded")))
+	}))
+	defer forwarded.Close()
+
+	loadRoutes(t, `
+[[Proxy]]
+host="app.example.org"
+destinazione="`+forwarded.URL+`"
+`)
+
+	for _, connection := range []string{"", "X-Forwarded-Proto, X-Forwarded-Host"} {
+		r := httptest.NewRequest("GET", "http://app.example.org/", nil)
+		r.Header.Set("X-Forwarded-Proto", "https")
+		r.Header.Set("X-Forwarded-Host", "evil.example.com")
+		r.Header.Set("Forwarded", "proto=https")
+		r.Header.Set("Connection", connection)
+
+		StripForwarding(r)
+
+		w := httptest.NewRecorder()
+		Match(r).ServeHTTP(w, r)
+
+		body, _ := ioutil.ReadAll(w.Result().Body)
+		if expected := "http|app.example.org|"; string(body) != expected {
+			t.Errorf("Connection %q: expected %q, got %q", connection, expected, body)
+		}
+	}
+
+	loadRoutes(t, `
+[[Proxy]]
+host="wiki.example.org"
+percorso="/wiki/"
+destinazione="`+backend.URL+`/base"
+rimuovi_percorso=true
+`)
+
+	// Identity headers sent by the client never reach the backend, even when they
+	// are listed in the Connection header or added without going through StripIdentity
+	for _, connection := range []string{"", "X-Auth-User", "X-Auth-Spoof"} {
+		r := httptest.NewRequest("GET", "http://wiki.example.org/wiki/page", nil)
+		r.Header.Set("X-Auth-User", "spoofed")
+		r.Header.Set("x-auth-spoof", "spoofed")
+		r.Header["X_Auth_User"] = []string{"spoofed"}
+		r.Header["x_auth_spoof"] = []string{"spoofed"}
+		r.Header.Set("Connection", connection)
+
+		w := httptest.NewRecorder()
+		Match(r).ServeHTTP(w, r)
+
+		body, _ := ioutil.ReadAll(w.Result().Body)
+		if expected := "/base/page|||"; string(body) != expected {
+			t.Errorf("Connection %q: expected %q, got %q", connection, expected, body)
+		}
+
+		w = httptest.NewRecorder()
+		Match(r).ServeHTTP(w, WithIdentity(r, http.Header{"X-Auth-User": {"professor"}}))
+
+		body, _ = ioutil.ReadAll(w.Result().Body)
+		if expected := "/base/page|professor||"; string(body) != expected {
+			t.Errorf("Connection %q: expected %q, got %q", connection, expected, body)
+		}
+	}
+}
@@ -0,0 +1,578 @@
+/*
+ * qr.go
+ *
+ * Generazione di codici QR.
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+// Package per generare i codici QR (ISO/IEC 18004) mostrati nelle pagine, ad
+// esempio per configurare le app di autenticazione. Supporta solo la codifica a
+// byte con correzione degli errori di livello M, fino alla versione 10 (213 byte),
+// sufficiente per gli URI otpauth.
+package qr
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Margine attorno al codice, in moduli, richiesto dallo standard
+const quietZone = 4
+
+var ErrTooLong = errors.New("qr: data too long")
+
+// Struttura dei blocchi di una versione con correzione di livello M
+type version struct {
+	ecPerBlock int
+	blocks     []int // data codewords of each block
+	alignment  []int // centers of the alignment patterns
+}
+
+var versions = []version{
+	1:  {10, []int{16}, nil},
+	2:  {16, []int{28}, []int{6, 18}},
+	3:  {26, []int{44}, []int{6, 22}},
+	4:  {18, []int{32, 32}, []int{6, 26}},
+	5:  {24, []int{43, 43}, []int{6, 30}},
+	6:  {16, []int{27, 27, 27, 27}, []int{6, 34}},
+	7:  {18, []int{31, 31, 31, 31}, []int{6, 22, 38}},
+	8:  {22, []int{38, 38, 39, 39}, []int{6, 24, 42}},
+	9:  {22, []int{36, 36, 36, 37, 37}, []int{6, 26, 46}},
+	10: {26, []int{43, 43, 43, 43, 44}, []int{6, 28, 50}},
+}
+
+// Codice QR
+type Code struct {
+	Size int
+
+	modules  [][]bool
+	function [][]bool
+}
+
+// Codifica i dati nel codice QR più piccolo che li contiene
+func Encode(data []byte) (*Code, error) {
+	for v := 1; v < len(versions); v++ {
+		if capacity(v) >= len(data) {
+			return encode(data, v), nil
+		}
+	}
+
+	return nil, ErrTooLong
+}
+
+// Indica se il modulo alla colonna x e alla riga y è scuro
+func (c *Code) Dark(x, y int) bool {
+	return c.modules[y][x]
+}
+
+// Restituisce il codice come immagine SVG, con il margine richiesto
+func (c *Code) SVG() string {
+	var path strings.Builder
+
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			if c.modules[y][x] {
+				fmt.Fprintf(&path, "M%d,%dh1v1h-1z", x+quietZone, y+quietZone)
+			}
+		}
+	}
+
+	size := c.Size + 2*quietZone
+
+	return fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" shape-rendering="crispEdges">`+
+		`<rect width="%d" height="%d" fill="#fff"/><path d="%s" fill="#000"/></svg>`,
+		size, size, size, size, path.String())
+}
+
+// Numero massimo di byte codificabili nella versione v
+func capacity(v int) int {
+	total := 0
+	for _, n := range versions[v].blocks {
+		total += n
+	}
+
+	// Mode indicator and character count
+	header := 4 + countBits(v)
+	return (total*8 - header) / 8
+}
+
+func countBits(v int) int {
+	if v < 10 {
+		return 8
+	}
+
+	return 16
+}
+
+func encode(data []byte, v int) *Code {
+	size := 17 + 4*v
+	c := &Code{Size: size}
+
+	c.modules = make([][]bool, size)
+	c.function = make([][]bool, size)
+	for i := range c.modules {
+		c.modules[i] = make([]bool, size)
+		c.function[i] = make([]bool, size)
+	}
+
+	c.drawFunctionPatterns(v)
+	c.drawCodewords(codewords(data, v))
+
+	// Choose the mask with the lowest penalty
+	best, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		c.applyMask(mask)
+		c.drawFormat(mask)
+
+		if p := c.penalty(); bestPenalty < 0 || p < bestPenalty {
+			best, bestPenalty = mask, p
+		}
+
+		// Masks are their own inverse
+		c.applyMask(mask)
+	}
+
+	c.applyMask(best)
+	c.drawFormat(best)
+	return c
+}
+
+// Restituisce le parole di codice con i dati e la correzione degli errori, interlacciate
+func codewords(data []byte, v int) []byte {
+	ver := versions[v]
+
+	total := 0
+	for _, n := range ver.blocks {
+		total += n
+	}
+
+	// Byte mode segment
+	var bits bitBuffer
+	bits.append(0x4, 4)
+	bits.append(len(data), countBits(v))
+	for _, b := range data {
+		bits.append(int(b), 8)
+	}
+
+	// Terminator and padding to whole bytes
+	for i := 0; i < 4 && bits.len() < total*8; i++ {
+		bits.append(0, 1)
+	}
+	for bits.len()%8 != 0 {
+		bits.append(0, 1)
+	}
+
+	padded := bits.bytes()
+	for pad := byte(0xEC); len(padded) < total; pad ^= 0xEC ^ 0x11 {
+		padded = append(padded, pad)
+	}
+
+	// Split into blocks and compute the error correction of each one
+	generator := rsGenerator(ver.ecPerBlock)
+	blocks := make([][]byte, len(ver.blocks))
+	ec := make([][]byte, len(ver.blocks))
+
+	offset := 0
+	for i, n := range ver.blocks {
+		blocks[i] = padded[offset : offset+n]
+		ec[i] = rsRemainder(blocks[i], generator)
+		offset += n
+	}
+
+	// Interleave the blocks
+	result := make([]byte, 0, total+ver.ecPerBlock*len(blocks))
+	for i := 0; i < ver.blocks[len(ver.blocks)-1]; i++ {
+		for _, b := range blocks {
+			if i < len(b) {
+				result = append(result, b[i])
+			}
+		}
+	}
+
+	for i := 0; i < ver.ecPerBlock; i++ {
+		for _, e := range ec {
+			result = append(result, e[i])
+		}
+	}
+
+	return result
+}
+
+func (c *Code) set(x, y int, dark bool) {
+	c.modules[y][x] = dark
+	c.function[y][x] = true
+}
+
+func (c *Code) drawFunctionPatterns(v int) {
+	size := c.Size
+
+	// Timing patterns
+	for i := 0; i < size; i++ {
+		c.set(6, i, i%2 == 0)
+		c.set(i, 6, i%2 == 0)
+	}
+
+	// Finder patterns with their separators
+	for _, center := range [][2]int{{3, 3}, {size - 4, 3}, {3, size - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := center[0]+dx, center[1]+dy
+				if x < 0 || x >= size || y < 0 || y >= size {
+					continue
+				}
+
+				dist := max(abs(dx), abs(dy))
+				c.set(x, y, dist != 2 && dist != 4)
+			}
+		}
+	}
+
+	// Alignment patterns, except where they would overlap the finders
+	positions := versions[v].alignment
+	last := len(positions) - 1
+
+	for i, cy := range positions {
+		for j, cx := range positions {
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue
+			}
+
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					c.set(cx+dx, cy+dy, max(abs(dx), abs(dy)) != 1)
+				}
+			}
+		}
+	}
+
+	// Reserve the format areas, drawn after choosing the mask
+	c.drawFormat(0)
+
+	// Version information
+	if v >= 7 {
+		bits := versionBits(v)
+
+		for i := 0; i < 18; i++ {
+			dark := (bits>>uint(i))&1 != 0
+			a, b := size-11+i%3, i/3
+
+			c.set(a, b, dark)
+			c.set(b, a, dark)
+		}
+	}
+}
+
+// Disegna le informazioni sul formato (livello M e maschera)
+func (c *Code) drawFormat(mask int) {
+	bits := formatBits(mask)
+	bit := func(i int) bool { return (bits>>uint(i))&1 != 0 }
+	size := c.Size
+
+	// First copy, around the top left finder
+	for i := 0; i <= 5; i++ {
+		c.set(8, i, bit(i))
+	}
+	c.set(8, 7, bit(6))
+	c.set(8, 8, bit(7))
+	c.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		c.set(14-i, 8, bit(i))
+	}
+
+	// Second copy, split between the other two finders
+	for i := 0; i < 8; i++ {
+		c.set(size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		c.set(8, size-15+i, bit(i))
+	}
+
+	// Always dark
+	c.set(8, size-8, true)
+}
+
+// Dispone i bit dei dati a zigzag, a coppie di colonne da destra
+func (c *Code) drawCodewords(data []byte) {
+	i := 0
+
+	for right := c.Size - 1; right >= 1; right -= 2 {
+		// Skip the vertical timing pattern
+		if right == 6 {
+			right = 5
+		}
+
+		upward := (right+1)&2 == 0
+
+		for vert := 0; vert < c.Size; vert++ {
+			y := vert
+			if upward {
+				y = c.Size - 1 - vert
+			}
+
+			for j := 0; j < 2; j++ {
+				x := right - j
+
+				if c.function[y][x] {
+					continue
+				}
+
+				// Remainder bits are left light
+				if i < len(data)*8 {
+					c.modules[y][x] = (data[i>>3]>>uint(7-i&7))&1 != 0
+					i++
+				}
+			}
+		}
+	}
+}
+
+func (c *Code) applyMask(mask int) {
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			if !c.function[y][x] && masked(mask, x, y) {
+				c.modules[y][x] = !c.modules[y][x]
+			}
+		}
+	}
+}
+
+func masked(mask, x, y int) bool {
+	switch mask {
+	case 0:
+		return (x+y)%2 == 0
+	case 1:
+		return y%2 == 0
+	case 2:
+		return x%3 == 0
+	case 3:
+		return (x+y)%3 == 0
+	case 4:
+		return (x/3+y/2)%2 == 0
+	case 5:
+		return x*y%2+x*y%3 == 0
+	case 6:
+		return (x*y%2+x*y%3)%2 == 0
+	default:
+		return ((x+y)%2+x*y%3)%2 == 0
+	}
+}
+
+// Penalità del codice secondo le regole dello standard: la maschera migliore
+// evita zone uniformi e sequenze simili ai marcatori di posizione
+func (c *Code) penalty() int {
+	size := c.Size
+	result := 0
+
+	at := func(x, y int, transposed bool) bool {
+		if transposed {
+			return c.modules[x][y]
+		}
+
+		return c.modules[y][x]
+	}
+
+	// Modules outside the code are part of the quiet zone, which is light
+	lightRun := func(from, to, y int, transposed bool) bool {
+		for x := from; x < to; x++ {
+			if x >= 0 && x < size && at(x, y, transposed) {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	finderLike := []bool{true, false, true, true, true, false, true}
+
+	for _, transposed := range []bool{false, true} {
+		for y := 0; y < size; y++ {
+			// Runs of five or more modules of the same color
+			run := 1
+			for x := 1; x < size; x++ {
+				if at(x, y, transposed) == at(x-1, y, transposed) {
+					run++
+					continue
+				}
+
+				if run >= 5 {
+					result += 3 + run - 5
+				}
+				run = 1
+			}
+			if run >= 5 {
+				result += 3 + run - 5
+			}
+
+			// Finder-like patterns with four light modules on one side
+			for x := 0; x+7 <= size; x++ {
+				match := true
+				for k, dark := range finderLike {
+					if at(x+k, y, transposed) != dark {
+						match = false
+						break
+					}
+				}
+
+				if match && (lightRun(x-4, x, y, transposed) || lightRun(x+7, x+11, y, transposed)) {
+					result += 40
+				}
+			}
+		}
+	}
+
+	// 2x2 blocks of the same color
+	for y := 0; y < size-1; y++ {
+		for x := 0; x < size-1; x++ {
+			color := c.modules[y][x]
+			if color == c.modules[y][x+1] && color == c.modules[y+1][x] && color == c.modules[y+1][x+1] {
+				result += 3
+			}
+		}
+	}
+
+	// Balance of dark and light modules
+	dark := 0
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			if c.modules[y][x] {
+				dark++
+			}
+		}
+	}
+
+	total := size * size
+	k := (abs(dark*20-total*10)+total-1)/total - 1
+	result += k * 10
+
+	return result
+}
+
+func formatBits(mask int) int {
+	// Level M is 00
+	data := mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+
+	return (data<<10 | rem) ^ 0x5412
+}
+
+func versionBits(v int) int {
+	rem := v
+	for i := 0; i < 12; i++ {
+		rem = (rem << 1) ^ ((rem >> 11) * 0x1F25)
+	}
+
+	return v<<12 | rem
+}
+
+// Polinomio generatore per n parole di correzione (Reed-Solomon su GF(256)),
+// senza il coefficiente del termine di grado massimo
+func rsGenerator(n int) []byte {
+	result := make([]byte, n)
+	result[n-1] = 1
+
+	// Multiply by (x - r^i) for i = 0..n-1, where r = 0x02 generates the field
+	root := byte(1)
+	for i := 0; i < n; i++ {
+		for j := range result {
+			result[j] = gfMultiply(result[j], root)
+			if j+1 < n {
+				result[j] ^= result[j+1]
+			}
+		}
+
+		root = gfMultiply(root, 0x02)
+	}
+
+	return result
+}
+
+// Resto della divisione dei dati per il polinomio generatore
+func rsRemainder(data, generator []byte) []byte {
+	result := make([]byte, len(generator))
+
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+
+		for i, g := range generator {
+			result[i] ^= gfMultiply(g, factor)
+		}
+	}
+
+	return result
+}
+
+// Prodotto in GF(256) con il polinomio x^8 + x^4 + x^3 + x^2 + 1
+func gfMultiply(x, y byte) byte {
+	z := 0
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11D)
+		z ^= int((y>>uint(i))&1) * int(x)
+	}
+
+	return byte(z)
+}
+
+// Buffer di bit, dal più significativo
+type bitBuffer struct {
+	bits []bool
+}
+
+func (b *bitBuffer) append(value, n int) {
+	for i := n - 1; i >= 0; i-- {
+		b.bits = append(b.bits, (value>>uint(i))&1 != 0)
+	}
+}
+
+func (b *bitBuffer) len() int {
+	return len(b.bits)
+}
+
+func (b *bitBuffer) bytes() []byte {
+	result := make([]byte, len(b.bits)/8)
+	for i, bit := range b.bits {
+		if bit {
+			result[i/8] |= 1 << uint(7-i%8)
+		}
+	}
+
+	return result
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+
+	return x
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+
+	return b
+}
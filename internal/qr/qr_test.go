@@ -0,0 +1,191 @@
+/*
+ * qr_test.go
+ *
+ * File di test per il package qr.
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+package qr
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestReedSolomon(t *testing.T) {
+	// "HELLO WORLD" as version 1-M, from the examples of the standard
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	expected := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+
+	if ec := rsRemainder(data, rsGenerator(10)); !bytes.Equal(ec, expected) {
+		t.Errorf("expected %v, got %v", expected, ec)
+	}
+}
+
+func TestFormatAndVersion(t *testing.T) {
+	if bits := formatBits(4); bits != 0x45F9 {
+		t.Errorf("unexpected format bits %015b", bits)
+	}
+
+	if bits := versionBits(7); bits != 0x07C94 {
+		t.Errorf("unexpected version bits %018b", bits)
+	}
+}
+
+func TestEncode(t *testing.T) {
+	uri := "otpauth://totp/SSO%20Scuola:professor?secret=JBSWY3DPEHPK3PXPJBSWY3DPEHPK3PXP&issuer=SSO%20Scuola&algorithm=SHA1&digits=6&period=30"
+
+	for _, data := range []string{"HELLO", uri, strings.Repeat("x", 213)} {
+		c, err := Encode([]byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := decode(t, c); got != data {
+			t.Errorf("expected %q, got %q", data, got)
+		}
+	}
+
+	if _, err := Encode(make([]byte, 214)); err != ErrTooLong {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	c, _ := Encode([]byte("HELLO"))
+	if c.Size != 21 || !c.Dark(0, 0) || c.Dark(7, 7) || !strings.HasPrefix(c.SVG(), "<svg") {
+		t.Error("unexpected code")
+	}
+}
+
+// Legge i dati di un codice, per controllare la disposizione dei moduli
+func decode(t *testing.T, c *Code) string {
+	v := (c.Size - 17) / 4
+
+	// Format information, from the first copy
+	format := 0
+	read := func(x, y int) {
+		format <<= 1
+		if c.modules[y][x] {
+			format |= 1
+		}
+	}
+
+	for i := 0; i < 6; i++ {
+		read(i, 8)
+	}
+	read(7, 8)
+	read(8, 8)
+	read(8, 7)
+	for i := 5; i >= 0; i-- {
+		read(8, i)
+	}
+
+	mask := -1
+	for m := 0; m < 8; m++ {
+		if formatBits(m) == format {
+			mask = m
+		}
+	}
+
+	if mask < 0 {
+		t.Fatalf("invalid format information %015b", format)
+	}
+
+	// Read the codewords back in the same order
+	c.applyMask(mask)
+	defer c.applyMask(mask)
+
+	var bits bitBuffer
+	for right := c.Size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+
+		for vert := 0; vert < c.Size; vert++ {
+			y := vert
+			if (right+1)&2 == 0 {
+				y = c.Size - 1 - vert
+			}
+
+			for j := 0; j < 2; j++ {
+				if x := right - j; !c.function[y][x] {
+					b := 0
+					if c.modules[y][x] {
+						b = 1
+					}
+					bits.append(b, 1)
+				}
+			}
+		}
+	}
+
+	raw := bits.bytes()
+	ver := versions[v]
+
+	// Deinterleave and check the error correction of each block
+	blocks := make([][]byte, len(ver.blocks))
+	k := 0
+	for i := 0; i < ver.blocks[len(ver.blocks)-1]; i++ {
+		for b, n := range ver.blocks {
+			if i < n {
+				blocks[b] = append(blocks[b], raw[k])
+				k++
+			}
+		}
+	}
+
+	generator := rsGenerator(ver.ecPerBlock)
+	var data []byte
+
+	for b := range blocks {
+		var ec []byte
+		for i := 0; i < ver.ecPerBlock; i++ {
+			ec = append(ec, raw[k+i*len(blocks)+b])
+		}
+
+		if !bytes.Equal(ec, rsRemainder(blocks[b], generator)) {
+			t.Fatalf("invalid error correction in block %d", b)
+		}
+
+		data = append(data, blocks[b]...)
+	}
+
+	// Byte mode segment
+	if data[0]>>4 != 0x4 {
+		t.Fatalf("unexpected mode %x", data[0]>>4)
+	}
+
+	var payload bitBuffer
+	for _, b := range data {
+		payload.append(int(b), 8)
+	}
+
+	n := 0
+	for i := 4; i < 4+countBits(v); i++ {
+		n <<= 1
+		if payload.bits[i] {
+			n |= 1
+		}
+	}
+
+	var result bitBuffer
+	result.bits = payload.bits[4+countBits(v) : 4+countBits(v)+8*n]
+	return string(result.bytes())
+}
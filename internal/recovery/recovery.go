@@ -0,0 +1,302 @@
+/*
+ * recovery.go
+ *
+ * Codici di recupero per reimpostare la password.
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+// Package per i codici di recupero monouso, che l'utente genera quando è
+// autenticato e conserva per reimpostare da solo la password dimenticata. Dei
+// codici viene conservato solo l'hash.
+package recovery
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"git.napaalm.xyz/napaalm/ssodav/internal/config"
+)
+
+const (
+	defaultCodes             = 10
+	defaultMinPasswordLength = 8
+
+	// Caratteri di ogni codice, ognuno dei quali vale 5 bit
+	codeLength = 10
+	saltSize   = 16
+)
+
+// Caratteri dei codici, senza quelli che si confondono (0 e O, 1 e I)
+const alphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+var (
+	ErrInvalidCode = errors.New("Nome utente o codice di recupero errato")
+	ErrStore       = errors.New("Recupero della password non disponibile. Riprova più tardi.")
+)
+
+// Codici di un utente
+type entry struct {
+	Salt    []byte    `json:"salt"`
+	Hashes  [][]byte  `json:"hashes"`
+	Created time.Time `json:"created"`
+}
+
+var (
+	mutex   sync.Mutex
+	path    string
+	entries map[string]*entry
+
+	// Hash dei codici in uso, che non vengono accettati finché non viene
+	// stabilito se consumarli
+	pending = make(map[string]bool)
+)
+
+// Carica i codici dal file indicato nella configurazione
+func Initialize() error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	path = ""
+	entries = nil
+
+	c := config.Config.Recovery
+	if !c.Enabled {
+		return nil
+	}
+
+	if c.File == "" {
+		return errors.New("File dei codici di recupero non configurato")
+	}
+
+	loaded := make(map[string]*entry)
+
+	b, err := ioutil.ReadFile(c.File)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Impossibile leggere i codici di recupero: %v", err)
+	} else if err == nil {
+		if err := json.Unmarshal(b, &loaded); err != nil {
+			return fmt.Errorf("Impossibile leggere i codici di recupero: %v", err)
+		}
+	}
+
+	path = c.File
+	entries = loaded
+	return nil
+}
+
+// Indica se i codici di recupero sono abilitati
+func Enabled() bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	return entries != nil
+}
+
+// Genera nuovi codici per l'utente, che sostituiscono quelli precedenti, e li
+// restituisce: non sarà più possibile leggerli
+func Generate(username string) ([]string, error) {
+	n := config.Config.Recovery.Codes
+	if n <= 0 {
+		n = defaultCodes
+	}
+
+	e := &entry{Salt: make([]byte, saltSize), Created: time.Now()}
+	if _, err := rand.Read(e.Salt); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, n)
+	for i := range codes {
+		b := make([]byte, codeLength)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+
+		for j := range b {
+			b[j] = alphabet[b[j]%byte(len(alphabet))]
+		}
+
+		codes[i] = string(b[:codeLength/2]) + "-" + string(b[codeLength/2:])
+		e.Hashes = append(e.Hashes, hash(e.Salt, string(b)))
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if entries == nil {
+		return nil, ErrStore
+	}
+
+	previous := entries[username]
+	entries[username] = e
+
+	if err := save(); err != nil {
+		log.Println("recovery: ", err.Error())
+		restore(username, previous)
+		return nil, ErrStore
+	}
+
+	return codes, nil
+}
+
+// Restituisce il numero di codici ancora utilizzabili dall'utente e il
+// momento in cui sono stati generati
+func Remaining(username string) (int, time.Time) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	e := entries[username]
+	if e == nil {
+		return 0, time.Time{}
+	}
+
+	return len(e.Hashes), e.Created
+}
+
+// Controlla il codice dell'utente ed esegue use: solo se riesce il codice
+// viene consumato e non potrà più essere usato. Se use fallisce ne restituisce
+// l'errore e il codice resta valido.
+func Redeem(username, code string, use func() error) error {
+	code = normalize(code)
+
+	// The code is reserved while in use, so that it can't be used twice without
+	// holding the lock during the request to the directory
+	h, ok := reserve(username, code)
+	if !ok {
+		return ErrInvalidCode
+	}
+
+	err := use()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	delete(pending, string(h))
+	if err != nil {
+		return err
+	}
+
+	// The codes may have been replaced in the meantime
+	e := entries[username]
+	if e == nil {
+		return nil
+	}
+
+	for i, stored := range e.Hashes {
+		if !hmac.Equal(h, stored) {
+			continue
+		}
+
+		e.Hashes = append(append([][]byte(nil), e.Hashes[:i]...), e.Hashes[i+1:]...)
+
+		// The code has been used already: it stays invalid until the next
+		// restart even if the file can't be written
+		if err := save(); err != nil {
+			log.Println("recovery: ", err.Error())
+		}
+
+		break
+	}
+
+	return nil
+}
+
+// Cerca il codice tra quelli dell'utente e, se non è già in uso, lo riserva
+// restituendone l'hash
+func reserve(username, code string) ([]byte, bool) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	e := entries[username]
+	if e == nil || len(code) != codeLength {
+		return nil, false
+	}
+
+	h := hash(e.Salt, code)
+	for _, stored := range e.Hashes {
+		if hmac.Equal(h, stored) && !pending[string(h)] {
+			pending[string(h)] = true
+			return h, true
+		}
+	}
+
+	return nil, false
+}
+
+// Controlla che la nuova password rispetti i requisiti
+func CheckPassword(password string) error {
+	min := config.Config.Recovery.MinPasswordLength
+	if min <= 0 {
+		min = defaultMinPasswordLength
+	}
+
+	if utf8.RuneCountInString(password) < min {
+		return fmt.Errorf("La password deve essere lunga almeno %d caratteri", min)
+	}
+
+	return nil
+}
+
+// Rimuove spazi e trattini e converte in maiuscolo il codice inserito
+func normalize(code string) string {
+	code = strings.ToUpper(code)
+	return strings.NewReplacer("-", "", " ", "").Replace(strings.TrimSpace(code))
+}
+
+func hash(salt []byte, code string) []byte {
+	h := sha256.New()
+	h.Write(salt)
+	h.Write([]byte(code))
+	return h.Sum(nil)
+}
+
+func restore(username string, previous *entry) {
+	if previous == nil {
+		delete(entries, username)
+	} else {
+		entries[username] = previous
+	}
+}
+
+// Scrive i codici nel file, sostituendolo in modo atomico
+func save() error {
+	b, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
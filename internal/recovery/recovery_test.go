@@ -0,0 +1,127 @@
+/*
+ * recovery_test.go
+ *
+ * File di test per il package recovery.
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+package recovery
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"git.napaalm.xyz/napaalm/ssodav/internal/config"
+)
+
+func TestCodes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config.Config.Recovery.Enabled = true
+	config.Config.Recovery.File = filepath.Join(dir, "recovery.json")
+	config.Config.Recovery.Codes = 5
+
+	if err := Initialize(); err != nil {
+		t.Fatal(err)
+	}
+
+	codes, err := Generate("fry")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n, _ := Remaining("fry"); len(codes) != 5 || n != 5 || len(codes[0]) != codeLength+1 {
+		t.Errorf("unexpected codes %v", codes)
+	}
+
+	// Only hashes are stored
+	b, _ := ioutil.ReadFile(config.Config.Recovery.File)
+	if strings.Contains(string(b), strings.Replace(codes[0], "-", "", 1)) {
+		t.Error("code stored in clear")
+	}
+
+	use := func() error { return nil }
+
+	if err := Redeem("professor", codes[0], use); err != ErrInvalidCode {
+		t.Errorf("code accepted for another user: %v", err)
+	}
+
+	// Codes aren't consumed when they can't be used
+	failure := errors.New("LDAP down")
+	if err := Redeem("fry", codes[0], func() error { return failure }); err != failure {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	if n, _ := Remaining("fry"); n != 5 {
+		t.Errorf("code consumed by a failed use: %d codes left", n)
+	}
+
+	// The store stays usable while the code is in use, but the code can't be used again
+	reused := func() error {
+		if n, _ := Remaining("fry"); n != 5 {
+			t.Errorf("expected 5 codes while in use, got %d", n)
+		}
+
+		if err := Redeem("fry", codes[0], use); err != ErrInvalidCode {
+			t.Errorf("code in use accepted: %v", err)
+		}
+
+		return nil
+	}
+
+	// Codes can be typed without the dash and in lower case
+	if err := Redeem("fry", " "+strings.ToLower(strings.Replace(codes[0], "-", " ", 1)), reused); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Redeem("fry", codes[0], use); err != ErrInvalidCode {
+		t.Errorf("code used twice: %v", err)
+	}
+
+	// Used codes stay used after a restart
+	if err := Initialize(); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, _ := Remaining("fry"); n != 4 {
+		t.Errorf("expected 4 codes, got %d", n)
+	}
+
+	// New codes replace the old ones
+	if _, err := Generate("fry"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Redeem("fry", codes[1], use); err != ErrInvalidCode {
+		t.Errorf("old code accepted: %v", err)
+	}
+
+	if CheckPassword("short") == nil || CheckPassword("long enough") != nil {
+		t.Error("unexpected password check")
+	}
+}
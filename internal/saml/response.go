@@ -0,0 +1,236 @@
+/*
+ * response.go
+ *
+ * Generazione di risposte SAML con asserzioni firmate.
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+package saml
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"time"
+
+	"git.napaalm.xyz/napaalm/ssodav/internal/auth"
+)
+
+// Algoritmi usati per la firma XML
+const (
+	algExcC14N     = "http://www.w3.org/2001/10/xml-exc-c14n#"
+	algEnveloped   = "http://www.w3.org/2000/09/xmldsig#enveloped-signature"
+	algRSASHA256   = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"
+	algSHA256      = "http://www.w3.org/2001/04/xmlenc#sha256"
+	attrNameFormat = "urn:oasis:names:tc:SAML:2.0:attrname-format:basic"
+	authnPassword  = "urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport"
+	authnUnknown   = "urn:oasis:names:tc:SAML:2.0:ac:classes:unspecified"
+	statusSuccess  = "urn:oasis:names:tc:SAML:2.0:status:Success"
+	cmBearer       = "urn:oasis:names:tc:SAML:2.0:cm:bearer"
+)
+
+// Cerca un utente nella directory; sostituita nei test
+var lookupUser = auth.LookupUser
+
+// Genera una risposta con un'asserzione firmata per il service provider.
+// inResponseTo è vuoto per le risposte non sollecitate (SSO avviato dall'IdP).
+func NewResponse(sp *ServiceProvider, acsURL, inResponseTo string, userInfo auth.UserInfo) ([]byte, error) {
+	now := time.Now().UTC()
+
+	responseID, err := newID()
+	if err != nil {
+		return nil, err
+	}
+
+	assertion, err := newAssertion(sp, acsURL, inResponseTo, userInfo, now)
+	if err != nil {
+		return nil, err
+	}
+
+	var b strings.Builder
+
+	b.WriteString(`<samlp:Response xmlns:samlp="` + nsProtocol + `" xmlns:saml="` + nsAssertion + `"`)
+	b.WriteString(` Destination="` + escapeAttr(acsURL) + `" ID="` + responseID + `"`)
+	if inResponseTo != "" {
+		b.WriteString(` InResponseTo="` + escapeAttr(inResponseTo) + `"`)
+	}
+	b.WriteString(` IssueInstant="` + formatTime(now) + `" Version="2.0">`)
+	b.WriteString(`<saml:Issuer>` + escapeText(EntityID()) + `</saml:Issuer>`)
+	b.WriteString(`<samlp:Status><samlp:StatusCode Value="` + statusSuccess + `"></samlp:StatusCode></samlp:Status>`)
+	b.WriteString(assertion)
+	b.WriteString(`</samlp:Response>`)
+
+	return []byte(b.String()), nil
+}
+
+// Genera un'asserzione firmata.
+// L'asserzione viene scritta direttamente in forma canonica (exclusive XML
+// canonicalization), in modo che il digest calcolato coincida con quello del SP.
+func newAssertion(sp *ServiceProvider, acsURL, inResponseTo string, userInfo auth.UserInfo, now time.Time) (string, error) {
+	assertionID, err := newID()
+	if err != nil {
+		return "", err
+	}
+
+	sessionIndex, err := newID()
+	if err != nil {
+		return "", err
+	}
+
+	var (
+		issuer  = `<saml:Issuer>` + escapeText(EntityID()) + `</saml:Issuer>`
+		content strings.Builder
+		expires = formatTime(now.Add(validity))
+	)
+
+	// Subject
+	content.WriteString(`<saml:Subject>`)
+	content.WriteString(`<saml:NameID Format="` + nameIDFormat + `">` + escapeText(userInfo.Username) + `</saml:NameID>`)
+	content.WriteString(`<saml:SubjectConfirmation Method="` + cmBearer + `"><saml:SubjectConfirmationData`)
+	if inResponseTo != "" {
+		content.WriteString(` InResponseTo="` + escapeAttr(inResponseTo) + `"`)
+	}
+	content.WriteString(` NotOnOrAfter="` + expires + `" Recipient="` + escapeAttr(acsURL) + `"></saml:SubjectConfirmationData>`)
+	content.WriteString(`</saml:SubjectConfirmation></saml:Subject>`)
+
+	// Conditions
+	content.WriteString(`<saml:Conditions NotBefore="` + formatTime(now.Add(-time.Minute)) + `" NotOnOrAfter="` + expires + `">`)
+	content.WriteString(`<saml:AudienceRestriction><saml:Audience>` + escapeText(sp.EntityID) + `</saml:Audience></saml:AudienceRestriction>`)
+	content.WriteString(`</saml:Conditions>`)
+
+	// AuthnStatement
+	// The instant is the last primary authentication, not the SSO, as for auth_time
+	authnInstant := userInfo.AuthTime
+	if authnInstant.IsZero() {
+		authnInstant = now
+	}
+
+	content.WriteString(`<saml:AuthnStatement AuthnInstant="` + formatTime(authnInstant) + `" SessionIndex="` + sessionIndex + `">`)
+	content.WriteString(`<saml:AuthnContext><saml:AuthnContextClassRef>` + authnContextClass(userInfo.Methods) + `</saml:AuthnContextClassRef></saml:AuthnContext>`)
+	content.WriteString(`</saml:AuthnStatement>`)
+
+	// AttributeStatement
+	names := make([]string, 0, len(attributes))
+	fields := make([]string, 0, len(attributes))
+	for name, field := range attributes {
+		names = append(names, name)
+		fields = append(fields, field)
+	}
+	sort.Strings(names)
+
+	// Users from a session don't carry the LDAP attributes
+	if userInfo.MissingAttributes(fields...) {
+		if entry, err := lookupUser(userInfo.Username); err == nil {
+			userInfo.Attributes = entry.Attributes
+		}
+	}
+
+	content.WriteString(`<saml:AttributeStatement>`)
+	for _, name := range names {
+		content.WriteString(`<saml:Attribute Name="` + escapeAttr(name) + `" NameFormat="` + attrNameFormat + `">`)
+		content.WriteString(`<saml:AttributeValue>` + escapeText(userInfo.Field(attributes[name])) + `</saml:AttributeValue>`)
+		content.WriteString(`</saml:Attribute>`)
+	}
+	content.WriteString(`</saml:AttributeStatement>`)
+
+	open := `<saml:Assertion xmlns:saml="` + nsAssertion + `" ID="` + assertionID + `" IssueInstant="` + formatTime(now) + `" Version="2.0">`
+	end := `</saml:Assertion>`
+
+	// Digest of the assertion without the signature (enveloped-signature transform)
+	digest := sha256.Sum256([]byte(open + issuer + content.String() + end))
+
+	signedInfo := `<ds:SignedInfo xmlns:ds="` + nsDSig + `">` +
+		`<ds:CanonicalizationMethod Algorithm="` + algExcC14N + `"></ds:CanonicalizationMethod>` +
+		`<ds:SignatureMethod Algorithm="` + algRSASHA256 + `"></ds:SignatureMethod>` +
+		`<ds:Reference URI="#` + assertionID + `">` +
+		`<ds:Transforms>` +
+		`<ds:Transform Algorithm="` + algEnveloped + `"></ds:Transform>` +
+		`<ds:Transform Algorithm="` + algExcC14N + `"></ds:Transform>` +
+		`</ds:Transforms>` +
+		`<ds:DigestMethod Algorithm="` + algSHA256 + `"></ds:DigestMethod>` +
+		`<ds:DigestValue>` + base64.StdEncoding.EncodeToString(digest[:]) + `</ds:DigestValue>` +
+		`</ds:Reference>` +
+		`</ds:SignedInfo>`
+
+	hashed := sha256.Sum256([]byte(signedInfo))
+	signature, err := signer.Sign(rand.Reader, hashed[:], crypto.SHA256)
+	if err != nil {
+		return "", err
+	}
+
+	// The signature goes right after the issuer, as required by the schema
+	sig := `<ds:Signature xmlns:ds="` + nsDSig + `">` + signedInfo +
+		`<ds:SignatureValue>` + base64.StdEncoding.EncodeToString(signature) + `</ds:SignatureValue>` +
+		`<ds:KeyInfo><ds:X509Data><ds:X509Certificate>` + base64.StdEncoding.EncodeToString(certificate.Raw) + `</ds:X509Certificate></ds:X509Data></ds:KeyInfo>` +
+		`</ds:Signature>`
+
+	return open + issuer + sig + content.String() + end, nil
+}
+
+// Restituisce la classe del contesto d'autenticazione dei metodi usati: il
+// profilo REFEDS MFA per due fattori, la password se è stata usata e una classe
+// non specificata per gli altri accessi, come quelli via email
+func authnContextClass(methods []string) string {
+	if auth.ACR(methods) == auth.ACRMultiFactor {
+		return auth.ACRMultiFactor
+	}
+
+	for _, m := range methods {
+		if m == "pwd" {
+			return authnPassword
+		}
+	}
+
+	return authnUnknown
+}
+
+// Genera un identificatore XML casuale
+func newID() (string, error) {
+	b := make([]byte, 20)
+
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return "_" + hex.EncodeToString(b), nil
+}
+
+// Formatta un istante secondo lo schema xs:dateTime
+func formatTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05Z")
+}
+
+// Effettua l'escape del testo come previsto dalla canonicalizzazione
+var textEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\r", "&#xD;")
+
+// Effettua l'escape degli attributi come previsto dalla canonicalizzazione
+var attrEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", `"`, "&quot;", "\t", "&#x9;", "\n", "&#xA;", "\r", "&#xD;")
+
+func escapeText(s string) string {
+	return textEscaper.Replace(s)
+}
+
+func escapeAttr(s string) string {
+	return attrEscaper.Replace(s)
+}
@@ -0,0 +1,335 @@
+/*
+ * saml.go
+ *
+ * Identity provider SAML 2.0.
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+// Package per l'identity provider SAML 2.0.
+package saml
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	"git.napaalm.xyz/napaalm/ssodav/internal/config"
+	"git.napaalm.xyz/napaalm/ssodav/internal/keys"
+	"git.napaalm.xyz/napaalm/ssodav/internal/url"
+)
+
+// Binding e namespace SAML
+const (
+	BindingHTTPRedirect = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect"
+	BindingHTTPPost     = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+
+	nsAssertion = "urn:oasis:names:tc:SAML:2.0:assertion"
+	nsProtocol  = "urn:oasis:names:tc:SAML:2.0:protocol"
+	nsMetadata  = "urn:oasis:names:tc:SAML:2.0:metadata"
+	nsDSig      = "http://www.w3.org/2000/09/xmldsig#"
+
+	nameIDFormat = "urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified"
+)
+
+// Dimensione massima di una richiesta decompressa
+const maxRequestSize = 1 << 20
+
+const defaultValidity = 5 * time.Minute
+
+// Attributi rilasciati se non specificati nella configurazione
+var defaultAttributes = map[string]string{
+	"uid":         "username",
+	"displayName": "full_name",
+	"ou":          "group",
+}
+
+var (
+	ErrUnknownServiceProvider = errors.New("Service provider sconosciuto!")
+	ErrInvalidRequest         = errors.New("Richiesta SAML non valida!")
+	ErrInvalidACS             = errors.New("Assertion consumer service non valido!")
+)
+
+// Endpoint di un service provider
+type Endpoint struct {
+	Binding   string `xml:"Binding,attr"`
+	Location  string `xml:"Location,attr"`
+	Index     int    `xml:"index,attr"`
+	IsDefault bool   `xml:"isDefault,attr"`
+}
+
+// Service provider importato dai metadati
+type ServiceProvider struct {
+	EntityID string
+	ACS      []Endpoint
+}
+
+// Metadati di un service provider
+type entityDescriptor struct {
+	EntityID        string `xml:"entityID,attr"`
+	SPSSODescriptor *struct {
+		AssertionConsumerServices []Endpoint `xml:"AssertionConsumerService"`
+	} `xml:"SPSSODescriptor"`
+}
+
+// Raccolta di metadati di più service provider
+type entitiesDescriptor struct {
+	EntityDescriptors []entityDescriptor `xml:"EntityDescriptor"`
+}
+
+var (
+	signer           crypto.Signer
+	certificate      *x509.Certificate
+	serviceProviders map[string]*ServiceProvider
+	attributes       map[string]string
+	validity         time.Duration
+)
+
+// Inizializza l'identity provider: carica chiave, certificato e metadati dei service provider
+func Initialize() error {
+	var err error
+
+	cfg := config.Config.SAML
+
+	if signer, err = keys.LoadPrivateKey(cfg.PrivateKey); err != nil {
+		return err
+	}
+
+	if _, ok := signer.(*rsa.PrivateKey); !ok {
+		return errors.New("saml: the signing key must be an RSA key")
+	}
+
+	if certificate, err = keys.LoadCertificate(cfg.Certificate); err != nil {
+		return err
+	}
+
+	serviceProviders = make(map[string]*ServiceProvider)
+
+	for _, path := range cfg.SPMetadata {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		if err := importMetadata(data); err != nil {
+			return fmt.Errorf("saml: %s: %v", path, err)
+		}
+	}
+
+	attributes = cfg.Attributes
+	if len(attributes) == 0 {
+		attributes = defaultAttributes
+	}
+
+	validity = cfg.Validity.Duration
+	if validity <= 0 {
+		validity = defaultValidity
+	}
+
+	return nil
+}
+
+// Restituisce l'entity ID dell'identity provider
+func EntityID() string {
+	if id := config.Config.SAML.EntityID; id != "" {
+		return id
+	}
+
+	return url.BaseURL() + "/saml/metadata"
+}
+
+// Cerca un service provider a partire dal suo entity ID
+func GetServiceProvider(entityID string) (*ServiceProvider, bool) {
+	sp, ok := serviceProviders[entityID]
+	return sp, ok
+}
+
+// Importa i metadati di uno o più service provider
+func importMetadata(data []byte) error {
+	var (
+		entities entitiesDescriptor
+		entity   entityDescriptor
+		imported []entityDescriptor
+	)
+
+	if err := xml.Unmarshal(data, &entities); err == nil && len(entities.EntityDescriptors) > 0 {
+		imported = entities.EntityDescriptors
+	} else if err := xml.Unmarshal(data, &entity); err == nil {
+		imported = []entityDescriptor{entity}
+	} else {
+		return err
+	}
+
+	for _, e := range imported {
+		if e.SPSSODescriptor == nil {
+			continue
+		}
+
+		sp := &ServiceProvider{EntityID: e.EntityID}
+
+		for _, acs := range e.SPSSODescriptor.AssertionConsumerServices {
+			if acs.Binding == BindingHTTPPost {
+				sp.ACS = append(sp.ACS, acs)
+			}
+		}
+
+		if sp.EntityID == "" || len(sp.ACS) == 0 {
+			return errors.New("no HTTP-POST assertion consumer service for " + e.EntityID)
+		}
+
+		// The default endpoint goes first
+		sort.SliceStable(sp.ACS, func(i, j int) bool {
+			return sp.ACS[i].IsDefault && !sp.ACS[j].IsDefault
+		})
+
+		serviceProviders[sp.EntityID] = sp
+	}
+
+	return nil
+}
+
+// Restituisce l'assertion consumer service richiesto, se appartiene al service provider
+func (sp *ServiceProvider) AssertionConsumerService(location string) (string, error) {
+	if location == "" {
+		return sp.ACS[0].Location, nil
+	}
+
+	for _, acs := range sp.ACS {
+		if acs.Location == location {
+			return location, nil
+		}
+	}
+
+	return "", ErrInvalidACS
+}
+
+// Richiesta di autenticazione di un service provider
+type AuthnRequest struct {
+	ID                          string `xml:"ID,attr"`
+	AssertionConsumerServiceURL string `xml:"AssertionConsumerServiceURL,attr"`
+	ProtocolBinding             string `xml:"ProtocolBinding,attr"`
+	Issuer                      string `xml:"Issuer"`
+
+	raw []byte
+}
+
+// Decodifica una richiesta ricevuta con il binding HTTP-Redirect
+func ParseRedirectRequest(samlRequest string) (*AuthnRequest, error) {
+	compressed, err := base64.StdEncoding.DecodeString(samlRequest)
+	if err != nil {
+		return nil, ErrInvalidRequest
+	}
+
+	raw, err := ioutil.ReadAll(io.LimitReader(flate.NewReader(bytes.NewReader(compressed)), maxRequestSize+1))
+	if err != nil {
+		return nil, ErrInvalidRequest
+	}
+
+	return parseRequest(raw)
+}
+
+// Decodifica una richiesta ricevuta con il binding HTTP-POST
+func ParsePostRequest(samlRequest string) (*AuthnRequest, error) {
+	// Some service providers wrap the encoded request
+	samlRequest = strings.Join(strings.Fields(samlRequest), "")
+
+	raw, err := base64.StdEncoding.DecodeString(samlRequest)
+	if err != nil {
+		return nil, ErrInvalidRequest
+	}
+
+	return parseRequest(raw)
+}
+
+// Codifica la richiesta per il binding HTTP-Redirect
+func (req *AuthnRequest) RedirectEncoding() (string, error) {
+	var buf bytes.Buffer
+
+	w, err := flate.NewWriter(&buf, flate.BestCompression)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := w.Write(req.raw); err != nil {
+		return "", err
+	}
+
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// Verifica una richiesta decodificata
+func parseRequest(raw []byte) (*AuthnRequest, error) {
+	var req AuthnRequest
+
+	if len(raw) > maxRequestSize {
+		return nil, ErrInvalidRequest
+	}
+
+	if err := xml.Unmarshal(raw, &req); err != nil {
+		return nil, ErrInvalidRequest
+	}
+
+	if req.ID == "" || strings.TrimSpace(req.Issuer) == "" {
+		return nil, ErrInvalidRequest
+	}
+
+	if req.ProtocolBinding != "" && req.ProtocolBinding != BindingHTTPPost {
+		return nil, ErrInvalidACS
+	}
+
+	req.Issuer = strings.TrimSpace(req.Issuer)
+	req.raw = raw
+
+	return &req, nil
+}
+
+// Genera i metadati dell'identity provider
+func Metadata() []byte {
+	var (
+		buf    bytes.Buffer
+		ssoURL = url.BaseURL() + "/saml/sso"
+	)
+
+	buf.WriteString(xml.Header)
+	fmt.Fprintf(&buf, `<md:EntityDescriptor xmlns:md="%s" entityID="%s">`, nsMetadata, escapeAttr(EntityID()))
+	fmt.Fprintf(&buf, `<md:IDPSSODescriptor WantAuthnRequestsSigned="false" protocolSupportEnumeration="%s">`, nsProtocol)
+	fmt.Fprintf(&buf, `<md:KeyDescriptor use="signing"><ds:KeyInfo xmlns:ds="%s"><ds:X509Data><ds:X509Certificate>%s</ds:X509Certificate></ds:X509Data></ds:KeyInfo></md:KeyDescriptor>`,
+		nsDSig, base64.StdEncoding.EncodeToString(certificate.Raw))
+	fmt.Fprintf(&buf, `<md:NameIDFormat>%s</md:NameIDFormat>`, nameIDFormat)
+	fmt.Fprintf(&buf, `<md:SingleSignOnService Binding="%s" Location="%s"/>`, BindingHTTPRedirect, escapeAttr(ssoURL))
+	fmt.Fprintf(&buf, `<md:SingleSignOnService Binding="%s" Location="%s"/>`, BindingHTTPPost, escapeAttr(ssoURL))
+	buf.WriteString(`</md:IDPSSODescriptor></md:EntityDescriptor>`)
+
+	return buf.Bytes()
+}
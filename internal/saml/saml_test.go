@@ -0,0 +1,250 @@
+/*
+ * saml_test.go
+ *
+ * File di test per il package saml.
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+package saml
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"git.napaalm.xyz/napaalm/ssodav/internal/auth"
+	"git.napaalm.xyz/napaalm/ssodav/internal/config"
+)
+
+const spMetadata = `<?xml version="1.0"?>
+<md:EntityDescriptor xmlns:md="urn:oasis:names:tc:SAML:2.0:metadata" entityID="https://elearning.example.org/sp">
+  <md:SPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol">
+    <md:AssertionConsumerService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Artifact" Location="https://elearning.example.org/artifact" index="0"/>
+    <md:AssertionConsumerService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST" Location="https://elearning.example.org/acs" index="1"/>
+    <md:AssertionConsumerService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST" Location="https://elearning.example.org/acs2" index="2" isDefault="true"/>
+  </md:SPSSODescriptor>
+</md:EntityDescriptor>`
+
+const authnRequest = `<samlp:AuthnRequest xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" ID="_req1" Version="2.0" IssueInstant="2021-01-01T00:00:00Z" AssertionConsumerServiceURL="https://elearning.example.org/acs" ProtocolBinding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"><saml:Issuer>https://elearning.example.org/sp</saml:Issuer></samlp:AuthnRequest>`
+
+// Genera chiave e certificato di test e inizializza il package
+func setup(t *testing.T) *rsa.PrivateKey {
+	dir, err := ioutil.TempDir("", "ssodav-saml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "sso.example.org"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]*pem.Block{
+		"key.pem":  {Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)},
+		"cert.pem": {Type: "CERTIFICATE", Bytes: der},
+	}
+
+	for name, block := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "sp.xml"), []byte(spMetadata), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config.Config.General.FQDN = "sso.example.org"
+	config.Config.SAML.PrivateKey = filepath.Join(dir, "key.pem")
+	config.Config.SAML.Certificate = filepath.Join(dir, "cert.pem")
+	config.Config.SAML.SPMetadata = []string{filepath.Join(dir, "sp.xml")}
+
+	if err := Initialize(); err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+func TestMetadata(t *testing.T) {
+	setup(t)
+
+	sp, ok := GetServiceProvider("https://elearning.example.org/sp")
+	if !ok {
+		t.Fatal("service provider not imported")
+	}
+
+	// Only HTTP-POST endpoints are kept, with the default one first
+	if len(sp.ACS) != 2 || sp.ACS[0].Location != "https://elearning.example.org/acs2" {
+		t.Errorf("unexpected endpoints: %v", sp.ACS)
+	}
+
+	if _, err := sp.AssertionConsumerService("https://evil.example.com/acs"); err != ErrInvalidACS {
+		t.Errorf("expected %v, got %v", ErrInvalidACS, err)
+	}
+
+	if !bytes.Contains(Metadata(), []byte(`entityID="http://sso.example.org/saml/metadata"`)) {
+		t.Error("unexpected entity ID in the IdP metadata")
+	}
+}
+
+func TestResponse(t *testing.T) {
+	key := setup(t)
+
+	// Encode the request for the HTTP-Redirect binding
+	var buf bytes.Buffer
+	w, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+	w.Write([]byte(authnRequest))
+	w.Close()
+
+	req, err := ParseRedirectRequest(base64.StdEncoding.EncodeToString(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if req.ID != "_req1" || req.Issuer != "https://elearning.example.org/sp" {
+		t.Fatalf("unexpected request: %+v", req)
+	}
+
+	sp, _ := GetServiceProvider(req.Issuer)
+	acs, err := sp.AssertionConsumerService(req.AssertionConsumerServiceURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := auth.UserInfo{Username: "fry", FullName: "Philip J. Fry & co. <delivery>", Group: "Delivery"}
+	response, err := NewResponse(sp, acs, req.ID, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := string(response)
+
+	for _, s := range []string{`InResponseTo="_req1"`, `Destination="https://elearning.example.org/acs"`, "Philip J. Fry &amp; co. &lt;delivery&gt;"} {
+		if !strings.Contains(res, s) {
+			t.Errorf("%q not found in the response", s)
+		}
+	}
+
+	// Verify the digest of the assertion without the enveloped signature
+	assertion := regexp.MustCompile(`<saml:Assertion .*</saml:Assertion>`).FindString(res)
+	signature := regexp.MustCompile(`<ds:Signature .*</ds:Signature>`).FindString(assertion)
+	signedInfo := regexp.MustCompile(`<ds:SignedInfo .*</ds:SignedInfo>`).FindString(signature)
+	digestValue := regexp.MustCompile(`<ds:DigestValue>(.*)</ds:DigestValue>`).FindStringSubmatch(signedInfo)[1]
+	signatureValue := regexp.MustCompile(`<ds:SignatureValue>(.*)</ds:SignatureValue>`).FindStringSubmatch(signature)[1]
+
+	digest := sha256.Sum256([]byte(strings.Replace(assertion, signature, "", 1)))
+	if base64.StdEncoding.EncodeToString(digest[:]) != digestValue {
+		t.Error("digest mismatch")
+	}
+
+	// Verify the signature of SignedInfo
+	sig, _ := base64.StdEncoding.DecodeString(signatureValue)
+	hashed := sha256.Sum256([]byte(signedInfo))
+	if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, hashed[:], sig); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAuthnStatement(t *testing.T) {
+	setup(t)
+
+	sp, _ := GetServiceProvider("https://elearning.example.org/sp")
+
+	// An SSO from an earlier session that used a second factor
+	authTime := time.Now().Add(-3 * time.Hour).UTC()
+	user := auth.UserInfo{Username: "fry", Methods: []string{"pwd", "otp"}, AuthTime: authTime}
+	response, err := NewResponse(sp, "https://elearning.example.org/acs", "", user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range []string{
+		`AuthnInstant="` + formatTime(authTime) + `"`,
+		`<saml:AuthnContextClassRef>` + auth.ACRMultiFactor + `</saml:AuthnContextClassRef>`,
+	} {
+		if !strings.Contains(string(response), s) {
+			t.Errorf("%q not found in the response", s)
+		}
+	}
+
+	for method, want := range map[string]string{"pwd": authnPassword, "email": authnUnknown} {
+		if got := authnContextClass([]string{method}); got != want {
+			t.Errorf("%s: expected %s, got %s", method, want, got)
+		}
+	}
+}
+
+func TestAttributes(t *testing.T) {
+	config.Config.SAML.Attributes = map[string]string{"mail": "mail", "displayName": "full_name"}
+	defer func() { config.Config.SAML.Attributes = nil }()
+	setup(t)
+
+	lookupUser = func(username string) (auth.UserInfo, error) {
+		return auth.UserInfo{Username: username, Attributes: map[string][]string{"mail": {"fry@planetexpress.com"}}}, nil
+	}
+	defer func() { lookupUser = auth.LookupUser }()
+
+	sp, _ := GetServiceProvider("https://elearning.example.org/sp")
+
+	// Users from a session carry no LDAP attributes, which are looked up in the directory
+	user := auth.UserInfo{Username: "fry", FullName: "Philip J. Fry", Group: "Delivery"}
+	response, err := NewResponse(sp, "https://elearning.example.org/acs", "", user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range []string{
+		`<saml:Attribute Name="mail" NameFormat="` + attrNameFormat + `"><saml:AttributeValue>fry@planetexpress.com</saml:AttributeValue>`,
+		`<saml:Attribute Name="displayName" NameFormat="` + attrNameFormat + `"><saml:AttributeValue>Philip J. Fry</saml:AttributeValue>`,
+	} {
+		if !strings.Contains(string(response), s) {
+			t.Errorf("%q not found in the response", s)
+		}
+	}
+}
@@ -0,0 +1,479 @@
+/*
+ * session.go
+ *
+ * Sessioni degli utenti conservate sul server.
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+// Sessioni degli utenti conservate sul server e identificate da un cookie opaco.
+package session
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"git.napaalm.xyz/napaalm/ssodav/internal/auth"
+	"git.napaalm.xyz/napaalm/ssodav/internal/config"
+)
+
+// Valori predefiniti se non specificati nella configurazione
+const (
+	defaultMaxPerUser = 20
+
+	defaultMaxLifetime         = 24 * time.Hour
+	defaultIdleTimeout         = 2 * time.Hour
+	defaultRememberMaxLifetime = 7 * 24 * time.Hour
+	defaultRememberIdleTimeout = 3 * 24 * time.Hour
+)
+
+const (
+	// Intervallo minimo tra due aggiornamenti dell'ultimo accesso
+	touchInterval = time.Minute
+
+	// Intervallo di salvataggio degli aggiornamenti dell'ultimo accesso
+	flushInterval = 30 * time.Second
+)
+
+var ErrNotFound = errors.New("Sessione non trovata oppure scaduta")
+
+// Sessione di un utente
+type Session struct {
+	// Identificatore pubblico, derivato dal segreto contenuto nel cookie
+	ID string `json:"id"`
+
+	Username string `json:"username"`
+	FullName string `json:"full_name"`
+	Group    string `json:"group"`
+
+	// Amministratore che impersonifica l'utente, se presente
+	Actor string `json:"actor,omitempty"`
+
+	Created  time.Time `json:"created"`
+	LastSeen time.Time `json:"last_seen"`
+
+	// Scadenza assoluta, indipendente dall'attività
+	Expires time.Time `json:"expires"`
+
+	// Durata massima di inattività, zero se la sessione scade solo con Expires
+	IdleTimeout time.Duration `json:"idle_timeout,omitempty"`
+
+	IP        string `json:"ip"`
+	UserAgent string `json:"user_agent"`
+
+	// Metodi di autenticazione usati (RFC 8176, es. "pwd")
+	Methods []string `json:"methods"`
+
+	// Ultima autenticazione dell'utente, che può essere più recente della
+	// creazione se l'utente ha dovuto accedere di nuovo
+	AuthTime time.Time `json:"auth_time,omitempty"`
+}
+
+// Restituisce il momento dell'ultima autenticazione dell'utente
+func (s Session) AuthenticatedAt() time.Time {
+	if s.AuthTime.IsZero() {
+		return s.Created
+	}
+
+	return s.AuthTime
+}
+
+// Restituisce il momento in cui la sessione scade, per inattività o perché
+// ha raggiunto la durata massima
+func (s Session) Deadline() time.Time {
+	if s.IdleTimeout > 0 {
+		if idle := s.LastSeen.Add(s.IdleTimeout); idle.Before(s.Expires) {
+			return idle
+		}
+	}
+
+	return s.Expires
+}
+
+// Restituisce le informazioni sull'utente della sessione
+func (s Session) UserInfo() auth.UserInfo {
+	return auth.UserInfo{
+		Username:  s.Username,
+		FullName:  s.FullName,
+		Group:     s.Group,
+		Actor:     s.Actor,
+		Expires:   s.Expires,
+		SessionID: s.ID,
+		Methods:   s.Methods,
+		AuthTime:  s.AuthenticatedAt(),
+	}
+}
+
+var (
+	mutex      sync.Mutex
+	sessions   map[string]*Session
+	path       string
+	maxPerUser int
+	dirty      bool
+	flushOnce  sync.Once
+)
+
+// Inizializza l'archivio delle sessioni, caricando quelle salvate nel file
+// indicato nella configurazione. Senza file le sessioni restano in memoria.
+func Initialize() error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	sessions = make(map[string]*Session)
+	dirty = false
+
+	path = config.Config.Sessions.File
+
+	maxPerUser = config.Config.Sessions.MaxPerUser
+	if maxPerUser <= 0 {
+		maxPerUser = defaultMaxPerUser
+	}
+
+	if path != "" {
+		if err := load(); err != nil {
+			return err
+		}
+
+		// Last-seen times are saved periodically rather than on every request
+		flushOnce.Do(func() {
+			go func() {
+				for range time.Tick(flushInterval) {
+					Flush()
+				}
+			}()
+		})
+	}
+
+	sweep(time.Now())
+	return nil
+}
+
+// Restituisce la durata massima e quella di inattività delle sessioni, secondo la
+// configurazione, a seconda che l'utente abbia chiesto di ricordare l'accesso
+func Lifetime(remember bool) (time.Duration, time.Duration) {
+	c := config.Config.Sessions
+
+	if remember {
+		return orDefault(c.RememberMaxLifetime.Duration, defaultRememberMaxLifetime),
+			orDefault(c.RememberIdleTimeout.Duration, defaultRememberIdleTimeout)
+	}
+
+	return orDefault(c.MaxLifetime.Duration, defaultMaxLifetime),
+		orDefault(c.IdleTimeout.Duration, defaultIdleTimeout)
+}
+
+// Crea una sessione e restituisce il segreto da inserire nel cookie. La sessione
+// dura al massimo lifetime e scade prima se resta inattiva per idle (se non è zero).
+// Restituisce anche le sessioni dell'utente terminate per fare posto alla nuova,
+// di cui vanno avvisati i servizi. Le sessioni impersonificate da un
+// amministratore sono contate a parte, così da non terminare quelle dell'utente.
+func Create(userInfo auth.UserInfo, ip, userAgent string, methods []string, lifetime, idle time.Duration) (string, Session, []Session, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", Session{}, nil, err
+	}
+
+	secret := base64.RawURLEncoding.EncodeToString(b)
+	now := time.Now()
+
+	s := &Session{
+		ID:          hashSecret(secret),
+		Username:    userInfo.Username,
+		FullName:    userInfo.FullName,
+		Group:       userInfo.Group,
+		Actor:       userInfo.Actor,
+		Created:     now,
+		LastSeen:    now,
+		Expires:     now.Add(lifetime),
+		IdleTimeout: idle,
+		IP:          ip,
+		UserAgent:   userAgent,
+		Methods:     methods,
+		AuthTime:    now,
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	sweep(now)
+	sessions[s.ID] = s
+
+	// The least recently used sessions are removed when a user has too many
+	var same []*Session
+	for _, other := range listUser(s.Username) {
+		if (other.Actor == "") == (s.Actor == "") {
+			same = append(same, other)
+		}
+	}
+
+	var evicted []Session
+	if len(same) > maxPerUser {
+		for _, old := range same[maxPerUser:] {
+			delete(sessions, old.ID)
+			evicted = append(evicted, *old)
+		}
+	}
+
+	// New sessions are saved with the next flush rather than rewriting the
+	// file on every login: losing one on a crash only means logging in again
+	dirty = true
+	return secret, *s, evicted, nil
+}
+
+// Restituisce la sessione corrispondente al segreto del cookie e ne aggiorna l'ultimo accesso
+func Get(secret string) (Session, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	s, err := lookup(hashSecret(secret), time.Now())
+	if err != nil {
+		return Session{}, err
+	}
+
+	// Short idle timeouts need a finer last-seen time
+	interval := touchInterval
+	if s.IdleTimeout > 0 && s.IdleTimeout/4 < interval {
+		interval = s.IdleTimeout / 4
+	}
+
+	if now := time.Now(); now.Sub(s.LastSeen) >= interval {
+		s.LastSeen = now
+		dirty = true
+	}
+
+	return *s, nil
+}
+
+// Registra una nuova autenticazione dell'utente della sessione, che ora ha
+// usato i metodi indicati
+func Reauthenticate(id string, methods []string) (Session, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	now := time.Now()
+
+	s, err := lookup(id, now)
+	if err != nil {
+		return Session{}, err
+	}
+
+	s.Methods = methods
+	s.AuthTime = now
+	s.LastSeen = now
+
+	save()
+	return *s, nil
+}
+
+// Restituisce la sessione con l'identificatore indicato
+func Lookup(id string) (Session, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	s, err := lookup(id, time.Now())
+	if err != nil {
+		return Session{}, err
+	}
+
+	return *s, nil
+}
+
+// Controlla se la sessione con l'identificatore indicato è ancora attiva
+func Active(id string) bool {
+	_, err := Lookup(id)
+	return err == nil
+}
+
+// Restituisce le sessioni attive di un utente, dalla più recente
+func List(username string) []Session {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	sweep(time.Now())
+
+	var list []Session
+	for _, s := range listUser(username) {
+		list = append(list, *s)
+	}
+
+	return list
+}
+
+// Termina una sessione
+func Delete(id string) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if _, ok := sessions[id]; !ok {
+		return ErrNotFound
+	}
+
+	delete(sessions, id)
+	save()
+
+	return nil
+}
+
+// Termina tutte le sessioni di un utente e le restituisce
+func DeleteUser(username string) []Session {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	var deleted []Session
+
+	for _, s := range listUser(username) {
+		delete(sessions, s.ID)
+		deleted = append(deleted, *s)
+	}
+
+	if len(deleted) > 0 {
+		save()
+	}
+
+	return deleted
+}
+
+// Salva le sessioni se sono cambiate dall'ultimo salvataggio
+func Flush() {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if dirty {
+		save()
+	}
+}
+
+// Cerca una sessione non scaduta; le sessioni scadute vengono eliminate
+func lookup(id string, now time.Time) (*Session, error) {
+	s, ok := sessions[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	if !now.Before(s.Deadline()) {
+		delete(sessions, id)
+		dirty = true
+		return nil, ErrNotFound
+	}
+
+	return s, nil
+}
+
+// Restituisce le sessioni di un utente, dalla più recente
+func listUser(username string) []*Session {
+	var list []*Session
+
+	for _, s := range sessions {
+		if s.Username == username {
+			list = append(list, s)
+		}
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].LastSeen.After(list[j].LastSeen)
+	})
+
+	return list
+}
+
+// Elimina le sessioni scadute
+func sweep(now time.Time) {
+	for id, s := range sessions {
+		if !now.Before(s.Deadline()) {
+			delete(sessions, id)
+			dirty = true
+		}
+	}
+}
+
+// Carica le sessioni dal file, se esiste
+func load() error {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var list []*Session
+	if err := json.Unmarshal(b, &list); err != nil {
+		return err
+	}
+
+	for _, s := range list {
+		sessions[s.ID] = s
+	}
+
+	return nil
+}
+
+// Scrive le sessioni nel file, sostituendolo in modo atomico
+func save() {
+	if path == "" {
+		dirty = false
+		return
+	}
+
+	list := make([]*Session, 0, len(sessions))
+	for _, s := range sessions {
+		list = append(list, s)
+	}
+
+	b, err := json.Marshal(list)
+	if err != nil {
+		log.Println("session: ", err.Error())
+		return
+	}
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		log.Println("session: ", err.Error())
+		return
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		log.Println("session: ", err.Error())
+		return
+	}
+
+	dirty = false
+}
+
+// Only a hash of the secret is stored, so the file can't be used to hijack sessions
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func orDefault(d, def time.Duration) time.Duration {
+	if d <= 0 {
+		return def
+	}
+
+	return d
+}
@@ -0,0 +1,190 @@
+/*
+ * session_test.go
+ *
+ * File di test per il package session.
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+package session
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"git.napaalm.xyz/napaalm/ssodav/internal/auth"
+	"git.napaalm.xyz/napaalm/ssodav/internal/config"
+)
+
+var testUser = auth.UserInfo{Username: "professor", FullName: "Hubert J. Farnsworth", Group: "Office Management"}
+
+func TestSessions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssodav-session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config.Config.Sessions.File = filepath.Join(dir, "sessions.json")
+	config.Config.Sessions.MaxPerUser = 2
+
+	if err := Initialize(); err != nil {
+		t.Fatal(err)
+	}
+
+	secret, s, _, err := Create(testUser, "127.0.0.1", "curl", []string{"pwd"}, time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := Get(secret)
+	if err != nil || got.ID != s.ID || got.UserInfo().SessionID != s.ID || got.UserInfo().Username != testUser.Username {
+		t.Error(got, err)
+	}
+
+	if _, err := Get(s.ID); err != ErrNotFound {
+		t.Error("the public identifier must not work as a secret")
+	}
+
+	// New sessions are saved with the next flush and survive a restart
+	Flush()
+	if err := Initialize(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Get(secret); err != nil {
+		t.Error(err)
+	}
+
+	// A new authentication keeps the session
+	time.Sleep(10 * time.Millisecond)
+	if got, err := Reauthenticate(s.ID, []string{"pwd", "otp"}); err != nil || got.ID != s.ID || !got.AuthenticatedAt().After(s.Created) || len(got.UserInfo().Methods) != 2 {
+		t.Error(got, err)
+	}
+
+	if !s.AuthenticatedAt().Equal(s.Created) || !s.UserInfo().AuthTime.Equal(s.Created) {
+		t.Errorf("unexpected authentication time %v", s.AuthenticatedAt())
+	}
+
+	// The least recently used sessions are dropped
+	time.Sleep(10 * time.Millisecond)
+	if _, _, evicted, _ := Create(testUser, "127.0.0.2", "firefox", []string{"pwd"}, time.Hour, 0); len(evicted) != 0 {
+		t.Errorf("unexpected evicted sessions %+v", evicted)
+	}
+	time.Sleep(10 * time.Millisecond)
+	_, _, evicted, _ := Create(testUser, "127.0.0.3", "chromium", []string{"pwd"}, time.Hour, 0)
+
+	list := List(testUser.Username)
+	if len(list) != 2 || list[0].IP != "127.0.0.3" || Active(s.ID) {
+		t.Errorf("unexpected sessions %+v", list)
+	}
+
+	// The dropped sessions are returned, so that the services can be notified
+	if len(evicted) != 1 || evicted[0].ID != s.ID {
+		t.Errorf("unexpected evicted sessions %+v", evicted)
+	}
+
+	// Impersonated sessions don't take the place of the user's own
+	impersonated := testUser
+	impersonated.Actor = "hermes"
+
+	for i := 0; i < 3; i++ {
+		time.Sleep(10 * time.Millisecond)
+		if _, _, evicted, _ := Create(impersonated, "127.0.0.4", "curl", []string{"pwd"}, time.Hour, 0); len(evicted) > 1 || (len(evicted) == 1 && evicted[0].Actor == "") {
+			t.Errorf("unexpected evicted sessions %+v", evicted)
+		}
+	}
+
+	list = List(testUser.Username)
+	if len(list) != 4 || list[2].IP != "127.0.0.3" {
+		t.Errorf("unexpected sessions %+v", list)
+	}
+
+	for _, s := range list[:2] {
+		if err := Delete(s.ID); err != nil {
+			t.Error(err)
+		}
+	}
+	list = List(testUser.Username)
+
+	if err := Delete(list[0].ID); err != nil || Active(list[0].ID) {
+		t.Error("session not deleted", err)
+	}
+
+	if deleted := DeleteUser(testUser.Username); len(deleted) != 1 || len(List(testUser.Username)) != 0 {
+		t.Errorf("expected 1 session deleted, got %d", len(deleted))
+	}
+
+	// Expired sessions
+	secret, _, _, _ = Create(testUser, "127.0.0.1", "curl", nil, -time.Second, 0)
+	if _, err := Get(secret); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	config.Config.Sessions.File = ""
+	if err := Initialize(); err != nil {
+		t.Fatal(err)
+	}
+
+	secret, s, _, err := Create(testUser, "127.0.0.1", "curl", []string{"pwd"}, time.Hour, 10*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !s.Deadline().Equal(s.LastSeen.Add(10 * time.Minute)) {
+		t.Errorf("unexpected deadline %v", s.Deadline())
+	}
+
+	// Activity moves the deadline forward, but never past the maximum lifetime
+	sessions[s.ID].LastSeen = time.Now().Add(-5 * time.Minute)
+
+	got, err := Get(secret)
+	if err != nil || time.Until(got.Deadline()) < 9*time.Minute {
+		t.Errorf("deadline not renewed: %v %v", got.Deadline(), err)
+	}
+
+	sessions[s.ID].Expires = time.Now().Add(time.Minute)
+	if got, _ := Get(secret); got.Deadline() != got.Expires {
+		t.Errorf("deadline %v past the expiry %v", got.Deadline(), got.Expires)
+	}
+
+	// Idle sessions expire
+	sessions[s.ID].Expires = time.Now().Add(time.Hour)
+	sessions[s.ID].LastSeen = time.Now().Add(-11 * time.Minute)
+
+	if _, err := Get(secret); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+
+	// Defaults
+	config.Config.Sessions.IdleTimeout.Duration = 30 * time.Minute
+
+	if lifetime, idle := Lifetime(false); lifetime != defaultMaxLifetime || idle != 30*time.Minute {
+		t.Errorf("unexpected lifetime %v and idle timeout %v", lifetime, idle)
+	}
+
+	if lifetime, idle := Lifetime(true); lifetime != defaultRememberMaxLifetime || idle != defaultRememberIdleTimeout {
+		t.Errorf("unexpected lifetime %v and idle timeout %v", lifetime, idle)
+	}
+}
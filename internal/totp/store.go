@@ -0,0 +1,226 @@
+/*
+ * store.go
+ *
+ * Archivio cifrato dei segreti TOTP.
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+package totp
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+
+	"git.napaalm.xyz/napaalm/ssodav/internal/auth"
+	"git.napaalm.xyz/napaalm/ssodav/internal/config"
+)
+
+// Lunghezza minima della chiave di cifratura
+const minKeySize = 16
+
+// Archivio dei segreti, cifrati con AES-GCM e legati al nome dell'utente: un
+// segreto copiato nella voce di un altro utente non viene accettato
+type store struct {
+	aead cipher.AEAD
+
+	// File con i segreti degli utenti
+	mutex   sync.Mutex
+	path    string
+	entries map[string]string
+
+	// Attributo LDAP con il segreto, se l'archivio è la directory
+	attribute string
+}
+
+// Crea l'archivio indicato nella configurazione
+func newStore() (*store, error) {
+	c := config.Config.TOTP
+
+	if c.Key == "" {
+		return nil, errors.New("Chiave per i segreti TOTP non configurata")
+	}
+
+	b, err := ioutil.ReadFile(c.Key)
+	if err != nil {
+		return nil, fmt.Errorf("Impossibile leggere la chiave per i segreti TOTP: %v", err)
+	}
+
+	key := bytes.TrimSpace(b)
+	if len(key) < minKeySize {
+		return nil, errors.New("Chiave per i segreti TOTP troppo corta")
+	}
+
+	sum := sha256.Sum256(key)
+
+	block, err := aes.NewCipher(sum[:])
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &store{aead: aead}
+
+	switch c.Store {
+	case "", "file":
+		if c.File == "" {
+			return nil, errors.New("File dei segreti TOTP non configurato")
+		}
+
+		s.path = c.File
+		s.entries = make(map[string]string)
+
+		if err := s.load(); err != nil {
+			return nil, err
+		}
+	case "ldap":
+		if c.Attribute == "" {
+			return nil, errors.New("Attributo LDAP dei segreti TOTP non configurato")
+		}
+
+		s.attribute = c.Attribute
+	default:
+		return nil, fmt.Errorf("Archivio dei segreti TOTP \"%s\" non valido", c.Store)
+	}
+
+	return s, nil
+}
+
+// Restituisce il segreto dell'utente, nil se non ne ha uno
+func (s *store) get(username string) ([]byte, error) {
+	var sealed string
+
+	if s.attribute == "" {
+		s.mutex.Lock()
+		sealed = s.entries[username]
+		s.mutex.Unlock()
+	} else {
+		values, err := auth.UserAttribute(username, s.attribute)
+		if err != nil {
+			log.Println("totp: ", err.Error())
+			return nil, ErrStore
+		}
+
+		if len(values) > 0 {
+			sealed = values[0]
+		}
+	}
+
+	if sealed == "" {
+		return nil, nil
+	}
+
+	b, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil || len(b) < s.aead.NonceSize() {
+		log.Printf("totp: invalid secret for %s\n", username)
+		return nil, ErrStore
+	}
+
+	nonce, ciphertext := b[:s.aead.NonceSize()], b[s.aead.NonceSize():]
+
+	secret, err := s.aead.Open(nil, nonce, ciphertext, []byte(username))
+	if err != nil {
+		log.Printf("totp: unable to decrypt the secret of %s\n", username)
+		return nil, ErrStore
+	}
+
+	return secret, nil
+}
+
+// Salva il segreto dell'utente
+func (s *store) set(username string, secret []byte) error {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	sealed := base64.StdEncoding.EncodeToString(s.aead.Seal(nonce, nonce, secret, []byte(username)))
+
+	if s.attribute != "" {
+		if err := auth.SetUserAttribute(username, s.attribute, []string{sealed}); err != nil {
+			log.Println("totp: ", err.Error())
+			return ErrStore
+		}
+
+		return nil
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	previous, existed := s.entries[username]
+	s.entries[username] = sealed
+
+	if err := s.save(); err != nil {
+		log.Println("totp: ", err.Error())
+
+		// Keep the memory consistent with the file
+		if existed {
+			s.entries[username] = previous
+		} else {
+			delete(s.entries, username)
+		}
+
+		return ErrStore
+	}
+
+	return nil
+}
+
+// Legge i segreti dal file, se esiste
+func (s *store) load() error {
+	b, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(b, &s.entries)
+}
+
+// Scrive i segreti nel file, sostituendolo in modo atomico
+func (s *store) save() error {
+	b, err := json.Marshal(s.entries)
+	if err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, s.path)
+}
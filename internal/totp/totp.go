@@ -0,0 +1,257 @@
+/*
+ * totp.go
+ *
+ * Verifica in due passaggi con codici TOTP.
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+// Package per la verifica in due passaggi con i codici TOTP (RFC 6238) generati
+// dalle app di autenticazione. I segreti degli utenti vengono conservati cifrati
+// in un file locale oppure in un attributo della loro voce LDAP.
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"git.napaalm.xyz/napaalm/ssodav/internal/auth"
+	"git.napaalm.xyz/napaalm/ssodav/internal/config"
+)
+
+const (
+	period     = 30
+	digits     = 6
+	secretSize = 20
+
+	// Passi di tolleranza per gli orologi dei dispositivi non sincronizzati
+	skew = 1
+)
+
+var (
+	ErrInvalidCode = errors.New("Codice di verifica errato")
+	ErrNotEnrolled = errors.New("Verifica in due passaggi non configurata")
+	ErrStore       = errors.New("Verifica in due passaggi non disponibile. Riprova più tardi.")
+)
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+var (
+	mutex   sync.Mutex
+	secrets *store
+
+	// Ultimo passo usato da ogni utente, perché i codici non possano essere riutilizzati
+	lastSteps map[string]int64
+)
+
+// Inizializza l'archivio dei segreti secondo la configurazione
+func Initialize() error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	secrets = nil
+	lastSteps = make(map[string]int64)
+
+	if !config.Config.TOTP.Enabled {
+		return nil
+	}
+
+	s, err := newStore()
+	if err != nil {
+		return err
+	}
+
+	secrets = s
+	return nil
+}
+
+// Indica se la verifica in due passaggi è abilitata
+func Enabled() bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	return secrets != nil
+}
+
+// Indica se la verifica è obbligatoria per il gruppo dell'utente
+func Required(userInfo auth.UserInfo) bool {
+	for _, group := range config.Config.TOTP.Groups {
+		if group == userInfo.Group {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Indica se l'utente ha configurato la verifica
+func Enrolled(username string) (bool, error) {
+	s := currentStore()
+	if s == nil {
+		return false, nil
+	}
+
+	secret, err := s.get(username)
+	return secret != nil, err
+}
+
+// Genera un nuovo segreto da mostrare all'utente
+func NewSecret() ([]byte, error) {
+	secret := make([]byte, secretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+
+	return secret, nil
+}
+
+// Restituisce l'URI otpauth con cui le app di autenticazione importano il segreto
+func URI(secret []byte, username string) string {
+	issuer := config.Config.TOTP.Issuer
+	if issuer == "" {
+		issuer = config.Config.General.FQDN
+	}
+
+	// Spaces must be encoded as %20, not as +
+	escape := func(s string) string {
+		return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+	}
+
+	return fmt.Sprintf("otpauth://totp/%s:%s?secret=%s&issuer=%s&algorithm=SHA1&digits=%d&period=%d",
+		escape(issuer), escape(username), encoding.EncodeToString(secret), escape(issuer), digits, period)
+}
+
+// Restituisce il segreto da inserire a mano nelle app, a gruppi di quattro caratteri
+func FormatSecret(secret []byte) string {
+	encoded := encoding.EncodeToString(secret)
+
+	var groups []string
+	for len(encoded) > 4 {
+		groups = append(groups, encoded[:4])
+		encoded = encoded[4:]
+	}
+
+	return strings.Join(append(groups, encoded), " ")
+}
+
+// Verifica il codice dell'utente, che in seguito non viene più accettato
+func Verify(username, code string) error {
+	s := currentStore()
+	if s == nil {
+		return ErrNotEnrolled
+	}
+
+	secret, err := s.get(username)
+	if err != nil {
+		return err
+	}
+
+	if secret == nil {
+		return ErrNotEnrolled
+	}
+
+	return use(username, secret, code)
+}
+
+// Attiva la verifica per l'utente, o ne sostituisce il segreto, dopo aver
+// controllato un codice generato dall'app con il nuovo segreto
+func Enroll(username string, secret []byte, code string) error {
+	s := currentStore()
+	if s == nil {
+		return ErrStore
+	}
+
+	if err := use(username, secret, code); err != nil {
+		return err
+	}
+
+	return s.set(username, secret)
+}
+
+// Restituisce l'archivio dei segreti, nil se la verifica non è abilitata.
+// L'archivio va usato senza il lock, per non bloccare tutti gli accessi
+// durante le richieste alla directory LDAP.
+func currentStore() *store {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	return secrets
+}
+
+// Controlla il codice e registra il passo usato
+func use(username string, secret []byte, code string) error {
+	step, ok := match(secret, code, time.Now())
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if !ok || step <= lastSteps[username] {
+		return ErrInvalidCode
+	}
+
+	lastSteps[username] = step
+	return nil
+}
+
+// Cerca il passo, nell'intervallo di tolleranza, in cui il codice è valido
+func match(secret []byte, code string, now time.Time) (int64, bool) {
+	code = strings.Replace(strings.TrimSpace(code), " ", "", -1)
+	if len(code) != digits {
+		return 0, false
+	}
+
+	current := now.Unix() / period
+
+	for step := current - skew; step <= current+skew; step++ {
+		if hmac.Equal([]byte(generate(secret, step, digits)), []byte(code)) {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
+
+// Calcola il codice per un passo (HOTP, RFC 4226)
+func generate(secret []byte, step int64, n int) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < n; i++ {
+		mod *= 10
+	}
+
+	return fmt.Sprintf("%0*d", n, value%mod)
+}
@@ -0,0 +1,165 @@
+/*
+ * totp_test.go
+ *
+ * File di test per il package totp.
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+package totp
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"git.napaalm.xyz/napaalm/ssodav/internal/auth"
+	"git.napaalm.xyz/napaalm/ssodav/internal/config"
+)
+
+func TestGenerate(t *testing.T) {
+	// Test vectors of RFC 6238 (SHA-1)
+	secret := []byte("12345678901234567890")
+
+	vectors := map[int64]string{
+		59:         "94287082",
+		1111111109: "07081804",
+		1234567890: "89005924",
+		2000000000: "69279037",
+	}
+
+	for unix, expected := range vectors {
+		if code := generate(secret, unix/period, 8); code != expected {
+			t.Errorf("expected %s at %d, got %s", expected, unix, code)
+		}
+	}
+
+	// Codes from the previous and the next step are accepted
+	now := time.Unix(1111111109, 0)
+	for _, delta := range []int64{-1, 0, 1} {
+		code := generate(secret, now.Unix()/period+delta, digits)
+		if _, ok := match(secret, code[:3]+" "+code[3:], now); !ok {
+			t.Errorf("code for step %+d refused", delta)
+		}
+	}
+
+	if _, ok := match(secret, generate(secret, now.Unix()/period+2, digits), now); ok {
+		t.Error("code out of the window accepted")
+	}
+}
+
+func TestEnrollment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "totp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key := filepath.Join(dir, "totp.key")
+	if err := ioutil.WriteFile(key, []byte("0123456789abcdef0123456789abcdef\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config.Config.General.FQDN = "sso.example.org"
+	config.Config.TOTP.Enabled = true
+	config.Config.TOTP.Groups = []string{"Docenti"}
+	config.Config.TOTP.Issuer = "SSO Scuola"
+	config.Config.TOTP.File = filepath.Join(dir, "totp.json")
+	config.Config.TOTP.Key = key
+
+	if err := Initialize(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !Required(auth.UserInfo{Group: "Docenti"}) || Required(auth.UserInfo{Group: "Studenti"}) {
+		t.Error("unexpected enforcement")
+	}
+
+	secret, err := NewSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uri := URI(secret, "professor")
+	if !strings.HasPrefix(uri, "otpauth://totp/SSO%20Scuola:professor?secret=") || !strings.Contains(uri, "issuer=SSO%20Scuola") {
+		t.Errorf("unexpected URI %s", uri)
+	}
+
+	if formatted := FormatSecret(secret); len(formatted) != 39 {
+		t.Errorf("unexpected formatted secret %q", formatted)
+	}
+
+	if err := Verify("professor", "123456"); err != ErrNotEnrolled {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	// Enrollment requires a valid code
+	code := func() string { return generate(secret, time.Now().Unix()/period, digits) }
+
+	if err := Enroll("professor", secret, "000000"); err != ErrInvalidCode && code() != "000000" {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	if err := Enroll("professor", secret, code()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The same code can't be used twice
+	if err := Verify("professor", code()); err != ErrInvalidCode {
+		t.Errorf("code reused: %v", err)
+	}
+
+	// The secret is stored encrypted and survives restarts
+	b, _ := ioutil.ReadFile(config.Config.TOTP.File)
+	if strings.Contains(string(b), encoding.EncodeToString(secret)) {
+		t.Error("secret stored in clear")
+	}
+
+	if err := Initialize(); err != nil {
+		t.Fatal(err)
+	}
+
+	if enrolled, err := Enrolled("professor"); !enrolled || err != nil {
+		t.Errorf("enrollment lost: %v", err)
+	}
+
+	if err := Verify("professor", code()); err != nil {
+		t.Error(err)
+	}
+
+	// Secrets are bound to their user
+	secrets.entries["fry"] = secrets.entries["professor"]
+	if _, err := secrets.get("fry"); err != ErrStore {
+		t.Errorf("secret accepted for another user: %v", err)
+	}
+
+	// A missing key is reported
+	config.Config.TOTP.Key = filepath.Join(dir, "missing.key")
+	if err := Initialize(); err == nil {
+		t.Error("missing key accepted")
+	}
+
+	config.Config.TOTP.Enabled = false
+	if err := Initialize(); err != nil || Enabled() {
+		t.Error("TOTP not disabled")
+	}
+}
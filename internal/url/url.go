@@ -41,8 +41,9 @@ func SanitizeURL(URL string) string {
 		return ""
 	}
 
-	// The URL must have the TLD specified in the configuration
-	if !strings.HasSuffix(u.Hostname(), config.Config.General.TLD) {
+	// The URL must have the TLD specified in the configuration,
+	// or belong to one of the authorized domains outside of it
+	if !strings.HasSuffix(u.Hostname(), config.Config.General.TLD) && !authorizedDomain(u.Hostname()) {
 		return ""
 	}
 
@@ -58,3 +59,71 @@ func SanitizeURL(URL string) string {
 	// Santize host and scheme and return
 	return u.String()
 }
+
+// Restituisce l'origine (schema e host) di un URL appartenente a uno dei domini
+// autorizzati, da usare come audience dei token. Se l'URL non è valido restituisce "".
+func Origin(URL string) string {
+	u, err := url.Parse(SanitizeURL(URL))
+	if err != nil || u.Host == "" {
+		return ""
+	}
+
+	if !authorizedDomain(u.Hostname()) {
+		return ""
+	}
+
+	return u.Scheme + "://" + strings.ToLower(u.Host)
+}
+
+// Controlla se l'URL, esclusa la query, è uno dei ricevitori registrati
+func Receiver(URL string) bool {
+	u, err := url.Parse(SanitizeURL(URL))
+	if err != nil || Origin(URL) == "" {
+		return false
+	}
+
+	for _, receiver := range config.Config.General.Receivers {
+		r, err := url.Parse(receiver)
+		if err != nil {
+			continue
+		}
+
+		if u.Scheme == r.Scheme && strings.EqualFold(u.Host, r.Host) && u.Path == r.Path {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Controlla se l'host è uno dei domini autorizzati
+func authorizedDomain(host string) bool {
+	for _, domain := range config.Config.General.Domains {
+		if strings.EqualFold(host, domain) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Restituisce l'URL base del servizio SSO
+func BaseURL() string {
+	var scheme string
+
+	fqdn := config.Config.General.FQDN
+
+	if config.Config.General.SecureCookies {
+		scheme = "https://"
+	} else {
+		scheme = "http://"
+	}
+
+	url := scheme + fqdn
+
+	if fqdn == "localhost" {
+		url += config.Config.General.Port
+	}
+
+	return url
+}
@@ -0,0 +1,168 @@
+/*
+ * attestation.go
+ *
+ * Verifica delle attestazioni delle chiavi di sicurezza.
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+package webauthn
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+)
+
+// Formati di attestazione supportati
+const (
+	formatNone    = "none"
+	formatPacked  = "packed"
+	formatFIDOU2F = "fido-u2f"
+)
+
+var errAttestation = errors.New("webauthn: invalid attestation")
+
+// Estensione dei certificati di attestazione con l'AAGUID del modello
+var oidAAGUID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 45724, 1, 1, 4}
+
+// Verifica la dichiarazione di attestazione e restituisce la catena di
+// certificati che la firma, vuota se l'attestazione è assente o self
+func verifyAttestation(format string, statement map[interface{}]interface{}, rawAuthData []byte, ad authenticatorData, clientDataHash []byte) ([]*x509.Certificate, error) {
+	signed := append(append([]byte(nil), rawAuthData...), clientDataHash...)
+
+	switch format {
+	case formatNone:
+		if len(statement) != 0 {
+			return nil, errAttestation
+		}
+		return nil, nil
+	case formatPacked:
+		alg, _ := statement["alg"].(int64)
+		sig, _ := statement["sig"].([]byte)
+
+		chain, err := parseChain(statement)
+		if err != nil {
+			return nil, err
+		}
+
+		// Self attestation: signed with the credential key
+		if chain == nil {
+			if alg != ad.publicKey.alg || ad.publicKey.verify(signed, sig) != nil {
+				return nil, errAttestation
+			}
+			return nil, nil
+		}
+
+		cert := chain[0]
+		if cert.Version != 3 || cert.IsCA || verifySignature(cert.PublicKey, alg, signed, sig) != nil {
+			return nil, errAttestation
+		}
+
+		// The model of the certificate must match the authenticator
+		for _, ext := range cert.Extensions {
+			if ext.Id.Equal(oidAAGUID) {
+				var aaguid []byte
+				if _, err := asn1.Unmarshal(ext.Value, &aaguid); err != nil || !bytes.Equal(aaguid, ad.aaguid) {
+					return nil, errAttestation
+				}
+			}
+		}
+
+		return chain, nil
+	case formatFIDOU2F:
+		sig, _ := statement["sig"].([]byte)
+
+		chain, err := parseChain(statement)
+		if err != nil || len(chain) != 1 {
+			return nil, errAttestation
+		}
+
+		certKey, ok := chain[0].PublicKey.(*ecdsa.PublicKey)
+		credentialKey, ok2 := ad.publicKey.key.(*ecdsa.PublicKey)
+		if !ok || !ok2 || certKey.Curve != elliptic.P256() {
+			return nil, errAttestation
+		}
+
+		// U2F signs the raw public key instead of the authenticator data
+		rpIDHash := sha256.Sum256([]byte(rp.id))
+		data := append([]byte{0}, rpIDHash[:]...)
+		data = append(data, clientDataHash...)
+		data = append(data, ad.credentialID...)
+		data = append(data, elliptic.Marshal(elliptic.P256(), credentialKey.X, credentialKey.Y)...)
+
+		if verifySignature(certKey, algES256, data, sig) != nil {
+			return nil, errAttestation
+		}
+
+		return chain, nil
+	}
+
+	return nil, errAttestation
+}
+
+// Legge la catena di certificati della dichiarazione, se presente
+func parseChain(statement map[interface{}]interface{}) ([]*x509.Certificate, error) {
+	x5c, ok := statement["x5c"]
+	if !ok {
+		return nil, nil
+	}
+
+	items, ok := x5c.([]interface{})
+	if !ok || len(items) == 0 {
+		return nil, errAttestation
+	}
+
+	chain := make([]*x509.Certificate, len(items))
+	for i, item := range items {
+		der, _ := item.([]byte)
+
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, errAttestation
+		}
+		chain[i] = cert
+	}
+
+	return chain, nil
+}
+
+// Controlla che la catena risalga a uno dei certificati radice dei produttori
+func verifyChain(chain []*x509.Certificate, roots *x509.CertPool) error {
+	if len(chain) == 0 {
+		return errAttestation
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err := chain[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+
+	return err
+}
@@ -0,0 +1,152 @@
+/*
+ * cbor.go
+ *
+ * Decodifica dei dati in formato CBOR (RFC 8949).
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+package webauthn
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Profondità massima degli elementi annidati
+const maxDepth = 16
+
+var errCBOR = errors.New("webauthn: invalid CBOR data")
+
+// Decodifica il primo elemento CBOR e restituisce i byte che lo seguono. Sono
+// supportati i tipi usati da WebAuthn: interi (int64), stringhe di byte e di
+// testo, array ([]interface{}), mappe (map[interface{}]interface{}) e valori
+// semplici; le lunghezze indefinite e i numeri in virgola mobile non lo sono.
+func decodeCBOR(data []byte) (interface{}, []byte, error) {
+	return decodeItem(data, 0)
+}
+
+func decodeItem(data []byte, depth int) (interface{}, []byte, error) {
+	if depth > maxDepth || len(data) == 0 {
+		return nil, nil, errCBOR
+	}
+
+	major := data[0] >> 5
+	n, rest, err := decodeArgument(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch major {
+	case 0:
+		if n > 1<<63-1 {
+			return nil, nil, errCBOR
+		}
+		return int64(n), rest, nil
+	case 1:
+		if n > 1<<63-1 {
+			return nil, nil, errCBOR
+		}
+		return -1 - int64(n), rest, nil
+	case 2, 3:
+		if n > uint64(len(rest)) {
+			return nil, nil, errCBOR
+		}
+		if major == 2 {
+			return append([]byte(nil), rest[:n]...), rest[n:], nil
+		}
+		return string(rest[:n]), rest[n:], nil
+	case 4:
+		// Each item takes at least a byte
+		if n > uint64(len(rest)) {
+			return nil, nil, errCBOR
+		}
+
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], rest, err = decodeItem(rest, depth+1); err != nil {
+				return nil, nil, err
+			}
+		}
+		return items, rest, nil
+	case 5:
+		if n > uint64(len(rest))/2 {
+			return nil, nil, errCBOR
+		}
+
+		items := make(map[interface{}]interface{}, n)
+		for i := uint64(0); i < n; i++ {
+			var key, value interface{}
+			if key, rest, err = decodeItem(rest, depth+1); err != nil {
+				return nil, nil, err
+			}
+
+			// Only integers and text strings can be compared
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, errCBOR
+			}
+
+			if _, ok := items[key]; ok {
+				return nil, nil, errCBOR
+			}
+
+			if value, rest, err = decodeItem(rest, depth+1); err != nil {
+				return nil, nil, err
+			}
+			items[key] = value
+		}
+		return items, rest, nil
+	case 6:
+		// Tags are ignored
+		return decodeItem(rest, depth+1)
+	default:
+		switch data[0] & 0x1f {
+		case 20:
+			return false, rest, nil
+		case 21:
+			return true, rest, nil
+		case 22, 23:
+			return nil, rest, nil
+		}
+		return nil, nil, errCBOR
+	}
+}
+
+// Legge l'argomento dell'elemento: il valore, la lunghezza o il numero di elementi
+func decodeArgument(data []byte) (uint64, []byte, error) {
+	info := data[0] & 0x1f
+	data = data[1:]
+
+	switch {
+	case info < 24:
+		return uint64(info), data, nil
+	case info == 24 && len(data) >= 1:
+		return uint64(data[0]), data[1:], nil
+	case info == 25 && len(data) >= 2:
+		return uint64(binary.BigEndian.Uint16(data)), data[2:], nil
+	case info == 26 && len(data) >= 4:
+		return uint64(binary.BigEndian.Uint32(data)), data[4:], nil
+	case info == 27 && len(data) >= 8:
+		return binary.BigEndian.Uint64(data), data[8:], nil
+	}
+
+	return 0, nil, errCBOR
+}
@@ -0,0 +1,146 @@
+/*
+ * cose.go
+ *
+ * Chiavi pubbliche in formato COSE (RFC 8152).
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+package webauthn
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"math/big"
+)
+
+// Algoritmi COSE supportati
+const (
+	algES256 = -7
+	algEdDSA = -8
+	algRS256 = -257
+)
+
+// Tipi di chiave e curve COSE
+const (
+	ktyOKP = 1
+	ktyEC2 = 2
+	ktyRSA = 3
+
+	crvP256    = 1
+	crvEd25519 = 6
+)
+
+var (
+	errUnsupportedKey = errors.New("webauthn: unsupported public key")
+	errSignature      = errors.New("webauthn: invalid signature")
+)
+
+// Chiave pubblica di una credenziale
+type publicKey struct {
+	alg int64
+	key crypto.PublicKey
+}
+
+// Legge una chiave pubblica COSE e restituisce i byte che la seguono
+func parsePublicKey(data []byte) (publicKey, []byte, error) {
+	item, rest, err := decodeCBOR(data)
+	if err != nil {
+		return publicKey{}, nil, err
+	}
+
+	m, ok := item.(map[interface{}]interface{})
+	if !ok {
+		return publicKey{}, nil, errUnsupportedKey
+	}
+
+	kty, _ := m[int64(1)].(int64)
+	alg, _ := m[int64(3)].(int64)
+	crv, _ := m[int64(-1)].(int64)
+
+	switch {
+	case kty == ktyEC2 && alg == algES256 && crv == crvP256:
+		x, _ := m[int64(-2)].([]byte)
+		y, _ := m[int64(-3)].([]byte)
+		if len(x) != 32 || len(y) != 32 {
+			return publicKey{}, nil, errUnsupportedKey
+		}
+
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return publicKey{}, nil, errUnsupportedKey
+		}
+
+		return publicKey{alg, key}, rest, nil
+	case kty == ktyOKP && alg == algEdDSA && crv == crvEd25519:
+		x, _ := m[int64(-2)].([]byte)
+		if len(x) != ed25519.PublicKeySize {
+			return publicKey{}, nil, errUnsupportedKey
+		}
+
+		return publicKey{alg, ed25519.PublicKey(x)}, rest, nil
+	case kty == ktyRSA && alg == algRS256:
+		n, _ := m[int64(-1)].([]byte)
+		e, _ := m[int64(-2)].([]byte)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return publicKey{}, nil, errUnsupportedKey
+		}
+
+		exponent := 0
+		for _, b := range e {
+			exponent = exponent<<8 | int(b)
+		}
+
+		return publicKey{alg, &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exponent}}, rest, nil
+	}
+
+	return publicKey{}, nil, errUnsupportedKey
+}
+
+// Verifica la firma dei dati con la chiave
+func (k publicKey) verify(data, signature []byte) error {
+	return verifySignature(k.key, k.alg, data, signature)
+}
+
+// Verifica una firma WebAuthn con l'algoritmo COSE indicato
+func verifySignature(key crypto.PublicKey, alg int64, data, signature []byte) error {
+	digest := sha256.Sum256(data)
+
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		if alg == algES256 && ecdsa.VerifyASN1(k, digest[:], signature) {
+			return nil
+		}
+	case ed25519.PublicKey:
+		if alg == algEdDSA && ed25519.Verify(k, data, signature) {
+			return nil
+		}
+	case *rsa.PublicKey:
+		if alg == algRS256 && rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], signature) == nil {
+			return nil
+		}
+	}
+
+	return errSignature
+}
@@ -0,0 +1,117 @@
+/*
+ * store.go
+ *
+ * Archivio delle credenziali degli utenti.
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+package webauthn
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// Credenziale registrata da un utente
+type Credential struct {
+	ID        []byte `json:"id"`
+	PublicKey []byte `json:"public_key"`
+	SignCount uint32 `json:"sign_count"`
+
+	// Modello dell'autenticatore e formato dell'attestazione
+	AAGUID []byte `json:"aaguid"`
+	Format string `json:"format"`
+
+	Name       string    `json:"name"`
+	Transports []string  `json:"transports,omitempty"`
+	Created    time.Time `json:"created"`
+	LastUsed   time.Time `json:"last_used,omitempty"`
+}
+
+// Restituisce l'ID della credenziale codificato per gli URL e i form
+func (c Credential) EncodedID() string {
+	return base64.RawURLEncoding.EncodeToString(c.ID)
+}
+
+// Utente con le sue credenziali
+type user struct {
+	// Identificatore casuale comunicato agli autenticatori (user handle)
+	ID          []byte       `json:"id"`
+	Credentials []Credential `json:"credentials"`
+}
+
+// Archivio delle credenziali, conservato in un file JSON
+type store struct {
+	path  string
+	users map[string]*user
+}
+
+// Carica l'archivio dal file, se esiste
+func newStore(path string) (*store, error) {
+	s := &store{
+		path:  path,
+		users: make(map[string]*user),
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(b, &s.users); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Cerca una credenziale tra quelle di tutti gli utenti
+func (s *store) find(id []byte) (string, *user, int) {
+	for username, u := range s.users {
+		for i, c := range u.Credentials {
+			if bytes.Equal(c.ID, id) {
+				return username, u, i
+			}
+		}
+	}
+
+	return "", nil, -1
+}
+
+// Scrive le credenziali nel file, sostituendolo in modo atomico
+func (s *store) save() error {
+	b, err := json.Marshal(s.users)
+	if err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, s.path)
+}
@@ -0,0 +1,867 @@
+/*
+ * webauthn.go
+ *
+ * Registrazione e verifica delle chiavi di sicurezza e delle passkey.
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+// Package per l'autenticazione con chiavi di sicurezza e passkey (WebAuthn). Il
+// server prepara le opzioni delle cerimonie di registrazione e di accesso, che
+// il browser passa a navigator.credentials, e ne verifica le risposte. Le
+// credenziali degli utenti vengono conservate in un file.
+package webauthn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"git.napaalm.xyz/napaalm/ssodav/internal/auth"
+	"git.napaalm.xyz/napaalm/ssodav/internal/config"
+	"git.napaalm.xyz/napaalm/ssodav/internal/url"
+)
+
+const (
+	challengeSize = 32
+	userIDSize    = 32
+
+	// Tempo a disposizione per completare una cerimonia
+	ceremonyTimeout = 5 * time.Minute
+
+	// Numero massimo di cerimonie in corso
+	maxCeremonies = 10000
+
+	// Numero massimo di credenziali per utente
+	maxCredentials = 10
+
+	maxCredentialIDSize = 1023
+	maxNameLength       = 64
+)
+
+// Flag dei dati dell'autenticatore
+const (
+	flagUserPresent  = 0x01
+	flagUserVerified = 0x04
+	flagAttested     = 0x40
+	flagExtensions   = 0x80
+)
+
+// Valori di verifica_utente
+const (
+	verificationRequired    = "required"
+	verificationPreferred   = "preferred"
+	verificationDiscouraged = "discouraged"
+)
+
+var (
+	ErrInvalidResponse   = errors.New("Risposta della chiave di sicurezza non valida")
+	ErrExpired           = errors.New("Richiesta scaduta. Riprova.")
+	ErrUnknownCredential = errors.New("Chiave di sicurezza non registrata")
+	ErrNotAllowed        = errors.New("Questo modello di chiave di sicurezza non è ammesso")
+	ErrDuplicate         = errors.New("Chiave di sicurezza già registrata")
+	ErrTooManyKeys       = errors.New("Hai raggiunto il numero massimo di chiavi di sicurezza")
+	ErrSignCount         = errors.New("La chiave di sicurezza potrebbe essere stata duplicata. Contatta l'amministratore.")
+	ErrTooManyRequests   = errors.New("Troppe richieste di accesso. Riprova più tardi.")
+	ErrStore             = errors.New("Chiavi di sicurezza non disponibili. Riprova più tardi.")
+)
+
+// Relying party, cioè il servizio a cui sono legate le credenziali
+type relyingParty struct {
+	id      string
+	name    string
+	origins []string
+
+	userVerification string
+	passwordless     bool
+
+	// Politica sulle attestazioni
+	attestation string
+	formats     []string
+	aaguids     [][]byte
+	roots       *x509.CertPool
+}
+
+// Cerimonia in corso, identificata dalla sua challenge
+type ceremony struct {
+	registration bool
+	username     string
+
+	// Accesso o sessione del browser che ha avviato la cerimonia
+	binding string
+
+	// Identificatore proposto all'autenticatore per un nuovo utente
+	userID []byte
+
+	expires time.Time
+}
+
+var (
+	mutex       sync.Mutex
+	rp          relyingParty
+	credentials *store
+	ceremonies  map[string]*ceremony
+)
+
+// Legge la configurazione e carica le credenziali registrate
+func Initialize() error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	credentials = nil
+	ceremonies = make(map[string]*ceremony)
+
+	c := config.Config.WebAuthn
+	if !c.Enabled {
+		return nil
+	}
+
+	if c.File == "" {
+		return errors.New("File delle chiavi di sicurezza non configurato")
+	}
+
+	r := relyingParty{
+		id:               c.RPID,
+		name:             c.RPName,
+		origins:          c.Origins,
+		userVerification: c.UserVerification,
+		passwordless:     c.Passwordless,
+		attestation:      c.Attestation,
+		formats:          c.Formats,
+	}
+
+	if r.id == "" {
+		r.id = config.Config.General.FQDN
+	}
+
+	if r.name == "" {
+		r.name = config.Config.General.PageTitle
+	}
+
+	if r.origins == nil {
+		r.origins = []string{url.BaseURL()}
+	}
+
+	switch r.userVerification {
+	case "":
+		r.userVerification = verificationPreferred
+	case verificationRequired, verificationPreferred, verificationDiscouraged:
+	default:
+		return fmt.Errorf("Valore di verifica_utente \"%s\" non valido", r.userVerification)
+	}
+
+	switch r.attestation {
+	case "":
+		r.attestation = "none"
+	case "none", "indirect", "direct":
+	default:
+		return fmt.Errorf("Valore di attestazione \"%s\" non valido", r.attestation)
+	}
+
+	if r.formats == nil {
+		r.formats = []string{formatNone, formatPacked, formatFIDOU2F}
+	}
+
+	for _, f := range r.formats {
+		if f != formatNone && f != formatPacked && f != formatFIDOU2F {
+			return fmt.Errorf("Formato di attestazione \"%s\" non supportato", f)
+		}
+	}
+
+	for _, s := range c.AAGUIDs {
+		aaguid, err := hex.DecodeString(strings.Replace(s, "-", "", -1))
+		if err != nil || len(aaguid) != 16 {
+			return fmt.Errorf("AAGUID \"%s\" non valido", s)
+		}
+		r.aaguids = append(r.aaguids, aaguid)
+	}
+
+	if c.Roots != "" {
+		b, err := ioutil.ReadFile(c.Roots)
+		if err != nil {
+			return fmt.Errorf("Impossibile leggere i certificati di attestazione: %v", err)
+		}
+
+		r.roots = x509.NewCertPool()
+		if !r.roots.AppendCertsFromPEM(b) {
+			return errors.New("Nessun certificato di attestazione valido")
+		}
+	}
+
+	s, err := newStore(c.File)
+	if err != nil {
+		return fmt.Errorf("Impossibile leggere le chiavi di sicurezza: %v", err)
+	}
+
+	rp = r
+	credentials = s
+	return nil
+}
+
+// Indica se le chiavi di sicurezza sono abilitate
+func Enabled() bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	return credentials != nil
+}
+
+// Indica se è possibile accedere con una passkey, senza password
+func Passwordless() bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	return credentials != nil && rp.passwordless
+}
+
+// Indica se la chiave è obbligatoria per il gruppo dell'utente
+func Required(userInfo auth.UserInfo) bool {
+	for _, group := range config.Config.WebAuthn.Groups {
+		if group == userInfo.Group {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Restituisce le credenziali registrate dall'utente
+func Credentials(username string) []Credential {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if credentials == nil || credentials.users[username] == nil {
+		return nil
+	}
+
+	return append([]Credential(nil), credentials.users[username].Credentials...)
+}
+
+// Elimina una credenziale dell'utente, indicata con Credential.EncodedID
+func Remove(username, id string) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	rawID, err := decode(id)
+	if credentials == nil || err != nil {
+		return ErrUnknownCredential
+	}
+
+	owner, u, i := credentials.find(rawID)
+	if owner != username {
+		return ErrUnknownCredential
+	}
+
+	previous := u.Credentials
+	u.Credentials = append(append([]Credential(nil), previous[:i]...), previous[i+1:]...)
+
+	if err := credentials.save(); err != nil {
+		log.Println("webauthn: ", err.Error())
+		u.Credentials = previous
+		return ErrStore
+	}
+
+	return nil
+}
+
+// Opzioni per navigator.credentials.create (PublicKeyCredentialCreationOptions),
+// con i valori binari codificati in base64url
+type CreationOptions struct {
+	Challenge              string                 `json:"challenge"`
+	RP                     rpEntity               `json:"rp"`
+	User                   userEntity             `json:"user"`
+	PubKeyCredParams       []credentialParameter  `json:"pubKeyCredParams"`
+	Timeout                int64                  `json:"timeout"`
+	ExcludeCredentials     []credentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection authenticatorSelection `json:"authenticatorSelection"`
+	Attestation            string                 `json:"attestation"`
+}
+
+// Opzioni per navigator.credentials.get (PublicKeyCredentialRequestOptions)
+type RequestOptions struct {
+	Challenge        string                 `json:"challenge"`
+	Timeout          int64                  `json:"timeout"`
+	RPID             string                 `json:"rpId"`
+	AllowCredentials []credentialDescriptor `json:"allowCredentials"`
+	UserVerification string                 `json:"userVerification"`
+}
+
+type rpEntity struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type userEntity struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+type credentialParameter struct {
+	Type string `json:"type"`
+	Alg  int64  `json:"alg"`
+}
+
+type credentialDescriptor struct {
+	Type       string   `json:"type"`
+	ID         string   `json:"id"`
+	Transports []string `json:"transports,omitempty"`
+}
+
+type authenticatorSelection struct {
+	ResidentKey        string `json:"residentKey"`
+	RequireResidentKey bool   `json:"requireResidentKey"`
+	UserVerification   string `json:"userVerification"`
+}
+
+// Avvia la registrazione di una nuova credenziale per l'utente. La risposta
+// va verificata con FinishRegistration, indicando lo stesso binding.
+func BeginRegistration(username, displayName, binding string) (CreationOptions, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if credentials == nil {
+		return CreationOptions{}, ErrStore
+	}
+
+	c := &ceremony{registration: true, username: username, binding: binding}
+
+	var existing []Credential
+	if u := credentials.users[username]; u != nil {
+		c.userID = u.ID
+		existing = u.Credentials
+	} else {
+		c.userID = make([]byte, userIDSize)
+		if _, err := rand.Read(c.userID); err != nil {
+			return CreationOptions{}, err
+		}
+	}
+
+	if len(existing) >= maxCredentials {
+		return CreationOptions{}, ErrTooManyKeys
+	}
+
+	challenge, err := startCeremony(c)
+	if err != nil {
+		return CreationOptions{}, err
+	}
+
+	// Passkeys are stored on the authenticator only if they can be used to log in
+	residentKey := "discouraged"
+	if rp.passwordless {
+		residentKey = "preferred"
+	}
+
+	options := CreationOptions{
+		Challenge: challenge,
+		RP:        rpEntity{ID: rp.id, Name: rp.name},
+		User: userEntity{
+			ID:          encode(c.userID),
+			Name:        username,
+			DisplayName: displayName,
+		},
+		PubKeyCredParams: []credentialParameter{
+			{"public-key", algES256},
+			{"public-key", algEdDSA},
+			{"public-key", algRS256},
+		},
+		Timeout:            ceremonyTimeout.Milliseconds(),
+		ExcludeCredentials: descriptors(existing),
+		AuthenticatorSelection: authenticatorSelection{
+			ResidentKey:      residentKey,
+			UserVerification: rp.userVerification,
+		},
+		Attestation: rp.attestation,
+	}
+
+	return options, nil
+}
+
+// Verifica la risposta di navigator.credentials.create e registra la
+// credenziale con il nome indicato
+func FinishRegistration(username, binding, name string, response []byte) (Credential, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if credentials == nil {
+		return Credential{}, ErrStore
+	}
+
+	r, err := parseResponse(response)
+	if err != nil {
+		return Credential{}, err
+	}
+
+	c, clientDataHash, err := verifyClientData(r.Response.ClientDataJSON, "webauthn.create")
+	if err != nil {
+		return Credential{}, err
+	}
+
+	if !c.registration || c.username != username || c.binding != binding {
+		return Credential{}, ErrExpired
+	}
+
+	rawAttestation, err := decode(r.Response.AttestationObject)
+	if err != nil {
+		return Credential{}, ErrInvalidResponse
+	}
+
+	item, rest, err := decodeCBOR(rawAttestation)
+	attestation, ok := item.(map[interface{}]interface{})
+	if err != nil || !ok || len(rest) != 0 {
+		return Credential{}, ErrInvalidResponse
+	}
+
+	format, _ := attestation["fmt"].(string)
+	statement, _ := attestation["attStmt"].(map[interface{}]interface{})
+	rawAuthData, _ := attestation["authData"].([]byte)
+
+	ad, err := parseAuthenticatorData(rawAuthData)
+	if err != nil || ad.flags&flagAttested == 0 || !bytes.Equal(ad.credentialID, r.rawID) {
+		return Credential{}, ErrInvalidResponse
+	}
+
+	if err := checkAuthenticatorData(ad, rp.userVerification == verificationRequired); err != nil {
+		return Credential{}, err
+	}
+
+	// Attestation policy
+	chain, err := verifyAttestation(format, statement, rawAuthData, ad, clientDataHash)
+	if err != nil {
+		return Credential{}, ErrInvalidResponse
+	}
+
+	if !allowed(format, rp.formats) || !allowedModel(ad.aaguid) {
+		return Credential{}, ErrNotAllowed
+	}
+
+	if rp.roots != nil && verifyChain(chain, rp.roots) != nil {
+		return Credential{}, ErrNotAllowed
+	}
+
+	if owner, _, _ := credentials.find(ad.credentialID); owner != "" {
+		return Credential{}, ErrDuplicate
+	}
+
+	u := credentials.users[username]
+	if u == nil {
+		u = &user{ID: c.userID}
+	}
+
+	if len(u.Credentials) >= maxCredentials {
+		return Credential{}, ErrTooManyKeys
+	}
+
+	name = strings.TrimSpace(name)
+	if name == "" {
+		name = "Chiave di sicurezza"
+	} else if runes := []rune(name); len(runes) > maxNameLength {
+		name = string(runes[:maxNameLength])
+	}
+
+	credential := Credential{
+		ID:         ad.credentialID,
+		PublicKey:  ad.rawKey,
+		SignCount:  ad.signCount,
+		AAGUID:     ad.aaguid,
+		Format:     format,
+		Name:       name,
+		Transports: r.Response.Transports,
+		Created:    time.Now(),
+	}
+
+	previous := u.Credentials
+	u.Credentials = append(append([]Credential(nil), previous...), credential)
+	credentials.users[username] = u
+
+	if err := credentials.save(); err != nil {
+		log.Println("webauthn: ", err.Error())
+
+		if previous == nil {
+			delete(credentials.users, username)
+		} else {
+			u.Credentials = previous
+		}
+		return Credential{}, ErrStore
+	}
+
+	return credential, nil
+}
+
+// Avvia un accesso con una delle credenziali dell'utente oppure, se username
+// è vuoto, con una passkey qualsiasi. La risposta va verificata con
+// FinishLogin, indicando lo stesso binding.
+func BeginLogin(username, binding string) (RequestOptions, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if credentials == nil || (username == "" && !rp.passwordless) {
+		return RequestOptions{}, ErrStore
+	}
+
+	options := RequestOptions{
+		Timeout:          ceremonyTimeout.Milliseconds(),
+		RPID:             rp.id,
+		UserVerification: rp.userVerification,
+	}
+
+	if username != "" {
+		u := credentials.users[username]
+		if u == nil || len(u.Credentials) == 0 {
+			return RequestOptions{}, ErrUnknownCredential
+		}
+
+		options.AllowCredentials = descriptors(u.Credentials)
+	} else {
+		// Passkeys replace both the password and the second factor
+		options.UserVerification = verificationRequired
+	}
+
+	challenge, err := startCeremony(&ceremony{username: username, binding: binding})
+	if err != nil {
+		return RequestOptions{}, err
+	}
+
+	options.Challenge = challenge
+	return options, nil
+}
+
+// Esito di un accesso
+type Assertion struct {
+	Username string
+
+	// Indica se l'autenticatore ha verificato l'utente (PIN o biometria)
+	UserVerified bool
+}
+
+// Verifica la risposta di navigator.credentials.get e restituisce l'utente
+// a cui appartiene la credenziale
+func FinishLogin(binding string, response []byte) (Assertion, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if credentials == nil {
+		return Assertion{}, ErrStore
+	}
+
+	r, err := parseResponse(response)
+	if err != nil {
+		return Assertion{}, err
+	}
+
+	c, clientDataHash, err := verifyClientData(r.Response.ClientDataJSON, "webauthn.get")
+	if err != nil {
+		return Assertion{}, err
+	}
+
+	if c.registration || c.binding != binding {
+		return Assertion{}, ErrExpired
+	}
+
+	username, u, i := credentials.find(r.rawID)
+	if u == nil || (c.username != "" && username != c.username) {
+		return Assertion{}, ErrUnknownCredential
+	}
+
+	// The user handle returned by passkeys must match the owner
+	if r.Response.UserHandle != "" {
+		if handle, err := decode(r.Response.UserHandle); err != nil || !bytes.Equal(handle, u.ID) {
+			return Assertion{}, ErrUnknownCredential
+		}
+	}
+
+	credential := &u.Credentials[i]
+
+	rawAuthData, err := decode(r.Response.AuthenticatorData)
+	if err != nil {
+		return Assertion{}, ErrInvalidResponse
+	}
+
+	ad, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return Assertion{}, ErrInvalidResponse
+	}
+
+	if err := checkAuthenticatorData(ad, c.username == "" || rp.userVerification == verificationRequired); err != nil {
+		return Assertion{}, err
+	}
+
+	key, _, err := parsePublicKey(credential.PublicKey)
+	if err != nil {
+		return Assertion{}, ErrInvalidResponse
+	}
+
+	signature, err := decode(r.Response.Signature)
+	if err != nil || key.verify(append(rawAuthData, clientDataHash...), signature) != nil {
+		return Assertion{}, ErrInvalidResponse
+	}
+
+	// A counter that doesn't grow reveals a cloned authenticator; those
+	// without a counter always return zero
+	if (ad.signCount != 0 || credential.SignCount != 0) && ad.signCount <= credential.SignCount {
+		log.Printf("webauthn: sign count of a credential of %s went from %d to %d\n", username, credential.SignCount, ad.signCount)
+		return Assertion{}, ErrSignCount
+	}
+
+	credential.SignCount = ad.signCount
+	credential.LastUsed = time.Now()
+
+	// Failing to record the counter doesn't prevent the login
+	if err := credentials.save(); err != nil {
+		log.Println("webauthn: ", err.Error())
+	}
+
+	return Assertion{
+		Username:     username,
+		UserVerified: ad.flags&flagUserVerified != 0,
+	}, nil
+}
+
+// Registra una cerimonia e ne restituisce la challenge
+func startCeremony(c *ceremony) (string, error) {
+	b := make([]byte, challengeSize)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+
+	for challenge, c := range ceremonies {
+		if now.After(c.expires) {
+			delete(ceremonies, challenge)
+		}
+	}
+
+	if len(ceremonies) >= maxCeremonies {
+		return "", ErrTooManyRequests
+	}
+
+	challenge := encode(b)
+	c.expires = now.Add(ceremonyTimeout)
+	ceremonies[challenge] = c
+
+	return challenge, nil
+}
+
+// Risposta del browser, serializzata come PublicKeyCredential.toJSON()
+type credentialResponse struct {
+	RawID    string `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string   `json:"clientDataJSON"`
+		AttestationObject string   `json:"attestationObject"`
+		AuthenticatorData string   `json:"authenticatorData"`
+		Signature         string   `json:"signature"`
+		UserHandle        string   `json:"userHandle"`
+		Transports        []string `json:"transports"`
+	} `json:"response"`
+
+	rawID []byte
+}
+
+func parseResponse(response []byte) (credentialResponse, error) {
+	var r credentialResponse
+
+	if err := json.Unmarshal(response, &r); err != nil || r.Type != "public-key" {
+		return r, ErrInvalidResponse
+	}
+
+	rawID, err := decode(r.RawID)
+	if err != nil || len(rawID) == 0 || len(rawID) > maxCredentialIDSize {
+		return r, ErrInvalidResponse
+	}
+
+	r.rawID = rawID
+	return r, nil
+}
+
+// Controlla i dati del client e restituisce la cerimonia a cui si riferiscono,
+// che non può più essere usata, e l'hash dei dati
+func verifyClientData(encoded, ceremonyType string) (*ceremony, []byte, error) {
+	raw, err := decode(encoded)
+	if err != nil {
+		return nil, nil, ErrInvalidResponse
+	}
+
+	var clientData struct {
+		Type        string `json:"type"`
+		Challenge   string `json:"challenge"`
+		Origin      string `json:"origin"`
+		CrossOrigin bool   `json:"crossOrigin"`
+	}
+
+	if err := json.Unmarshal(raw, &clientData); err != nil || clientData.Type != ceremonyType {
+		return nil, nil, ErrInvalidResponse
+	}
+
+	if !allowed(clientData.Origin, rp.origins) || clientData.CrossOrigin {
+		return nil, nil, ErrInvalidResponse
+	}
+
+	c, ok := ceremonies[clientData.Challenge]
+	if !ok {
+		return nil, nil, ErrExpired
+	}
+
+	// Challenges can be used only once
+	delete(ceremonies, clientData.Challenge)
+
+	if time.Now().After(c.expires) {
+		return nil, nil, ErrExpired
+	}
+
+	hash := sha256.Sum256(raw)
+	return c, hash[:], nil
+}
+
+// Dati dell'autenticatore
+type authenticatorData struct {
+	rpIDHash  []byte
+	flags     byte
+	signCount uint32
+
+	// Credenziale appena creata, solo nella registrazione
+	aaguid       []byte
+	credentialID []byte
+	publicKey    publicKey
+	rawKey       []byte
+}
+
+func parseAuthenticatorData(data []byte) (authenticatorData, error) {
+	var ad authenticatorData
+
+	if len(data) < 37 {
+		return ad, ErrInvalidResponse
+	}
+
+	ad.rpIDHash = data[:32]
+	ad.flags = data[32]
+	ad.signCount = binary.BigEndian.Uint32(data[33:37])
+	rest := data[37:]
+
+	if ad.flags&flagAttested != 0 {
+		if len(rest) < 18 {
+			return ad, ErrInvalidResponse
+		}
+
+		ad.aaguid = rest[:16]
+		n := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+
+		if n == 0 || n > maxCredentialIDSize || len(rest) < n {
+			return ad, ErrInvalidResponse
+		}
+
+		ad.credentialID = rest[:n]
+		rest = rest[n:]
+
+		key, after, err := parsePublicKey(rest)
+		if err != nil {
+			return ad, err
+		}
+
+		ad.publicKey = key
+		ad.rawKey = rest[:len(rest)-len(after)]
+		rest = after
+	}
+
+	// Extensions are ignored
+	if ad.flags&flagExtensions != 0 {
+		var err error
+		if _, rest, err = decodeCBOR(rest); err != nil {
+			return ad, ErrInvalidResponse
+		}
+	}
+
+	if len(rest) != 0 {
+		return ad, ErrInvalidResponse
+	}
+
+	return ad, nil
+}
+
+// Controlla che i dati siano destinati al servizio e che l'utente sia presente
+// e, se richiesto, verificato
+func checkAuthenticatorData(ad authenticatorData, requireVerification bool) error {
+	hash := sha256.Sum256([]byte(rp.id))
+
+	if !bytes.Equal(ad.rpIDHash, hash[:]) || ad.flags&flagUserPresent == 0 {
+		return ErrInvalidResponse
+	}
+
+	if requireVerification && ad.flags&flagUserVerified == 0 {
+		return ErrInvalidResponse
+	}
+
+	return nil
+}
+
+// Controlla se il modello dell'autenticatore è ammesso
+func allowedModel(aaguid []byte) bool {
+	if rp.aaguids == nil {
+		return true
+	}
+
+	for _, a := range rp.aaguids {
+		if bytes.Equal(a, aaguid) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func allowed(value string, values []string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+func descriptors(list []Credential) []credentialDescriptor {
+	result := make([]credentialDescriptor, len(list))
+	for i, c := range list {
+		result[i] = credentialDescriptor{Type: "public-key", ID: c.EncodedID(), Transports: c.Transports}
+	}
+
+	return result
+}
+
+func encode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decode(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
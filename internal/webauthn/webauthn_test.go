@@ -0,0 +1,534 @@
+/*
+ * webauthn_test.go
+ *
+ * File di test per il package webauthn.
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+package webauthn
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"git.napaalm.xyz/napaalm/ssodav/internal/config"
+)
+
+const origin = "https://sso.example.org"
+
+func TestCBOR(t *testing.T) {
+	// {1: 2, "abc": [1, -1], "b": h'0102', "t": true}
+	data := []byte{0xa4, 0x01, 0x02, 0x63, 'a', 'b', 'c', 0x82, 0x01, 0x20, 0x61, 'b', 0x42, 0x01, 0x02, 0x61, 't', 0xf5, 0xff}
+
+	item, rest, err := decodeCBOR(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[interface{}]interface{}{
+		int64(1): int64(2),
+		"abc":    []interface{}{int64(1), int64(-1)},
+		"b":      []byte{1, 2},
+		"t":      true,
+	}
+
+	if !reflect.DeepEqual(item, expected) || len(rest) != 1 {
+		t.Errorf("unexpected item %v, rest %v", item, rest)
+	}
+
+	invalid := [][]byte{
+		{},
+		{0x63, 'a', 'b'},               // truncated string
+		{0x9f, 0x01, 0xff},             // indefinite length
+		{0xa2, 0x01, 0x01, 0x01, 0x02}, // duplicate key
+		{0xa1, 0x41, 0x00, 0x01},       // byte string key
+		{0xfa, 0, 0, 0, 0},             // float
+		{0x9b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+	}
+
+	for _, data := range invalid {
+		if _, _, err := decodeCBOR(data); err == nil {
+			t.Errorf("invalid data %x accepted", data)
+		}
+	}
+
+	nested := make([]byte, maxDepth+2)
+	for i := range nested {
+		nested[i] = 0x81
+	}
+
+	if _, _, err := decodeCBOR(append(nested, 0x00)); err == nil {
+		t.Error("too deep data accepted")
+	}
+}
+
+func TestCeremonies(t *testing.T) {
+	setup(t)
+
+	a := newAuthenticator(t)
+
+	options, err := BeginRegistration("professor", "Hubert J. Farnsworth", "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if options.RP.ID != "sso.example.org" || options.User.Name != "professor" || len(options.ExcludeCredentials) != 0 {
+		t.Errorf("unexpected options %+v", options)
+	}
+
+	// The ceremony belongs to the session that started it
+	if _, err := FinishRegistration("professor", "other", "", a.register(t, options, formatNone)); err != ErrExpired {
+		t.Errorf("expected ErrExpired, got %v", err)
+	}
+
+	options, _ = BeginRegistration("professor", "Hubert J. Farnsworth", "session")
+	credential, err := FinishRegistration("professor", "session", " Chiave USB ", a.register(t, options, formatNone))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if credential.Name != "Chiave USB" || len(Credentials("professor")) != 1 {
+		t.Errorf("unexpected credential %+v", credential)
+	}
+
+	// The same credential can't be registered twice
+	options, _ = BeginRegistration("professor", "Hubert J. Farnsworth", "session")
+	if len(options.ExcludeCredentials) != 1 || options.User.ID != encode(credentials.users["professor"].ID) {
+		t.Errorf("unexpected options %+v", options)
+	}
+
+	if _, err := FinishRegistration("professor", "session", "", a.register(t, options, formatNone)); err != ErrDuplicate {
+		t.Errorf("expected ErrDuplicate, got %v", err)
+	}
+
+	// Second factor
+	request, err := BeginLogin("professor", "pending")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(request.AllowCredentials) != 1 || request.AllowCredentials[0].ID != credential.EncodedID() {
+		t.Errorf("unexpected options %+v", request)
+	}
+
+	response := a.login(t, request, origin, flagUserPresent, false)
+
+	assertion, err := FinishLogin("pending", response)
+	if err != nil || assertion.Username != "professor" || assertion.UserVerified {
+		t.Errorf("unexpected assertion %+v %v", assertion, err)
+	}
+
+	// Responses can't be replayed
+	if _, err := FinishLogin("pending", response); err != ErrExpired {
+		t.Errorf("expected ErrExpired, got %v", err)
+	}
+
+	request, _ = BeginLogin("professor", "pending")
+	if _, err := FinishLogin("pending", a.login(t, request, "https://evil.example.com", flagUserPresent, false)); err != ErrInvalidResponse {
+		t.Errorf("expected ErrInvalidResponse, got %v", err)
+	}
+
+	// A counter going backwards reveals a clone
+	request, _ = BeginLogin("professor", "pending")
+	a.count -= 2
+	if _, err := FinishLogin("pending", a.login(t, request, origin, flagUserPresent, false)); err != ErrSignCount {
+		t.Errorf("expected ErrSignCount, got %v", err)
+	}
+	a.count += 2
+
+	// Passkeys require user verification
+	if _, err := BeginLogin("", ""); err != ErrStore {
+		t.Errorf("passkey login allowed: %v", err)
+	}
+
+	rp.passwordless = true
+
+	request, _ = BeginLogin("", "")
+	if _, err := FinishLogin("", a.login(t, request, origin, flagUserPresent, true)); err != ErrInvalidResponse {
+		t.Errorf("expected ErrInvalidResponse, got %v", err)
+	}
+
+	request, _ = BeginLogin("", "")
+	if request.UserVerification != verificationRequired || request.AllowCredentials != nil {
+		t.Errorf("unexpected options %+v", request)
+	}
+
+	assertion, err = FinishLogin("", a.login(t, request, origin, flagUserPresent|flagUserVerified, true))
+	if err != nil || assertion.Username != "professor" || !assertion.UserVerified {
+		t.Errorf("unexpected assertion %+v %v", assertion, err)
+	}
+
+	// Credentials survive restarts
+	if err := Initialize(); err != nil {
+		t.Fatal(err)
+	}
+
+	stored := Credentials("professor")
+	if len(stored) != 1 || stored[0].SignCount != a.count || stored[0].LastUsed.IsZero() {
+		t.Errorf("unexpected credentials %+v", stored)
+	}
+
+	if err := Remove("fry", credential.EncodedID()); err != ErrUnknownCredential {
+		t.Errorf("expected ErrUnknownCredential, got %v", err)
+	}
+
+	if err := Remove("professor", credential.EncodedID()); err != nil || len(Credentials("professor")) != 0 {
+		t.Errorf("credential not removed: %v", err)
+	}
+
+	if _, err := BeginLogin("professor", "pending"); err != ErrUnknownCredential {
+		t.Errorf("expected ErrUnknownCredential, got %v", err)
+	}
+}
+
+func TestAttestation(t *testing.T) {
+	setup(t)
+
+	a := newAuthenticator(t)
+
+	// Self attestation
+	options, _ := BeginRegistration("professor", "", "session")
+	if _, err := FinishRegistration("professor", "session", "", a.register(t, options, formatPacked)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Attestation certificates issued by the vendor
+	root, rootKey := newCertificate(t, nil, nil, true)
+	a = newAuthenticator(t)
+	a.chain, a.attestationKey = newCertificate(t, root, rootKey, false)
+
+	for _, format := range []string{formatPacked, formatFIDOU2F} {
+		options, _ = BeginRegistration("fry", "", "session")
+		a.id[0]++
+		if _, err := FinishRegistration("fry", "session", "", a.register(t, options, format)); err != nil {
+			t.Errorf("%s: %v", format, err)
+		}
+	}
+
+	// Only the configured vendors
+	rp.roots = x509.NewCertPool()
+	rp.roots.AddCert(root)
+
+	options, _ = BeginRegistration("fry", "", "session")
+	a.id[0]++
+	if _, err := FinishRegistration("fry", "session", "", a.register(t, options, formatPacked)); err != nil {
+		t.Error(err)
+	}
+
+	other, _ := newCertificate(t, nil, nil, true)
+	rp.roots = x509.NewCertPool()
+	rp.roots.AddCert(other)
+
+	for _, format := range []string{formatNone, formatPacked} {
+		options, _ = BeginRegistration("fry", "", "session")
+		a.id[0]++
+		if _, err := FinishRegistration("fry", "session", "", a.register(t, options, format)); err != ErrNotAllowed {
+			t.Errorf("%s: expected ErrNotAllowed, got %v", format, err)
+		}
+	}
+	rp.roots = nil
+
+	// Only the configured formats and models
+	rp.formats = []string{formatPacked}
+
+	options, _ = BeginRegistration("fry", "", "session")
+	a.id[0]++
+	if _, err := FinishRegistration("fry", "session", "", a.register(t, options, formatNone)); err != ErrNotAllowed {
+		t.Errorf("expected ErrNotAllowed, got %v", err)
+	}
+
+	rp.aaguids = [][]byte{make([]byte, 16)}
+
+	options, _ = BeginRegistration("fry", "", "session")
+	a.id[0]++
+	if _, err := FinishRegistration("fry", "session", "", a.register(t, options, formatPacked)); err != ErrNotAllowed {
+		t.Errorf("expected ErrNotAllowed, got %v", err)
+	}
+
+	// Forged attestation
+	rp.aaguids = nil
+	a.attestationKey, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	options, _ = BeginRegistration("fry", "", "session")
+	a.id[0]++
+	if _, err := FinishRegistration("fry", "session", "", a.register(t, options, formatPacked)); err != ErrInvalidResponse {
+		t.Errorf("expected ErrInvalidResponse, got %v", err)
+	}
+}
+
+func setup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webauthn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	config.Config.General.FQDN = "sso.example.org"
+	config.Config.General.SecureCookies = true
+	config.Config.WebAuthn.Enabled = true
+	config.Config.WebAuthn.File = filepath.Join(dir, "webauthn.json")
+
+	if err := Initialize(); err != nil {
+		t.Fatal(err)
+	}
+
+	if rp.origins[0] != origin {
+		t.Fatalf("unexpected origins %v", rp.origins)
+	}
+}
+
+// Autenticatore software
+type authenticator struct {
+	key    *ecdsa.PrivateKey
+	id     []byte
+	aaguid []byte
+	count  uint32
+
+	// Certificato con cui firma le attestazioni
+	chain          *x509.Certificate
+	attestationKey *ecdsa.PrivateKey
+}
+
+func newAuthenticator(t *testing.T) *authenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := &authenticator{key: key, id: make([]byte, 16), aaguid: make([]byte, 16)}
+	rand.Read(a.id)
+	rand.Read(a.aaguid)
+
+	return a
+}
+
+func (a *authenticator) authData(flags byte, attested bool) []byte {
+	rpIDHash := sha256.Sum256([]byte("sso.example.org"))
+
+	a.count++
+	data := append(rpIDHash[:], flags, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(data[33:], a.count)
+
+	if attested {
+		data[32] |= flagAttested
+		data = append(data, a.aaguid...)
+		data = append(data, byte(len(a.id)>>8), byte(len(a.id)))
+		data = append(data, a.id...)
+		data = append(data, encodeCBOR(map[interface{}]interface{}{
+			1:  ktyEC2,
+			3:  algES256,
+			-1: crvP256,
+			-2: pad(a.key.X.Bytes()),
+			-3: pad(a.key.Y.Bytes()),
+		})...)
+	}
+
+	return data
+}
+
+func (a *authenticator) register(t *testing.T, options CreationOptions, format string) []byte {
+	clientData := a.clientData("webauthn.create", options.Challenge, origin)
+	clientDataHash := sha256.Sum256(clientData)
+
+	authData := a.authData(flagUserPresent, true)
+	signed := append(append([]byte(nil), authData...), clientDataHash[:]...)
+	statement := map[interface{}]interface{}{}
+
+	switch format {
+	case formatPacked:
+		key := a.key
+		if a.chain != nil {
+			key = a.attestationKey
+			statement["x5c"] = []interface{}{a.chain.Raw}
+		}
+
+		statement["alg"] = algES256
+		statement["sig"] = sign(t, key, signed)
+	case formatFIDOU2F:
+		rpIDHash := sha256.Sum256([]byte("sso.example.org"))
+		data := append([]byte{0}, rpIDHash[:]...)
+		data = append(data, clientDataHash[:]...)
+		data = append(data, a.id...)
+		data = append(data, elliptic.Marshal(elliptic.P256(), a.key.X, a.key.Y)...)
+
+		statement["x5c"] = []interface{}{a.chain.Raw}
+		statement["sig"] = sign(t, a.attestationKey, data)
+	}
+
+	attestation := encodeCBOR(map[interface{}]interface{}{
+		"fmt":      format,
+		"attStmt":  statement,
+		"authData": authData,
+	})
+
+	return a.response(t, map[string]interface{}{
+		"clientDataJSON":    encode(clientData),
+		"attestationObject": encode(attestation),
+		"transports":        []string{"usb"},
+	})
+}
+
+func (a *authenticator) login(t *testing.T, options RequestOptions, origin string, flags byte, passkey bool) []byte {
+	clientData := a.clientData("webauthn.get", options.Challenge, origin)
+	clientDataHash := sha256.Sum256(clientData)
+	authData := a.authData(flags, false)
+
+	response := map[string]interface{}{
+		"clientDataJSON":    encode(clientData),
+		"authenticatorData": encode(authData),
+		"signature":         encode(sign(t, a.key, append(append([]byte(nil), authData...), clientDataHash[:]...))),
+	}
+
+	if passkey {
+		response["userHandle"] = encode(credentials.users["professor"].ID)
+	}
+
+	return a.response(t, response)
+}
+
+func (a *authenticator) clientData(ceremonyType, challenge, origin string) []byte {
+	b, _ := json.Marshal(map[string]interface{}{
+		"type":      ceremonyType,
+		"challenge": challenge,
+		"origin":    origin,
+	})
+
+	return b
+}
+
+func (a *authenticator) response(t *testing.T, response map[string]interface{}) []byte {
+	b, err := json.Marshal(map[string]interface{}{
+		"id":       encode(a.id),
+		"rawId":    encode(a.id),
+		"type":     "public-key",
+		"response": response,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
+
+func sign(t *testing.T, key *ecdsa.PrivateKey, data []byte) []byte {
+	digest := sha256.Sum256(data)
+
+	sig, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return sig
+}
+
+// Crea un certificato firmato da parent, o autofirmato se parent è nil
+func newCertificate(t *testing.T, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, ca bool) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: "Authenticator Attestation", OrganizationalUnit: []string{"Authenticator Attestation"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		BasicConstraintsValid: true,
+		IsCA:                  ca,
+	}
+
+	if ca {
+		template.KeyUsage = x509.KeyUsageCertSign
+	}
+
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert, key
+}
+
+func pad(b []byte) []byte {
+	return append(make([]byte, 32-len(b)), b...)
+}
+
+// Codifica in CBOR i tipi usati nei test
+func encodeCBOR(v interface{}) []byte {
+	header := func(major byte, n int) []byte {
+		switch {
+		case n < 24:
+			return []byte{major<<5 | byte(n)}
+		case n < 256:
+			return []byte{major<<5 | 24, byte(n)}
+		default:
+			return []byte{major<<5 | 25, byte(n >> 8), byte(n)}
+		}
+	}
+
+	switch v := v.(type) {
+	case int:
+		if v < 0 {
+			return header(1, -1-v)
+		}
+		return header(0, v)
+	case string:
+		return append(header(3, len(v)), v...)
+	case []byte:
+		return append(header(2, len(v)), v...)
+	case []interface{}:
+		b := header(4, len(v))
+		for _, item := range v {
+			b = append(b, encodeCBOR(item)...)
+		}
+		return b
+	case map[interface{}]interface{}:
+		b := header(5, len(v))
+		for key, item := range v {
+			b = append(b, encodeCBOR(key)...)
+			b = append(b, encodeCBOR(item)...)
+		}
+		return b
+	}
+
+	panic("unsupported type")
+}
@@ -0,0 +1,318 @@
+/*
+ * cookie.go
+ *
+ * Scrittura e lettura dei cookie secondo una politica comune.
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+// Package per i cookie scritti dal server e dai servizi: applica a ogni cookie
+// gli stessi attributi (prefisso, SameSite, HttpOnly, Secure, dominio e percorso)
+// e suddivide in più cookie i valori troppo lunghi, come i token, ricomponendoli
+// in lettura.
+package cookie
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Prefissi dei nomi dei cookie riconosciuti dai browser
+const (
+	HostPrefix   = "__Host-"
+	SecurePrefix = "__Secure-"
+)
+
+const (
+	// Lunghezza massima predefinita del valore di ogni cookie, che lascia
+	// spazio a nome e attributi entro i 4096 byte garantiti dai browser
+	DefaultMaxSize = 3800
+
+	// Numero massimo di parti in cui viene suddiviso un valore
+	maxChunks = 16
+)
+
+// Spazio riservato all'inizio della prima parte per il numero di parti ("16.")
+var countSize = len(strconv.Itoa(maxChunks)) + 1
+
+var (
+	ErrInvalidPrefix = errors.New("cookie: invalid prefix")
+	ErrInsecure      = errors.New("cookie: the prefix or SameSite=None require secure cookies")
+	ErrHostPrefix    = errors.New("cookie: the __Host- prefix requires no domain and the / path")
+	ErrTooLarge      = errors.New("cookie: value too large")
+)
+
+// Politica applicata ai cookie
+type Policy struct {
+	// Prefisso dei nomi: "", HostPrefix oppure SecurePrefix
+	Prefix string
+
+	// Domini dei cookie: viene usato il più specifico tra quelli che contengono
+	// l'host della richiesta, altrimenti il cookie vale solo per l'host stesso
+	Domains []string
+
+	// Percorso dei cookie, "/" se vuoto
+	Path string
+
+	Secure   bool
+	HTTPOnly bool
+	SameSite http.SameSite
+
+	// Lunghezza massima del valore di ogni cookie, DefaultMaxSize se nulla
+	MaxSize int
+}
+
+// Controlla che gli attributi siano compatibili tra loro
+func (p Policy) Validate() error {
+	switch p.Prefix {
+	case "", HostPrefix, SecurePrefix:
+	default:
+		return ErrInvalidPrefix
+	}
+
+	if (p.Prefix != "" || p.SameSite == http.SameSiteNoneMode) && !p.Secure {
+		return ErrInsecure
+	}
+
+	if p.Prefix == HostPrefix && (len(p.Domains) > 0 || p.path() != "/") {
+		return ErrHostPrefix
+	}
+
+	return nil
+}
+
+// Restituisce il nome completo del cookie, con il prefisso
+func (p Policy) Name(name string) string {
+	return p.Prefix + name
+}
+
+// Imposta il cookie name per la richiesta r. Se expires è nullo il cookie dura
+// fino alla chiusura del browser. Le parti rimaste da un valore precedente
+// vengono eliminate.
+func (p Policy) Set(w http.ResponseWriter, r *http.Request, name, value string, expires time.Time) error {
+	name = p.Name(name)
+	size := p.maxSize()
+
+	var chunks []string
+	if len(value) > size {
+		// The first part starts with the number of parts, so that a value missing
+		// some of them isn't taken for a shorter one
+		n := size - countSize
+		for len(value) > 0 {
+			if n > len(value) {
+				n = len(value)
+			}
+
+			chunks = append(chunks, value[:n])
+			value = value[n:]
+			n = size
+		}
+
+		if len(chunks) > maxChunks {
+			return ErrTooLarge
+		}
+
+		chunks[0] = strconv.Itoa(len(chunks)) + "." + chunks[0]
+	}
+
+	maxAge := 0
+	if !expires.IsZero() {
+		maxAge = int(time.Until(expires).Seconds())
+		if maxAge <= 0 {
+			maxAge = -1
+		}
+	}
+
+	if chunks == nil {
+		p.clear(w, r, name, 0, false)
+		http.SetCookie(w, p.cookie(r, name, value, expires, maxAge))
+		return nil
+	}
+
+	p.clear(w, r, name, len(chunks), true)
+	for i, chunk := range chunks {
+		http.SetCookie(w, p.cookie(r, chunkName(name, i), chunk, expires, maxAge))
+	}
+
+	return nil
+}
+
+// Legge il cookie name, ricomponendone le parti se è stato suddiviso.
+// Restituisce http.ErrNoCookie se il cookie è assente o incompleto.
+func (p Policy) Get(r *http.Request, name string) (string, error) {
+	name = p.Name(name)
+
+	if c, err := r.Cookie(name); err == nil {
+		return c.Value, nil
+	}
+
+	first, err := r.Cookie(chunkName(name, 0))
+	if err != nil {
+		return "", http.ErrNoCookie
+	}
+
+	i := strings.IndexByte(first.Value, '.')
+	if i < 0 {
+		return "", http.ErrNoCookie
+	}
+
+	count, err := strconv.Atoi(first.Value[:i])
+	if err != nil || count < 1 || count > maxChunks {
+		return "", http.ErrNoCookie
+	}
+
+	var value strings.Builder
+	value.WriteString(first.Value[i+1:])
+
+	for i := 1; i < count; i++ {
+		c, err := r.Cookie(chunkName(name, i))
+		if err != nil {
+			return "", http.ErrNoCookie
+		}
+
+		value.WriteString(c.Value)
+	}
+
+	return value.String(), nil
+}
+
+// Elimina il cookie name e tutte le sue parti inviate con la richiesta
+func (p Policy) Clear(w http.ResponseWriter, r *http.Request, name string) {
+	name = p.Name(name)
+
+	http.SetCookie(w, p.cookie(r, name, "", time.Unix(0, 0), -1))
+	p.clear(w, r, name, 0, false)
+}
+
+// Controlla se un cookie ricevuto è il cookie name o una delle sue parti
+func (p Policy) Matches(cookieName, name string) bool {
+	name = p.Name(name)
+	if cookieName == name {
+		return true
+	}
+
+	if !strings.HasPrefix(cookieName, name+".") {
+		return false
+	}
+
+	_, err := strconv.Atoi(cookieName[len(name)+1:])
+	return err == nil
+}
+
+// Elimina le parti del cookie name a partire dalla parte from e, se chunked,
+// il cookie intero rimasto da un valore non suddiviso
+func (p Policy) clear(w http.ResponseWriter, r *http.Request, name string, from int, chunked bool) {
+	if r == nil {
+		return
+	}
+
+	for _, c := range r.Cookies() {
+		if c.Name == name {
+			if chunked {
+				http.SetCookie(w, p.cookie(r, name, "", time.Unix(0, 0), -1))
+			}
+
+			continue
+		}
+
+		if !strings.HasPrefix(c.Name, name+".") {
+			continue
+		}
+
+		if i, err := strconv.Atoi(c.Name[len(name)+1:]); err == nil && i >= from {
+			http.SetCookie(w, p.cookie(r, c.Name, "", time.Unix(0, 0), -1))
+		}
+	}
+}
+
+func (p Policy) cookie(r *http.Request, name, value string, expires time.Time, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     p.path(),
+		Domain:   p.domain(r),
+		Expires:  expires,
+		MaxAge:   maxAge,
+		Secure:   p.Secure,
+		HttpOnly: p.HTTPOnly,
+		SameSite: p.SameSite,
+	}
+}
+
+// Sceglie il dominio più specifico che contiene l'host della richiesta
+func (p Policy) domain(r *http.Request) string {
+	if p.Prefix == HostPrefix || r == nil {
+		return ""
+	}
+
+	host := strings.ToLower(r.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	domain := ""
+	for _, d := range p.Domains {
+		d = strings.TrimPrefix(strings.ToLower(d), ".")
+
+		if (host == d || strings.HasSuffix(host, "."+d)) && len(d) > len(domain) {
+			domain = d
+		}
+	}
+
+	return domain
+}
+
+func (p Policy) path() string {
+	if p.Path == "" {
+		return "/"
+	}
+
+	return p.Path
+}
+
+func (p Policy) maxSize() int {
+	if p.MaxSize <= 0 {
+		return DefaultMaxSize
+	}
+
+	return p.MaxSize
+}
+
+func chunkName(name string, i int) string {
+	return name + "." + strconv.Itoa(i)
+}
+
+// Converte il valore di SameSite dalla configurazione ("lax", "strict" o "none",
+// "lax" se vuoto)
+func ParseSameSite(value string) (http.SameSite, error) {
+	switch strings.ToLower(value) {
+	case "", "lax":
+		return http.SameSiteLaxMode, nil
+	case "strict":
+		return http.SameSiteStrictMode, nil
+	case "none":
+		return http.SameSiteNoneMode, nil
+	}
+
+	return 0, errors.New("cookie: invalid SameSite mode " + strconv.Quote(value))
+}
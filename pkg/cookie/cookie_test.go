@@ -0,0 +1,216 @@
+/*
+ * cookie_test.go
+ *
+ * File di test per il package cookie.
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+package cookie
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Restituisce una richiesta con i cookie impostati nella risposta, come farebbe il browser
+func roundTrip(w *httptest.ResponseRecorder) *http.Request {
+	r := httptest.NewRequest("GET", "https://sso.example.org/", nil)
+
+	for _, c := range w.Result().Cookies() {
+		if c.MaxAge >= 0 && c.Value != "" {
+			r.AddCookie(&http.Cookie{Name: c.Name, Value: c.Value})
+		}
+	}
+
+	return r
+}
+
+func TestPolicy(t *testing.T) {
+	p := Policy{
+		Domains:  []string{"example.org", "sso.example.org", "scuola.edu.it"},
+		Secure:   true,
+		HTTPOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	}
+
+	if err := p.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The most specific domain containing the host is used
+	r := httptest.NewRequest("GET", "https://sso.example.org:8443/", nil)
+	w := httptest.NewRecorder()
+
+	if err := p.Set(w, r, "sso_session", "secret", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("expected one cookie, got %d", len(cookies))
+	}
+
+	c := cookies[0]
+	if c.Name != "sso_session" || c.Value != "secret" || c.Domain != "sso.example.org" || c.Path != "/" ||
+		!c.Secure || !c.HttpOnly || c.SameSite != http.SameSiteStrictMode || c.MaxAge <= 0 {
+		t.Errorf("unexpected cookie %+v", c)
+	}
+
+	// Hosts outside the domains get host-only cookies
+	r = httptest.NewRequest("GET", "https://evil.org/", nil)
+	w = httptest.NewRecorder()
+	p.Set(w, r, "sso_session", "secret", time.Time{})
+
+	if c := w.Result().Cookies()[0]; c.Domain != "" || c.MaxAge != 0 {
+		t.Errorf("unexpected cookie %+v", c)
+	}
+
+	// Incompatible attributes
+	invalid := []Policy{
+		{Prefix: "__Foo-", Secure: true},
+		{Prefix: SecurePrefix},
+		{SameSite: http.SameSiteNoneMode},
+		{Prefix: HostPrefix, Secure: true, Domains: []string{"example.org"}},
+		{Prefix: HostPrefix, Secure: true, Path: "/app"},
+	}
+
+	for _, p := range invalid {
+		if p.Validate() == nil {
+			t.Errorf("invalid policy %+v accepted", p)
+		}
+	}
+
+	if _, err := ParseSameSite("Sometimes"); err == nil {
+		t.Error("invalid SameSite mode accepted")
+	}
+}
+
+func TestHostPrefix(t *testing.T) {
+	p := Policy{Prefix: HostPrefix, Secure: true, HTTPOnly: true}
+	if err := p.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("GET", "https://sso.example.org/", nil)
+	w := httptest.NewRecorder()
+	p.Set(w, r, "sso_session", "secret", time.Time{})
+
+	c := w.Result().Cookies()[0]
+	if c.Name != "__Host-sso_session" || c.Domain != "" || c.Path != "/" || !c.Secure {
+		t.Errorf("unexpected cookie %+v", c)
+	}
+
+	if value, err := p.Get(roundTrip(w), "sso_session"); err != nil || value != "secret" {
+		t.Errorf("unexpected value %q: %v", value, err)
+	}
+
+	if !p.Matches("__Host-sso_session", "sso_session") || p.Matches("sso_session", "sso_session") {
+		t.Error("prefix ignored when matching names")
+	}
+}
+
+func TestChunks(t *testing.T) {
+	p := Policy{MaxSize: 100}
+	value := strings.Repeat("abcdefghij", 25)
+
+	w := httptest.NewRecorder()
+	if err := p.Set(w, nil, "access_token", value, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+
+	cookies := w.Result().Cookies()
+	if len(cookies) != 3 || cookies[0].Name != "access_token.0" || cookies[2].Name != "access_token.2" {
+		t.Fatalf("unexpected chunks %v", cookies)
+	}
+
+	for _, c := range cookies {
+		if len(c.Value) > 100 {
+			t.Errorf("chunk %s too large: %d", c.Name, len(c.Value))
+		}
+	}
+
+	r := roundTrip(w)
+	if got, err := p.Get(r, "access_token"); err != nil || got != value {
+		t.Fatalf("value not reassembled: %v", err)
+	}
+
+	// Values missing a chunk are refused, wherever the chunk is
+	for _, missing := range []string{"access_token.0", "access_token.1", "access_token.2"} {
+		partial := httptest.NewRequest("GET", "/", nil)
+		for _, c := range cookies {
+			if c.Name != missing {
+				partial.AddCookie(&http.Cookie{Name: c.Name, Value: c.Value})
+			}
+		}
+
+		if _, err := p.Get(partial, "access_token"); err != http.ErrNoCookie {
+			t.Errorf("value without %s: unexpected error %v", missing, err)
+		}
+	}
+
+	for _, name := range []string{"access_token", "access_token.2"} {
+		if !p.Matches(name, "access_token") {
+			t.Errorf("%s not matched", name)
+		}
+	}
+
+	if p.Matches("access_token.x", "access_token") || p.Matches("access_tokens", "access_token") {
+		t.Error("unrelated cookie matched")
+	}
+
+	// A shorter value removes the chunks left over
+	w = httptest.NewRecorder()
+	p.Set(w, r, "access_token", "short", time.Time{})
+
+	deleted := 0
+	for _, c := range w.Result().Cookies() {
+		switch {
+		case c.Name == "access_token" && c.Value == "short":
+		case strings.HasPrefix(c.Name, "access_token.") && c.MaxAge < 0:
+			deleted++
+		default:
+			t.Errorf("unexpected cookie %+v", c)
+		}
+	}
+
+	if deleted != 3 {
+		t.Errorf("expected 3 chunks deleted, got %d", deleted)
+	}
+
+	// Clearing removes every chunk
+	w = httptest.NewRecorder()
+	p.Clear(w, r, "access_token")
+
+	if n := len(w.Result().Cookies()); n != 4 {
+		t.Errorf("expected 4 deleted cookies, got %d", n)
+	}
+
+	if _, err := p.Get(httptest.NewRequest("GET", "/", nil), "access_token"); err != http.ErrNoCookie {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	// Values too large are refused
+	if err := p.Set(httptest.NewRecorder(), nil, "access_token", strings.Repeat("x", 100*maxChunks+1), time.Time{}); err != ErrTooLarge {
+		t.Errorf("unexpected error %v", err)
+	}
+}
@@ -0,0 +1,130 @@
+/*
+ * cache.go
+ *
+ * Cache contro il riutilizzo delle prove e nonce del server.
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+package dpop
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+// Intervallo minimo tra due pulizie della cache
+const cleanupInterval = time.Minute
+
+// Identificatori delle prove già usate, fino alla loro scadenza, al più max
+type ReplayCache struct {
+	mutex       sync.Mutex
+	seen        map[string]time.Time
+	max         int
+	lastCleanup time.Time
+}
+
+func NewReplayCache(max int) *ReplayCache {
+	return &ReplayCache{seen: make(map[string]time.Time), max: max}
+}
+
+// Registra un identificatore e restituisce vero se era già stato visto. Se la
+// cache è piena l'identificatore non viene registrato e risulta già visto:
+// eliminare identificatori non scaduti permetterebbe di riutilizzarli.
+func (c *ReplayCache) Seen(id string, expires time.Time) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+
+	// Remove expired entries, right away if the cache is full
+	if now.Sub(c.lastCleanup) > cleanupInterval || len(c.seen) >= c.max {
+		for k, exp := range c.seen {
+			if now.After(exp) {
+				delete(c.seen, k)
+			}
+		}
+		c.lastCleanup = now
+	}
+
+	if exp, ok := c.seen[id]; ok && now.Before(exp) {
+		return true
+	}
+
+	if len(c.seen) >= c.max {
+		return true
+	}
+
+	c.seen[id] = expires
+
+	return false
+}
+
+// Genera e verifica nonce senza memorizzarli: ogni nonce contiene l'istante
+// di emissione e un HMAC con una chiave casuale
+type NonceSource struct {
+	key      []byte
+	lifetime time.Duration
+}
+
+// Crea una sorgente di nonce validi per la durata indicata
+func NewNonceSource(lifetime time.Duration) (*NonceSource, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+
+	return &NonceSource{key: key, lifetime: lifetime}, nil
+}
+
+// Restituisce un nuovo nonce
+func (n *NonceSource) New() string {
+	return encode(n.sign(time.Now().Unix()))
+}
+
+// Controlla se un nonce è stato emesso da questa sorgente e non è scaduto
+func (n *NonceSource) Valid(nonce string) bool {
+	b, err := decode(nonce)
+	if err != nil || len(b) != 8+sha256.Size {
+		return false
+	}
+
+	issued := int64(binary.BigEndian.Uint64(b[:8]))
+	if !hmac.Equal(b, n.sign(issued)) {
+		return false
+	}
+
+	age := time.Since(time.Unix(issued, 0))
+
+	return age >= -clockSkew && age <= n.lifetime
+}
+
+func (n *NonceSource) sign(issued int64) []byte {
+	b := make([]byte, 8, 8+sha256.Size)
+	binary.BigEndian.PutUint64(b, uint64(issued))
+
+	mac := hmac.New(sha256.New, n.key)
+	mac.Write(b)
+
+	return mac.Sum(b)
+}
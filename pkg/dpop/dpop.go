@@ -0,0 +1,331 @@
+/*
+ * dpop.go
+ *
+ * Prove di possesso della chiave (DPoP, RFC 9449).
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+// Package per le prove di possesso della chiave DPoP (RFC 9449), con cui i token
+// vengono vincolati alla chiave del client che li ha richiesti.
+package dpop
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/url"
+	"strings"
+	"time"
+
+	"git.napaalm.xyz/napaalm/ssodav/pkg/jwk"
+	"github.com/gbrlsnchs/jwt/v3"
+)
+
+// Nome dell'header con la prova e schema dell'header Authorization
+const (
+	Header      = "DPoP"
+	NonceHeader = "DPoP-Nonce"
+	Scheme      = "DPoP"
+)
+
+const (
+	proofType = "dpop+jwt"
+
+	defaultMaxAge = 5 * time.Minute
+
+	// Prove non scadute ricordate al più dalla cache contro il riutilizzo
+	defaultMaxProofs = 100000
+
+	// Tolleranza per gli orologi dei client in anticipo
+	clockSkew = time.Minute
+)
+
+var (
+	ErrInvalidProof  = errors.New("dpop: invalid proof")
+	ErrExpiredProof  = errors.New("dpop: proof too old or issued in the future")
+	ErrReplayedProof = errors.New("dpop: proof already used")
+	ErrMismatch      = errors.New("dpop: proof doesn't match the request")
+	ErrUseNonce      = errors.New("dpop: a valid server nonce is required")
+)
+
+// Intestazione della prova, con la chiave pubblica del client
+type proofHeader struct {
+	Type      string   `json:"typ"`
+	Algorithm string   `json:"alg"`
+	Key       *jwk.Key `json:"jwk"`
+}
+
+// Claim della prova
+type proofClaims struct {
+	ID              string `json:"jti"`
+	Method          string `json:"htm"`
+	URL             string `json:"htu"`
+	IssuedAt        int64  `json:"iat"`
+	AccessTokenHash string `json:"ath,omitempty"`
+	Nonce           string `json:"nonce,omitempty"`
+}
+
+// Prova verificata
+type Proof struct {
+	// Impronta della chiave pubblica (RFC 7638), da confrontare con cnf.jkt
+	Thumbprint string
+	ID         string
+	IssuedAt   time.Time
+}
+
+// Verifica le prove DPoP
+type Validator struct {
+	// Età massima delle prove
+	MaxAge time.Duration
+
+	// Se non è nil, le prove devono contenere un nonce valido emesso dal server
+	Nonces *NonceSource
+
+	replay *ReplayCache
+}
+
+// Crea un validatore con la propria cache contro il riutilizzo delle prove
+func NewValidator() *Validator {
+	return &Validator{
+		MaxAge: defaultMaxAge,
+		replay: NewReplayCache(defaultMaxProofs),
+	}
+}
+
+// Verifica la prova per la richiesta indicata (metodo e URL). Se la richiesta
+// presenta un token, accessToken deve essere non vuoto e la prova ne deve
+// contenere l'hash.
+func (v *Validator) Verify(proof, method, requestURL string, accessToken []byte) (*Proof, error) {
+	parts := strings.Split(proof, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidProof
+	}
+
+	b, err := decode(parts[0])
+	if err != nil {
+		return nil, ErrInvalidProof
+	}
+
+	var header proofHeader
+	if err := json.Unmarshal(b, &header); err != nil || header.Type != proofType || header.Key == nil {
+		return nil, ErrInvalidProof
+	}
+
+	alg, err := algorithm(header.Algorithm, *header.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	var claims proofClaims
+	if _, err := jwt.Verify([]byte(proof), alg, &claims, jwt.ValidateHeader); err != nil {
+		return nil, ErrInvalidProof
+	}
+
+	if claims.ID == "" || claims.Method != method || !sameURL(claims.URL, requestURL) {
+		return nil, ErrMismatch
+	}
+
+	if len(accessToken) > 0 && claims.AccessTokenHash != hashToken(accessToken) {
+		return nil, ErrMismatch
+	}
+
+	now := time.Now()
+	issuedAt := time.Unix(claims.IssuedAt, 0)
+
+	if issuedAt.Before(now.Add(-v.MaxAge)) || issuedAt.After(now.Add(clockSkew)) {
+		return nil, ErrExpiredProof
+	}
+
+	if v.Nonces != nil && !v.Nonces.Valid(claims.Nonce) {
+		return nil, ErrUseNonce
+	}
+
+	thumbprint, err := header.Key.Thumbprint()
+	if err != nil {
+		return nil, ErrInvalidProof
+	}
+
+	// A proof can be used only once; while the cache is full, new proofs are refused
+	if v.replay.Seen(thumbprint+" "+claims.ID, now.Add(v.MaxAge+clockSkew)) {
+		return nil, ErrReplayedProof
+	}
+
+	return &Proof{
+		Thumbprint: thumbprint,
+		ID:         claims.ID,
+		IssuedAt:   issuedAt,
+	}, nil
+}
+
+// Crea una prova per una richiesta, firmata con la chiave del client (ES256 o RS256).
+// accessToken e nonce possono essere vuoti.
+func NewProof(key crypto.Signer, method, requestURL string, accessToken []byte, nonce string) (string, error) {
+	public, err := jwk.New(key.Public())
+	if err != nil {
+		return "", err
+	}
+	public.KeyID = ""
+
+	header := proofHeader{Type: proofType, Key: &public}
+
+	switch key.(type) {
+	case *ecdsa.PrivateKey:
+		header.Algorithm = "ES256"
+	case *rsa.PrivateKey:
+		header.Algorithm = "RS256"
+	default:
+		return "", jwk.ErrUnsupportedKey
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+
+	claims := proofClaims{
+		ID:       encode(id),
+		Method:   method,
+		URL:      requestURL,
+		IssuedAt: time.Now().Unix(),
+		Nonce:    nonce,
+	}
+
+	if len(accessToken) > 0 {
+		claims.AccessTokenHash = hashToken(accessToken)
+	}
+
+	h, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := encode(h) + "." + encode(c)
+	digest := sha256.Sum256([]byte(signingInput))
+
+	var signature []byte
+
+	switch key := key.(type) {
+	case *ecdsa.PrivateKey:
+		if key.Curve != elliptic.P256() {
+			return "", jwk.ErrUnsupportedCurve
+		}
+
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			return "", err
+		}
+
+		// JWS uses the fixed-size concatenation of r and s
+		signature = append(pad(r, 32), pad(s, 32)...)
+
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return signingInput + "." + encode(signature), nil
+}
+
+// Restituisce l'algoritmo di verifica per la chiave contenuta nella prova
+func algorithm(name string, key jwk.Key) (jwt.Algorithm, error) {
+	// Private keys must never be sent
+	if key.D != "" {
+		return nil, ErrInvalidProof
+	}
+
+	pub, err := key.PublicKey()
+	if err != nil {
+		return nil, ErrInvalidProof
+	}
+
+	switch pub := pub.(type) {
+	case *ecdsa.PublicKey:
+		if name == "ES256" && pub.Curve == elliptic.P256() {
+			return jwt.NewES256(jwt.ECDSAPublicKey(pub)), nil
+		}
+	case *rsa.PublicKey:
+		if name == "RS256" {
+			return jwt.NewRS256(jwt.RSAPublicKey(pub)), nil
+		}
+	}
+
+	return nil, ErrInvalidProof
+}
+
+// Confronta due URL ignorando query e frammento (RFC 9449, sezione 4.3)
+func sameURL(a, b string) bool {
+	ua, errA := url.Parse(a)
+	ub, errB := url.Parse(b)
+
+	if errA != nil || errB != nil {
+		return false
+	}
+
+	return normalizeURL(ua) == normalizeURL(ub)
+}
+
+func normalizeURL(u *url.URL) string {
+	scheme := strings.ToLower(u.Scheme)
+	host := strings.ToLower(u.Hostname())
+
+	if port := u.Port(); port != "" && !(scheme == "http" && port == "80") && !(scheme == "https" && port == "443") {
+		host += ":" + port
+	}
+
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+
+	return scheme + "://" + host + path
+}
+
+// Hash del token contenuto nella claim ath
+func hashToken(token []byte) string {
+	sum := sha256.Sum256(token)
+	return encode(sum[:])
+}
+
+func pad(n *big.Int, size int) []byte {
+	b := n.Bytes()
+	return append(make([]byte, size-len(b)), b...)
+}
+
+func encode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decode(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(s)
+}
@@ -0,0 +1,202 @@
+/*
+ * dpop_test.go
+ *
+ * File di test per il package dpop.
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+package dpop
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"git.napaalm.xyz/napaalm/ssodav/pkg/jwk"
+)
+
+const tokenURL = "https://sso.example.org/token"
+
+func newKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+func TestProof(t *testing.T) {
+	key := newKey(t)
+	v := NewValidator()
+
+	proof, err := NewProof(key, "POST", tokenURL, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Query and fragment are ignored, like default ports and case of the host
+	p, err := v.Verify(proof, "POST", "https://SSO.example.org:443/token?x=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	public, _ := jwk.New(&key.PublicKey)
+	if p.Thumbprint != public.KeyID {
+		t.Errorf("expected thumbprint %s, got %s", public.KeyID, p.Thumbprint)
+	}
+
+	if _, err := v.Verify(proof, "POST", tokenURL, nil); err != ErrReplayedProof {
+		t.Errorf("expected ErrReplayedProof, got %v", err)
+	}
+
+	cases := []struct {
+		method, url string
+		err         error
+	}{
+		{"GET", tokenURL, ErrMismatch},
+		{"POST", "https://sso.example.org/token/exchange", ErrMismatch},
+		{"POST", "http://sso.example.org/token", ErrMismatch},
+	}
+
+	for _, c := range cases {
+		proof, _ := NewProof(key, "POST", tokenURL, nil, "")
+
+		if _, err := v.Verify(proof, c.method, c.url, nil); err != c.err {
+			t.Errorf("%s %s: expected %v, got %v", c.method, c.url, c.err, err)
+		}
+	}
+
+	// Tampered signature
+	proof, _ = NewProof(key, "POST", tokenURL, nil, "")
+	if _, err := v.Verify(proof[:len(proof)-4]+"AAAA", "POST", tokenURL, nil); err != ErrInvalidProof {
+		t.Errorf("expected ErrInvalidProof, got %v", err)
+	}
+
+	// Old proofs
+	v.MaxAge = -2 * clockSkew
+	if _, err := v.Verify(proof, "POST", tokenURL, nil); err != ErrExpiredProof {
+		t.Errorf("expected ErrExpiredProof, got %v", err)
+	}
+}
+
+func TestAccessTokenHash(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v := NewValidator()
+	token := []byte("eyJhbGciOiJIUzI1NiJ9.eyJzdWIiOiJwcm9mZXNzb3IifQ.c2ln")
+
+	proof, _ := NewProof(key, "GET", "https://app.example.org/", token, "")
+	if _, err := v.Verify(proof, "GET", "https://app.example.org/", []byte("another token")); err != ErrMismatch {
+		t.Errorf("expected ErrMismatch, got %v", err)
+	}
+
+	proof, _ = NewProof(key, "GET", "https://app.example.org/", token, "")
+	if _, err := v.Verify(proof, "GET", "https://app.example.org/", token); err != nil {
+		t.Error(err)
+	}
+
+	// A proof without ath can't be used with a token
+	proof, _ = NewProof(key, "GET", "https://app.example.org/", nil, "")
+	if _, err := v.Verify(proof, "GET", "https://app.example.org/", token); err != ErrMismatch {
+		t.Errorf("expected ErrMismatch, got %v", err)
+	}
+}
+
+func TestReplayCache(t *testing.T) {
+	c := NewReplayCache(3)
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if c.Seen(strconv.Itoa(i), now.Add(time.Minute)) {
+			t.Fatalf("identifier %d already seen", i)
+		}
+	}
+
+	if !c.Seen("0", now.Add(time.Minute)) {
+		t.Error("replay not detected")
+	}
+
+	// A full cache refuses new identifiers rather than forgetting the ones in use
+	if !c.Seen("new", now.Add(time.Minute)) || len(c.seen) != 3 {
+		t.Errorf("identifier registered in a full cache: %d entries", len(c.seen))
+	}
+
+	// Expired identifiers make room at once
+	c.seen["0"] = now.Add(-time.Second)
+	if c.Seen("new", now.Add(time.Minute)) {
+		t.Error("identifier refused after an expiry")
+	}
+}
+
+func TestNonce(t *testing.T) {
+	key := newKey(t)
+
+	nonces, err := NewNonceSource(time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v := NewValidator()
+	v.Nonces = nonces
+
+	proof, _ := NewProof(key, "POST", tokenURL, nil, "")
+	if _, err := v.Verify(proof, "POST", tokenURL, nil); err != ErrUseNonce {
+		t.Errorf("expected ErrUseNonce, got %v", err)
+	}
+
+	other, _ := NewNonceSource(time.Minute)
+	proof, _ = NewProof(key, "POST", tokenURL, nil, other.New())
+	if _, err := v.Verify(proof, "POST", tokenURL, nil); err != ErrUseNonce {
+		t.Errorf("expected ErrUseNonce for a foreign nonce, got %v", err)
+	}
+
+	proof, _ = NewProof(key, "POST", tokenURL, nil, nonces.New())
+	if _, err := v.Verify(proof, "POST", tokenURL, nil); err != nil {
+		t.Error(err)
+	}
+
+	expired := &NonceSource{key: nonces.key, lifetime: -2 * clockSkew}
+	if expired.Valid(nonces.New()) {
+		t.Error("expired nonce accepted")
+	}
+}
+
+func TestPrivateKeyInProof(t *testing.T) {
+	key := newKey(t)
+
+	proof, _ := NewProof(key, "POST", tokenURL, nil, "")
+	parts := strings.Split(proof, ".")
+
+	header, _ := decode(parts[0])
+	leaked := strings.Replace(string(header), `"crv"`, `"d":"`+encode(key.D.Bytes())+`","crv"`, 1)
+
+	if _, err := NewValidator().Verify(encode([]byte(leaked))+"."+parts[1]+"."+parts[2], "POST", tokenURL, nil); err != ErrInvalidProof {
+		t.Errorf("expected ErrInvalidProof, got %v", err)
+	}
+}
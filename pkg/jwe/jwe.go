@@ -0,0 +1,368 @@
+/*
+ * jwe.go
+ *
+ * Cifratura dei token in formato JSON Web Encryption (RFC 7516).
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+// Package per la cifratura dei token in formato JSON Web Encryption (RFC 7516),
+// serializzazione compatta. Sono supportati gli algoritmi RSA-OAEP, RSA-OAEP-256
+// ed ECDH-ES per la chiave e A256GCM per il contenuto.
+package jwe
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash"
+	"math/big"
+
+	"git.napaalm.xyz/napaalm/ssodav/pkg/jwk"
+)
+
+// Algoritmi supportati
+const (
+	RSAOAEP    = "RSA-OAEP"
+	RSAOAEP256 = "RSA-OAEP-256"
+	ECDHES     = "ECDH-ES"
+	A256GCM    = "A256GCM"
+)
+
+var (
+	ErrMalformed   = errors.New("jwe: malformed token")
+	ErrAlgorithm   = errors.New("jwe: unsupported algorithm")
+	ErrKeyMismatch = errors.New("jwe: key doesn't match the algorithm")
+	ErrDecryption  = errors.New("jwe: decryption failed")
+)
+
+// Intestazione protetta
+type Header struct {
+	Algorithm   string   `json:"alg"`
+	Encryption  string   `json:"enc"`
+	ContentType string   `json:"cty,omitempty"`
+	KeyID       string   `json:"kid,omitempty"`
+	Ephemeral   *jwk.Key `json:"epk,omitempty"`
+	PartyUInfo  string   `json:"apu,omitempty"`
+	PartyVInfo  string   `json:"apv,omitempty"`
+}
+
+// Restituisce l'algoritmo predefinito per una chiave: RSA-OAEP per RSA, ECDH-ES per EC
+func DefaultAlgorithm(pub crypto.PublicKey) string {
+	if _, ok := pub.(*ecdsa.PublicKey); ok {
+		return ECDHES
+	}
+
+	return RSAOAEP
+}
+
+// Controlla se un token è cifrato (cinque parti invece delle tre di un JWS)
+func IsEncrypted(token []byte) bool {
+	return bytes.Count(token, []byte{'.'}) == 4
+}
+
+// Cifra un token firmato (JWT annidato) per la chiave pubblica indicata
+func Encrypt(token []byte, pub crypto.PublicKey, alg, kid string) ([]byte, error) {
+	header := Header{
+		Algorithm:   alg,
+		Encryption:  A256GCM,
+		ContentType: "JWT",
+		KeyID:       kid,
+	}
+
+	var cek, encryptedKey []byte
+
+	switch alg {
+	case RSAOAEP, RSAOAEP256:
+		rsaPub, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return nil, ErrKeyMismatch
+		}
+
+		cek = make([]byte, 32)
+		if _, err := rand.Read(cek); err != nil {
+			return nil, err
+		}
+
+		var err error
+		encryptedKey, err = rsa.EncryptOAEP(oaepHash(alg), rand.Reader, rsaPub, cek, nil)
+		if err != nil {
+			return nil, err
+		}
+
+	case ECDHES:
+		ecPub, ok := pub.(*ecdsa.PublicKey)
+		if !ok {
+			return nil, ErrKeyMismatch
+		}
+
+		recipient, err := ecPub.ECDH()
+		if err != nil {
+			return nil, ErrKeyMismatch
+		}
+
+		ephemeral, err := recipient.Curve().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+
+		z, err := ephemeral.ECDH(recipient)
+		if err != nil {
+			return nil, err
+		}
+
+		epk, err := ephemeralKey(ephemeral.PublicKey().Bytes(), ecPub)
+		if err != nil {
+			return nil, err
+		}
+		header.Ephemeral = &epk
+
+		// Direct key agreement: the derived key is the content encryption key
+		cek = concatKDF(z, A256GCM, nil, nil, 256)
+
+	default:
+		return nil, ErrAlgorithm
+	}
+
+	h, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	protected := encode(h)
+
+	gcm, err := newGCM(cek)
+	if err != nil {
+		return nil, err
+	}
+
+	iv := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+
+	// The protected header is the additional authenticated data
+	sealed := gcm.Seal(nil, iv, token, []byte(protected))
+	ciphertext, tag := sealed[:len(sealed)-gcm.Overhead()], sealed[len(sealed)-gcm.Overhead():]
+
+	return []byte(protected + "." + encode(encryptedKey) + "." + encode(iv) + "." + encode(ciphertext) + "." + encode(tag)), nil
+}
+
+// Legge l'intestazione di un token cifrato, per scegliere la chiave con cui decifrarlo
+func ParseHeader(token []byte) (Header, error) {
+	var header Header
+
+	parts := bytes.Split(token, []byte{'.'})
+	if len(parts) != 5 {
+		return header, ErrMalformed
+	}
+
+	h, err := decode(string(parts[0]))
+	if err != nil {
+		return header, ErrMalformed
+	}
+
+	if err := json.Unmarshal(h, &header); err != nil {
+		return header, ErrMalformed
+	}
+
+	return header, nil
+}
+
+// Decifra un token con la chiave privata indicata e restituisce il contenuto
+func Decrypt(token []byte, priv crypto.PrivateKey) ([]byte, error) {
+	header, err := ParseHeader(token)
+	if err != nil {
+		return nil, err
+	}
+
+	if header.Encryption != A256GCM {
+		return nil, ErrAlgorithm
+	}
+
+	parts := bytes.Split(token, []byte{'.'})
+
+	var segments [4][]byte
+	for i := range segments {
+		if segments[i], err = decode(string(parts[i+1])); err != nil {
+			return nil, ErrMalformed
+		}
+	}
+	encryptedKey, iv, ciphertext, tag := segments[0], segments[1], segments[2], segments[3]
+
+	var cek []byte
+
+	switch header.Algorithm {
+	case RSAOAEP, RSAOAEP256:
+		rsaPriv, ok := priv.(*rsa.PrivateKey)
+		if !ok {
+			return nil, ErrKeyMismatch
+		}
+
+		cek, err = rsa.DecryptOAEP(oaepHash(header.Algorithm), nil, rsaPriv, encryptedKey, nil)
+		if err != nil || len(cek) != 32 {
+			// Don't reveal whether the key decryption failed (RFC 7516, section 11.5)
+			cek = make([]byte, 32)
+			rand.Read(cek)
+		}
+
+	case ECDHES:
+		ecPriv, ok := priv.(*ecdsa.PrivateKey)
+		if !ok || header.Ephemeral == nil || len(encryptedKey) != 0 {
+			return nil, ErrKeyMismatch
+		}
+
+		cek, err = agreeKey(ecPriv, header)
+		if err != nil {
+			return nil, err
+		}
+
+	default:
+		return nil, ErrAlgorithm
+	}
+
+	gcm, err := newGCM(cek)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(iv) != gcm.NonceSize() || len(tag) != gcm.Overhead() {
+		return nil, ErrMalformed
+	}
+
+	plaintext, err := gcm.Open(nil, iv, append(ciphertext, tag...), parts[0])
+	if err != nil {
+		return nil, ErrDecryption
+	}
+
+	return plaintext, nil
+}
+
+// Calcola la chiave del contenuto a partire dalla chiave effimera del mittente
+func agreeKey(priv *ecdsa.PrivateKey, header Header) ([]byte, error) {
+	// jwk.PublicKey checks that the point is on the curve
+	pub, err := header.Ephemeral.PublicKey()
+	if err != nil {
+		return nil, ErrMalformed
+	}
+
+	ecPub, ok := pub.(*ecdsa.PublicKey)
+	if !ok || ecPub.Curve != priv.Curve {
+		return nil, ErrKeyMismatch
+	}
+
+	ecdhPriv, err := priv.ECDH()
+	if err != nil {
+		return nil, ErrKeyMismatch
+	}
+
+	ecdhPub, err := ecPub.ECDH()
+	if err != nil {
+		return nil, ErrMalformed
+	}
+
+	z, err := ecdhPriv.ECDH(ecdhPub)
+	if err != nil {
+		return nil, ErrDecryption
+	}
+
+	apu, errU := decode(header.PartyUInfo)
+	apv, errV := decode(header.PartyVInfo)
+	if errU != nil || errV != nil {
+		return nil, ErrMalformed
+	}
+
+	return concatKDF(z, header.Encryption, apu, apv, 256), nil
+}
+
+// Concat KDF con SHA-256 (NIST SP 800-56A), come definito nella RFC 7518, sezione 4.6.2
+func concatKDF(z []byte, algorithmID string, apu, apv []byte, keyBits int) []byte {
+	var otherInfo bytes.Buffer
+
+	for _, field := range [][]byte{[]byte(algorithmID), apu, apv} {
+		binary.Write(&otherInfo, binary.BigEndian, uint32(len(field)))
+		otherInfo.Write(field)
+	}
+	binary.Write(&otherInfo, binary.BigEndian, uint32(keyBits))
+
+	var key []byte
+
+	for counter := uint32(1); len(key) < keyBits/8; counter++ {
+		h := sha256.New()
+		binary.Write(h, binary.BigEndian, counter)
+		h.Write(z)
+		h.Write(otherInfo.Bytes())
+		key = h.Sum(key)
+	}
+
+	return key[:keyBits/8]
+}
+
+// Rappresenta la chiave pubblica effimera (punto non compresso) come JWK
+func ephemeralKey(point []byte, recipient *ecdsa.PublicKey) (jwk.Key, error) {
+	size := (len(point) - 1) / 2
+
+	key, err := jwk.New(&ecdsa.PublicKey{
+		Curve: recipient.Curve,
+		X:     new(big.Int).SetBytes(point[1 : 1+size]),
+		Y:     new(big.Int).SetBytes(point[1+size:]),
+	})
+	if err != nil {
+		return jwk.Key{}, err
+	}
+
+	// The ephemeral key doesn't need an identifier
+	key.KeyID = ""
+
+	return key, nil
+}
+
+func oaepHash(alg string) hash.Hash {
+	if alg == RSAOAEP256 {
+		return sha256.New()
+	}
+
+	return sha1.New()
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func encode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decode(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(s)
+}
@@ -0,0 +1,241 @@
+/*
+ * jwk.go
+ *
+ * Rappresentazione delle chiavi pubbliche in formato JSON Web Key (RFC 7517).
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+// Package per la rappresentazione delle chiavi pubbliche in formato JSON Web Key
+// (RFC 7517), con il calcolo dell'impronta secondo la RFC 7638.
+package jwk
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+)
+
+var (
+	ErrUnsupportedKey   = errors.New("jwk: unsupported key type")
+	ErrUnsupportedCurve = errors.New("jwk: unsupported curve")
+	ErrInvalidKey       = errors.New("jwk: invalid key parameters")
+)
+
+// Chiave pubblica RSA o EC
+type Key struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid,omitempty"`
+	Use       string `json:"use,omitempty"`
+	Algorithm string `json:"alg,omitempty"`
+
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+
+	// EC
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+	Y     string `json:"y,omitempty"`
+
+	// Parametro privato (RSA ed EC): mai presente in una chiave pubblica valida
+	D string `json:"d,omitempty"`
+}
+
+// Insieme di chiavi, come pubblicato su /.well-known/jwks.json
+type Set struct {
+	Keys []Key `json:"keys"`
+}
+
+// Crea la JWK di una chiave pubblica RSA o ECDSA. L'identificatore è l'impronta della chiave.
+func New(pub crypto.PublicKey) (Key, error) {
+	var key Key
+
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		key.KeyType = "RSA"
+		key.N = encode(pub.N.Bytes())
+		key.E = encode(big.NewInt(int64(pub.E)).Bytes())
+
+	case *ecdsa.PublicKey:
+		name, size, ok := curveName(pub.Curve)
+		if !ok {
+			return Key{}, ErrUnsupportedCurve
+		}
+
+		key.KeyType = "EC"
+		key.Curve = name
+		key.X = encode(pad(pub.X.Bytes(), size))
+		key.Y = encode(pad(pub.Y.Bytes(), size))
+
+	default:
+		return Key{}, ErrUnsupportedKey
+	}
+
+	kid, err := key.Thumbprint()
+	if err != nil {
+		return Key{}, err
+	}
+	key.KeyID = kid
+
+	return key, nil
+}
+
+// Restituisce la chiave pubblica rappresentata dalla JWK
+func (k Key) PublicKey() (crypto.PublicKey, error) {
+	switch k.KeyType {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil || len(n) == 0 {
+			return nil, ErrInvalidKey
+		}
+
+		e, err := decode(k.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, ErrInvalidKey
+		}
+
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+
+	case "EC":
+		curve, size, ok := curveByName(k.Curve)
+		if !ok {
+			return nil, ErrUnsupportedCurve
+		}
+
+		x, errX := decode(k.X)
+		y, errY := decode(k.Y)
+		if errX != nil || errY != nil || len(x) != size || len(y) != size {
+			return nil, ErrInvalidKey
+		}
+
+		pub := &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+
+		if !curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, ErrInvalidKey
+		}
+
+		return pub, nil
+
+	default:
+		return nil, ErrUnsupportedKey
+	}
+}
+
+// Calcola l'impronta SHA-256 della chiave (RFC 7638), codificata in base64url
+func (k Key) Thumbprint() (string, error) {
+	var members interface{}
+
+	// The required members, in lexicographic order
+	switch k.KeyType {
+	case "RSA":
+		members = struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{k.E, k.KeyType, k.N}
+
+	case "EC":
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		}{k.Curve, k.KeyType, k.X, k.Y}
+
+	default:
+		return "", ErrUnsupportedKey
+	}
+
+	b, err := json.Marshal(members)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(b)
+
+	return encode(sum[:]), nil
+}
+
+// Cerca una chiave in base all'identificatore
+func (s Set) Lookup(kid string) (Key, bool) {
+	for _, key := range s.Keys {
+		if key.KeyID == kid {
+			return key, true
+		}
+	}
+
+	return Key{}, false
+}
+
+func curveName(curve elliptic.Curve) (string, int, bool) {
+	switch curve {
+	case elliptic.P256():
+		return "P-256", 32, true
+	case elliptic.P384():
+		return "P-384", 48, true
+	case elliptic.P521():
+		return "P-521", 66, true
+	}
+
+	return "", 0, false
+}
+
+func curveByName(name string) (elliptic.Curve, int, bool) {
+	switch name {
+	case "P-256":
+		return elliptic.P256(), 32, true
+	case "P-384":
+		return elliptic.P384(), 48, true
+	case "P-521":
+		return elliptic.P521(), 66, true
+	}
+
+	return nil, 0, false
+}
+
+// Aggiunge zeri iniziali fino alla lunghezza indicata
+func pad(b []byte, size int) []byte {
+	if len(b) >= size {
+		return b
+	}
+
+	return append(make([]byte, size-len(b)), b...)
+}
+
+func encode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decode(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(s)
+}
@@ -0,0 +1,126 @@
+/*
+ * jwk_test.go
+ *
+ * File di test per il package jwk.
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+package jwk
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"testing"
+)
+
+// Esempio della RFC 7638, sezione 3.1
+func TestThumbprint(t *testing.T) {
+	key := Key{
+		KeyType: "RSA",
+		N:       "0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw",
+		E:       "AQAB",
+		KeyID:   "2011-04-29",
+	}
+
+	thumbprint, err := key.Thumbprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs"; thumbprint != expected {
+		t.Errorf("expected %s, got %s", expected, thumbprint)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, pub := range []interface{}{&rsaKey.PublicKey, &ecKey.PublicKey} {
+		key, err := New(pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := json.Marshal(Set{[]Key{key}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var set Set
+		if err := json.Unmarshal(b, &set); err != nil {
+			t.Fatal(err)
+		}
+
+		parsed, ok := set.Lookup(key.KeyID)
+		if !ok {
+			t.Fatalf("key %s not found in %s", key.KeyID, b)
+		}
+
+		decoded, err := parsed.PublicKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		switch pub := pub.(type) {
+		case *rsa.PublicKey:
+			if !pub.Equal(decoded) {
+				t.Error("RSA key mismatch")
+			}
+		case *ecdsa.PublicKey:
+			if !pub.Equal(decoded) {
+				t.Error("EC key mismatch")
+			}
+		}
+	}
+}
+
+func TestInvalidKey(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := New(&ecKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A point that isn't on the curve
+	key.Y = key.X
+	if _, err := key.PublicKey(); err == nil {
+		t.Error("invalid point accepted")
+	}
+
+	key.Curve = "P-192"
+	if _, err := key.PublicKey(); err != ErrUnsupportedCurve {
+		t.Error("unsupported curve accepted")
+	}
+}
@@ -0,0 +1,69 @@
+/*
+ * pkce.go
+ *
+ * Proof Key for Code Exchange (RFC 7636) con il metodo S256.
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+// Package per la Proof Key for Code Exchange (RFC 7636): il servizio che chiede
+// un codice monouso invia l'impronta (code_challenge) di un segreto casuale
+// (code_verifier), che deve poi presentare per scambiare il codice. Un codice
+// intercettato è inutile senza il segreto. È supportato solo il metodo S256.
+package pkce
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+)
+
+// Metodo di calcolo dell'impronta (parametro code_challenge_method)
+const Method = "S256"
+
+// Byte casuali del segreto, che codificati danno 43 caratteri
+const verifierSize = 32
+
+// Genera un nuovo segreto
+func NewVerifier() (string, error) {
+	b := make([]byte, verifierSize)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Restituisce l'impronta del segreto
+func Challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// Indica se l'impronta ha il formato di quelle calcolate con S256
+func ValidChallenge(challenge string) bool {
+	b, err := base64.RawURLEncoding.DecodeString(challenge)
+	return err == nil && len(b) == sha256.Size
+}
+
+// Controlla che il segreto corrisponda all'impronta
+func Verify(verifier, challenge string) bool {
+	return verifier != "" && subtle.ConstantTimeCompare([]byte(Challenge(verifier)), []byte(challenge)) == 1
+}
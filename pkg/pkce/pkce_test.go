@@ -0,0 +1,59 @@
+/*
+ * pkce_test.go
+ *
+ * File di test per il package pkce.
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+package pkce
+
+import "testing"
+
+// Esempio della RFC 7636, appendice B
+func TestChallenge(t *testing.T) {
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+
+	if expected := "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"; Challenge(verifier) != expected {
+		t.Errorf("expected %s, got %s", expected, Challenge(verifier))
+	}
+}
+
+func TestVerify(t *testing.T) {
+	verifier, err := NewVerifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	challenge := Challenge(verifier)
+	if !ValidChallenge(challenge) || !Verify(verifier, challenge) {
+		t.Error("verifier not accepted")
+	}
+
+	other, _ := NewVerifier()
+	if Verify(other, challenge) || Verify("", challenge) {
+		t.Error("wrong verifier accepted")
+	}
+
+	for _, challenge := range []string{"", "short", challenge + "="} {
+		if ValidChallenge(challenge) {
+			t.Errorf("invalid challenge %q accepted", challenge)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+/*
+ * crossdomain.go
+ *
+ * Ricevitore per l'accesso dai domini esterni al dominio dei cookie del server.
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+package verifier
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"git.napaalm.xyz/napaalm/ssodav/pkg/cookie"
+	"git.napaalm.xyz/napaalm/ssodav/pkg/pkce"
+)
+
+const (
+	// Prefisso dei nomi dei cookie con lo state degli accessi in corso, che legano
+	// il codice ricevuto dal server al browser che ha iniziato l'accesso. Ogni
+	// accesso ha il proprio cookie (StateCookie_<state>), così che accessi
+	// contemporanei da più schede non si sovrascrivano. Il cookie conserva anche
+	// il segreto PKCE con cui il codice viene scambiato.
+	StateCookie = "sso_state"
+
+	// Durata massima di un accesso, dal middleware al ricevitore
+	stateLifetime = 10 * time.Minute
+
+	// Byte casuali dello state
+	stateSize = 16
+
+	// Dimensione massima della risposta del server allo scambio del codice
+	maxTokenResponseSize = 1 << 20
+)
+
+var ErrCodeExchange = errors.New("verifier: unable to exchange the code")
+
+var exchangeClient = &http.Client{Timeout: 10 * time.Second}
+
+// Restituisce l'handler del ricevitore per i servizi in domini che non ricevono il
+// cookie di sessione del server: scambia il codice ricevuto con un token, che viene
+// verificato e conservato nel cookie del servizio (v.Cookie e v.CookieName), e
+// reindirizza a next. Il parametro state deve corrispondere a quello impostato dal
+// middleware nel suo cookie StateCookie, perché un attaccante non possa far accedere
+// l'utente con il proprio account consegnandogli un suo codice.
+// ssoURL è l'URL base del server. L'URL del ricevitore va indicato come redirect_uri
+// nella pagina di accesso del middleware, ad esempio:
+//
+//	http.Handle("/sso/callback", v.CrossDomainReceiver("https://sso.example.org"))
+//	http.Handle("/", v.Middleware("https://sso.example.org/crossdomain?redirect_uri=https://scuola.edu.it/sso/callback")(handler))
+func (v *Verifier) CrossDomainReceiver(ssoURL string) http.Handler {
+	tokenURL := strings.TrimSuffix(ssoURL, "/") + "/crossdomain/token"
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+
+		code := query.Get("code")
+		if code == "" {
+			http.Error(w, "Codice mancante", http.StatusBadRequest)
+			return
+		}
+
+		// The code must be delivered to the browser that started the login
+		verifier, ok := v.checkState(w, r, query.Get("state"))
+		if !ok {
+			http.Error(w, "Accesso non riuscito", http.StatusForbidden)
+			return
+		}
+
+		// The receiver's own URL, without the parameters added by the server
+		redirectURI := requestURL(r)
+		if i := strings.IndexByte(redirectURI, '?'); i >= 0 {
+			redirectURI = redirectURI[:i]
+		}
+
+		if !v.redeemCode(w, r, tokenURL, code, redirectURI, verifier) {
+			return
+		}
+
+		w.Header().Set("Cache-Control", "no-store")
+		http.Redirect(w, r, localURL(query.Get("next"), r.Host), http.StatusSeeOther)
+	})
+}
+
+// Scambia il codice con un token presso il server, lo verifica e lo conserva nel
+// cookie del servizio. In caso di errore risponde al client e restituisce falso.
+func (v *Verifier) redeemCode(w http.ResponseWriter, r *http.Request, tokenURL, code, redirectURI, verifier string) bool {
+	token, err := exchangeCode(tokenURL, code, redirectURI, verifier)
+	if err != nil {
+		http.Error(w, "Accesso non riuscito", http.StatusBadGateway)
+		return false
+	}
+
+	claims, err := v.Verify(token)
+	if err != nil {
+		http.Error(w, "Accesso non riuscito", http.StatusForbidden)
+		return false
+	}
+
+	if err := v.cookiePolicy(r).Set(w, r, v.cookieName(), string(token), claims.ExpiresAt); err != nil {
+		http.Error(w, "Accesso non riuscito", http.StatusInternalServerError)
+		return false
+	}
+
+	return true
+}
+
+// Genera lo state e il segreto PKCE di un nuovo accesso, li conserva in un
+// cookie dedicato e restituisce lo state e l'impronta del segreto
+func (v *Verifier) newState(w http.ResponseWriter, r *http.Request) (string, string, error) {
+	b := make([]byte, stateSize)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+
+	verifier, err := pkce.NewVerifier()
+	if err != nil {
+		return "", "", err
+	}
+
+	state := base64.RawURLEncoding.EncodeToString(b)
+	if err := v.cookiePolicy(r).Set(w, r, stateCookie(state), state+"."+verifier, time.Now().Add(stateLifetime)); err != nil {
+		return "", "", err
+	}
+
+	return state, pkce.Challenge(verifier), nil
+}
+
+// Controlla che lo state ricevuto sia conservato nel proprio cookie, che viene
+// eliminato perché non possa essere riutilizzato, e restituisce il segreto PKCE
+func (v *Verifier) checkState(w http.ResponseWriter, r *http.Request, state string) (string, bool) {
+	// Only states generated by newState can name a cookie
+	if b, err := base64.RawURLEncoding.DecodeString(state); err != nil || len(b) != stateSize {
+		return "", false
+	}
+
+	policy := v.cookiePolicy(r)
+
+	value, err := policy.Get(r, stateCookie(state))
+	if err != nil {
+		return "", false
+	}
+
+	policy.Clear(w, r, stateCookie(state))
+
+	i := strings.IndexByte(value, '.')
+	if i < 0 || subtle.ConstantTimeCompare([]byte(state), []byte(value[:i])) != 1 {
+		return "", false
+	}
+
+	return value[i+1:], true
+}
+
+// Restituisce il nome del cookie di un accesso
+func stateCookie(state string) string {
+	return StateCookie + "_" + state
+}
+
+// Restituisce la politica dei cookie del servizio, con Secure sulle pagine servite in HTTPS
+func (v *Verifier) cookiePolicy(r *http.Request) cookie.Policy {
+	policy := v.Cookie
+	if strings.HasPrefix(requestURL(r), "https://") {
+		policy.Secure = true
+	}
+
+	return policy
+}
+
+// Scambia il codice con un token presso il server
+func exchangeCode(tokenURL, code, redirectURI, verifier string) ([]byte, error) {
+	resp, err := exchangeClient.PostForm(tokenURL, url.Values{
+		"code":          {code},
+		"redirect_uri":  {redirectURI},
+		"code_verifier": {verifier},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, ErrCodeExchange
+	}
+
+	var body struct {
+		AccessToken string `json:"access_token"`
+	}
+
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxTokenResponseSize)).Decode(&body); err != nil || body.AccessToken == "" {
+		return nil, ErrCodeExchange
+	}
+
+	return []byte(body.AccessToken), nil
+}
+
+// Restituisce next solo se appartiene al sito del servizio, altrimenti "/"
+func localURL(next, host string) string {
+	u, err := url.Parse(next)
+	if err != nil || next == "" {
+		return "/"
+	}
+
+	// Relative paths must not be protocol-relative URLs
+	if !u.IsAbs() && u.Host == "" && strings.HasPrefix(next, "/") && !strings.HasPrefix(next, "//") {
+		return next
+	}
+
+	if (u.Scheme == "http" || u.Scheme == "https") && strings.EqualFold(u.Host, host) {
+		return next
+	}
+
+	return "/"
+}
@@ -0,0 +1,143 @@
+/*
+ * jwks.go
+ *
+ * Recupero e memorizzazione delle chiavi pubbliche del server.
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+package verifier
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"git.napaalm.xyz/napaalm/ssodav/pkg/jwk"
+	"github.com/gbrlsnchs/jwt/v3"
+)
+
+const (
+	// Durata della memorizzazione delle chiavi
+	keysCacheDuration = time.Hour
+
+	// Intervallo minimo tra due richieste delle chiavi
+	keysRefreshInterval = time.Minute
+
+	// Dimensione massima della risposta del server
+	maxKeysSize = 1 << 20
+)
+
+// Insieme di chiavi pubbliche ottenute dal server
+type keySet struct {
+	url    string
+	client *http.Client
+
+	mutex       sync.Mutex
+	keys        map[string]jwt.Algorithm
+	fetched     time.Time
+	lastAttempt time.Time
+}
+
+func newKeySet(url string) *keySet {
+	return &keySet{
+		url:    url,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Restituisce l'algoritmo di verifica per la chiave indicata
+func (ks *keySet) algorithm(kid, alg string) (jwt.Algorithm, error) {
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+
+	now := time.Now()
+	verifier, ok := ks.keys[kid+" "+alg]
+
+	// Refresh the keys when they expire or on an unknown key ID (the key may have
+	// been rotated), but not more often than keysRefreshInterval
+	if (!ok || now.Sub(ks.fetched) > keysCacheDuration) && now.Sub(ks.lastAttempt) >= keysRefreshInterval {
+		ks.lastAttempt = now
+
+		keys, err := ks.fetch()
+		if err == nil {
+			ks.keys = keys
+			ks.fetched = now
+			verifier, ok = ks.keys[kid+" "+alg]
+		} else if ks.keys == nil {
+			return nil, ErrKeysUnavailable
+		}
+	}
+
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+
+	return verifier, nil
+}
+
+// Scarica le chiavi e prepara un algoritmo di verifica per ciascuna
+func (ks *keySet) fetch() (map[string]jwt.Algorithm, error) {
+	resp, err := ks.client.Get(ks.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, ErrKeysUnavailable
+	}
+
+	var set jwk.Set
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxKeysSize)).Decode(&set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]jwt.Algorithm)
+
+	for _, key := range set.Keys {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+
+		pub, err := key.PublicKey()
+		if err != nil {
+			continue
+		}
+
+		switch pub := pub.(type) {
+		case *rsa.PublicKey:
+			if key.Algorithm == "" || key.Algorithm == "RS256" {
+				keys[key.KeyID+" RS256"] = jwt.NewRS256(jwt.RSAPublicKey(pub))
+			}
+
+		case *ecdsa.PublicKey:
+			if (key.Algorithm == "" || key.Algorithm == "ES256") && pub.Curve == elliptic.P256() {
+				keys[key.KeyID+" ES256"] = jwt.NewES256(jwt.ECDSAPublicKey(pub))
+			}
+		}
+	}
+
+	return keys, nil
+}
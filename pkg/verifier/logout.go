@@ -0,0 +1,135 @@
+/*
+ * logout.go
+ *
+ * Ricezione delle notifiche di disconnessione inviate dal server (back-channel).
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+package verifier
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gbrlsnchs/jwt/v3"
+)
+
+// Evento contenuto nei logout token (OpenID Connect Back-Channel Logout)
+const logoutEvent = "http://schemas.openid.net/event/backchannel-logout"
+
+var ErrInvalidLogoutToken = errors.New("verifier: invalid logout token")
+
+// Informazioni contenute in un logout token valido
+type LogoutClaims struct {
+	// Utente disconnesso
+	Username string
+
+	// Sessione terminata sul server, la stessa indicata dalla claim sid dei token
+	SessionID string
+
+	// Identificatore univoco del token, per chi vuole scartare i token già ricevuti
+	ID string
+
+	Issuer   string
+	Audience string
+	IssuedAt time.Time
+}
+
+type logoutPayload struct {
+	jwt.Payload
+	Events    map[string]interface{} `json:"events"`
+	SessionID string                 `json:"sid"`
+	Nonce     *string                `json:"nonce"`
+}
+
+// Verifica un logout token. L'audience è l'ID con cui l'applicazione è registrata
+// come client sul server, che deve essere tra quelle del verificatore.
+func (v *Verifier) VerifyLogoutToken(token []byte) (*LogoutClaims, error) {
+	alg, err := v.algorithm(token)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		now = time.Now()
+		pl  logoutPayload
+
+		validators = []jwt.Validator{
+			jwt.IssuedAtValidator(now),
+			jwt.ExpirationTimeValidator(now),
+			jwt.AudienceValidator(v.audiences),
+		}
+	)
+
+	if v.Issuer != "" {
+		validators = append(validators, jwt.IssuerValidator(v.Issuer))
+	}
+
+	if _, err := jwt.Verify(token, alg, &pl, jwt.ValidateHeader, jwt.ValidatePayload(&pl.Payload, validators...)); err != nil {
+		return nil, err
+	}
+
+	// Access tokens never carry the event, and ID tokens are the only ones with a nonce
+	if _, ok := pl.Events[logoutEvent]; !ok || pl.Nonce != nil || len(pl.Audience) != 1 {
+		return nil, ErrInvalidLogoutToken
+	}
+
+	if pl.Subject == "" && pl.SessionID == "" {
+		return nil, ErrInvalidLogoutToken
+	}
+
+	claims := &LogoutClaims{
+		Username:  pl.Subject,
+		SessionID: pl.SessionID,
+		ID:        pl.JWTID,
+		Issuer:    pl.Issuer,
+		Audience:  pl.Audience[0],
+	}
+
+	if pl.IssuedAt != nil {
+		claims.IssuedAt = pl.IssuedAt.Time
+	}
+
+	return claims, nil
+}
+
+// Restituisce l'handler per l'URL logout_backchannel dell'applicazione: verifica
+// il logout token ricevuto e chiama logout, che deve terminare le sessioni locali
+// dell'utente (o solo quelle ottenute dalla sessione SessionID, se non è vuota).
+func (v *Verifier) LogoutHandler(logout func(*LogoutClaims)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "Metodo non consentito", http.StatusMethodNotAllowed)
+			return
+		}
+
+		claims, err := v.VerifyLogoutToken([]byte(r.PostFormValue("logout_token")))
+		if err != nil {
+			http.Error(w, "Logout token non valido", http.StatusBadRequest)
+			return
+		}
+
+		logout(claims)
+	})
+}
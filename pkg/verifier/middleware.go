@@ -0,0 +1,268 @@
+/*
+ * middleware.go
+ *
+ * Middleware net/http per i servizi che richiedono un utente autenticato.
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+package verifier
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"git.napaalm.xyz/napaalm/ssodav/pkg/cookie"
+	"git.napaalm.xyz/napaalm/ssodav/pkg/dpop"
+	"git.napaalm.xyz/napaalm/ssodav/pkg/pkce"
+)
+
+// Nome del cookie in cui il servizio conserva il proprio token. Il cookie di sessione
+// del server SSO è opaco: il middleware ottiene il token con il codice monouso che il
+// server aggiunge a next dopo l'accesso, e lo conserva in questo cookie.
+const SessionCookie = "access_token"
+
+// Percorso predefinito in cui il middleware riceve il codice dopo l'accesso
+const CallbackPath = "/sso/callback"
+
+// Politica predefinita del cookie del token
+var defaultCookie = cookie.Policy{HTTPOnly: true, SameSite: http.SameSiteLaxMode}
+
+type contextKey struct{}
+
+// Restituisce un contesto contenente le informazioni sull'utente
+func NewContext(ctx context.Context, claims *Claims) context.Context {
+	return context.WithValue(ctx, contextKey{}, claims)
+}
+
+// Restituisce le informazioni sull'utente memorizzate nel contesto
+func FromContext(ctx context.Context) (*Claims, bool) {
+	claims, ok := ctx.Value(contextKey{}).(*Claims)
+	return claims, ok
+}
+
+// Ottiene il token di una richiesta dall'header Authorization (schema Bearer o DPoP)
+// o dal cookie SessionCookie, anche se suddiviso in più parti
+func TokenFromRequest(r *http.Request) ([]byte, error) {
+	_, token, err := tokenFromRequest(r, defaultCookie, SessionCookie)
+	return token, err
+}
+
+// Come TokenFromRequest, con il cookie indicato e restituendo anche lo schema
+// dell'header Authorization
+func tokenFromRequest(r *http.Request, policy cookie.Policy, name string) (string, []byte, error) {
+	if header := r.Header.Get("Authorization"); header != "" {
+		i := strings.IndexByte(header, ' ')
+		if i < 0 {
+			return "", nil, ErrInvalidTokenType
+		}
+
+		scheme := header[:i]
+		if !strings.EqualFold(scheme, "Bearer") && !strings.EqualFold(scheme, dpop.Scheme) {
+			return "", nil, ErrInvalidTokenType
+		}
+
+		return scheme, []byte(strings.TrimSpace(header[i+1:])), nil
+	}
+
+	if value, err := policy.Get(r, name); err == nil {
+		return "", []byte(value), nil
+	}
+
+	return "", nil, ErrMissingToken
+}
+
+// Restituisce il percorso in cui il middleware riceve il codice
+func (v *Verifier) callbackPath() string {
+	if v.CallbackPath == "" {
+		return CallbackPath
+	}
+
+	return v.CallbackPath
+}
+
+// Restituisce il nome del cookie del token
+func (v *Verifier) cookieName() string {
+	if v.CookieName == "" {
+		return SessionCookie
+	}
+
+	return v.CookieName
+}
+
+// Verifica il token di una richiesta. I token vincolati a una chiave DPoP sono
+// accettati solo con lo schema DPoP e una prova valida per la richiesta.
+func (v *Verifier) VerifyRequest(r *http.Request) (*Claims, error) {
+	scheme, token, err := tokenFromRequest(r, v.Cookie, v.cookieName())
+	if err != nil {
+		return nil, err
+	}
+
+	claims, err := v.Verify(token)
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.EqualFold(scheme, dpop.Scheme) {
+		if claims.KeyThumbprint != "" {
+			return nil, ErrBoundToken
+		}
+
+		return claims, nil
+	}
+
+	proofs := r.Header.Values(dpop.Header)
+	if len(proofs) != 1 {
+		return nil, dpop.ErrInvalidProof
+	}
+
+	proof, err := v.DPoP.Verify(proofs[0], r.Method, requestURL(r), token)
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.KeyThumbprint == "" || claims.KeyThumbprint != proof.Thumbprint {
+		return nil, dpop.ErrMismatch
+	}
+
+	return claims, nil
+}
+
+// Restituisce un middleware che lascia passare solo le richieste con un token valido
+// e inserisce l'utente nel contesto. La navigazione viene reindirizzata alla pagina
+// di accesso loginURL, con next impostato al ricevitore del middleware (v.CallbackPath)
+// che riporta all'URL richiesto, state a un valore casuale e code_challenge
+// all'impronta di un segreto PKCE, entrambi conservati in un cookie StateCookie; le
+// altre richieste ricevono 401. Dopo l'accesso il server riporta il browser al
+// ricevitore con state e un codice monouso, che il middleware scambia con un token
+// per l'origine del servizio, conservato nel cookie del servizio (v.Cookie e
+// v.CookieName). L'URL del ricevitore va registrato tra i ricevitori del server.
+//
+// I token ottenuti da una sessione restano validi fino alla scadenza anche se la
+// sessione viene terminata: per accorgersene serve l'introspezione (/introspect).
+func (v *Verifier) Middleware(loginURL string) func(http.Handler) http.Handler {
+	tokenURL := ""
+	if u, err := url.Parse(loginURL); err == nil {
+		tokenURL = u.Scheme + "://" + u.Host + "/crossdomain/token"
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Back from the login page with a code for this service
+			if r.URL.Path == v.callbackPath() && r.Method == "GET" {
+				query := r.URL.Query()
+
+				verifier, ok := v.checkState(w, r, query.Get("state"))
+				if !ok {
+					http.Error(w, "Accesso non riuscito", http.StatusForbidden)
+					return
+				}
+
+				if !v.redeemCode(w, r, tokenURL, query.Get("code"), requestOrigin(r), verifier) {
+					return
+				}
+
+				w.Header().Set("Cache-Control", "no-store")
+				http.Redirect(w, r, localURL(query.Get("next"), r.Host), http.StatusSeeOther)
+				return
+			}
+
+			claims, err := v.VerifyRequest(r)
+			if err == nil {
+				next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), claims)))
+				return
+			}
+
+			// API clients can't go through the login page
+			if (r.Method != "GET" && r.Method != "HEAD") || r.Header.Get("Authorization") != "" {
+				unauthorized(w, r, v.DPoP, err)
+				return
+			}
+
+			state, challenge, err := v.newState(w, r)
+			if err != nil {
+				http.Error(w, "Accesso non riuscito", http.StatusInternalServerError)
+				return
+			}
+
+			callback := requestOrigin(r) + v.callbackPath() + "?next=" + url.QueryEscape(r.URL.RequestURI())
+			http.Redirect(w, r, redirectURL(loginURL, callback, state, challenge), http.StatusFound)
+		})
+	}
+}
+
+// Risponde 401 con la sfida adatta allo schema usato dal client (RFC 6750 e RFC 9449)
+func unauthorized(w http.ResponseWriter, r *http.Request, validator *dpop.Validator, err error) {
+	scheme, _, _ := tokenFromRequest(r, defaultCookie, SessionCookie)
+
+	switch {
+	case err == dpop.ErrUseNonce:
+		w.Header().Set(dpop.NonceHeader, validator.Nonces.New())
+		w.Header().Set("WWW-Authenticate", `DPoP error="use_dpop_nonce"`)
+	case strings.EqualFold(scheme, dpop.Scheme) || err == ErrBoundToken:
+		w.Header().Set("WWW-Authenticate", `DPoP error="invalid_token"`)
+	default:
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+	}
+
+	http.Error(w, "Autenticazione richiesta", http.StatusUnauthorized)
+}
+
+// Aggiunge i parametri next, state e l'impronta PKCE all'URL della pagina di accesso
+func redirectURL(loginURL, next, state, challenge string) string {
+	u, err := url.Parse(loginURL)
+	if err != nil {
+		return loginURL
+	}
+
+	query := u.Query()
+	query.Set("next", next)
+	query.Set("state", state)
+	query.Set("code_challenge", challenge)
+	query.Set("code_challenge_method", pkce.Method)
+	u.RawQuery = query.Encode()
+
+	return u.String()
+}
+
+// Ricostruisce l'URL richiesto, anche dietro a un reverse proxy
+func requestURL(r *http.Request) string {
+	return requestOrigin(r) + r.URL.RequestURI()
+}
+
+// Ricostruisce l'origine (schema e host) della richiesta, anche dietro a un reverse proxy
+func requestOrigin(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto == "http" || proto == "https" {
+		scheme = proto
+	}
+
+	host := r.Host
+	if fwdHost := r.Header.Get("X-Forwarded-Host"); fwdHost != "" {
+		host = fwdHost
+	}
+
+	return scheme + "://" + host
+}
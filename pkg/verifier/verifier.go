@@ -0,0 +1,328 @@
+/*
+ * verifier.go
+ *
+ * Verifica dei token emessi da ssodav per i servizi che li utilizzano.
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+// Package per la verifica dei token emessi da ssodav da parte dei servizi che li
+// utilizzano. Le chiavi possono essere la chiave segreta condivisa (HS256) oppure
+// quelle pubblicate dal server su /.well-known/jwks.json (RS256 ed ES256).
+//
+// Esempio:
+//
+//	v := verifier.NewJWKS("https://sso.example.org/.well-known/jwks.json", "https://app.example.org")
+//	http.Handle("/", v.Middleware("https://sso.example.org/")(handler))
+//
+// Nell'handler l'utente si ottiene con verifier.FromContext(r.Context()).
+// L'audience è l'origine del servizio, che deve essere tra i domini autorizzati del
+// server: dopo l'accesso il middleware ottiene un token valido solo per essa e lo
+// conserva in un proprio cookie. In alternativa il token può essere ricevuto su un
+// percorso dedicato con CrossDomainReceiver.
+// Se il server cifra i token per il servizio, la chiave privata va impostata
+// in DecryptionKey e i token vengono decifrati prima della verifica.
+package verifier
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"git.napaalm.xyz/napaalm/ssodav/pkg/cookie"
+	"git.napaalm.xyz/napaalm/ssodav/pkg/dpop"
+	"git.napaalm.xyz/napaalm/ssodav/pkg/jwe"
+	"github.com/gbrlsnchs/jwt/v3"
+)
+
+var (
+	ErrMalformed        = errors.New("verifier: malformed token")
+	ErrAlgorithm        = errors.New("verifier: unexpected signing algorithm")
+	ErrInvalidAudience  = errors.New("verifier: token not issued for this service")
+	ErrUnknownKey       = errors.New("verifier: unknown signing key")
+	ErrKeysUnavailable  = errors.New("verifier: unable to fetch the signing keys")
+	ErrMissingToken     = errors.New("verifier: missing token")
+	ErrEncrypted        = errors.New("verifier: encrypted token without a decryption key")
+	ErrInvalidTokenType = errors.New("verifier: invalid Authorization header")
+	ErrBoundToken       = errors.New("verifier: DPoP-bound token presented as a bearer token")
+)
+
+// Informazioni contenute in un token valido
+type Claims struct {
+	Username  string
+	FullName  string
+	Group     string
+	Issuer    string
+	Audience  string
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+
+	// Impronta della chiave DPoP a cui è vincolato il token, vuota per i token bearer
+	KeyThumbprint string
+
+	// Scope a cui è limitato il token, vuoto se non ci sono limitazioni
+	Scope string
+
+	// Utente che agisce per conto di Username (es. un amministratore che lo impersonifica)
+	Actor string
+
+	// Sessione sul server da cui è stato ottenuto il token, se presente
+	SessionID string
+
+	// Metodi con cui l'utente si è autenticato (claim amr, RFC 8176), ad esempio
+	// "pwd" e "otp" per la verifica in due passaggi, oppure "email" (non
+	// registrato) per l'accesso con un codice inviato per email
+	Methods []string
+
+	// Garanzia dell'autenticazione (claim acr), da confrontare con quella richiesta
+	// per le operazioni sensibili
+	ACR string
+
+	// Momento in cui l'utente ha inserito le credenziali l'ultima volta (claim auth_time),
+	// zero se non indicato
+	AuthTime time.Time
+
+	// Claim aggiuntive configurate sul server (es. email, matricola)
+	Extra map[string]interface{}
+}
+
+// Formato del payload JWT emesso da ssodav
+type payload struct {
+	Payload  jwt.Payload
+	FullName string `json:"full_name"`
+	Group    string `json:"group"`
+
+	Confirmation *struct {
+		JKT string `json:"jkt"`
+	} `json:"cnf"`
+
+	Scope     string    `json:"scope"`
+	SessionID string    `json:"sid"`
+	Methods   []string  `json:"amr"`
+	ACR       string    `json:"acr"`
+	AuthTime  *jwt.Time `json:"auth_time"`
+	Actor     *struct {
+		Subject string `json:"sub"`
+	} `json:"act"`
+
+	Extra map[string]interface{} `json:"-"`
+}
+
+// Decodifica il payload separando le claim aggiuntive
+func (p *payload) UnmarshalJSON(b []byte) error {
+	type plain payload
+
+	if err := json.Unmarshal(b, (*plain)(p)); err != nil {
+		return err
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return err
+	}
+
+	delete(fields, "Payload")
+	delete(fields, "full_name")
+	delete(fields, "group")
+	delete(fields, "cnf")
+	delete(fields, "scope")
+	delete(fields, "act")
+	delete(fields, "sid")
+	delete(fields, "amr")
+	delete(fields, "acr")
+	delete(fields, "auth_time")
+
+	if len(fields) > 0 {
+		p.Extra = fields
+	}
+
+	return nil
+}
+
+// Verifica i token destinati a una delle audience indicate
+type Verifier struct {
+	// Emittente atteso (fqdn_sso del server), ignorato se vuoto
+	Issuer string
+
+	// Chiave privata per i token cifrati (JWE), se il server li cifra per questo servizio
+	DecryptionKey crypto.PrivateKey
+
+	// Validatore delle prove DPoP per i token vincolati a una chiave
+	// (si possono richiedere i nonce impostandone il campo Nonces)
+	DPoP *dpop.Validator
+
+	// Politica e nome (SessionCookie se vuoto) del cookie in cui il servizio conserva
+	// il token, scritto da CrossDomainReceiver e letto dal middleware. Sulle pagine
+	// servite in HTTPS il cookie è sempre Secure.
+	Cookie     cookie.Policy
+	CookieName string
+
+	// Percorso (CallbackPath se vuoto) in cui il middleware riceve il codice dopo
+	// l'accesso, che deve essere servito dal middleware. L'URL completo va
+	// registrato tra i ricevitori del server.
+	CallbackPath string
+
+	audiences jwt.Audience
+	hmac      jwt.Algorithm
+	jwks      *keySet
+}
+
+// Crea un verificatore per i token firmati con la chiave segreta condivisa (HS256)
+func NewHMAC(secret []byte, audiences ...string) *Verifier {
+	return &Verifier{
+		DPoP:      dpop.NewValidator(),
+		Cookie:    defaultCookie,
+		audiences: jwt.Audience(audiences),
+		hmac:      jwt.NewHS256(secret),
+	}
+}
+
+// Crea un verificatore per i token firmati con le chiavi pubblicate all'URL indicato.
+// Le chiavi vengono mantenute in memoria e richieste di nuovo solo quando scadono
+// o quando compare un identificatore sconosciuto.
+func NewJWKS(jwksURL string, audiences ...string) *Verifier {
+	return &Verifier{
+		DPoP:      dpop.NewValidator(),
+		Cookie:    defaultCookie,
+		audiences: jwt.Audience(audiences),
+		jwks:      newKeySet(jwksURL),
+	}
+}
+
+// Verifica un token e ne restituisce le informazioni
+func (v *Verifier) Verify(token []byte) (*Claims, error) {
+	if jwe.IsEncrypted(token) {
+		if v.DecryptionKey == nil {
+			return nil, ErrEncrypted
+		}
+
+		decrypted, err := jwe.Decrypt(token, v.DecryptionKey)
+		if err != nil {
+			return nil, err
+		}
+		token = decrypted
+	}
+
+	alg, err := v.algorithm(token)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		now = time.Now()
+		pl  payload
+
+		validators = []jwt.Validator{
+			jwt.IssuedAtValidator(now),
+			jwt.ExpirationTimeValidator(now),
+			jwt.AudienceValidator(v.audiences),
+		}
+	)
+
+	if v.Issuer != "" {
+		validators = append(validators, jwt.IssuerValidator(v.Issuer))
+	}
+
+	if _, err := jwt.Verify(token, alg, &pl, jwt.ValidateHeader, jwt.ValidatePayload(&pl.Payload, validators...)); err != nil {
+		return nil, err
+	}
+
+	// Tokens valid for more than one service are rejected, like the server does
+	if len(pl.Payload.Audience) != 1 {
+		return nil, ErrInvalidAudience
+	}
+
+	// Tokens issued by ssodav always have these claims, while the validator of
+	// the issue time accepts tokens without it
+	if pl.Payload.ExpirationTime == nil || pl.Payload.IssuedAt == nil {
+		return nil, ErrMalformed
+	}
+
+	claims := &Claims{
+		Username:  pl.Payload.Subject,
+		FullName:  pl.FullName,
+		Group:     pl.Group,
+		Issuer:    pl.Payload.Issuer,
+		Audience:  pl.Payload.Audience[0],
+		Scope:     pl.Scope,
+		SessionID: pl.SessionID,
+		Methods:   pl.Methods,
+		ACR:       pl.ACR,
+		IssuedAt:  pl.Payload.IssuedAt.Time,
+		ExpiresAt: pl.Payload.ExpirationTime.Time,
+		Extra:     pl.Extra,
+	}
+
+	if pl.AuthTime != nil {
+		claims.AuthTime = pl.AuthTime.Time
+	}
+
+	if pl.Actor != nil {
+		claims.Actor = pl.Actor.Subject
+	}
+
+	if pl.Confirmation != nil {
+		claims.KeyThumbprint = pl.Confirmation.JKT
+	}
+
+	return claims, nil
+}
+
+// Sceglie l'algoritmo con cui verificare il token
+func (v *Verifier) algorithm(token []byte) (jwt.Algorithm, error) {
+	if v.hmac != nil {
+		return v.hmac, nil
+	}
+
+	header, err := decodeHeader(token)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only asymmetric algorithms make sense with published keys
+	if header.Algorithm != "RS256" && header.Algorithm != "ES256" {
+		return nil, ErrAlgorithm
+	}
+
+	return v.jwks.algorithm(header.KeyID, header.Algorithm)
+}
+
+// Decodifica l'intestazione di un token senza verificarlo
+func decodeHeader(token []byte) (jwt.Header, error) {
+	var header jwt.Header
+
+	sep := bytes.IndexByte(token, '.')
+	if sep < 0 {
+		return header, ErrMalformed
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(string(token[:sep]))
+	if err != nil {
+		return header, ErrMalformed
+	}
+
+	if err := json.Unmarshal(b, &header); err != nil {
+		return header, ErrMalformed
+	}
+
+	return header, nil
+}
@@ -0,0 +1,770 @@
+/*
+ * verifier_test.go
+ *
+ * File di test per il package verifier.
+ *
+ * Copyright (c) 2021 Antonio Napolitano <nap@napaalm.xyz>
+ *
+ * This file is part of ssodav.
+ *
+ * ssodav is free software; you can redistribute it and/or modify it
+ * under the terms of the Affero GNU General Public License as
+ * published by the Free Software Foundation; either version 3, or (at
+ * your option) any later version.
+ *
+ * ssodav is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+ * or FITNESS FOR A PARTICULAR PURPOSE.  See the Affero GNU General
+ * Public License for more details.
+ *
+ * You should have received a copy of the Affero GNU General Public
+ * License along with ssodav; see the file LICENSE. If not see
+ * <http://www.gnu.org/licenses/>.
+ */
+
+package verifier
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"git.napaalm.xyz/napaalm/ssodav/internal/auth"
+	"git.napaalm.xyz/napaalm/ssodav/internal/config"
+	"git.napaalm.xyz/napaalm/ssodav/internal/crossdomain"
+	"git.napaalm.xyz/napaalm/ssodav/pkg/dpop"
+	"git.napaalm.xyz/napaalm/ssodav/pkg/jwe"
+	"git.napaalm.xyz/napaalm/ssodav/pkg/jwk"
+	"git.napaalm.xyz/napaalm/ssodav/pkg/pkce"
+	"github.com/gbrlsnchs/jwt/v3"
+)
+
+var testUser = auth.UserInfo{
+	Username: "professor",
+	FullName: "Hubert J. Farnsworth",
+	Group:    "Office Management",
+}
+
+// Configura la firma dei token del server
+func initializeSigning(t *testing.T, alg, key string) {
+	config.Config.General.FQDN = "sso.example.org"
+	config.Config.General.JWTSecret = "secret"
+	config.Config.General.JWTAlgorithm = alg
+	config.Config.General.JWTKey = key
+
+	if err := auth.InitializeSigning(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func issue(t *testing.T, audience string) []byte {
+	token, err := auth.IssueToken(testUser, audience, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return token
+}
+
+func TestHMAC(t *testing.T) {
+	initializeSigning(t, "HS256", "")
+
+	v := NewHMAC([]byte("secret"), "https://app.example.org")
+	v.Issuer = "sso.example.org"
+
+	claims, err := v.Verify(issue(t, "https://app.example.org"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if claims.Username != testUser.Username || claims.FullName != testUser.FullName || claims.Group != testUser.Group {
+		t.Errorf("unexpected claims %+v", claims)
+	}
+
+	if claims.Audience != "https://app.example.org" || claims.ExpiresAt.Before(time.Now()) {
+		t.Errorf("unexpected claims %+v", claims)
+	}
+
+	if _, err := v.Verify(issue(t, "https://other.example.org")); err == nil {
+		t.Error("token for another audience accepted")
+	}
+
+	if _, err := NewHMAC([]byte("wrong"), "https://app.example.org").Verify(issue(t, "https://app.example.org")); err == nil {
+		t.Error("token with a wrong signature accepted")
+	}
+}
+
+func TestExtraClaims(t *testing.T) {
+	now := time.Now()
+
+	token, err := jwt.Sign(map[string]interface{}{
+		"Payload": jwt.Payload{
+			Subject:        "professor",
+			Audience:       jwt.Audience{"https://app.example.org"},
+			ExpirationTime: jwt.NumericDate(now.Add(time.Hour)),
+			IssuedAt:       jwt.NumericDate(now),
+		},
+		"full_name": testUser.FullName,
+		"group":     testUser.Group,
+		"email":     "professor@planetexpress.com",
+		"scope":     "read",
+		"act":       map[string]string{"sub": "hermes"},
+	}, jwt.NewHS256([]byte("secret")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := NewHMAC([]byte("secret"), "https://app.example.org").Verify(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(claims.Extra) != 1 || claims.Extra["email"] != "professor@planetexpress.com" || claims.FullName != testUser.FullName ||
+		claims.Scope != "read" || claims.Actor != "hermes" {
+		t.Errorf("unexpected claims %+v", claims)
+	}
+}
+
+func TestRequiredClaims(t *testing.T) {
+	now := time.Now()
+
+	// Tokens must expire and carry their issue time, as the server requires
+	for _, pl := range []jwt.Payload{
+		{Subject: "professor", Audience: jwt.Audience{"https://app.example.org"}, IssuedAt: jwt.NumericDate(now)},
+		{Subject: "professor", Audience: jwt.Audience{"https://app.example.org"}, ExpirationTime: jwt.NumericDate(now.Add(time.Hour))},
+	} {
+		token, err := jwt.Sign(map[string]interface{}{"Payload": pl}, jwt.NewHS256([]byte("secret")))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := NewHMAC([]byte("secret"), "https://app.example.org").Verify(token); err == nil {
+			t.Errorf("token without required claims accepted: %+v", pl)
+		}
+	}
+}
+
+func TestAuthenticationContext(t *testing.T) {
+	initializeSigning(t, "HS256", "")
+
+	authTime := time.Now().Add(-time.Minute).Truncate(time.Second)
+
+	user := testUser
+	user.Methods = []string{"pwd", "otp"}
+	user.AuthTime = authTime
+
+	token, err := auth.IssueToken(user, "https://app.example.org", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := NewHMAC([]byte("secret"), "https://app.example.org").Verify(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if claims.ACR != auth.ACRMultiFactor || !claims.AuthTime.Equal(authTime) || len(claims.Methods) != 2 {
+		t.Errorf("unexpected claims %+v", claims)
+	}
+
+	// The typed claims are not repeated among the extra ones
+	if _, ok := claims.Extra["acr"]; ok {
+		t.Errorf("acr in the extra claims: %+v", claims.Extra)
+	}
+
+	if _, ok := claims.Extra["auth_time"]; ok {
+		t.Errorf("auth_time in the extra claims: %+v", claims.Extra)
+	}
+
+	// Tokens without an authentication context
+	claims, err = NewHMAC([]byte("secret"), "https://app.example.org").Verify(issue(t, "https://app.example.org"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if claims.ACR != "" || !claims.AuthTime.IsZero() {
+		t.Errorf("unexpected claims %+v", claims)
+	}
+}
+
+func TestEncrypted(t *testing.T) {
+	initializeSigning(t, "HS256", "")
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := jwe.Encrypt(issue(t, "https://app.example.org"), &priv.PublicKey, jwe.ECDHES, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v := NewHMAC([]byte("secret"), "https://app.example.org")
+	if _, err := v.Verify(token); err != ErrEncrypted {
+		t.Errorf("expected ErrEncrypted, got %v", err)
+	}
+
+	v.DecryptionKey = priv
+	if claims, err := v.Verify(token); err != nil || claims.Username != testUser.Username {
+		t.Error(claims, err)
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	key := writeKey(t)
+	defer os.Remove(key)
+
+	initializeSigning(t, "ES256", key)
+
+	var fetches int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(mustMarshal(t, auth.PublicKeys()))
+	}))
+	defer server.Close()
+
+	v := NewJWKS(server.URL, "https://app.example.org")
+
+	for i := 0; i < 3; i++ {
+		claims, err := v.Verify(issue(t, "https://app.example.org"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if claims.Username != testUser.Username {
+			t.Errorf("unexpected claims %+v", claims)
+		}
+	}
+
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Errorf("expected the keys to be fetched once, got %d", n)
+	}
+
+	// HS256 tokens are never accepted with published keys
+	initializeSigning(t, "HS256", "")
+	if _, err := v.Verify(issue(t, "https://app.example.org")); err != ErrAlgorithm {
+		t.Errorf("expected ErrAlgorithm, got %v", err)
+	}
+
+	// After a key rotation the keys are fetched again, but not before the refresh interval
+	rotated := writeKey(t)
+	defer os.Remove(rotated)
+
+	initializeSigning(t, "ES256", rotated)
+	if _, err := v.Verify(issue(t, "https://app.example.org")); err != ErrUnknownKey {
+		t.Errorf("expected ErrUnknownKey, got %v", err)
+	}
+
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Errorf("expected no new requests, got %d", n)
+	}
+
+	v.jwks.lastAttempt = time.Now().Add(-keysRefreshInterval)
+	if _, err := v.Verify(issue(t, "https://app.example.org")); err != nil {
+		t.Error(err)
+	}
+
+	if n := atomic.LoadInt32(&fetches); n != 2 {
+		t.Errorf("expected the keys to be fetched again, got %d requests", n)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	initializeSigning(t, "HS256", "")
+
+	v := NewHMAC([]byte("secret"), "https://app.example.org")
+	handler := v.Middleware("https://sso.example.org/")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := FromContext(r.Context())
+		if !ok {
+			t.Error("missing claims in context")
+			return
+		}
+
+		w.Write([]byte(claims.Username))
+	}))
+
+	// Navigation without a token goes to the login page
+	r := httptest.NewRequest("GET", "https://app.example.org/page?x=1", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	// The login page sends the browser back to the receiver, then to the page
+	location, _ := url.Parse(w.Result().Header.Get("Location"))
+	if w.Code != http.StatusFound || location.Host != "sso.example.org" ||
+		location.Query().Get("next") != "https://app.example.org"+CallbackPath+"?next=%2Fpage%3Fx%3D1" {
+		t.Errorf("unexpected response %d %s", w.Code, location)
+	}
+
+	// The state sent to the server is kept in a cookie, with the PKCE verifier
+	cookies := w.Result().Cookies()
+	if state := location.Query().Get("state"); state == "" || len(cookies) != 1 || cookies[0].Name != StateCookie+"_"+state ||
+		!strings.HasPrefix(cookies[0].Value, state+".") || !cookies[0].HttpOnly || !cookies[0].Secure {
+		t.Fatalf("unexpected state %q with cookies %v", state, cookies)
+	}
+
+	verifier := strings.SplitN(cookies[0].Value, ".", 2)[1]
+	if location.Query().Get("code_challenge") != pkce.Challenge(verifier) || location.Query().Get("code_challenge_method") != pkce.Method {
+		t.Errorf("unexpected PKCE parameters in %s", location)
+	}
+
+	// API requests get 401
+	r = httptest.NewRequest("POST", "https://app.example.org/api", nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401, got %d", w.Code)
+	}
+
+	// Bearer token for the service
+	r = httptest.NewRequest("POST", "https://app.example.org/api", nil)
+	r.Header.Set("Authorization", "Bearer "+string(issue(t, "https://app.example.org")))
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK || w.Body.String() != testUser.Username {
+		t.Errorf("unexpected response %d %s", w.Code, w.Body.String())
+	}
+
+	// Token stored by the service in its cookie
+	r = httptest.NewRequest("GET", "https://app.example.org/page", nil)
+	r.AddCookie(&http.Cookie{Name: SessionCookie, Value: string(issue(t, "https://app.example.org"))})
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("expected 200, got %d", w.Code)
+	}
+
+	// Tokens for the SSO service itself aren't accepted by the other services
+	r = httptest.NewRequest("GET", "https://app.example.org/page", nil)
+	r.AddCookie(&http.Cookie{Name: SessionCookie, Value: string(issue(t, "https://sso.example.org"))})
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusFound {
+		t.Errorf("expected 302, got %d", w.Code)
+	}
+
+	// Token for another service
+	r = httptest.NewRequest("GET", "https://app.example.org/page", nil)
+	r.Header.Set("Authorization", "Bearer "+string(issue(t, "https://other.example.org")))
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusUnauthorized || !strings.Contains(w.Result().Header.Get("WWW-Authenticate"), "invalid_token") {
+		t.Errorf("expected 401, got %d", w.Code)
+	}
+}
+
+func mustMarshal(t *testing.T, v interface{}) []byte {
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Error(err)
+	}
+
+	return b
+}
+
+// Scrive una nuova chiave privata P-256 in un file temporaneo
+func writeKey(t *testing.T) string {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := ioutil.TempFile("", "ssodav-jwt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	pem.Encode(f, &pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+
+	return f.Name()
+}
+
+func TestDPoP(t *testing.T) {
+	initializeSigning(t, "HS256", "")
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	public, _ := jwk.New(&key.PublicKey)
+	token, err := auth.IssueToken(testUser, "https://app.example.org", time.Hour, auth.WithConfirmation(public.KeyID))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v := NewHMAC([]byte("secret"), "https://app.example.org")
+	request := func(scheme, method, proofURL string) *http.Request {
+		r := httptest.NewRequest("POST", "https://app.example.org/api?x=1", nil)
+		r.Header.Set("Authorization", scheme+" "+string(token))
+
+		if proofURL != "" {
+			proof, err := dpop.NewProof(key, method, proofURL, token, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.Header.Set(dpop.Header, proof)
+		}
+
+		return r
+	}
+
+	claims, err := v.VerifyRequest(request("DPoP", "POST", "https://app.example.org/api"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if claims.KeyThumbprint != public.KeyID {
+		t.Errorf("expected thumbprint %s, got %s", public.KeyID, claims.KeyThumbprint)
+	}
+
+	cases := map[string]struct {
+		r   *http.Request
+		err error
+	}{
+		"bearer":       {request("Bearer", "", ""), ErrBoundToken},
+		"no proof":     {request("DPoP", "", ""), dpop.ErrInvalidProof},
+		"wrong method": {request("DPoP", "GET", "https://app.example.org/api"), dpop.ErrMismatch},
+		"wrong url":    {request("DPoP", "POST", "https://other.example.org/api"), dpop.ErrMismatch},
+	}
+
+	for name, c := range cases {
+		if _, err := v.VerifyRequest(c.r); err != c.err {
+			t.Errorf("%s: expected %v, got %v", name, c.err, err)
+		}
+	}
+
+	// Proof made with another key
+	other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	proof, _ := dpop.NewProof(other, "POST", "https://app.example.org/api", token, "")
+
+	r := request("DPoP", "", "")
+	r.Header.Set(dpop.Header, proof)
+
+	if _, err := v.VerifyRequest(r); err != dpop.ErrMismatch {
+		t.Errorf("expected ErrMismatch, got %v", err)
+	}
+
+	// Nonces are requested with the challenge
+	v.DPoP.Nonces, _ = dpop.NewNonceSource(time.Minute)
+	handler := v.Middleware("https://sso.example.org/")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, request("DPoP", "POST", "https://app.example.org/api"))
+
+	if w.Code != http.StatusUnauthorized || w.Result().Header.Get(dpop.NonceHeader) == "" ||
+		!strings.Contains(w.Result().Header.Get("WWW-Authenticate"), "use_dpop_nonce") {
+		t.Errorf("unexpected response %d %v", w.Code, w.Result().Header)
+	}
+}
+
+func TestLogoutToken(t *testing.T) {
+	initializeSigning(t, "HS256", "")
+
+	v := NewHMAC([]byte("secret"), "moodle")
+	v.Issuer = "sso.example.org"
+
+	token, err := auth.IssueLogoutToken(testUser.Username, "session-id", "moodle")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := v.VerifyLogoutToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if claims.Username != testUser.Username || claims.SessionID != "session-id" || claims.Audience != "moodle" || claims.ID == "" {
+		t.Errorf("unexpected claims %+v", claims)
+	}
+
+	// Access tokens aren't logout tokens, and logout tokens aren't access tokens
+	if _, err := v.VerifyLogoutToken(issue(t, "moodle")); err == nil {
+		t.Error("access token accepted as a logout token")
+	}
+
+	if _, err := v.Verify(token); err == nil {
+		t.Error("logout token accepted as an access token")
+	}
+
+	other, _ := auth.IssueLogoutToken(testUser.Username, "session-id", "wiki")
+	if _, err := v.VerifyLogoutToken(other); err == nil {
+		t.Error("logout token for another application accepted")
+	}
+
+	// Back-channel endpoint
+	var received *LogoutClaims
+	handler := v.LogoutHandler(func(c *LogoutClaims) { received = c })
+
+	post := func(token []byte) int {
+		r := httptest.NewRequest("POST", "https://moodle.example.org/backchannel", strings.NewReader("logout_token="+string(token)))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	if code := post(other); code != http.StatusBadRequest || received != nil {
+		t.Errorf("expected 400, got %d", code)
+	}
+
+	if code := post(token); code != http.StatusOK || received == nil || received.SessionID != "session-id" {
+		t.Errorf("expected 200, got %d", code)
+	}
+}
+
+func TestMiddlewareLogin(t *testing.T) {
+	initializeSigning(t, "HS256", "")
+	crossdomain.Initialize()
+
+	var app *httptest.Server
+
+	// Login page of a user with a session and code exchange, as done by the server
+	ssoRequests := 0
+	sso := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ssoRequests++
+
+		switch r.URL.Path {
+		case "/":
+			next, state := r.URL.Query().Get("next"), r.URL.Query().Get("state")
+			if !strings.HasPrefix(next, app.URL+CallbackPath+"?") || state == "" {
+				http.Error(w, "unexpected login request", http.StatusBadRequest)
+				return
+			}
+
+			code, err := crossdomain.NewCode(testUser, app.URL, r.URL.Query().Get("code_challenge"), time.Hour)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+
+			http.Redirect(w, r, next+"&code="+code+"&state="+state, http.StatusSeeOther)
+
+		case "/crossdomain/token":
+			userInfo, exp, err := crossdomain.Redeem(r.PostFormValue("code"), r.PostFormValue("redirect_uri"), r.PostFormValue("code_verifier"))
+			if err != nil {
+				http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+				return
+			}
+
+			token, _ := auth.IssueToken(userInfo, r.PostFormValue("redirect_uri"), exp)
+			w.Write(mustMarshal(t, map[string]string{"access_token": string(token)}))
+		}
+	}))
+	defer sso.Close()
+
+	app = httptest.NewServer(nil)
+	defer app.Close()
+
+	v := NewHMAC([]byte("secret"), app.URL)
+	app.Config.Handler = v.Middleware(sso.URL + "/")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, _ := FromContext(r.Context())
+		w.Write([]byte(claims.Username + " " + claims.Audience))
+	}))
+
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar}
+
+	// The redirects end on the requested page, without the code
+	resp, err := client.Get(app.URL + "/page?x=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || resp.Request.URL.String() != app.URL+"/page?x=1" || string(body) != testUser.Username+" "+app.URL {
+		t.Fatalf("unexpected response %d %s: %s", resp.StatusCode, resp.Request.URL, body)
+	}
+
+	// Then the token stored by the service is used
+	resp, err = client.Get(app.URL + "/other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || ssoRequests != 2 {
+		t.Errorf("unexpected response %d after %d requests to the server", resp.StatusCode, ssoRequests)
+	}
+
+	// A code for someone else's login isn't accepted by another browser
+	code, _ := crossdomain.NewCode(auth.UserInfo{Username: "attacker"}, app.URL, "", time.Hour)
+
+	client = &http.Client{Jar: nil, CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+
+	resp, err = client.Get(app.URL + CallbackPath + "?code=" + code + "&state=forged")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected 403, got %d", resp.StatusCode)
+	}
+}
+
+func TestCrossDomainReceiver(t *testing.T) {
+	initializeSigning(t, "HS256", "")
+
+	const (
+		receiver = "https://scuola.edu.it/sso/callback"
+		verifier = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	)
+
+	sso := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/crossdomain/token" || r.PostFormValue("code") != "good" || r.PostFormValue("redirect_uri") != receiver ||
+			r.PostFormValue("code_verifier") != verifier {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+
+		w.Write(mustMarshal(t, map[string]string{"access_token": string(issue(t, "https://scuola.edu.it"))}))
+	}))
+	defer sso.Close()
+
+	handler := NewHMAC([]byte("secret"), "https://scuola.edu.it").CrossDomainReceiver(sso.URL + "/")
+
+	const (
+		s1 = "AAAAAAAAAAAAAAAAAAAAAA"
+		s2 = "AQAAAAAAAAAAAAAAAAAAAA"
+	)
+
+	// Callback for the login started with the state s1
+	callback := func(query string) *http.Request {
+		r := httptest.NewRequest("GET", receiver+query+"&state="+s1, nil)
+		r.AddCookie(&http.Cookie{Name: StateCookie + "_" + s1, Value: s1 + "." + verifier})
+		return r
+	}
+
+	get := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, callback(query))
+		return w
+	}
+
+	w := get("?code=good&next=%2Fcorsi%3Fid%3D1")
+	if w.Code != http.StatusSeeOther || w.Result().Header.Get("Location") != "/corsi?id=1" {
+		t.Fatalf("unexpected response %d %v", w.Code, w.Result().Header)
+	}
+
+	// The state cookie is removed and the token stored
+	cookies := w.Result().Cookies()
+	if len(cookies) != 2 || cookies[0].Name != StateCookie+"_"+s1 || cookies[0].MaxAge >= 0 ||
+		cookies[1].Name != SessionCookie || !cookies[1].HttpOnly || !cookies[1].Secure {
+		t.Fatalf("unexpected cookies %v", cookies)
+	}
+
+	if _, err := NewHMAC([]byte("secret"), "https://scuola.edu.it").Verify([]byte(cookies[1].Value)); err != nil {
+		t.Error(err)
+	}
+
+	// Logins started in parallel from two tabs keep their own state
+	parallel := httptest.NewRequest("GET", receiver+"?code=good&state="+s2, nil)
+	parallel.AddCookie(&http.Cookie{Name: StateCookie + "_" + s1, Value: s1 + "." + verifier})
+	parallel.AddCookie(&http.Cookie{Name: StateCookie + "_" + s2, Value: s2 + "." + verifier})
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, parallel)
+
+	if cookies := w.Result().Cookies(); w.Code != http.StatusSeeOther || len(cookies) != 2 || cookies[0].Name != StateCookie+"_"+s2 {
+		t.Errorf("parallel login refused: %d %v", w.Code, cookies)
+	}
+
+	// Codes delivered without the state of the browser are refused (login CSRF)
+	mismatched := httptest.NewRequest("GET", receiver+"?code=good&state="+s2, nil)
+	mismatched.AddCookie(&http.Cookie{Name: StateCookie + "_" + s1, Value: s1 + "." + verifier})
+
+	renamed := httptest.NewRequest("GET", receiver+"?code=good&state="+s2, nil)
+	renamed.AddCookie(&http.Cookie{Name: StateCookie + "_" + s2, Value: s1 + "." + verifier})
+
+	for _, r := range []*http.Request{
+		httptest.NewRequest("GET", receiver+"?code=good", nil),
+		httptest.NewRequest("GET", receiver+"?code=good&state="+s1, nil),
+		mismatched,
+		renamed,
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%s: expected 403, got %d", r.URL, w.Code)
+		}
+
+		for _, c := range w.Result().Cookies() {
+			if c.Name == SessionCookie {
+				t.Errorf("%s: token stored", r.URL)
+			}
+		}
+	}
+
+	// Users aren't sent to other sites
+	for _, next := range []string{"https://evil.example.com/", "//evil.example.com/"} {
+		if w := get("?code=good&next=" + url.QueryEscape(next)); w.Result().Header.Get("Location") != "/" {
+			t.Errorf("redirected to %s", w.Result().Header.Get("Location"))
+		}
+	}
+
+	if w := get("?code=bad"); w.Code != http.StatusBadGateway || len(w.Result().Cookies()) != 1 {
+		t.Errorf("unexpected response %d", w.Code)
+	}
+
+	// Tokens for other services are rejected
+	other := NewHMAC([]byte("secret"), "https://other.edu.it").CrossDomainReceiver(sso.URL)
+
+	w = httptest.NewRecorder()
+	other.ServeHTTP(w, callback("?code=good"))
+
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected 403, got %d", w.Code)
+	}
+	// Large tokens are split in chunks, which are reassembled when reading them
+	v := NewHMAC([]byte("secret"), "https://scuola.edu.it")
+	v.Cookie.MaxSize = 64
+	v.CookieName = "token"
+
+	w = httptest.NewRecorder()
+	v.CrossDomainReceiver(sso.URL).ServeHTTP(w, callback("?code=good"))
+
+	cookies = w.Result().Cookies()[1:]
+	if len(cookies) < 2 || cookies[0].Name != "token.0" || !cookies[0].Secure {
+		t.Fatalf("unexpected cookies %v", cookies)
+	}
+
+	r := httptest.NewRequest("GET", "https://scuola.edu.it/corsi", nil)
+	for _, c := range cookies {
+		r.AddCookie(&http.Cookie{Name: c.Name, Value: c.Value})
+	}
+
+	if _, err := v.VerifyRequest(r); err != nil {
+		t.Error(err)
+	}
+}